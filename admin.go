@@ -0,0 +1,242 @@
+package substrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// managers holds the process managers of all provisioned transports, so the
+// admin API can reach their processes.
+var managers = struct {
+	sync.Mutex
+	set map[*ProcessManager]struct{}
+}{set: make(map[*ProcessManager]struct{})}
+
+func registerManager(pm *ProcessManager) {
+	managers.Lock()
+	managers.set[pm] = struct{}{}
+	managers.Unlock()
+}
+
+func unregisterManager(pm *ProcessManager) {
+	managers.Lock()
+	delete(managers.set, pm)
+	managers.Unlock()
+}
+
+func registeredManagers() []*ProcessManager {
+	managers.Lock()
+	defer managers.Unlock()
+
+	result := make([]*ProcessManager, 0, len(managers.set))
+	for pm := range managers.set {
+		result = append(result, pm)
+	}
+	return result
+}
+
+// ProcessInfo describes a running process in admin API responses and to
+// programs embedding a ProcessManager.
+type ProcessInfo struct {
+	Script         string    `json:"script"`
+	Socket         string    `json:"socket"`
+	PID            int       `json:"pid,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	LastUsed       time.Time `json:"last_used"`
+	ActiveRequests int       `json:"active_requests"`
+	Frozen         bool      `json:"frozen,omitempty"`
+	Inspector      string    `json:"inspector,omitempty"`
+
+	// Health is what the process last reported on its control socket
+	Health *ProcessHealth `json:"health,omitempty"`
+}
+
+// processRequest is the body of the stop and restart endpoints.
+type processRequest struct {
+	Script string `json:"script"`
+}
+
+// adminAPI exposes substrate processes on Caddy's admin endpoint:
+//
+//	GET  /substrate/processes          lists running processes
+//	POST /substrate/processes/stop     stops the process for {"script": ...}
+//	POST /substrate/processes/restart  replaces the process for {"script": ...}
+//	POST /substrate/processes/freeze   pauses the process for {"script": ...}
+//	POST /substrate/processes/thaw     resumes the process for {"script": ...}
+//	GET  /substrate/upstreams          lists processes as reverse_proxy upstreams
+//	GET  /substrate/scripts            lists the usage of scripts, running or not
+//	GET  /substrate/exits[?script=...] lists the latest unexpected exits of scripts
+//	GET  /substrate/bundle?script=...  downloads the diagnostics of a script as a tarball
+//	*    /substrate/inspector/<pid>/   forwards to the process's inspector
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.substrate",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/substrate/processes", Handler: caddy.AdminHandlerFunc(a.handleList)},
+		{Pattern: "/substrate/processes/stop", Handler: caddy.AdminHandlerFunc(a.handleStop)},
+		{Pattern: "/substrate/processes/restart", Handler: caddy.AdminHandlerFunc(a.handleRestart)},
+		{Pattern: "/substrate/processes/freeze", Handler: caddy.AdminHandlerFunc(a.handleFreeze)},
+		{Pattern: "/substrate/processes/thaw", Handler: caddy.AdminHandlerFunc(a.handleThaw)},
+		{Pattern: "/substrate/upstreams", Handler: caddy.AdminHandlerFunc(a.handleUpstreams)},
+		{Pattern: "/substrate/scripts", Handler: caddy.AdminHandlerFunc(a.handleScripts)},
+		{Pattern: "/substrate/exits", Handler: caddy.AdminHandlerFunc(a.handleExits)},
+		{Pattern: "/substrate/bundle", Handler: caddy.AdminHandlerFunc(a.handleBundle)},
+		{Pattern: inspectorPrefix, Handler: caddy.AdminHandlerFunc(a.handleInspector)},
+	}
+}
+
+func (adminAPI) handleList(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	infos := []ProcessInfo{}
+	for _, pm := range registeredManagers() {
+		infos = append(infos, pm.Processes()...)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Script < infos[j].Script })
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(infos)
+}
+
+// handleScripts lists the usage of every script started since Caddy
+// started, or before with persist_usage.
+func (adminAPI) handleScripts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	for _, pm := range registeredManagers() {
+		pm.recordUsage()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(scriptUsage.list())
+}
+
+// handleExits lists the exits of processes substrate did not stop, for
+// diagnosing intermittent crashes after the fact.
+func (adminAPI) handleExits(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(exitHistory.list(r.URL.Query().Get("script")))
+}
+
+func (a adminAPI) handleStop(w http.ResponseWriter, r *http.Request) error {
+	return a.forScript(w, r, infallible((*ProcessManager).stopProcess))
+}
+
+func (a adminAPI) handleRestart(w http.ResponseWriter, r *http.Request) error {
+	return a.forScript(w, r, infallible((*ProcessManager).restartProcess))
+}
+
+func (a adminAPI) handleFreeze(w http.ResponseWriter, r *http.Request) error {
+	return a.forScript(w, r, (*ProcessManager).freezeProcess)
+}
+
+func (a adminAPI) handleThaw(w http.ResponseWriter, r *http.Request) error {
+	return a.forScript(w, r, (*ProcessManager).thawProcess)
+}
+
+// processAction acts on the process running a script, reporting whether
+// there is one.
+type processAction func(*ProcessManager, string) (bool, error)
+
+func infallible(action func(*ProcessManager, string) bool) processAction {
+	return func(pm *ProcessManager, script string) (bool, error) {
+		return action(pm, script), nil
+	}
+}
+
+// forScript applies action to the script named in the request body in every
+// transport, failing with 404 if no transport runs it.
+func (adminAPI) forScript(w http.ResponseWriter, r *http.Request, action processAction) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var req processRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Script == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("request body must be {\"script\": <path>}"),
+		}
+	}
+
+	found := false
+	for _, pm := range registeredManagers() {
+		ok, err := action(pm, req.Script)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("%s: %w", req.Script, err),
+			}
+		}
+		if ok {
+			found = true
+		}
+	}
+	if !found {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no running process for %s", req.Script),
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// Info describes the current state of the process.
+func (p *Process) Info() ProcessInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	info := ProcessInfo{
+		Script:         p.scriptPath,
+		Socket:         p.SocketPath,
+		StartedAt:      p.startedAt,
+		LastUsed:       p.lastUsed,
+		ActiveRequests: p.activeRequests,
+		Frozen:         p.frozen,
+		Inspector:      p.inspector,
+		Health:         p.health,
+	}
+	// cmd is only safe to read once the process has started
+	if !p.startedAt.IsZero() {
+		info.PID = p.cmd.Process.Pid
+	}
+	return info
+}
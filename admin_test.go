@@ -0,0 +1,144 @@
+package substrate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func newAdminTestManager(t *testing.T) *ProcessManager {
+	t.Helper()
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(0, caddy.Duration(time.Second), nil, "", NewDenoManager("", logger), logger, processOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	registerManager(pm)
+	t.Cleanup(func() {
+		unregisterManager(pm)
+		pm.Stop()
+	})
+	return pm
+}
+
+func TestAdminAPI_ListAndStop(t *testing.T) {
+	pm := newAdminTestManager(t)
+	process := &Process{scriptPath: "/srv/app.js", SocketPath: "/tmp/app.sock", logger: pm.logger}
+	pm.processes.acquire("/srv/app.js", func() (*Process, error) { return process, nil })
+
+	api := adminAPI{}
+	rec := httptest.NewRecorder()
+	if err := api.handleList(rec, httptest.NewRequest("GET", "/substrate/processes", nil)); err != nil {
+		t.Fatalf("handleList failed: %v", err)
+	}
+
+	var infos []ProcessInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatalf("Failed to decode list: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Script != "/srv/app.js" || infos[0].ActiveRequests != 1 {
+		t.Errorf("Unexpected process list: %+v", infos)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/substrate/processes/stop", strings.NewReader(`{"script": "/srv/app.js"}`))
+	if err := api.handleStop(rec, req); err != nil {
+		t.Fatalf("handleStop failed: %v", err)
+	}
+	if pm.processes.get("/srv/app.js") != nil {
+		t.Error("Stopped process should be removed")
+	}
+}
+
+func TestAdminAPI_StopUnknownScript(t *testing.T) {
+	newAdminTestManager(t)
+
+	req := httptest.NewRequest("POST", "/substrate/processes/stop", strings.NewReader(`{"script": "/srv/missing.js"}`))
+	err := adminAPI{}.handleStop(httptest.NewRecorder(), req)
+
+	apiErr, ok := err.(caddy.APIError)
+	if !ok || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Errorf("Expected 404 API error, got %v", err)
+	}
+}
+
+func TestAdminAPI_FreezeAndThaw(t *testing.T) {
+	// A fake cgroup v2 hierarchy with Caddy in /system.slice/caddy.service
+	root := t.TempDir()
+	selfCgroup := filepath.Join(t.TempDir(), "cgroup")
+	if err := os.WriteFile(selfCgroup, []byte("0::/system.slice/caddy.service\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "system.slice/caddy.service"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldRoot, oldSelf := cgroupRoot, selfCgroupFile
+	cgroupRoot, selfCgroupFile = root, selfCgroup
+	t.Cleanup(func() { cgroupRoot, selfCgroupFile = oldRoot, oldSelf })
+
+	pm := newAdminTestManager(t)
+	process := &Process{
+		scriptPath: "/srv/app.js",
+		SocketPath: "/tmp/app.sock",
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: 4242}},
+		startedAt:  time.Now(),
+		logger:     pm.logger,
+	}
+	pm.processes.acquire("/srv/app.js", func() (*Process, error) { return process, nil })
+	// The stub must not be signalled on cleanup
+	t.Cleanup(func() { pm.processes.remove("/srv/app.js", process) })
+
+	api := adminAPI{}
+	post := func(handler func(http.ResponseWriter, *http.Request) error) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"script": "/srv/app.js"}`))
+		if err := handler(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+	cgroup := filepath.Join(root, "system.slice/caddy.service/substrate-4242")
+	read := func(name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(cgroup, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		return string(data)
+	}
+
+	post(api.handleFreeze)
+	if got := read("cgroup.procs"); got != "4242" {
+		t.Errorf("Expected the process to be moved to its cgroup, got %q", got)
+	}
+	if got := read("cgroup.freeze"); got != "1" || !process.Info().Frozen {
+		t.Errorf("Expected the process to be frozen, cgroup.freeze is %q", got)
+	}
+
+	post(api.handleThaw)
+	if got := read("cgroup.freeze"); got != "0" || process.Info().Frozen {
+		t.Errorf("Expected the process to be thawed, cgroup.freeze is %q", got)
+	}
+}
+
+func TestOwnCgroup_RequiresV2(t *testing.T) {
+	selfCgroup := filepath.Join(t.TempDir(), "cgroup")
+	if err := os.WriteFile(selfCgroup, []byte("4:memory:/caddy\n1:cpu:/caddy\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldSelf := selfCgroupFile
+	selfCgroupFile = selfCgroup
+	t.Cleanup(func() { selfCgroupFile = oldSelf })
+
+	if _, err := ownCgroup(); err == nil {
+		t.Error("Expected an error without a cgroup v2 entry")
+	}
+}
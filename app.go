@@ -0,0 +1,426 @@
+package substrate
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/dustin/go-humanize"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+	httpcaddyfile.RegisterGlobalOption("substrate", parseGlobalOptions)
+}
+
+// App holds server-wide defaults for substrate transports, configured with
+// the global `substrate { ... }` Caddyfile block. Every transport inherits
+// the options it doesn't set itself; env is merged, with the transport's
+// values winning. The app also runs the scheduled jobs and the named
+// services.
+type App struct {
+	IdleTimeout              *caddy.Duration   `json:"idle_timeout,omitempty"`
+	StartupTimeout           caddy.Duration    `json:"startup_timeout,omitempty"`
+	SocketDir                string            `json:"socket_dir,omitempty"`
+	Env                      map[string]string `json:"env,omitempty"`
+	DenoOpts                 string            `json:"deno_opts,omitempty"`
+	CacheDir                 string            `json:"cache_dir,omitempty"`
+	MaxStartsPerMinute       int               `json:"max_starts_per_minute,omitempty"`
+	MaxClientStartsPerMinute int               `json:"max_client_starts_per_minute,omitempty"`
+	MaxRequestBody           int64             `json:"max_request_body,omitempty"`
+	StopTimeout              caddy.Duration    `json:"stop_timeout,omitempty"`
+
+	// Jobs are scripts run on a schedule with the app's env, deno_opts and
+	// cache_dir.
+	Jobs []Job `json:"jobs,omitempty"`
+
+	// Services are named processes that transports share with
+	// `service <name>`.
+	Services map[string]*Service `json:"services,omitempty"`
+
+	jobs     *jobRunner
+	services *ProcessManager
+}
+
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "substrate",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+func (a *App) Validate() error {
+	if a.IdleTimeout != nil && *a.IdleTimeout < -1 {
+		return fmt.Errorf("idle_timeout must be >= -1")
+	}
+	if a.StartupTimeout < 0 {
+		return fmt.Errorf("startup_timeout cannot be negative")
+	}
+	if a.StopTimeout < 0 {
+		return fmt.Errorf("stop_timeout cannot be negative")
+	}
+	if a.MaxStartsPerMinute < 0 || a.MaxClientStartsPerMinute < 0 || a.MaxRequestBody < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+
+	names := make(map[string]bool, len(a.Jobs))
+	for i := range a.Jobs {
+		if err := a.Jobs[i].validate(); err != nil {
+			return err
+		}
+		if names[a.Jobs[i].Name] {
+			return fmt.Errorf("duplicate job name %s", a.Jobs[i].Name)
+		}
+		names[a.Jobs[i].Name] = true
+	}
+
+	for name, svc := range a.Services {
+		if err := svc.validate(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) Provision(ctx caddy.Context) error {
+	if len(a.Jobs) == 0 && len(a.Services) == 0 {
+		return nil
+	}
+
+	logger := ctx.Logger()
+	deno := NewDenoManager(a.CacheDir, logger)
+
+	if len(a.Jobs) > 0 {
+		a.jobs = &jobRunner{
+			jobs:     a.Jobs,
+			env:      a.Env,
+			denoOpts: a.DenoOpts,
+			runtime:  deno.Get,
+			logger:   logger,
+		}
+	}
+
+	if len(a.Services) > 0 {
+		startupTimeout := a.StartupTimeout
+		if startupTimeout == 0 {
+			startupTimeout = caddy.Duration(3 * time.Second)
+		}
+		// Services are never idle-stopped
+		manager, err := newProcessManager(0, startupTimeout, a.Env, a.DenoOpts, deno, logger, processOptions{socketDir: a.SocketDir, stopTimeout: time.Duration(a.StopTimeout)})
+		if err != nil {
+			return fmt.Errorf("failed to create service process manager: %w", err)
+		}
+		a.services = manager
+		registerManager(manager)
+	}
+	return nil
+}
+
+// Start runs the jobs. Services start with their first request; other
+// processes belong to the transports.
+func (a *App) Start() error {
+	if a.jobs != nil {
+		a.jobs.start()
+	}
+	return nil
+}
+
+func (a *App) Stop() error {
+	if a.jobs != nil {
+		a.jobs.stop()
+	}
+	if a.services != nil {
+		unregisterManager(a.services)
+		a.services.Stop()
+	}
+	return nil
+}
+
+// service returns the named service and the manager running it.
+func (a *App) service(name string) (*Service, *ProcessManager, error) {
+	svc, ok := a.Services[name]
+	if !ok || a.services == nil {
+		return nil, nil, fmt.Errorf("unknown service %s", name)
+	}
+	return svc, a.services, nil
+}
+
+// inherit fills the options t did not set from the app defaults.
+func (a *App) inherit(t *SubstrateTransport) {
+	if a.IdleTimeout != nil && !t.isSet("idle_timeout") {
+		t.IdleTimeout = *a.IdleTimeout
+	}
+	if a.StartupTimeout != 0 && !t.isSet("startup_timeout") {
+		t.StartupTimeout = a.StartupTimeout
+	}
+	if a.SocketDir != "" && !t.isSet("socket_dir") {
+		t.SocketDir = a.SocketDir
+	}
+	if a.DenoOpts != "" && !t.isSet("deno_opts") {
+		t.DenoOpts = a.DenoOpts
+	}
+	if a.CacheDir != "" && !t.isSet("cache_dir") {
+		t.CacheDir = a.CacheDir
+	}
+	if a.MaxStartsPerMinute != 0 && !t.isSet("max_starts_per_minute") {
+		t.MaxStartsPerMinute = a.MaxStartsPerMinute
+	}
+	if a.MaxClientStartsPerMinute != 0 && !t.isSet("max_client_starts_per_minute") {
+		t.MaxClientStartsPerMinute = a.MaxClientStartsPerMinute
+	}
+	if a.MaxRequestBody != 0 && !t.isSet("max_request_body") {
+		t.MaxRequestBody = a.MaxRequestBody
+	}
+	if a.StopTimeout != 0 && !t.isSet("stop_timeout") {
+		t.StopTimeout = a.StopTimeout
+	}
+
+	if len(a.Env) > 0 {
+		env := make(map[string]string, len(a.Env)+len(t.Env))
+		for k, v := range a.Env {
+			env[k] = v
+		}
+		for k, v := range t.Env {
+			env[k] = v
+		}
+		t.Env = env
+	}
+}
+
+// parseGlobalOptions sets up the substrate app from the global options block:
+//
+//	substrate {
+//	    idle_timeout <duration>
+//	    startup_timeout <duration>
+//	    socket_dir <path>
+//	    env {
+//	        <key> <value>
+//	    }
+//	    deno_opts <opts>
+//	    cache_dir <path>
+//	    max_starts_per_minute <n>
+//	    max_client_starts_per_minute <n>
+//	    max_request_body <size>
+//	    stop_timeout <duration>
+//	    service <name> {
+//	        script <path>
+//	        command <program> [<args...>]
+//	        dir <path>
+//	        env {
+//	            <key> <value>
+//	        }
+//	    }
+//	    job <name> <script> {
+//	        every <duration>
+//	        timeout <duration>
+//	        env {
+//	            <key> <value>
+//	        }
+//	    }
+//	}
+func parseGlobalOptions(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := new(App)
+
+	d.Next() // consume option name
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "idle_timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			var dur time.Duration
+			switch d.Val() {
+			case "0":
+			case "-1":
+				dur = -1
+			default:
+				var err error
+				if dur, err = time.ParseDuration(d.Val()); err != nil {
+					return nil, d.Errf("parsing idle_timeout: %v", err)
+				}
+			}
+			idle := caddy.Duration(dur)
+			app.IdleTimeout = &idle
+		case "startup_timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("parsing startup_timeout: %v", err)
+			}
+			app.StartupTimeout = caddy.Duration(dur)
+		case "socket_dir":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			app.SocketDir = d.Val()
+		case "env":
+			if app.Env == nil {
+				app.Env = make(map[string]string)
+			}
+			for d.NextBlock(1) {
+				key := d.Val()
+				if !d.NextArg() {
+					return nil, d.Errf("env directive requires key-value pairs")
+				}
+				app.Env[key] = d.Val()
+			}
+		case "deno_opts":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			app.DenoOpts = d.Val()
+		case "cache_dir":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			app.CacheDir = d.Val()
+		case "max_starts_per_minute", "max_client_starts_per_minute":
+			option := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("parsing %s: %v", option, err)
+			}
+			if option == "max_starts_per_minute" {
+				app.MaxStartsPerMinute = n
+			} else {
+				app.MaxClientStartsPerMinute = n
+			}
+		case "max_request_body":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return nil, d.Errf("parsing max_request_body: %v", err)
+			}
+			app.MaxRequestBody = int64(size)
+		case "stop_timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("parsing stop_timeout: %v", err)
+			}
+			app.StopTimeout = caddy.Duration(dur)
+		case "service":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			name := d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			svc, err := parseService(d)
+			if err != nil {
+				return nil, err
+			}
+			if app.Services == nil {
+				app.Services = make(map[string]*Service)
+			}
+			app.Services[name] = svc
+		case "job":
+			job, err := parseJob(d)
+			if err != nil {
+				return nil, err
+			}
+			app.Jobs = append(app.Jobs, job)
+		default:
+			return nil, d.Errf("unknown directive: %s", d.Val())
+		}
+	}
+
+	return httpcaddyfile.App{
+		Name:  "substrate",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+func parseJob(d *caddyfile.Dispenser) (Job, error) {
+	var job Job
+	if !d.Args(&job.Name, &job.Script) {
+		return job, d.ArgErr()
+	}
+	if d.NextArg() {
+		return job, d.ArgErr()
+	}
+
+	for d.NextBlock(1) {
+		switch d.Val() {
+		case "every", "timeout":
+			option := d.Val()
+			if !d.NextArg() {
+				return job, d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return job, d.Errf("parsing %s: %v", option, err)
+			}
+			if option == "every" {
+				job.Every = caddy.Duration(dur)
+			} else {
+				job.Timeout = caddy.Duration(dur)
+			}
+		case "env":
+			if job.Env == nil {
+				job.Env = make(map[string]string)
+			}
+			for d.NextBlock(2) {
+				key := d.Val()
+				if !d.NextArg() {
+					return job, d.Errf("env directive requires key-value pairs")
+				}
+				job.Env[key] = d.Val()
+			}
+		default:
+			return job, d.Errf("unknown job option: %s", d.Val())
+		}
+	}
+	return job, nil
+}
+
+func parseService(d *caddyfile.Dispenser) (*Service, error) {
+	svc := new(Service)
+	for d.NextBlock(1) {
+		switch d.Val() {
+		case "script":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			svc.Script = d.Val()
+		case "command":
+			svc.Command = d.RemainingArgs()
+			if len(svc.Command) == 0 {
+				return nil, d.ArgErr()
+			}
+		case "dir":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			svc.Dir = d.Val()
+		case "env":
+			if svc.Env == nil {
+				svc.Env = make(map[string]string)
+			}
+			for d.NextBlock(2) {
+				key := d.Val()
+				if !d.NextArg() {
+					return nil, d.Errf("env directive requires key-value pairs")
+				}
+				svc.Env[key] = d.Val()
+			}
+		default:
+			return nil, d.Errf("unknown service option: %s", d.Val())
+		}
+	}
+	return svc, nil
+}
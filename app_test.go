@@ -0,0 +1,92 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestParseGlobalOptions(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		idle_timeout 0
+		startup_timeout 10s
+		socket_dir /run/substrate
+		env {
+			APP_ENV production
+		}
+		max_request_body 1MB
+		stop_timeout 4s
+	}`)
+
+	val, err := parseGlobalOptions(d, nil)
+	if err != nil {
+		t.Fatalf("parseGlobalOptions failed: %v", err)
+	}
+
+	var app App
+	if err := json.Unmarshal(val.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatalf("Failed to decode app config: %v", err)
+	}
+	if app.IdleTimeout == nil || *app.IdleTimeout != 0 {
+		t.Errorf("Expected explicit idle_timeout 0, got %v", app.IdleTimeout)
+	}
+	if app.StartupTimeout != caddy.Duration(10*time.Second) {
+		t.Errorf("Expected startup_timeout 10s, got %v", time.Duration(app.StartupTimeout))
+	}
+	if app.SocketDir != "/run/substrate" || app.Env["APP_ENV"] != "production" || app.MaxRequestBody != 1000000 ||
+		app.StopTimeout != caddy.Duration(4*time.Second) {
+		t.Errorf("Unexpected app config: %+v", app)
+	}
+}
+
+func TestApp_InheritOnlyUnsetOptions(t *testing.T) {
+	idle := caddy.Duration(5 * time.Minute)
+	app := &App{
+		IdleTimeout:    &idle,
+		StartupTimeout: caddy.Duration(10 * time.Second),
+		SocketDir:      "/run/substrate",
+		Env:            map[string]string{"APP_ENV": "production", "REGION": "eu"},
+	}
+
+	transport := &SubstrateTransport{}
+	config := `{"startup_timeout": 1000000000, "env": {"APP_ENV": "staging"}}`
+	if err := json.Unmarshal([]byte(config), transport); err != nil {
+		t.Fatalf("Failed to decode transport: %v", err)
+	}
+	app.inherit(transport)
+
+	if transport.IdleTimeout != idle {
+		t.Errorf("Unset idle_timeout should be inherited, got %v", time.Duration(transport.IdleTimeout))
+	}
+	if transport.StartupTimeout != caddy.Duration(time.Second) {
+		t.Errorf("Explicit startup_timeout should be kept, got %v", time.Duration(transport.StartupTimeout))
+	}
+	if transport.SocketDir != "/run/substrate" {
+		t.Errorf("Unset socket_dir should be inherited, got %q", transport.SocketDir)
+	}
+	if transport.Env["APP_ENV"] != "staging" || transport.Env["REGION"] != "eu" {
+		t.Errorf("Env should merge with transport values winning, got %v", transport.Env)
+	}
+}
+
+func TestSubstrateTransport_DefaultsWhenUnset(t *testing.T) {
+	transport := &SubstrateTransport{}
+	if err := json.Unmarshal([]byte(`{"startup_timeout": 1000000000}`), transport); err != nil {
+		t.Fatalf("Failed to decode transport: %v", err)
+	}
+	if err := transport.applyDefaults(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatalf("applyDefaults failed: %v", err)
+	}
+
+	if transport.IdleTimeout != caddy.Duration(time.Hour) {
+		t.Errorf("Expected default idle_timeout 1h, got %v", time.Duration(transport.IdleTimeout))
+	}
+	if transport.StartupTimeout != caddy.Duration(time.Second) {
+		t.Errorf("Explicit startup_timeout should be kept, got %v", time.Duration(transport.StartupTimeout))
+	}
+}
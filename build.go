@@ -0,0 +1,253 @@
+package substrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// BuildConfig is a build step run in the script's directory before a process
+// starts, e.g. to compile sources the script loads. It runs before the first
+// start and again only when the content of its inputs changes.
+type BuildConfig struct {
+	// Command is the program and arguments to run.
+	Command []string `json:"command"`
+
+	// Inputs are glob patterns, relative to the script's directory, for the
+	// files the build reads. Without inputs the build runs once per script
+	// directory.
+	Inputs []string `json:"inputs,omitempty"`
+
+	// Timeout stops a build that takes longer. Default 5m.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+const defaultBuildTimeout = 5 * time.Minute
+
+func (c *BuildConfig) validate() error {
+	if len(c.Command) == 0 {
+		return fmt.Errorf("build requires a command")
+	}
+	for _, pattern := range c.Inputs {
+		if filepath.IsAbs(pattern) {
+			return fmt.Errorf("build inputs must be relative to the script directory, got %q", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid build input %q: %w", pattern, err)
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("build timeout cannot be negative")
+	}
+	return nil
+}
+
+// BuildError is a build step that failed. Its output is reported like the
+// output of a process that failed to start.
+type BuildError struct {
+	Err    error
+	Output string
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("build failed: %v", e.Err)
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// builder runs the build step and remembers, per script directory, the hash
+// of the inputs it last built and the result, so a failed build is not rerun
+// for every request either.
+type builder struct {
+	config BuildConfig
+	env    map[string]string
+	opts   processOptions
+	logger *zap.Logger
+
+	// Builds are rare, so one lock serializes them all
+	mu    sync.Mutex
+	built map[string]buildResult
+}
+
+type buildResult struct {
+	hash string
+	err  error
+}
+
+func newBuilder(config *BuildConfig, env map[string]string, opts processOptions, logger *zap.Logger) *builder {
+	if config == nil {
+		return nil
+	}
+	// Builds run on the host's resolver, outside the hosts namespace
+	opts.hosts = nil
+	return &builder{
+		config: *config,
+		env:    env,
+		opts:   opts,
+		logger: logger,
+		built:  make(map[string]buildResult),
+	}
+}
+
+// ensure builds the directory of script unless its inputs are unchanged
+// since the last build, in which case that build's error is returned.
+func (b *builder) ensure(script string) error {
+	if b == nil {
+		return nil
+	}
+
+	dir := filepath.Dir(script)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hash, err := b.inputHash(dir)
+	if err != nil {
+		return &BuildError{Err: err}
+	}
+	if last, ok := b.built[dir]; ok && last.hash == hash {
+		return last.err
+	}
+
+	err = b.run(dir, script)
+	if err == nil {
+		// Hash again so a build that touches its own inputs does not
+		// rebuild on the next start
+		if hash, err = b.inputHash(dir); err != nil {
+			return &BuildError{Err: err}
+		}
+	}
+	b.built[dir] = buildResult{hash, err}
+	return err
+}
+
+func (b *builder) run(dir, script string) error {
+	timeout := time.Duration(b.config.Timeout)
+	if timeout == 0 {
+		timeout = defaultBuildTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := buildCommand(b.config.Command[0], b.config.Command[1:], b.opts)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for key, value := range b.env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Env = append(cmd.Env, "SUBSTRATE=true", "SUBSTRATE_BUILD="+script)
+	if err := configureProcessSecurity(cmd, script, b.opts); err != nil {
+		return &BuildError{Err: fmt.Errorf("failed to configure build security: %w", err)}
+	}
+
+	b.logger.Info("running build",
+		zap.String("dir", dir),
+		zap.Strings("command", b.config.Command),
+	)
+	start := time.Now()
+
+	output, err := runWithContext(ctx, cmd)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %v", timeout)
+		}
+		b.logger.Error("build failed",
+			zap.String("dir", dir),
+			zap.ByteString("output", output),
+			zap.Error(err),
+		)
+		return &BuildError{Err: err, Output: string(output)}
+	}
+
+	b.logger.Info("build finished",
+		zap.String("dir", dir),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return nil
+}
+
+// runWithContext runs cmd, killing it when ctx is done, and returns its
+// combined output.
+func runWithContext(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	// Children left holding the output pipe must not keep the build going
+	cmd.WaitDelay = time.Second
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	started := make(chan struct{})
+	go func() {
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := cmd.Start()
+		close(started)
+		if err == nil {
+			err = cmd.Wait()
+		}
+		done <- result{output.Bytes(), err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.output, r.err
+	case <-ctx.Done():
+		<-started
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		r := <-done
+		return r.output, ctx.Err()
+	}
+}
+
+// inputHash hashes the names and content of the files matched by the
+// inputs.
+func (b *builder) inputHash(dir string) (string, error) {
+	var files []string
+	for _, pattern := range b.config.Inputs {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return "", err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for i, file := range files {
+		if i > 0 && file == files[i-1] {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("reading build input: %w", err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", file, info.Size())
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("reading build input: %w", err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
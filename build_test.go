@@ -0,0 +1,131 @@
+package substrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBuilder_RebuildsOnInputChange(t *testing.T) {
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "app.js")
+	source := filepath.Join(dir, "app.ts")
+	for _, file := range []string{scriptPath, source} {
+		if err := os.WriteFile(file, []byte("// v1"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+	}
+	runs := filepath.Join(dir, "runs")
+
+	b := newBuilder(&BuildConfig{
+		Command: []string{"/bin/sh", "-c", "echo run >> runs"},
+		Inputs:  []string{"*.ts"},
+	}, nil, processOptions{}, zaptest.NewLogger(t))
+
+	countRuns := func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := b.ensure(scriptPath); err != nil {
+			t.Fatalf("ensure failed: %v", err)
+		}
+	}
+	if got := countRuns(); got != 1 {
+		t.Fatalf("Expected one build for unchanged inputs, got %d", got)
+	}
+
+	// Only the content matters, not the modification time
+	if err := os.WriteFile(source, []byte("// v1"), 0644); err != nil {
+		t.Fatalf("Failed to rewrite source: %v", err)
+	}
+	if err := b.ensure(scriptPath); err != nil {
+		t.Fatalf("ensure failed: %v", err)
+	}
+	if got := countRuns(); got != 1 {
+		t.Errorf("Expected no build for identical content, got %d builds", got)
+	}
+
+	if err := os.WriteFile(source, []byte("// v2"), 0644); err != nil {
+		t.Fatalf("Failed to change source: %v", err)
+	}
+	if err := b.ensure(scriptPath); err != nil {
+		t.Fatalf("ensure failed: %v", err)
+	}
+	if got := countRuns(); got != 2 {
+		t.Errorf("Expected a rebuild after the input changed, got %d builds", got)
+	}
+}
+
+func TestProcessManager_BuildFailure(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{build: &BuildConfig{Command: []string{"/bin/sh", "-c", "echo 'syntax error' >&2; exit 3"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	scriptPath := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	_, err = pm.getOrCreateHost(scriptPath, "")
+	var startupErr *ProcessStartupError
+	if !errors.As(err, &startupErr) {
+		t.Fatalf("Expected a ProcessStartupError, got %v", err)
+	}
+	if startupErr.ExitCode != 3 || !strings.Contains(startupErr.Stderr, "syntax error") {
+		t.Errorf("Expected the build's exit code and output, got %+v", startupErr)
+	}
+
+	// The failure is kept until the inputs change
+	_, err = pm.getOrCreateHost(scriptPath, "")
+	if !errors.As(err, &startupErr) || startupErr.ExitCode != 3 {
+		t.Errorf("Expected the cached build failure, got %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfile_Build(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		build {
+			command deno bundle main.ts app.js
+			inputs *.ts lib/*.ts
+			timeout 1m
+		}
+	}`)
+
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	build := transport.Build
+	if build == nil || strings.Join(build.Command, " ") != "deno bundle main.ts app.js" ||
+		strings.Join(build.Inputs, " ") != "*.ts lib/*.ts" || build.Timeout != caddy.Duration(time.Minute) {
+		t.Fatalf("Unexpected build: %+v", build)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	build.Inputs = []string{"/srv/app/*.ts"}
+	if err := transport.Validate(); err == nil {
+		t.Error("Absolute build inputs should be rejected")
+	}
+}
@@ -0,0 +1,241 @@
+package substrate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// redactValue removes the password of a URL-like value such as a database
+// connection string.
+func redactValue(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+	u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return strings.Replace(u.String(), "xxxxx", "[redacted]", 1)
+}
+
+// redactBundleEnv is redactEnv, also removing passwords from URL values.
+func redactBundleEnv(env []string) []string {
+	result := redactEnv(env)
+	for i, entry := range result {
+		name, value, _ := strings.Cut(entry, "=")
+		result[i] = name + "=" + redactValue(value)
+	}
+	return result
+}
+
+// redactJSON returns a JSON document with the values of secret keys, and
+// the passwords of URLs, replaced.
+func redactJSON(raw []byte) (json.RawMessage, error) {
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(redactJSONValue(doc), "", "  ")
+}
+
+// redactJSONValue replaces, in place, the secrets of a decoded JSON value.
+func redactJSONValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if _, isString := value.(string); isString && secretEnvName.MatchString(key) {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = redactJSONValue(value)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactJSONValue(v[i])
+		}
+	case string:
+		return redactValue(v)
+	}
+	return v
+}
+
+// safeFileName replaces the characters of name that don't belong in a file
+// name.
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// bundleName names the bundle of script, and the directory its files are in.
+func bundleName(script string, now time.Time) string {
+	return "substrate-" + safeFileName(filepath.Base(script)) + "-" + now.UTC().Format("20060102T150405Z")
+}
+
+// crashBundle holds what is known of a script for a bug report.
+type crashBundle struct {
+	script    string
+	processes []ProcessInfo
+	exits     []ProcessExit
+	usage     *ScriptUsage
+	env       []string        // of the running or last exited process
+	config    json.RawMessage // of the transport that ran it
+}
+
+// collectBundle gathers the diagnostics of script, reporting whether
+// substrate knows anything about it.
+func collectBundle(script string) (crashBundle, bool) {
+	b := crashBundle{script: script}
+
+	for _, pm := range registeredManagers() {
+		for _, process := range pm.processes.snapshot() {
+			if process.scriptPath != script {
+				continue
+			}
+			b.processes = append(b.processes, process.Info())
+			if b.env == nil {
+				b.env, b.config = process.context()
+			}
+		}
+	}
+	if history := exitHistory.list(script); len(history) > 0 {
+		b.exits = history[0].Exits
+	}
+	if b.env == nil {
+		if c, ok := exitHistory.context(script); ok {
+			b.env, b.config = c.env, c.config
+		}
+	}
+	for _, usage := range scriptUsage.list() {
+		if usage.Script == script {
+			b.usage = &usage
+		}
+	}
+
+	known := len(b.processes) > 0 || len(b.exits) > 0 || b.usage != nil
+	return b, known
+}
+
+// writeTo writes the bundle as a gzipped tarball. Secrets in the environment
+// and the config are redacted.
+func (b crashBundle) writeTo(w *bytes.Buffer, now time.Time) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	dir := bundleName(b.script, now)
+
+	add := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    dir + "/" + name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		})
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		return err
+	}
+	addJSON := func(name string, v any) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, append(data, '\n'))
+	}
+
+	summary := fmt.Sprintf("script: %s\ncollected: %s\nprocesses running: %d\nexits recorded: %d\n",
+		b.script, now.UTC().Format(time.RFC3339), len(b.processes), len(b.exits))
+	if err := add("summary.txt", []byte(summary)); err != nil {
+		return err
+	}
+	if err := addJSON("processes.json", b.processes); err != nil {
+		return err
+	}
+	if err := addJSON("exits.json", b.exits); err != nil {
+		return err
+	}
+	for _, exit := range b.exits {
+		if exit.Stderr == "" {
+			continue
+		}
+		name := fmt.Sprintf("logs/%s-%d.stderr", exit.Time.UTC().Format("20060102T150405Z"), exit.PID)
+		if err := add(name, []byte(exit.Stderr)); err != nil {
+			return err
+		}
+	}
+	if b.usage != nil {
+		if err := addJSON("usage.json", b.usage); err != nil {
+			return err
+		}
+	}
+	if b.env != nil {
+		if err := add("env.txt", []byte(strings.Join(redactBundleEnv(b.env), "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	if b.config != nil {
+		config, err := redactJSON(b.config)
+		if err != nil {
+			return err
+		}
+		if err := add("config.json", append(config, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// handleBundle serves the diagnostics of the script in the script query
+// parameter as a tarball to attach to bug reports.
+func (adminAPI) handleBundle(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	script := r.URL.Query().Get("script")
+	if script == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("missing script query parameter"),
+		}
+	}
+
+	b, known := collectBundle(script)
+	if !known {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("nothing is known about script %s", script),
+		}
+	}
+
+	var buf bytes.Buffer
+	now := time.Now()
+	if err := b.writeTo(&buf, now); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	name := bundleName(script, now) + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
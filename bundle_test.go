@@ -0,0 +1,135 @@
+package substrate
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRedactBundleEnv(t *testing.T) {
+	env := redactBundleEnv([]string{
+		"APP_ENV=production",
+		"API_KEY=abc123",
+		"DATABASE_URL=postgres://app:hunter2@db:5432/app",
+		"HOME=/home/app",
+	})
+	want := []string{
+		"APP_ENV=production",
+		"API_KEY=[redacted]",
+		"DATABASE_URL=postgres://app:[redacted]@db:5432/app",
+		"HOME=/home/app",
+	}
+	if strings.Join(env, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected %q, got %q", want, env)
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	raw := `{"env":{"STRIPE_SECRET":"sk_live","REDIS":"redis://:pw@cache"},"idle_timeout":300,"deno_options":"--allow-net"}`
+	redactedJSON, err := redactJSON([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Env         map[string]string `json:"env"`
+		IdleTimeout int               `json:"idle_timeout"`
+		DenoOptions string            `json:"deno_options"`
+	}
+	if err := json.Unmarshal(redactedJSON, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Env["STRIPE_SECRET"] != "[redacted]" || doc.Env["REDIS"] != "redis://:[redacted]@cache" {
+		t.Errorf("Expected secrets redacted, got %+v", doc.Env)
+	}
+	if doc.IdleTimeout != 300 || doc.DenoOptions != "--allow-net" {
+		t.Errorf("Expected other values kept, got %+v", doc)
+	}
+}
+
+func TestAdminAPI_Bundle(t *testing.T) {
+	script := "/srv/bundled.js"
+	exitHistory.record(script, ProcessExit{Time: time.Now(), PID: 4242, ExitCode: 1, Stderr: "TypeError: boom\n"})
+	exitHistory.recordContext(script, exitContext{
+		env:    []string{"APP_ENV=production", "SESSION_TOKEN=abc"},
+		config: json.RawMessage(`{"env":{"SESSION_TOKEN":"abc"},"idle_timeout":300}`),
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/substrate/bundle?script="+url.QueryEscape(script), nil)
+	if err := (adminAPI{}).handleBundle(rec, req); err != nil {
+		t.Fatalf("handleBundle failed: %v", err)
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); !strings.Contains(disposition, `filename="substrate-bundled.js-`) {
+		t.Errorf("Unexpected Content-Disposition %q", disposition)
+	}
+
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Expected a gzipped bundle: %v", err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Reading bundle: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		_, name, _ := strings.Cut(header.Name, "/")
+		files[name] = string(data)
+	}
+
+	for _, name := range []string{"summary.txt", "processes.json", "exits.json", "env.txt", "config.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %s in the bundle, got %v", name, files)
+		}
+	}
+	if !strings.Contains(files["exits.json"], `"pid": 4242`) {
+		t.Errorf("Expected the exit in exits.json, got %s", files["exits.json"])
+	}
+	var stderr string
+	for name, data := range files {
+		if strings.HasPrefix(name, "logs/") && strings.HasSuffix(name, "-4242.stderr") {
+			stderr = data
+		}
+	}
+	if stderr != "TypeError: boom\n" {
+		t.Errorf("Expected the stderr of the exit, got %q", stderr)
+	}
+	if strings.Contains(files["env.txt"], "abc") || strings.Contains(files["config.json"], "abc") {
+		t.Errorf("Expected secrets redacted, got %s and %s", files["env.txt"], files["config.json"])
+	}
+	if !strings.Contains(files["env.txt"], "APP_ENV=production") {
+		t.Errorf("Expected the environment, got %s", files["env.txt"])
+	}
+}
+
+func TestAdminAPI_BundleErrors(t *testing.T) {
+	tests := []struct {
+		uri    string
+		status int
+	}{
+		{"/substrate/bundle", http.StatusBadRequest},
+		{"/substrate/bundle?script=" + url.QueryEscape("/srv/never-ran.js"), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		err := (adminAPI{}).handleBundle(httptest.NewRecorder(), httptest.NewRequest("GET", tt.uri, nil))
+		apiErr, ok := err.(caddy.APIError)
+		if !ok || apiErr.HTTPStatus != tt.status {
+			t.Errorf("%s: expected status %d, got %v", tt.uri, tt.status, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package substrate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// The cgroup v2 hierarchy and the file naming Caddy's own cgroup; variables
+// so tests can point them at a fake hierarchy.
+var (
+	cgroupRoot     = "/sys/fs/cgroup"
+	selfCgroupFile = "/proc/self/cgroup"
+)
+
+// ownCgroup returns Caddy's cgroup v2 path, relative to cgroupRoot.
+func ownCgroup() (string, error) {
+	f, err := os.Open(selfCgroupFile)
+	if err != nil {
+		return "", fmt.Errorf("reading own cgroup: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("freezing processes requires cgroup v2")
+}
+
+// cgroupLimit is a value written to a cgroup file, such as pids.max.
+type cgroupLimit struct {
+	file  string
+	value string
+}
+
+// ensureCgroupLocked moves the process into a cgroup of its own, below
+// Caddy's, unless it is in one already. limits are written in order before
+// the process is moved. p.mu must be held.
+func (p *Process) ensureCgroupLocked(limits []cgroupLimit) error {
+	if p.cgroupDir != "" {
+		return nil
+	}
+	parent, err := ownCgroup()
+	if err != nil {
+		return err
+	}
+	pid := strconv.Itoa(p.cmd.Process.Pid)
+	dir := filepath.Join(cgroupRoot, parent, "substrate-"+pid)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("creating cgroup: %w", err)
+	}
+	for _, limit := range limits {
+		if err := os.WriteFile(filepath.Join(dir, limit.file), []byte(limit.value), 0644); err != nil {
+			os.Remove(dir)
+			return fmt.Errorf("setting cgroup %s: %w", limit.file, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(pid), 0644); err != nil {
+		os.Remove(dir)
+		return fmt.Errorf("moving process to its cgroup: %w", err)
+	}
+	p.cgroupDir = dir
+	return nil
+}
+
+// freeze pauses the process with the cgroup v2 freezer. The process is moved
+// into a cgroup of its own, below Caddy's, unless its limits put it in one
+// already.
+// Requests to a frozen process wait until it is thawed.
+func (p *Process) freeze() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.startedAt.IsZero() {
+		return fmt.Errorf("process has not started")
+	}
+	if err := p.ensureCgroupLocked(nil); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(p.cgroupDir, "cgroup.freeze"), []byte("1"), 0644); err != nil {
+		return fmt.Errorf("freezing cgroup: %w", err)
+	}
+	p.frozen = true
+	return nil
+}
+
+// thaw resumes a frozen process.
+func (p *Process) thaw() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.thawLocked()
+}
+
+func (p *Process) thawLocked() error {
+	if !p.frozen {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(p.cgroupDir, "cgroup.freeze"), []byte("0"), 0644); err != nil {
+		return fmt.Errorf("thawing cgroup: %w", err)
+	}
+	p.frozen = false
+	return nil
+}
+
+// removeCgroup deletes the process's cgroup, if any. The process must have
+// exited.
+func (p *Process) removeCgroup() {
+	p.mu.RLock()
+	dir := p.cgroupDir
+	p.mu.RUnlock()
+	if dir == "" {
+		return
+	}
+	if err := os.Remove(dir); err != nil {
+		p.logger.Warn("failed to remove process cgroup",
+			zap.String("script_path", p.scriptPath),
+			zap.String("cgroup", dir),
+			zap.Error(err),
+		)
+	}
+}
+
+// freezeProcess freezes the processes running file, in every namespace.
+func (pm *ProcessManager) freezeProcess(file string) (bool, error) {
+	found := false
+	for _, key := range pm.keysFor(file) {
+		process := pm.processes.get(key)
+		if process == nil {
+			continue
+		}
+		found = true
+		if err := process.freeze(); err != nil {
+			return true, err
+		}
+	}
+	if found {
+		pm.logger.Warn("process frozen", zap.String("script_path", file))
+	}
+	return found, nil
+}
+
+// thawProcess thaws the processes running file, in every namespace.
+func (pm *ProcessManager) thawProcess(file string) (bool, error) {
+	found := false
+	for _, key := range pm.keysFor(file) {
+		process := pm.processes.get(key)
+		if process == nil {
+			continue
+		}
+		found = true
+		if err := process.thaw(); err != nil {
+			return true, err
+		}
+	}
+	if found {
+		pm.logger.Info("process thawed", zap.String("script_path", file))
+	}
+	return found, nil
+}
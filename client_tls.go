@@ -0,0 +1,59 @@
+package substrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ClientTLSConfig passes details of the client's TLS connection to the
+// process in request headers, e.g. for client certificate authentication.
+// The headers are removed from requests that did not use TLS, so clients
+// cannot set them.
+type ClientTLSConfig struct {
+	// Cert sets X-Client-Cert to the client certificate, as a URL-encoded
+	// "pem" or as the hex SHA-256 "fingerprint" of its DER encoding. Empty
+	// sends no certificate.
+	Cert string `json:"cert,omitempty"`
+
+	// SNI sets X-Client-SNI to the server name the client asked for.
+	SNI bool `json:"sni,omitempty"`
+}
+
+func (c *ClientTLSConfig) validate() error {
+	switch c.Cert {
+	case "", "pem", "fingerprint":
+	default:
+		return fmt.Errorf("client_tls cert must be pem or fingerprint, got %q", c.Cert)
+	}
+	return nil
+}
+
+// apply replaces the client TLS headers of req with the details of its
+// connection.
+func (c *ClientTLSConfig) apply(req *http.Request) {
+	req.Header.Del("X-Client-Cert")
+	req.Header.Del("X-Client-SNI")
+	if req.TLS == nil {
+		return
+	}
+
+	if c.SNI && req.TLS.ServerName != "" {
+		req.Header.Set("X-Client-SNI", req.TLS.ServerName)
+	}
+	if c.Cert == "" || len(req.TLS.PeerCertificates) == 0 {
+		return
+	}
+	der := req.TLS.PeerCertificates[0].Raw
+	switch c.Cert {
+	case "pem":
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		req.Header.Set("X-Client-Cert", url.PathEscape(string(block)))
+	case "fingerprint":
+		sum := sha256.Sum256(der)
+		req.Header.Set("X-Client-Cert", hex.EncodeToString(sum[:]))
+	}
+}
@@ -0,0 +1,103 @@
+package substrate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func testClientCert(t *testing.T) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestClientTLS_Apply(t *testing.T) {
+	cert := testClientCert(t)
+
+	req := httptest.NewRequest("GET", "/app.js", nil)
+	req.TLS = &tls.ConnectionState{ServerName: "app.example.com", PeerCertificates: []*x509.Certificate{cert}}
+	(&ClientTLSConfig{Cert: "pem", SNI: true}).apply(req)
+	if got := req.Header.Get("X-Client-SNI"); got != "app.example.com" {
+		t.Errorf("Expected X-Client-SNI, got %q", got)
+	}
+	decoded, err := url.PathUnescape(req.Header.Get("X-Client-Cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(decoded))
+	if block == nil || string(block.Bytes) != string(cert.Raw) {
+		t.Errorf("Expected the certificate as PEM, got %q", req.Header.Get("X-Client-Cert"))
+	}
+
+	req.Header.Del("X-Client-Cert")
+	(&ClientTLSConfig{Cert: "fingerprint"}).apply(req)
+	sum := sha256.Sum256(cert.Raw)
+	if got := req.Header.Get("X-Client-Cert"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected the fingerprint, got %q", got)
+	}
+	if req.Header.Get("X-Client-SNI") != "" {
+		t.Error("SNI should not be sent unless enabled")
+	}
+
+	// Headers from clients without TLS are dropped
+	req = httptest.NewRequest("GET", "/app.js", nil)
+	req.Header.Set("X-Client-Cert", "forged")
+	req.Header.Set("X-Client-SNI", "forged")
+	(&ClientTLSConfig{Cert: "pem", SNI: true}).apply(req)
+	if req.Header.Get("X-Client-Cert") != "" || req.Header.Get("X-Client-SNI") != "" {
+		t.Error("Client-supplied TLS headers should be removed")
+	}
+}
+
+func TestUnmarshalCaddyfile_ClientTLS(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		client_tls {
+			cert fingerprint
+			sni
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.ClientTLS == nil || transport.ClientTLS.Cert != "fingerprint" || !transport.ClientTLS.SNI {
+		t.Errorf("Expected client_tls cert fingerprint with sni, got %+v", transport.ClientTLS)
+	}
+
+	transport.ClientTLS.Cert = "der"
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an unknown cert format to be rejected")
+	}
+}
@@ -0,0 +1,360 @@
+package substrate
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// ClusterConfig makes the Caddy instances sharing a storage backend agree
+// on which of them runs each script, so a script is started on one node
+// instead of on every node the load balancer sends its requests to.
+type ClusterConfig struct {
+	// Address is the URL other nodes reach this one at, serving the same
+	// routes, e.g. http://10.0.0.5. It also identifies the node.
+	Address string `json:"address"`
+
+	// HeartbeatInterval is how often the node announces itself in storage
+	// and reads which other nodes are up. Nodes not heard from in three
+	// intervals are left out. Default 10s.
+	HeartbeatInterval caddy.Duration `json:"heartbeat_interval,omitempty"`
+}
+
+const (
+	defaultClusterHeartbeat = 10 * time.Second
+
+	// clusterStoragePrefix is where nodes announce themselves in storage.
+	clusterStoragePrefix = "substrate/cluster"
+
+	// clusterMissedHeartbeats is how many heartbeats a node may miss before
+	// its scripts move to other nodes.
+	clusterMissedHeartbeats = 3
+
+	// clusterForgetAfter is how long the entry of a node that stopped is
+	// kept in storage.
+	clusterForgetAfter = time.Hour
+
+	// clusterReplicas is how many points each node has on the hash ring,
+	// spreading scripts evenly.
+	clusterReplicas = 64
+
+	// clusterForwardedHeader marks a request another node forwarded, which
+	// is served where it arrives. It carries the forwarding node, a time and
+	// their HMAC with the cluster secret, so clients cannot set it. It starts
+	// with X-Substrate-, so it never reaches the process.
+	clusterForwardedHeader = "X-Substrate-Forwarded-By"
+
+	// clusterSecretKey is where the secret nodes sign forwarded requests
+	// with is kept in storage, created by the first node.
+	clusterSecretKey = "substrate/cluster_secret"
+
+	// clusterForwardedMaxAge is how old a forwarded request's signature may
+	// be, allowing for clock differences between nodes.
+	clusterForwardedMaxAge = 5 * time.Minute
+)
+
+func (c *ClusterConfig) validate() error {
+	u, err := url.Parse(c.Address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("cluster address must be an http or https URL without a path, got %q", c.Address)
+	}
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("cluster heartbeat_interval cannot be negative")
+	}
+	return nil
+}
+
+func (c *ClusterConfig) heartbeatInterval() time.Duration {
+	if c.HeartbeatInterval == 0 {
+		return defaultClusterHeartbeat
+	}
+	return time.Duration(c.HeartbeatInterval)
+}
+
+// clusterMember is the entry a node keeps in storage.
+type clusterMember struct {
+	Address string    `json:"address"`
+	Updated time.Time `json:"updated"`
+}
+
+// hashRing maps keys to nodes by consistent hashing, so a node joining or
+// leaving only moves the keys it takes or had.
+type hashRing struct {
+	points []uint64 // sorted
+	nodes  map[uint64]string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{nodes: make(map[uint64]string, len(nodes)*clusterReplicas)}
+	for _, node := range nodes {
+		for i := 0; i < clusterReplicas; i++ {
+			point := ringHash(node + "#" + strconv.Itoa(i))
+			r.points = append(r.points, point)
+			r.nodes[point] = node
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// owner returns the node key hashes to, or "" for an empty ring.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i]]
+}
+
+// clusterNode keeps this node's membership and the ring of live nodes.
+type clusterNode struct {
+	config  *ClusterConfig
+	address string // normalized config.Address
+	storage certmagic.Storage
+	logger  *zap.Logger
+	client  *http.Transport
+
+	mu     sync.RWMutex
+	nodes  []string // live, sorted
+	ring   *hashRing
+	secret []byte // shared by the nodes, nil until loaded from storage
+}
+
+func newClusterNode(config *ClusterConfig, storage certmagic.Storage, logger *zap.Logger) *clusterNode {
+	address := clusterAddress(config.Address)
+	return &clusterNode{
+		config:  config,
+		address: address,
+		storage: storage,
+		logger:  logger,
+		client: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		nodes: []string{address},
+		ring:  newHashRing([]string{address}),
+	}
+}
+
+// clusterAddress normalizes an address so every node names a node the same.
+func clusterAddress(address string) string {
+	u, err := url.Parse(address)
+	if err != nil {
+		return address
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// memberKey is where the node at address is announced in storage.
+func memberKey(address string) string {
+	sum := sha256.Sum256([]byte(address))
+	return path.Join(clusterStoragePrefix, hex.EncodeToString(sum[:8])+".json")
+}
+
+// run announces the node until ctx is done.
+func (c *clusterNode) run(ctx context.Context) {
+	defer c.client.CloseIdleConnections()
+
+	interval := c.config.heartbeatInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.heartbeat(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			c.logger.Warn("cluster heartbeat failed", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeat stores the node's entry and rebuilds the ring from the entries
+// of the nodes heard from recently.
+func (c *clusterNode) heartbeat(ctx context.Context, now time.Time) error {
+	if err := c.loadSecret(ctx); err != nil {
+		return fmt.Errorf("loading cluster secret: %w", err)
+	}
+	data, err := json.Marshal(clusterMember{Address: c.address, Updated: now})
+	if err != nil {
+		return err
+	}
+	if err := c.storage.Store(ctx, memberKey(c.address), data); err != nil {
+		return err
+	}
+
+	keys, err := c.storage.List(ctx, clusterStoragePrefix, false)
+	if err != nil {
+		return err
+	}
+	live := []string{c.address}
+	stale := time.Duration(clusterMissedHeartbeats) * c.config.heartbeatInterval()
+	for _, key := range keys {
+		data, err := c.storage.Load(ctx, key)
+		if err != nil {
+			continue
+		}
+		var member clusterMember
+		if err := json.Unmarshal(data, &member); err != nil || member.Address == c.address {
+			continue
+		}
+		switch age := now.Sub(member.Updated); {
+		case age < stale:
+			live = append(live, member.Address)
+		case age > clusterForgetAfter:
+			c.storage.Delete(ctx, key)
+		}
+	}
+	sort.Strings(live)
+
+	c.mu.Lock()
+	changed := !slices.Equal(c.nodes, live)
+	if changed {
+		c.nodes, c.ring = live, newHashRing(live)
+	}
+	c.mu.Unlock()
+	if changed {
+		c.logger.Info("cluster membership changed", zap.Strings("nodes", live))
+	}
+	return nil
+}
+
+// loadSecret reads the cluster secret from storage, creating it when no
+// node has yet.
+func (c *clusterNode) loadSecret(ctx context.Context) error {
+	c.mu.RLock()
+	loaded := c.secret != nil
+	c.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	secret, err := c.storage.Load(ctx, clusterSecretKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := c.storage.Lock(ctx, clusterSecretKey); err != nil {
+			return err
+		}
+		defer c.storage.Unlock(ctx, clusterSecretKey)
+		// Another node may have created it while this one waited
+		secret, err = c.storage.Load(ctx, clusterSecretKey)
+		if errors.Is(err, fs.ErrNotExist) {
+			secret = make([]byte, 32)
+			rand.Read(secret)
+			err = c.storage.Store(ctx, clusterSecretKey, secret)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.secret = secret
+	c.mu.Unlock()
+	return nil
+}
+
+// sign returns the clusterForwardedHeader value for a request this node
+// forwards at now, or "" before the secret is loaded.
+func (c *clusterNode) sign(now time.Time) string {
+	c.mu.RLock()
+	secret := c.secret
+	c.mu.RUnlock()
+	if secret == nil {
+		return ""
+	}
+	payload := c.address + " " + strconv.FormatInt(now.Unix(), 10)
+	return payload + " " + clusterMAC(secret, payload)
+}
+
+// forwardedBy returns the node that forwarded a request with the
+// clusterForwardedHeader value header, or "" unless the value is signed
+// with the cluster secret recently.
+func (c *clusterNode) forwardedBy(header string, now time.Time) string {
+	c.mu.RLock()
+	secret := c.secret
+	c.mu.RUnlock()
+	i := strings.LastIndexByte(header, ' ')
+	if secret == nil || i < 0 {
+		return ""
+	}
+	payload, mac := header[:i], header[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(clusterMAC(secret, payload))) {
+		return ""
+	}
+	address, signed, _ := strings.Cut(payload, " ")
+	unix, err := strconv.ParseInt(signed, 10, 64)
+	if err != nil {
+		return ""
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > clusterForwardedMaxAge || age < -clusterForwardedMaxAge {
+		return ""
+	}
+	return address
+}
+
+func clusterMAC(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// owner returns the address of the node that should run key.
+func (c *clusterNode) owner(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.owner(key)
+}
+
+// errClusterUnsigned is returned by forward before the cluster secret is
+// loaded, when the owner could not tell the request was forwarded.
+var errClusterUnsigned = errors.New("cluster secret not loaded yet")
+
+// forward sends req to the node at owner, which serves it itself.
+func (c *clusterNode) forward(req *http.Request, owner string) (*http.Response, error) {
+	target, err := url.Parse(owner)
+	if err != nil {
+		return nil, err
+	}
+	signature := c.sign(time.Now())
+	if signature == "" {
+		return nil, errClusterUnsigned
+	}
+	out := req.Clone(req.Context())
+	out.URL.Scheme, out.URL.Host = target.Scheme, target.Host
+	out.Header.Set(clusterForwardedHeader, signature)
+	return c.client.RoundTrip(out)
+}
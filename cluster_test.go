@@ -0,0 +1,229 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestHashRing(t *testing.T) {
+	nodes := []string{"http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3"}
+	ring := newHashRing(nodes)
+
+	counts := map[string]int{}
+	owners := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("/srv/app%d.js", i)
+		owners[key] = ring.owner(key)
+		counts[owners[key]]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 500 {
+			t.Errorf("Expected scripts spread over nodes, got %v", counts)
+		}
+	}
+
+	// A new node only takes scripts, never moves them between the others
+	bigger := newHashRing(append(nodes, "http://10.0.0.4"))
+	moved := 0
+	for key, owner := range owners {
+		if got := bigger.owner(key); got != owner {
+			if got != "http://10.0.0.4" {
+				t.Fatalf("%s moved from %s to %s", key, owner, got)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Errorf("Expected about a quarter of the scripts to move, got %d", moved)
+	}
+
+	if owner := newHashRing(nil).owner("/srv/app.js"); owner != "" {
+		t.Errorf("Expected no owner on an empty ring, got %q", owner)
+	}
+}
+
+func TestClusterNode_Heartbeat(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	logger := zaptest.NewLogger(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	a := newClusterNode(&ClusterConfig{Address: "http://10.0.0.1/"}, storage, logger)
+	b := newClusterNode(&ClusterConfig{Address: "http://10.0.0.2"}, storage, logger)
+	if err := a.heartbeat(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.heartbeat(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.heartbeat(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both nodes agree on the owner of every script
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("/srv/app%d.js", i)
+		if a.owner(key) != b.owner(key) {
+			t.Fatalf("Nodes disagree on %s: %s and %s", key, a.owner(key), b.owner(key))
+		}
+	}
+	if len(a.nodes) != 2 || a.nodes[0] != "http://10.0.0.1" || a.nodes[1] != "http://10.0.0.2" {
+		t.Errorf("Expected both nodes, got %v", a.nodes)
+	}
+	// and on the secret requests are forwarded with
+	if a.secret == nil || string(a.secret) != string(b.secret) {
+		t.Error("Expected the nodes to share the cluster secret")
+	}
+
+	// A node missing its heartbeats is left out
+	later := now.Add(clusterMissedHeartbeats * defaultClusterHeartbeat)
+	if err := a.heartbeat(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.nodes) != 1 {
+		t.Errorf("Expected the silent node left out, got %v", a.nodes)
+	}
+
+	// and forgotten eventually
+	if err := a.heartbeat(ctx, now.Add(2*clusterForgetAfter)); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(ctx, memberKey("http://10.0.0.2")) {
+		t.Error("Expected the entry of a long gone node deleted")
+	}
+}
+
+func TestClusterNode_Forward(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte("served by owner"))
+	}))
+	defer server.Close()
+
+	node := newClusterNode(&ClusterConfig{Address: "http://10.0.0.1"}, nil, zaptest.NewLogger(t))
+	req := httptest.NewRequest("GET", "http://localhost/app.js?x=1", nil)
+	req.Host = "example.com"
+	if _, err := node.forward(req, server.URL); err != errClusterUnsigned {
+		t.Errorf("Expected no forwarding without the secret, got %v", err)
+	}
+
+	node.secret = []byte("secret")
+	resp, err := node.forward(req, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got.Host != "example.com" || got.URL.RequestURI() != "/app.js?x=1" {
+		t.Errorf("Expected the request as sent, got host %q and %q", got.Host, got.URL.RequestURI())
+	}
+	if by := node.forwardedBy(got.Header.Get(clusterForwardedHeader), time.Now()); by != "http://10.0.0.1" {
+		t.Errorf("Expected the forwarding node signed in %s, got %q", clusterForwardedHeader, got.Header.Get(clusterForwardedHeader))
+	}
+	if req.Header.Get(clusterForwardedHeader) != "" {
+		t.Error("The original request should not be modified")
+	}
+}
+
+func TestClusterNode_ForwardedBy(t *testing.T) {
+	node := newClusterNode(&ClusterConfig{Address: "http://10.0.0.1"}, nil, zaptest.NewLogger(t))
+	now := time.Now()
+	if by := node.forwardedBy("http://10.0.0.2", now); by != "" {
+		t.Errorf("Expected nothing trusted before the secret is loaded, got %q", by)
+	}
+
+	node.secret = []byte("secret")
+	other := newClusterNode(&ClusterConfig{Address: "http://10.0.0.2"}, nil, zaptest.NewLogger(t))
+	other.secret = node.secret
+	signed := other.sign(now)
+	if by := node.forwardedBy(signed, now); by != "http://10.0.0.2" {
+		t.Errorf("Expected the signing node, got %q", by)
+	}
+
+	forger := newClusterNode(&ClusterConfig{Address: "http://10.0.0.2"}, nil, zaptest.NewLogger(t))
+	forger.secret = []byte("guessed")
+	for _, header := range []string{
+		"http://10.0.0.2",
+		"http://10.0.0.2 " + strconv.FormatInt(now.Unix(), 10),
+		forger.sign(now),
+		strings.Replace(signed, "10.0.0.2", "10.0.0.3", 1),
+		other.sign(now.Add(-time.Hour)),
+	} {
+		if by := node.forwardedBy(header, now); by != "" {
+			t.Errorf("Expected %q not to be trusted, got %q", header, by)
+		}
+	}
+}
+
+func TestRoundTrip_ClusterForgedForward(t *testing.T) {
+	var forwarded string
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(clusterForwardedHeader)
+		w.Write([]byte("served by owner"))
+	}))
+	defer owner.Close()
+
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{}, zaptest.NewLogger(t))
+	node := newClusterNode(&ClusterConfig{Address: "http://10.0.0.1"}, nil, zaptest.NewLogger(t))
+	node.secret = []byte("secret")
+	node.nodes, node.ring = []string{owner.URL}, newHashRing([]string{owner.URL})
+	transport.cluster = node
+
+	// A script not running here, with the header a client made up
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("http.matchers.file.absolute", filepath.Join(t.TempDir(), "other.js"))
+	req.Header.Set(clusterForwardedHeader, "http://10.0.0.2")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "served by owner" {
+		t.Errorf("Expected the request forwarded to the owner, got %d %q", resp.StatusCode, body)
+	}
+	if node.forwardedBy(forwarded, time.Now()) != "http://10.0.0.1" {
+		t.Errorf("Expected the owner to get this node's signature, got %q", forwarded)
+	}
+}
+
+func TestUnmarshalCaddyfile_Cluster(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		cluster http://10.0.0.5:8080 {
+			heartbeat_interval 5s
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	want := ClusterConfig{Address: "http://10.0.0.5:8080", HeartbeatInterval: caddy.Duration(5 * time.Second)}
+	if transport.Cluster == nil || *transport.Cluster != want {
+		t.Fatalf("Expected %+v, got %+v", want, transport.Cluster)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	for _, address := range []string{"10.0.0.5:8080", "ftp://10.0.0.5", "http://10.0.0.5/app"} {
+		transport.Cluster = &ClusterConfig{Address: address}
+		if err := transport.Validate(); err == nil {
+			t.Errorf("Expected an error for address %q", address)
+		}
+	}
+}
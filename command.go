@@ -0,0 +1,569 @@
+package substrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "substrate",
+		Short: "Commands for working with substrate processes",
+		CobraFunc: func(cmd *cobra.Command) {
+			checkCmd := &cobra.Command{
+				Use:   "check [--env <key=value>] [--deno-opts <opts>] [--startup-timeout <duration>] <script>",
+				Short: "Starts a script the way the transport would and reports on it",
+				Long: `
+Spawns the script exactly like the substrate transport: same socket argument,
+working directory, environment and process permissions. It waits for the
+socket to become ready, sends one GET request, and prints the startup time,
+the response status and any output the script wrote.
+
+Use it to find out why requests to a script fail with 502 Bad Gateway. The
+script is stopped before the command exits.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdCheck),
+			}
+			addLocalFlags(checkCmd)
+			checkCmd.Flags().String("path", "/", "Request path for the test request")
+			cmd.AddCommand(checkCmd)
+
+			replayCmd := &cobra.Command{
+				Use:   "replay [--env <key=value>] [--deno-opts <opts>] [--script <path>] [--header <name: value>] <recording>",
+				Short: "Sends recorded requests again to a script started locally",
+				Long: `
+Starts the script of a recording, written by the record option of the
+substrate transport, the way caddy substrate check does, and sends it the
+recorded requests in order. Each response is compared with the recorded one
+and the requests answered differently are listed.
+
+Redacted values are sent as [redacted]; use --header to give secret headers
+such as Authorization a value that works locally. By default the script
+recorded is started; use --script for a local copy of it.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdReplay),
+			}
+			addLocalFlags(replayCmd)
+			replayCmd.Flags().String("script", "", "Script to start instead of the recorded one")
+			replayCmd.Flags().StringArrayP("header", "H", nil, "Header replacing the recorded one, as \"name: value\" (repeatable)")
+			cmd.AddCommand(replayCmd)
+
+			psCmd := &cobra.Command{
+				Use:   "ps [--address <interface>] [--config <path> [--adapter <name>]]",
+				Short: "Lists the processes of a running Caddy instance",
+				Long: `
+Lists the substrate processes of the running Caddy instance, using the admin
+API's /substrate/processes endpoint.
+`,
+				Args: cobra.NoArgs,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdPs),
+			}
+			addAdminFlags(psCmd)
+			cmd.AddCommand(psCmd)
+
+			exitsCmd := &cobra.Command{
+				Use:   "exits [--address <interface>] [--config <path> [--adapter <name>]] [<script>]",
+				Short: "Lists the latest unexpected exits of scripts",
+				Long: `
+Lists the processes of the running Caddy instance that exited without
+substrate stopping them, newest first, with the last line of their stderr,
+using the admin API's /substrate/exits endpoint. With a script, lists only
+its exits and prints their stderr in full.
+`,
+				Args: cobra.MaximumNArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdExits),
+			}
+			addAdminFlags(exitsCmd)
+			cmd.AddCommand(exitsCmd)
+
+			bundleCmd := &cobra.Command{
+				Use:   "bundle [--address <interface>] [--config <path> [--adapter <name>]] [--output <file>] <script>",
+				Short: "Downloads the diagnostics of a script for a bug report",
+				Long: `
+Downloads a tarball with what the running Caddy instance knows of the script:
+its processes, latest exits and their stderr, startup times, environment and
+transport config, with secrets redacted. Uses the admin API's
+/substrate/bundle endpoint.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdBundle),
+			}
+			addAdminFlags(bundleCmd)
+			bundleCmd.Flags().StringP("output", "o", "", "File to write the bundle to (default: the name the server gives)")
+			cmd.AddCommand(bundleCmd)
+
+			killCmd := &cobra.Command{
+				Use:   "kill [--address <interface>] [--config <path> [--adapter <name>]] <script>",
+				Short: "Stops the process running a script",
+				Long: `
+Stops the process running the script in the running Caddy instance. The next
+request for the script starts a new process.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdKill),
+			}
+			addAdminFlags(killCmd)
+			cmd.AddCommand(killCmd)
+
+			restartCmd := &cobra.Command{
+				Use:   "restart [--address <interface>] [--config <path> [--adapter <name>]] <script>",
+				Short: "Replaces the process running a script",
+				Long: `
+Starts a new process for the script in the running Caddy instance and switches
+requests to it once it is ready; the old process is then drained and stopped.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdRestart),
+			}
+			addAdminFlags(restartCmd)
+			cmd.AddCommand(restartCmd)
+
+			freezeCmd := &cobra.Command{
+				Use:   "freeze [--address <interface>] [--config <path> [--adapter <name>]] <script>",
+				Short: "Pauses the process running a script",
+				Long: `
+Pauses the process running the script in the running Caddy instance with the
+cgroup v2 freezer, keeping its state for investigation. Requests to it wait
+until it is thawed. Requires cgroup v2 and permission to manage Caddy's cgroup.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdFreeze),
+			}
+			addAdminFlags(freezeCmd)
+			cmd.AddCommand(freezeCmd)
+
+			thawCmd := &cobra.Command{
+				Use:   "thaw [--address <interface>] [--config <path> [--adapter <name>]] <script>",
+				Short: "Resumes a frozen process",
+				Long: `
+Resumes the process running the script after caddy substrate freeze.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdThaw),
+			}
+			addAdminFlags(thawCmd)
+			cmd.AddCommand(thawCmd)
+
+			initCmd := &cobra.Command{
+				Use:   "init [deno|node|python]",
+				Short: "Writes a minimal server and Caddyfile to start from",
+				Long: `
+Writes a server listening on the socket substrate passes it, and a Caddyfile
+serving it, into the current directory. The default deno runtime serves every
+.js file as an endpoint; node and python run a single server as a service.
+Existing files are never overwritten.
+`,
+				Args: cobra.MaximumNArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdInit),
+			}
+			cmd.AddCommand(initCmd)
+		},
+	})
+}
+
+// addLocalFlags adds the flags of the commands starting a script locally.
+func addLocalFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayP("env", "e", nil, "Environment variable for the process, as key=value (repeatable)")
+	cmd.Flags().String("deno-opts", "", "Extra options passed to deno run")
+	cmd.Flags().String("cache-dir", "", "Directory the Deno runtime is cached in")
+	cmd.Flags().String("socket-dir", "", "Directory for the process socket")
+	cmd.Flags().String("umask", "", "File mode creation mask for the process")
+	cmd.Flags().String("group", "", "Primary group for the process (requires root)")
+	cmd.Flags().Duration("startup-timeout", 3*time.Second, "How long to wait for the socket")
+}
+
+// localManager returns a process manager starting scripts as the transport
+// would with the options of addLocalFlags.
+func localManager(fl caddycmd.Flags) (*ProcessManager, error) {
+	envFlags, err := fl.GetStringArray("env")
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string, len(envFlags))
+	for _, kv := range envFlags {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("env must be key=value, got %q", kv)
+		}
+		env[key] = value
+	}
+
+	// Reuse the transport's option handling so the process is set up the same
+	t := &SubstrateTransport{
+		StartupTimeout: caddy.Duration(fl.Duration("startup-timeout")),
+		Env:            env,
+		DenoOpts:       fl.String("deno-opts"),
+		CacheDir:       fl.String("cache-dir"),
+		SocketDir:      fl.String("socket-dir"),
+		Umask:          fl.String("umask"),
+		Group:          fl.String("group"),
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	opts, err := t.processOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := caddy.Log().Named("substrate")
+	return newProcessManager(0, t.StartupTimeout, t.Env, t.DenoOpts, NewDenoManager(t.CacheDir, logger), logger, opts)
+}
+
+func cmdCheck(fl caddycmd.Flags) (int, error) {
+	script, err := filepath.Abs(fl.Arg(0))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	manager, err := localManager(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer manager.Stop()
+
+	fmt.Printf("Starting %s\n", script)
+	start := time.Now()
+	socketPath, err := manager.getOrCreateHost(script, "")
+	if err != nil {
+		fmt.Printf("Startup failed after %v\n", time.Since(start).Round(time.Millisecond))
+		var startupErr *ProcessStartupError
+		if errors.As(err, &startupErr) {
+			fmt.Printf("Exit code: %d\n", startupErr.ExitCode)
+			printOutput("stdout", startupErr.Stdout)
+			printOutput("stderr", startupErr.Stderr)
+		}
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Printf("Ready after %v on %s\n", time.Since(start).Round(time.Millisecond), socketPath)
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	start = time.Now()
+	resp, err := client.Get("http://localhost" + fl.String("path"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("test request failed: %w", err)
+	}
+	resp.Body.Close()
+	fmt.Printf("GET %s: %s in %v\n", fl.String("path"), resp.Status, time.Since(start).Round(time.Millisecond))
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdReplay(fl caddycmd.Flags) (int, error) {
+	exchanges, err := readRecording(fl.Arg(0))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(exchanges) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no requests recorded in %s", fl.Arg(0))
+	}
+
+	headerFlags, err := fl.GetStringArray("header")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	override := make(http.Header, len(headerFlags))
+	for _, h := range headerFlags {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("header must be \"name: value\", got %q", h)
+		}
+		override.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	script := exchanges[len(exchanges)-1].Script
+	if s := fl.String("script"); s != "" {
+		if script, err = filepath.Abs(s); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+
+	manager, err := localManager(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer manager.Stop()
+
+	fmt.Printf("Starting %s\n", script)
+	socketPath, err := manager.getOrCreateHost(script, "")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	client := socketClient(socketPath, 30*time.Second)
+	defer client.CloseIdleConnections()
+
+	differ := 0
+	for _, exchange := range exchanges {
+		req, err := exchange.replayRequest(override)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		line := exchange.Request.Method + " " + exchange.Request.URI
+		resp, err := client.Do(req)
+		if err != nil {
+			differ++
+			fmt.Printf("%s: %v\n", line, err)
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			differ++
+			fmt.Printf("%s: %v\n", line, err)
+			continue
+		}
+		if diff := exchange.replayDiff(resp.StatusCode, body); diff != "" {
+			differ++
+			fmt.Printf("%s: %s\n", line, diff)
+		} else {
+			fmt.Printf("%s: %d as recorded\n", line, resp.StatusCode)
+		}
+	}
+
+	fmt.Printf("%d of %d requests answered differently\n", differ, len(exchanges))
+	if differ > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d requests answered differently", differ)
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func addAdminFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("config", "c", "", "Configuration file to use to parse the admin address, if --address is not used")
+	cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+	cmd.Flags().String("address", "", "The address to use to reach the admin API endpoint, if not the default")
+}
+
+// adminRequest sends a request to the admin API of the running instance.
+func adminRequest(fl caddycmd.Flags, method, uri string, body any) (*http.Response, error) {
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(fl.String("address"), nil, fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/json")
+	return caddycmd.AdminAPIRequest(adminAddr, method, uri, headers, reader)
+}
+
+func cmdPs(fl caddycmd.Flags) (int, error) {
+	resp, err := adminRequest(fl, http.MethodGet, "/substrate/processes", nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+
+	var infos []ProcessInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding response: %v", err)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tUPTIME\tIDLE\tACTIVE\tSCRIPT")
+	for _, info := range infos {
+		uptime := "starting"
+		if !info.StartedAt.IsZero() {
+			uptime = now.Sub(info.StartedAt).Round(time.Second).String()
+		}
+		script := info.Script
+		if info.Frozen {
+			script += " (frozen)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n",
+			info.PID,
+			uptime,
+			now.Sub(info.LastUsed).Round(time.Second),
+			info.ActiveRequests,
+			script,
+		)
+	}
+	w.Flush()
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdExits(fl caddycmd.Flags) (int, error) {
+	uri := "/substrate/exits"
+	if fl.NArg() == 1 {
+		script, err := filepath.Abs(fl.Arg(0))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		uri += "?script=" + url.QueryEscape(script)
+	}
+
+	resp, err := adminRequest(fl, http.MethodGet, uri, nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+
+	var history []ScriptExits
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding response: %v", err)
+	}
+
+	if fl.NArg() == 1 {
+		for _, scriptExits := range history {
+			for _, exit := range scriptExits.Exits {
+				fmt.Printf("%s  pid %d  %s\n", exit.Time.Format(time.RFC3339), exit.PID, describeExit(exit))
+				if exit.Stderr != "" {
+					fmt.Println(strings.TrimRight(exit.Stderr, "\n"))
+				}
+				fmt.Println()
+			}
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	// All scripts' exits, newest first
+	type scriptExit struct {
+		script string
+		exit   ProcessExit
+	}
+	var exits []scriptExit
+	for _, scriptExits := range history {
+		for _, exit := range scriptExits.Exits {
+			exits = append(exits, scriptExit{scriptExits.Script, exit})
+		}
+	}
+	sort.Slice(exits, func(i, j int) bool { return exits[i].exit.Time.After(exits[j].exit.Time) })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tPID\tEXIT\tSCRIPT\tSTDERR")
+	for _, e := range exits {
+		lines := strings.Split(strings.TrimRight(e.exit.Stderr, "\n"), "\n")
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n",
+			e.exit.Time.Format(time.RFC3339),
+			e.exit.PID,
+			describeExit(e.exit),
+			e.script,
+			lines[len(lines)-1],
+		)
+	}
+	w.Flush()
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdBundle(fl caddycmd.Flags) (int, error) {
+	script, err := filepath.Abs(fl.Arg(0))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	resp, err := adminRequest(fl, http.MethodGet, "/substrate/bundle?script="+url.QueryEscape(script), nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+
+	output := fl.String("output")
+	if output == "" {
+		_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		output = filepath.Base(params["filename"])
+		if output == "." || output == "/" {
+			output = "substrate-bundle.tar.gz"
+		}
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := f.Close(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Println(output)
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// describeExit returns how a process ended: its signal or exit code.
+func describeExit(exit ProcessExit) string {
+	if exit.Signal != "" {
+		return exit.Signal
+	}
+	return "code " + strconv.Itoa(exit.ExitCode)
+}
+
+func cmdKill(fl caddycmd.Flags) (int, error) {
+	return scriptCommand(fl, "/substrate/processes/stop")
+}
+
+func cmdRestart(fl caddycmd.Flags) (int, error) {
+	return scriptCommand(fl, "/substrate/processes/restart")
+}
+
+func cmdFreeze(fl caddycmd.Flags) (int, error) {
+	return scriptCommand(fl, "/substrate/processes/freeze")
+}
+
+func cmdThaw(fl caddycmd.Flags) (int, error) {
+	return scriptCommand(fl, "/substrate/processes/thaw")
+}
+
+// scriptCommand posts the absolute path of the script argument to uri.
+func scriptCommand(fl caddycmd.Flags, uri string) (int, error) {
+	script, err := filepath.Abs(fl.Arg(0))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	resp, err := adminRequest(fl, http.MethodPost, uri, processRequest{Script: script})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	resp.Body.Close()
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func printOutput(stream, output string) {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return
+	}
+	fmt.Fprintf(os.Stdout, "--- %s ---\n%s\n", stream, output)
+}
@@ -0,0 +1,43 @@
+package substrate
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/pflag"
+)
+
+func checkFlags(t *testing.T, args ...string) caddycmd.Flags {
+	t.Helper()
+	fs := pflag.NewFlagSet("check", pflag.ContinueOnError)
+	fs.StringArrayP("env", "e", nil, "")
+	fs.String("deno-opts", "", "")
+	fs.String("cache-dir", "", "")
+	fs.String("socket-dir", "", "")
+	fs.String("umask", "", "")
+	fs.String("group", "", "")
+	fs.Duration("startup-timeout", 3*time.Second, "")
+	fs.String("path", "/", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	return caddycmd.Flags{FlagSet: fs}
+}
+
+func TestCmdCheck_InvalidEnv(t *testing.T) {
+	code, err := cmdCheck(checkFlags(t, "--env", "NOVALUE", "app.js"))
+	if err == nil || code != caddy.ExitCodeFailedStartup {
+		t.Errorf("Expected env parse failure, got code=%d err=%v", code, err)
+	}
+}
+
+func TestCmdCheck_MissingScript(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.js")
+	code, err := cmdCheck(checkFlags(t, missing))
+	if err == nil || code != caddy.ExitCodeFailedStartup {
+		t.Errorf("Expected missing script to fail, got code=%d err=%v", code, err)
+	}
+}
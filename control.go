@@ -0,0 +1,191 @@
+package substrate
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxControlBody bounds the JSON bodies accepted on a control socket.
+const maxControlBody = 64 << 10
+
+// defaultMaxExtend is how long past its idle expiry a process may keep
+// itself running unless max_extend says otherwise.
+const defaultMaxExtend = 10 * time.Minute
+
+// ProcessHealth is the status a process last reported on its control
+// socket, listed by the admin API.
+type ProcessHealth struct {
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// controlPath returns the path of the control socket next to socketPath. It
+// is no longer, so it fits wherever socketPath does.
+func controlPath(socketPath string) string {
+	return strings.TrimSuffix(socketPath, ".sock") + ".ctl"
+}
+
+// openControlLocked starts serving the process's control socket and exports
+// it as SUBSTRATE_CONTROL_SOCKET and SUBSTRATE_CONTROL_URL. Only the user
+// the process runs as may connect. p.mu must be held and p.cmd configured.
+func (p *Process) openControlLocked() error {
+	path := controlPath(p.SocketPath)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	if p.cmd.SysProcAttr != nil && p.cmd.SysProcAttr.Credential != nil {
+		cred := p.cmd.SysProcAttr.Credential
+		if err := os.Chown(path, int(cred.Uid), int(cred.Gid)); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /recycle", p.handleControlRecycle)
+	mux.HandleFunc("POST /extend", p.handleControlExtend)
+	mux.HandleFunc("POST /busy", p.handleControlBusy)
+	mux.HandleFunc("PUT /health", p.handleControlHealth)
+	p.control = &http.Server{
+		Handler:           http.MaxBytesHandler(mux, maxControlBody),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go p.control.Serve(listener)
+
+	p.cmd.Env = append(p.cmd.Env,
+		"SUBSTRATE_CONTROL_SOCKET="+path,
+		"SUBSTRATE_CONTROL_URL=http+unix://"+url.PathEscape(path),
+	)
+	return nil
+}
+
+// closeControl stops serving the control socket and removes it. The
+// process must have exited or failed to start.
+func (p *Process) closeControl() {
+	if p.control == nil {
+		return
+	}
+	if err := p.control.Close(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.logger.Warn("failed to close control socket",
+			zap.String("script_path", p.scriptPath),
+			zap.Error(err),
+		)
+	}
+}
+
+// handleControlRecycle replaces the process with a fresh one, as a restart
+// through the admin API would.
+func (p *Process) handleControlRecycle(w http.ResponseWriter, r *http.Request) {
+	if p.onRecycle == nil {
+		http.Error(w, "recycling is not available for this process", http.StatusNotImplemented)
+		return
+	}
+	p.onRecycle()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleControlExtend keeps the process from being stopped as idle for the
+// given number of seconds, for background work after the last response.
+func (p *Process) handleControlExtend(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Seconds float64 `json:"seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Seconds <= 0 {
+		http.Error(w, `expected {"seconds": <positive number>}`, http.StatusBadRequest)
+		return
+	}
+
+	writeExtension(w, p.extendIdle(time.Duration(body.Seconds*float64(time.Second))))
+}
+
+// handleControlBusy keeps the process for another idle timeout, as a
+// request would. Scripts call it repeatedly while doing background work.
+// Processes that are never stopped as idle, or stopped after every request,
+// have nothing to extend.
+func (p *Process) handleControlBusy(w http.ResponseWriter, r *http.Request) {
+	if p.idleTimeout <= 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeExtension(w, p.extendIdle(time.Duration(p.idleTimeout)))
+}
+
+// writeExtension answers an extension request with the time the process is
+// kept until.
+func writeExtension(w http.ResponseWriter, until time.Time) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]time.Time{"until": until})
+}
+
+// handleControlHealth records the health the process reports.
+func (p *Process) handleControlHealth(w http.ResponseWriter, r *http.Request) {
+	var health ProcessHealth
+	if err := json.NewDecoder(r.Body).Decode(&health); err != nil || health.Status == "" {
+		http.Error(w, `expected {"status": <string>, "message": <string>}`, http.StatusBadRequest)
+		return
+	}
+	health.UpdatedAt = time.Now()
+
+	p.mu.Lock()
+	changed := p.health == nil || p.health.Status != health.Status
+	p.health = &health
+	p.mu.Unlock()
+
+	if changed {
+		p.logger.Info("process reported health",
+			zap.String("script_path", p.scriptPath),
+			zap.String("status", health.Status),
+			zap.String("message", health.Message),
+		)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// extendIdle keeps the process from being stopped as idle for at least d,
+// and returns until when. With max_extend, the process is kept no longer
+// than that past the idle expiry of its last request, however often it asks.
+func (p *Process) extendIdle(d time.Duration) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if p.opts.maxExtend > 0 && p.idleTimeout > 0 {
+		limit := p.lastUsed.Add(time.Duration(p.idleTimeout) + p.opts.maxExtend)
+		if until.After(limit) {
+			p.logger.Debug("idle extension capped by max_extend",
+				zap.String("script_path", p.scriptPath),
+				zap.Time("limit", limit),
+			)
+			until = limit
+		}
+	}
+	if until.After(p.keepUntil) {
+		p.keepUntil = until
+	}
+	return p.keepUntil
+}
+
+// idleExpiryLocked returns when the process may be stopped as idle: the
+// idle timeout after its last use, or later if it extended its lifetime.
+// p.mu must be held.
+func (p *Process) idleExpiryLocked(idleTimeout time.Duration) time.Time {
+	expiry := p.lastUsed.Add(idleTimeout)
+	if p.keepUntil.After(expiry) {
+		return p.keepUntil
+	}
+	return expiry
+}
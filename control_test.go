@@ -0,0 +1,186 @@
+package substrate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestProcess_Control(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, printing where its control socket is and staying up
+	process := newStubProcess(t, pm, "echo \"$SUBSTRATE_CONTROL_SOCKET\"\nexec sleep 10")
+	recycled := make(chan struct{}, 1)
+	process.onRecycle = func() { recycled <- struct{}{} }
+	if err := process.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	path := controlPath(process.SocketPath)
+	for deadline := time.Now().Add(2 * time.Second); process.startupStdout.String() == "" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := strings.TrimSpace(process.startupStdout.String()); got != path {
+		t.Errorf("Expected SUBSTRATE_CONTROL_SOCKET %q, got %q", path, got)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	send := func(method, endpoint, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://substrate"+endpoint, strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, endpoint, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := send("POST", "/extend", `{"seconds": 60}`); status != http.StatusOK {
+		t.Errorf("Expected 200 from /extend, got %d", status)
+	}
+	process.mu.RLock()
+	expiry := process.idleExpiryLocked(time.Second)
+	process.mu.RUnlock()
+	if time.Until(expiry) < 50*time.Second {
+		t.Errorf("Expected the idle expiry to be extended, got %v", expiry)
+	}
+	if status := send("POST", "/extend", `{"seconds": -1}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative extension, got %d", status)
+	}
+
+	if status := send("PUT", "/health", `{"status": "degraded", "message": "cache cold"}`); status != http.StatusNoContent {
+		t.Errorf("Expected 204 from /health, got %d", status)
+	}
+	if health := process.Info().Health; health == nil || health.Status != "degraded" || health.Message != "cache cold" {
+		t.Errorf("Unexpected health %+v", health)
+	}
+
+	if status := send("POST", "/recycle", ""); status != http.StatusAccepted {
+		t.Errorf("Expected 202 from /recycle, got %d", status)
+	}
+	select {
+	case <-recycled:
+	case <-time.After(time.Second):
+		t.Error("Expected the process to ask for a recycle")
+	}
+
+	if err := process.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	<-process.exitChan
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the control socket to be removed, got %v", err)
+	}
+}
+
+func TestProcess_IdleExpiry(t *testing.T) {
+	now := time.Now()
+	p := &Process{lastUsed: now}
+	if got := p.idleExpiryLocked(time.Minute); !got.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected expiry a minute after last use, got %v", got)
+	}
+
+	p.keepUntil = now.Add(time.Hour)
+	if got := p.idleExpiryLocked(time.Minute); !got.Equal(p.keepUntil) {
+		t.Errorf("Expected the extension to win, got %v", got)
+	}
+}
+
+func TestProcess_ExtendIdleMaxExtend(t *testing.T) {
+	lastUsed := time.Now()
+	p := &Process{
+		lastUsed:    lastUsed,
+		idleTimeout: caddy.Duration(time.Minute),
+		opts:        processOptions{maxExtend: 5 * time.Minute},
+		logger:      zaptest.NewLogger(t),
+	}
+
+	if until := p.extendIdle(2 * time.Minute); time.Until(until) < 110*time.Second {
+		t.Errorf("Expected an extension within max_extend to be granted, got %v", until)
+	}
+	limit := lastUsed.Add(6 * time.Minute)
+	if until := p.extendIdle(time.Hour); !until.Equal(limit) {
+		t.Errorf("Expected the extension to be capped at %v, got %v", limit, until)
+	}
+
+	p.opts.maxExtend = 0
+	if until := p.extendIdle(time.Hour); time.Until(until) < 59*time.Minute {
+		t.Errorf("Expected no cap without max_extend, got %v", until)
+	}
+}
+
+func TestControl_Busy(t *testing.T) {
+	p := &Process{
+		lastUsed:    time.Now(),
+		idleTimeout: caddy.Duration(time.Minute),
+		logger:      zaptest.NewLogger(t),
+	}
+	rec := httptest.NewRecorder()
+	p.handleControlBusy(rec, httptest.NewRequest("POST", "/busy", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if time.Until(p.keepUntil) < 55*time.Second {
+		t.Errorf("Expected busy to keep the process another idle timeout, got %v", p.keepUntil)
+	}
+
+	p = &Process{logger: zaptest.NewLogger(t)}
+	rec = httptest.NewRecorder()
+	p.handleControlBusy(rec, httptest.NewRequest("POST", "/busy", nil))
+	if rec.Code != http.StatusNoContent || !p.keepUntil.IsZero() {
+		t.Errorf("Expected nothing to extend without an idle timeout, got %d", rec.Code)
+	}
+}
+
+func TestUnmarshalCaddyfile_MaxExtend(t *testing.T) {
+	for input, want := range map[string]caddy.Duration{
+		"30m": caddy.Duration(30 * time.Minute),
+		"-1":  caddy.Duration(-1),
+	} {
+		d := caddyfile.NewTestDispenser(`substrate {
+			max_extend ` + input + `
+		}`)
+		transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+		if err := transport.UnmarshalCaddyfile(d); err != nil {
+			t.Fatal(err)
+		}
+		if transport.MaxExtend != want {
+			t.Errorf("max_extend %s: got %v", input, transport.MaxExtend)
+		}
+		if err := transport.Validate(); err != nil {
+			t.Errorf("max_extend %s: unexpected error %v", input, err)
+		}
+	}
+
+	if err := (&SubstrateTransport{StartupTimeout: caddy.Duration(time.Second), MaxExtend: caddy.Duration(-time.Minute)}).Validate(); err == nil {
+		t.Error("Expected an error for a negative max_extend")
+	}
+}
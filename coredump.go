@@ -0,0 +1,136 @@
+package substrate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Where the kernel writes core dumps, see core(5).
+const (
+	corePatternFile = "/proc/sys/kernel/core_pattern"
+	coreUsesPIDFile = "/proc/sys/kernel/core_uses_pid"
+)
+
+// coreFiles returns the glob pattern the kernel's core_pattern may have
+// named the core dump of process pid, which ran in dir. Specifiers other
+// than %p, %P and %% match anything, including the thread ids of %i and %I,
+// since any thread may have crashed. It fails when cores are piped to a
+// handler, such as systemd-coredump, which keeps them itself.
+func coreFiles(pattern string, usesPID bool, pid int, dir string) (string, error) {
+	pattern = strings.TrimSpace(pattern)
+	if handler, ok := strings.CutPrefix(pattern, "|"); ok {
+		return "", fmt.Errorf("core dumps are piped to a handler (%s)", handler)
+	}
+
+	var glob strings.Builder
+	hasPID := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '%' && i+1 < len(pattern):
+			i++
+			switch pattern[i] {
+			case '%':
+				glob.WriteByte('%')
+			case 'p', 'P':
+				glob.WriteString(strconv.Itoa(pid))
+				hasPID = true
+			default:
+				glob.WriteByte('*')
+			}
+		case c == '*' || c == '?' || c == '[' || c == '\\':
+			glob.WriteByte('\\')
+			glob.WriteByte(c)
+		default:
+			glob.WriteByte(c)
+		}
+	}
+	if usesPID && !hasPID {
+		glob.WriteString("." + strconv.Itoa(pid))
+	}
+
+	result := glob.String()
+	if !filepath.IsAbs(result) {
+		result = filepath.Join(dir, result)
+	}
+	return result, nil
+}
+
+// collectCore moves the core dump of the exited process into the core dump
+// directory and returns its new path.
+func (p *Process) collectCore(pid int, startedAt time.Time) (string, error) {
+	pattern, err := os.ReadFile(corePatternFile)
+	if err != nil {
+		return "", err
+	}
+	usesPID, _ := os.ReadFile(coreUsesPIDFile)
+	glob, err := coreFiles(string(pattern), strings.TrimSpace(string(usesPID)) == "1", pid, p.cmd.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	matches, err := filepath.Glob(glob)
+	if err != nil {
+		return "", err
+	}
+	// The newest file written since the process started
+	var core string
+	var coreTime time.Time
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().Before(startedAt) {
+			continue
+		}
+		if core == "" || info.ModTime().After(coreTime) {
+			core, coreTime = match, info.ModTime()
+		}
+	}
+	if core == "" {
+		return "", fmt.Errorf("no core dump matching %s", glob)
+	}
+
+	if err := os.MkdirAll(p.opts.coreDumpDir, 0700); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("core.%s.%d.%d", filepath.Base(p.scriptPath), pid, coreTime.Unix())
+	dest := filepath.Join(p.opts.coreDumpDir, name)
+	if err := moveFile(core, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// moveFile renames src to dest, copying it when they are on different
+// filesystems.
+func moveFile(src, dest string) error {
+	err := os.Rename(src, dest)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Remove(src)
+}
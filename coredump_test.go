@@ -0,0 +1,104 @@
+package substrate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCoreFiles(t *testing.T) {
+	tests := []struct {
+		pattern string
+		usesPID bool
+		want    string
+	}{
+		{"core", false, "/srv/app/core"},
+		{"core", true, "/srv/app/core.42"},
+		{"core.%p", true, "/srv/app/core.42"},
+		{"/var/crash/core.%e.%p.%t", false, "/var/crash/core.*.42.*"},
+		{"/var/crash/%%core[%i]", true, "/var/crash/%core\\[*].42"},
+	}
+	for _, tt := range tests {
+		got, err := coreFiles(tt.pattern+"\n", tt.usesPID, 42, "/srv/app")
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.pattern, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.pattern, tt.want, got)
+		}
+	}
+
+	if _, err := coreFiles("|/usr/lib/systemd/systemd-coredump %P %u", false, 42, "/srv/app"); err == nil {
+		t.Error("Expected an error for cores piped to a handler")
+	}
+}
+
+func TestProcess_CollectsCoreDump(t *testing.T) {
+	pattern, err := os.ReadFile(corePatternFile)
+	if err != nil || strings.HasPrefix(string(pattern), "|") {
+		t.Skip("core dumps are not written to files on this host")
+	}
+
+	dumpDir := filepath.Join(t.TempDir(), "cores")
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{coreDumpDir: dumpDir},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, crashing
+	process := startStubProcess(t, pm, "kill -SEGV $$")
+	<-process.exitChan
+
+	history := exitHistory.list(process.scriptPath)
+	if len(history) != 1 || history[0].Exits[0].Signal != "SIGSEGV" {
+		t.Fatalf("Expected a SIGSEGV exit, got %+v", history)
+	}
+	core := history[0].Exits[0].Core
+	if core == "" {
+		t.Skip("no core dump was written, the host may not allow them")
+	}
+	if filepath.Dir(core) != dumpDir {
+		t.Errorf("Expected the core in %s, got %s", dumpDir, core)
+	}
+	if _, err := os.Stat(core); err != nil {
+		t.Errorf("Expected the core dump to exist: %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfile_CoreDumpDir(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		core_dump_dir /var/lib/substrate/cores
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.CoreDumpDir != "/var/lib/substrate/cores" {
+		t.Errorf("Expected core_dump_dir, got %q", transport.CoreDumpDir)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	transport.CoreDumpDir = "cores"
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for a relative core_dump_dir")
+	}
+}
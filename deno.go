@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
 	"go.uber.org/zap"
 )
@@ -31,6 +32,7 @@ type DenoManager struct {
 	version string
 	rootDir string
 	logger  *zap.Logger
+	mu      sync.Mutex // serializes downloads from concurrent process starts
 }
 
 // NewDenoManager creates a new DenoManager with the default version
@@ -51,6 +53,9 @@ func NewDenoManager(cacheDir string, logger *zap.Logger) *DenoManager {
 
 // Get returns the path to the Deno binary, downloading it if necessary
 func (dm *DenoManager) Get() (string, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
 	exePath := dm.executablePath()
 
 	if dm.validateBinary(exePath) {
@@ -0,0 +1,92 @@
+package substrate
+
+import (
+	"encoding/json"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	httpcaddyfile.RegisterDirective("substrate_run", parseSubstrateRun)
+	httpcaddyfile.RegisterDirectiveOrder("substrate_run", httpcaddyfile.Before, "reverse_proxy")
+}
+
+// parseSubstrateRun sets up a substrate_run directive:
+//
+//	substrate_run <glob...> {
+//	    <transport options>
+//	}
+//
+// It is shorthand for a named matcher on the path globs plus a file matcher,
+// and a reverse_proxy to that matcher using the substrate transport:
+//
+//	@substrate {
+//	    path <glob...>
+//	    file {path}
+//	}
+//	reverse_proxy @substrate {
+//	    transport substrate {
+//	        <transport options>
+//	    }
+//	}
+//
+// With the static_files option, only executable files are proxied, and the
+// other matched files are served by file_server:
+//
+//	@substrate {
+//	    path <glob...>
+//	    file {path}
+//	    substrate_executable
+//	}
+//	reverse_proxy @substrate { ... }
+//	@static {
+//	    path <glob...>
+//	    file {path}
+//	}
+//	file_server @static
+func parseSubstrateRun(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	h.Next() // consume directive name
+
+	globs := h.RemainingArgs()
+	if len(globs) == 0 {
+		return nil, h.ArgErr()
+	}
+
+	transport := new(SubstrateTransport)
+	if err := transport.unmarshalOptions(h.Dispenser); err != nil {
+		return nil, err
+	}
+	if err := transport.checkConflicts(); err != nil {
+		return nil, h.Err(err.Error())
+	}
+
+	matchers := caddy.ModuleMap{
+		"path": caddyconfig.JSON(caddyhttp.MatchPath(globs), nil),
+		"file": caddyconfig.JSON(fileserver.MatchFile{TryFiles: []string{"{http.request.uri.path}"}}, nil),
+	}
+
+	transportRaw := caddyconfig.JSONModuleObject(transport, "protocol", "substrate", nil)
+	handler := &reverseproxy.Handler{
+		TransportRaw: json.RawMessage(transportRaw),
+		// The substrate transport picks the socket per request; the upstream
+		// only has to exist
+		Upstreams: reverseproxy.UpstreamPool{{Dial: "localhost:80"}},
+	}
+
+	if !transport.staticFiles {
+		return h.NewRoute(matchers, handler), nil
+	}
+
+	staticMatchers := caddy.ModuleMap{
+		"path": matchers["path"],
+		"file": matchers["file"],
+	}
+	matchers["substrate_executable"] = caddyconfig.JSON(MatchExecutable{}, nil)
+	routes := h.NewRoute(matchers, handler)
+	return append(routes, h.NewRoute(staticMatchers, &fileserver.FileServer{})...), nil
+}
@@ -0,0 +1,131 @@
+package substrate
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestSubstrateRunDirective(t *testing.T) {
+	input := `:8080 {
+		substrate_run *.server.js {
+			idle_timeout 10m
+		}
+		file_server
+	}`
+
+	out, _, err := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("Adapt failed: %v", err)
+	}
+
+	var config struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []struct {
+						Match  []map[string]json.RawMessage `json:"match"`
+						Handle []map[string]json.RawMessage `json:"handle"`
+					} `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(out, &config); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+
+	routes := config.Apps.HTTP.Servers["srv0"].Routes
+	if len(routes) != 2 {
+		t.Fatalf("Expected substrate and file_server routes, got %d: %s", len(routes), out)
+	}
+
+	route := routes[0]
+	if len(route.Match) != 1 || string(route.Match[0]["path"]) != `["*.server.js"]` || route.Match[0]["file"] == nil {
+		t.Errorf("Expected path and file matchers, got %s", out)
+	}
+
+	var transport map[string]any
+	if err := json.Unmarshal(route.Handle[0]["transport"], &transport); err != nil {
+		t.Fatalf("Failed to decode transport: %v", err)
+	}
+	if transport["protocol"] != "substrate" || transport["idle_timeout"] != float64(600000000000) {
+		t.Errorf("Expected substrate transport with idle_timeout 10m, got %v", transport)
+	}
+}
+
+func TestSubstrateRunDirective_Globs(t *testing.T) {
+	input := `:8080 {
+		substrate_run *.js *.ts {
+			type_check
+		}
+	}`
+
+	out, _, err := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("Adapt failed: %v", err)
+	}
+	if !strings.Contains(string(out), `"path":["*.js","*.ts"]`) || !strings.Contains(string(out), `"type_check":true`) {
+		t.Errorf("Expected both globs and type_check, got %s", out)
+	}
+
+	_, _, err = caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}.Adapt([]byte(`:8080 {
+		substrate_run
+	}`), nil)
+	if err == nil {
+		t.Error("Expected an error without a glob")
+	}
+}
+
+func TestSubstrateRunDirective_StaticFiles(t *testing.T) {
+	input := `:8080 {
+		substrate_run *.js {
+			static_files
+		}
+	}`
+
+	out, _, err := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("Adapt failed: %v", err)
+	}
+
+	var config struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []struct {
+						Match  []map[string]json.RawMessage `json:"match"`
+						Handle []map[string]json.RawMessage `json:"handle"`
+					} `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(out, &config); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+
+	routes := config.Apps.HTTP.Servers["srv0"].Routes
+	if len(routes) != 2 {
+		t.Fatalf("Expected proxy and static routes, got %d: %s", len(routes), out)
+	}
+	if routes[0].Match[0]["substrate_executable"] == nil || string(routes[0].Handle[0]["handler"]) != `"reverse_proxy"` {
+		t.Errorf("Expected executable files proxied first, got %s", out)
+	}
+	if routes[1].Match[0]["substrate_executable"] != nil || string(routes[1].Handle[0]["handler"]) != `"file_server"` {
+		t.Errorf("Expected other files served by file_server, got %s", out)
+	}
+	if strings.Contains(string(routes[0].Handle[0]["transport"]), "static_files") {
+		t.Errorf("static_files should not reach the transport config: %s", out)
+	}
+
+	d := caddyfile.NewTestDispenser(`substrate {
+		static_files
+	}`)
+	if err := (&SubstrateTransport{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected static_files to be rejected outside substrate_run")
+	}
+}
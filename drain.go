@@ -0,0 +1,70 @@
+package substrate
+
+import "sync"
+
+// drainSet tracks the sockets of processes about to be stopped. Requests
+// still routed to a draining socket ask for the connection to be closed
+// afterwards, and idle pooled connections to it are closed right away, so no
+// client request is sent over a keep-alive connection the process is about to
+// drop.
+type drainSet struct {
+	mu      sync.Mutex
+	sockets map[string]struct{}
+	// CloseIdleConnections of every HTTP transport dialing the manager's
+	// sockets, keyed by the transport owning it
+	closers map[any]func()
+}
+
+func newDrainSet() *drainSet {
+	return &drainSet{
+		sockets: make(map[string]struct{}),
+		closers: make(map[any]func()),
+	}
+}
+
+// register adds closeIdle to the functions called when a socket starts
+// draining. A later register for the same owner replaces it.
+func (d *drainSet) register(owner any, closeIdle func()) {
+	d.mu.Lock()
+	d.closers[owner] = closeIdle
+	d.mu.Unlock()
+}
+
+// unregister removes the function registered for owner.
+func (d *drainSet) unregister(owner any) {
+	d.mu.Lock()
+	delete(d.closers, owner)
+	d.mu.Unlock()
+}
+
+// start marks socketPath as draining and closes idle pooled connections.
+// http.Transport can only close idle connections to all hosts at once; the
+// others are simply redialed when next needed.
+func (d *drainSet) start(socketPath string) {
+	d.mu.Lock()
+	d.sockets[socketPath] = struct{}{}
+	closers := make([]func(), 0, len(d.closers))
+	for _, closeIdle := range d.closers {
+		closers = append(closers, closeIdle)
+	}
+	d.mu.Unlock()
+
+	for _, closeIdle := range closers {
+		closeIdle()
+	}
+}
+
+// draining reports whether socketPath belongs to a process being stopped.
+func (d *drainSet) draining(socketPath string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.sockets[socketPath]
+	return ok
+}
+
+// done forgets socketPath once its process exited.
+func (d *drainSet) done(socketPath string) {
+	d.mu.Lock()
+	delete(d.sockets, socketPath)
+	d.mu.Unlock()
+}
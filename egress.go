@@ -0,0 +1,51 @@
+package substrate
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// EgressPolicy restricts the hosts a script may connect to, using Deno's
+// network permission. Scripts keep every other permission.
+type EgressPolicy struct {
+	// Allow lists the hosts scripts may reach, as host or host:port. Empty
+	// allows no outgoing connections.
+	Allow []string `json:"allow,omitempty"`
+}
+
+func (e *EgressPolicy) validate() error {
+	for _, host := range e.Allow {
+		name := host
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("egress: invalid port in %q", host)
+			}
+			name = h
+		}
+		if name == "" || strings.ContainsAny(name, ",/ \t@") || strings.Contains(name, "://") {
+			return fmt.Errorf("egress: %q must be a host or host:port", host)
+		}
+	}
+	return nil
+}
+
+// denoPermissions returns the deno run flags granting every permission but
+// network access outside the allowed hosts. Unix socket access, which the
+// process needs to serve, falls under the file permissions.
+func (e *EgressPolicy) denoPermissions() []string {
+	flags := []string{
+		"--allow-read",
+		"--allow-write",
+		"--allow-env",
+		"--allow-run",
+		"--allow-sys",
+		"--allow-ffi",
+		"--allow-import",
+	}
+	if len(e.Allow) > 0 {
+		flags = append(flags, "--allow-net="+strings.Join(e.Allow, ","))
+	}
+	return flags
+}
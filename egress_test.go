@@ -0,0 +1,92 @@
+package substrate
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestEgressPolicy_Validate(t *testing.T) {
+	valid := &EgressPolicy{Allow: []string{"api.example.com", "db.internal:5432", "10.0.0.1:443", "[::1]:8080"}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, host := range []string{"https://api.example.com", "a.com,b.com", "db:99999", "db:", "user@host", ""} {
+		if err := (&EgressPolicy{Allow: []string{host}}).validate(); err == nil {
+			t.Errorf("Expected an error for %q", host)
+		}
+	}
+}
+
+func TestProcess_Egress(t *testing.T) {
+	tests := []struct {
+		name   string
+		egress *EgressPolicy
+		want   []string
+		absent []string
+	}{
+		{"no policy", nil, []string{"--allow-all"}, []string{"--allow-net"}},
+		{"no network", &EgressPolicy{}, []string{"--allow-read", "--allow-write"}, []string{"--allow-all", "--allow-net"}},
+		{"allowed hosts", &EgressPolicy{Allow: []string{"api.example.com:443", "db"}}, []string{"--allow-net=api.example.com:443,db"}, []string{"--allow-all"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := zaptest.NewLogger(t)
+			pm, err := newProcessManager(
+				caddy.Duration(0),
+				caddy.Duration(time.Second),
+				nil,
+				"",
+				NewDenoManager("", logger),
+				logger,
+				processOptions{egress: tt.egress},
+			)
+			if err != nil {
+				t.Fatalf("Failed to create process manager: %v", err)
+			}
+			defer pm.Stop()
+
+			// Stands in for deno, printing its arguments
+			process := startStubProcess(t, pm, "echo \"$@\"")
+			<-process.exitChan
+
+			args := strings.Fields(process.startupStdout.String())
+			for _, flag := range tt.want {
+				if !slices.Contains(args, flag) {
+					t.Errorf("Expected %s in %v", flag, args)
+				}
+			}
+			for _, prefix := range tt.absent {
+				if slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, prefix) }) {
+					t.Errorf("Expected no %s in %v", prefix, args)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfile_Egress(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		egress api.example.com:443 db.internal:5432
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.Egress == nil || len(transport.Egress.Allow) != 2 {
+		t.Errorf("Unexpected egress %+v", transport.Egress)
+	}
+
+	d = caddyfile.NewTestDispenser(`substrate {
+		egress
+		runtime go
+	}`)
+	if err := (&SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error combining egress and runtime go")
+	}
+}
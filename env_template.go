@@ -0,0 +1,39 @@
+package substrate
+
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// requestPlaceholderPrefix starts the placeholders that are only known per
+// request, such as {http.request.host}.
+const requestPlaceholderPrefix = "{http."
+
+// splitEnv separates the env values that use request placeholders, which
+// are expanded when a process is started for a request, from the rest.
+func splitEnv(env map[string]string) (static, templates map[string]string) {
+	for name, value := range env {
+		if strings.Contains(value, requestPlaceholderPrefix) {
+			if templates == nil {
+				templates = make(map[string]string)
+			}
+			templates[name] = value
+			continue
+		}
+		if static == nil {
+			static = make(map[string]string)
+		}
+		static[name] = value
+	}
+	return static, templates
+}
+
+// expandEnv expands templates with the placeholders of a request.
+func expandEnv(templates map[string]string, repl *caddy.Replacer) map[string]string {
+	env := make(map[string]string, len(templates))
+	for name, value := range templates {
+		env[name] = repl.ReplaceAll(value, "")
+	}
+	return env
+}
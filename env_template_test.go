@@ -0,0 +1,52 @@
+package substrate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSplitEnv(t *testing.T) {
+	static, templates := splitEnv(map[string]string{
+		"APP_ENV":  "production",
+		"DATABASE": "tenant_{http.request.host.labels.2}",
+		"HOST":     "{http.request.host}",
+	})
+	if len(static) != 1 || static["APP_ENV"] != "production" {
+		t.Errorf("Expected only APP_ENV static, got %v", static)
+	}
+	if len(templates) != 2 {
+		t.Errorf("Expected two templates, got %v", templates)
+	}
+
+	repl := caddy.NewReplacer()
+	repl.Set("http.request.host", "acme.example.com")
+	repl.Set("http.request.host.labels.2", "acme")
+	env := expandEnv(templates, repl)
+	if env["DATABASE"] != "tenant_acme" || env["HOST"] != "acme.example.com" {
+		t.Errorf("Unexpected expanded env %v", env)
+	}
+}
+
+func TestValidate_EnvTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport SubstrateTransport
+		wantErr   bool
+	}{
+		{"shared process", SubstrateTransport{}, true},
+		{"namespace", SubstrateTransport{Namespace: "{http.request.host}"}, false},
+		{"one process per request", SubstrateTransport{IdleTimeout: -1}, false},
+		{"per_request isolation", SubstrateTransport{Isolation: "per_request"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.transport.StartupTimeout = caddy.Duration(time.Second)
+			tt.transport.Env = map[string]string{"HOST": "{http.request.host}"}
+			if err := tt.transport.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package substrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ETagConfig makes the transport handle conditional GETs for scripts: it
+// adds an ETag to responses that lack one and answers a matching
+// If-None-Match with 304 Not Modified.
+type ETagConfig struct {
+	// TTL is how long an ETag seen for a URL is trusted to still be
+	// current. Within it, a request whose If-None-Match matches gets a 304
+	// without reaching (or starting) the process. 0 always asks the process
+	// and only saves sending the body.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// etagBodyLimit is the largest response body the transport hashes for an
+// ETag; larger responses, and those of unknown length, are passed on
+// without one.
+const etagBodyLimit = 1 << 20
+
+// maxETags bounds the number of URLs an etagStore remembers.
+const maxETags = 10000
+
+func (c *ETagConfig) validate() error {
+	if c.TTL < 0 {
+		return fmt.Errorf("etag ttl cannot be negative")
+	}
+	return nil
+}
+
+// etagStore remembers the latest ETag of each script URL for ETagConfig.TTL.
+type etagStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]etagEntry
+}
+
+type etagEntry struct {
+	etag    string
+	expires time.Time
+}
+
+func newETagStore(config *ETagConfig) *etagStore {
+	return &etagStore{ttl: time.Duration(config.TTL), entries: make(map[string]etagEntry)}
+}
+
+// etagKey returns the key for conditional handling of req to script, or ""
+// when the request is not a plain GET or HEAD.
+func etagKey(req *http.Request, script string) string {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return ""
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Upgrade") != "" {
+		return ""
+	}
+	return script + " " + req.URL.RequestURI()
+}
+
+// current returns the remembered ETag for key, or "".
+func (s *etagStore) current(key string, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return ""
+	}
+	if !now.Before(entry.expires) {
+		delete(s.entries, key)
+		return ""
+	}
+	return entry.etag
+}
+
+// remember records etag as current for key. When the store is full, expired
+// entries are dropped first; if none are, etag is not remembered.
+func (s *etagStore) remember(key, etag string, now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= maxETags {
+		for k, entry := range s.entries {
+			if !now.Before(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		if len(s.entries) >= maxETags {
+			return
+		}
+	}
+	s.entries[key] = etagEntry{etag: etag, expires: now.Add(s.ttl)}
+}
+
+// tag makes sure a successful resp carries an ETag, hashing its body when
+// the script set none, and remembers it under key. It returns the ETag, or
+// "" when resp has none. Streamed responses are never hashed, so they reach
+// the client as they are written.
+func (s *etagStore) tag(key string, resp *http.Response, now time.Time) string {
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		if resp.Request != nil && resp.Request.Method == http.MethodHead {
+			return ""
+		}
+		if resp.ContentLength < 0 || resp.ContentLength > etagBodyLimit {
+			return ""
+		}
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+			return ""
+		}
+		body, ok := bufferBody(resp, etagBodyLimit)
+		if !ok {
+			return ""
+		}
+		sum := sha256.Sum256(body)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		resp.Header.Set("ETag", etag)
+	}
+
+	// Only responses any client may reuse are answered without the process
+	directives := cacheControl(resp.Header)
+	if directives["private"] == "" && directives["no-store"] == "" && resp.Header.Get("Set-Cookie") == "" {
+		s.remember(key, etag, now)
+	}
+	return etag
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison RFC 9110 prescribes for it.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedResponse is the 304 answer to req for a resource with etag.
+// header holds the headers of the full response, if known.
+func notModifiedResponse(req *http.Request, etag string, header http.Header) *http.Response {
+	notModified := make(http.Header)
+	// RFC 9110 15.4.5: headers a 200 would have carried that describe the
+	// representation's validity
+	for _, field := range []string{"Cache-Control", "Content-Location", "Date", "Expires", "Vary"} {
+		if value := header.Values(field); len(value) > 0 {
+			notModified[field] = value
+		}
+	}
+	notModified.Set("ETag", etag)
+	return &http.Response{
+		Status:     "304 Not Modified",
+		StatusCode: http.StatusNotModified,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     notModified,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
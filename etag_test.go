@@ -0,0 +1,174 @@
+package substrate
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`"x", "abc"`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`*`, `"abc"`, true},
+		{`"x"`, `"abc"`, false},
+		{``, `"abc"`, false},
+		{`"abc"`, ``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestETagStore_Tag(t *testing.T) {
+	store := newETagStore(&ETagConfig{TTL: caddy.Duration(time.Minute)})
+	now := time.Now()
+
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("hello")), ContentLength: 5}
+	etag := store.tag("k", resp, now)
+	if etag == "" || resp.Header.Get("ETag") != etag {
+		t.Fatalf("Expected a computed ETag on the response, got %q", etag)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hello" {
+		t.Errorf("Expected the body to be passed on, got %q", body)
+	}
+	if got := store.current("k", now.Add(time.Second)); got != etag {
+		t.Errorf("Expected the ETag to be remembered, got %q", got)
+	}
+	if got := store.current("k", now.Add(time.Minute)); got != "" {
+		t.Errorf("Expected the ETag to expire, got %q", got)
+	}
+
+	// The script's own ETag is kept; private responses are not remembered
+	resp = &http.Response{StatusCode: 200, Header: http.Header{"Etag": {`"v1"`}, "Cache-Control": {"private"}}, Body: http.NoBody}
+	if etag := store.tag("p", resp, now); etag != `"v1"` {
+		t.Errorf("Expected the script's ETag, got %q", etag)
+	}
+	if got := store.current("p", now); got != "" {
+		t.Errorf("A private response's ETag should not be remembered, got %q", got)
+	}
+}
+
+func TestETagStore_TagStream(t *testing.T) {
+	store := newETagStore(&ETagConfig{TTL: caddy.Duration(time.Minute)})
+
+	// A stream that has sent its first event and stays open
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go io.WriteString(writer, "data: first\n\n")
+	for _, header := range []http.Header{{}, {"Content-Type": {"text/event-stream; charset=utf-8"}}} {
+		resp := &http.Response{StatusCode: 200, Header: header, Body: reader, ContentLength: -1}
+		if header.Get("Content-Type") != "" {
+			resp.ContentLength = 1 << 10
+		}
+		tagged := make(chan string, 1)
+		go func() { tagged <- store.tag("k", resp, time.Now()) }()
+		select {
+		case etag := <-tagged:
+			if etag != "" || resp.Header.Get("ETag") != "" {
+				t.Errorf("Expected no ETag for a stream, got %q", etag)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a stream with %v passed on without waiting for its end", header)
+		}
+	}
+
+	first := make([]byte, len("data: first\n\n"))
+	if _, err := io.ReadFull(reader, first); err != nil || string(first) != "data: first\n\n" {
+		t.Errorf("Expected the first event readable right away, got %q, %v", first, err)
+	}
+}
+
+func TestRoundTrip_ETag(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{ETag: &ETagConfig{TTL: caddy.Duration(time.Minute)}}, zaptest.NewLogger(t))
+
+	resp, err := transport.RoundTrip(req.Clone(req.Context()))
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("Expected a 200 with an ETag, got %d %q", resp.StatusCode, etag)
+	}
+
+	// Without its process, the script can only be answered from the ETag
+	for _, process := range transport.manager.processes.snapshot() {
+		transport.manager.processes.remove(process.key, process)
+	}
+
+	conditional := req.Clone(req.Context())
+	conditional.Header.Set("If-None-Match", etag)
+	resp, err = transport.RoundTrip(conditional)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+		t.Errorf("Expected 304 with the ETag, got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestRoundTrip_ETagWithoutTTL(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{ETag: &ETagConfig{}}, zaptest.NewLogger(t))
+
+	resp, err := transport.RoundTrip(req.Clone(req.Context()))
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+
+	conditional := req.Clone(req.Context())
+	conditional.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	resp, err = transport.RoundTrip(conditional)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected the process response to become a 304, got %d", resp.StatusCode)
+	}
+
+	conditional.Header.Set("If-None-Match", `"other"`)
+	resp, err = transport.RoundTrip(conditional.Clone(conditional.Context()))
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("Expected the full response for another ETag, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestUnmarshalCaddyfile_ETag(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		etag 30s
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if transport.ETag == nil || transport.ETag.TTL != caddy.Duration(30*time.Second) {
+		t.Errorf("Unexpected etag config %+v", transport.ETag)
+	}
+
+	transport.FlushInterval = -1
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for etag with flush_interval -1")
+	}
+}
@@ -0,0 +1,73 @@
+package substrate
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(MatchExecutable{})
+}
+
+// MatchExecutable matches requests whose file is a regular file with an
+// execute permission bit set, so executable scripts can be run while other
+// files, plain .js assets included, are served as they are.
+//
+// Caddyfile:
+//
+//	substrate_executable [<path>]
+type MatchExecutable struct {
+	// Path of the file, with placeholders. Default
+	// {http.matchers.file.absolute}, the file found by a file matcher
+	// evaluated before this one.
+	Path string `json:"path,omitempty"`
+}
+
+const defaultExecutablePath = "{http.matchers.file.absolute}"
+
+func (MatchExecutable) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.substrate_executable",
+		New: func() caddy.Module { return new(MatchExecutable) },
+	}
+}
+
+func (m *MatchExecutable) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume matcher name
+	if d.NextArg() {
+		m.Path = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func (m MatchExecutable) MatchWithError(r *http.Request) (bool, error) {
+	path := m.Path
+	if path == "" {
+		path = defaultExecutablePath
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	path = repl.ReplaceAll(path, "")
+	if path == "" {
+		return false, nil
+	}
+	return isExecutable(path), nil
+}
+
+// isExecutable reports whether path is a regular file anyone may execute.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
+var (
+	_ caddy.Module                      = (*MatchExecutable)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchExecutable)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchExecutable)(nil)
+)
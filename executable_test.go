@@ -0,0 +1,67 @@
+package substrate
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestMatchExecutable(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "api.js")
+	asset := filepath.Join(dir, "app.js")
+	if err := os.WriteFile(script, []byte("// stub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(asset, []byte("// stub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"executable script", script, true},
+		{"plain asset", asset, false},
+		{"directory", dir, false},
+		{"missing file", filepath.Join(dir, "missing.js"), false},
+		{"no file matched", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			if tt.path != "" {
+				repl.Set("http.matchers.file.absolute", tt.path)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+			got, err := MatchExecutable{}.MatchWithError(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("MatchWithError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchExecutable_UnmarshalCaddyfile(t *testing.T) {
+	var m MatchExecutable
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`substrate_executable {vars.script}`)); err != nil {
+		t.Fatal(err)
+	}
+	if m.Path != "{vars.script}" {
+		t.Errorf("Expected path {vars.script}, got %q", m.Path)
+	}
+	if err := (&MatchExecutable{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`substrate_executable a b`)); err == nil {
+		t.Error("Expected an error for two paths")
+	}
+}
@@ -0,0 +1,170 @@
+package substrate
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// exitHistorySize is how many exits are kept per script.
+	exitHistorySize = 10
+
+	// maxExitScripts bounds the scripts exits are kept for; those that
+	// exited least recently are forgotten first.
+	maxExitScripts = 1000
+)
+
+// ProcessExit describes a process that exited without substrate stopping
+// it, listed by the admin API.
+type ProcessExit struct {
+	Time     time.Time `json:"time"`
+	PID      int       `json:"pid,omitempty"`
+	ExitCode int       `json:"exit_code"`
+	Signal   string    `json:"signal,omitempty"` // set when a signal ended the process
+	Stderr   string    `json:"stderr,omitempty"` // the last of its output
+	Core     string    `json:"core,omitempty"`   // its collected core dump
+}
+
+// ScriptExits is the exit history of a script, newest first.
+type ScriptExits struct {
+	Script string        `json:"script"`
+	Exits  []ProcessExit `json:"exits"`
+}
+
+// exitLog keeps the latest exits of every script.
+type exitLog struct {
+	mu       sync.Mutex
+	scripts  map[string][]ProcessExit // oldest first
+	contexts map[string]exitContext   // of the latest exit, for crash bundles
+}
+
+// exitContext is how the process that exited last was run.
+type exitContext struct {
+	env    []string
+	config json.RawMessage
+}
+
+// exitHistory is shared by all transports, so the history of a script
+// survives config reloads.
+var exitHistory = newExitLog()
+
+func newExitLog() *exitLog {
+	return &exitLog{
+		scripts:  make(map[string][]ProcessExit),
+		contexts: make(map[string]exitContext),
+	}
+}
+
+// record adds an exit of script, forgetting the oldest beyond
+// exitHistorySize.
+func (l *exitLog) record(script string, exit ProcessExit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	exits, ok := l.scripts[script]
+	if !ok && len(l.scripts) >= maxExitScripts {
+		l.evictLocked()
+	}
+	exits = append(exits, exit)
+	if len(exits) > exitHistorySize {
+		exits = append([]ProcessExit(nil), exits[len(exits)-exitHistorySize:]...)
+	}
+	l.scripts[script] = exits
+}
+
+// evictLocked forgets the script whose latest exit is the oldest. l.mu must
+// be held.
+func (l *exitLog) evictLocked() {
+	var oldest string
+	var oldestTime time.Time
+	for script, exits := range l.scripts {
+		if last := exits[len(exits)-1].Time; oldest == "" || last.Before(oldestTime) {
+			oldest, oldestTime = script, last
+		}
+	}
+	delete(l.scripts, oldest)
+	delete(l.contexts, oldest)
+}
+
+// recordContext keeps how the process of the latest exit of script was run.
+func (l *exitLog) recordContext(script string, c exitContext) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.scripts[script]; ok {
+		l.contexts[script] = c
+	}
+}
+
+// context returns how the process of the latest exit of script was run.
+func (l *exitLog) context(script string) (exitContext, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.contexts[script]
+	return c, ok
+}
+
+// list returns the exit history of script, or of every script when it is
+// empty, sorted by script.
+func (l *exitLog) list(script string) []ScriptExits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := []ScriptExits{}
+	for name, exits := range l.scripts {
+		if script != "" && name != script {
+			continue
+		}
+		newestFirst := make([]ProcessExit, len(exits))
+		for i, exit := range exits {
+			newestFirst[len(exits)-1-i] = exit
+		}
+		result = append(result, ScriptExits{Script: name, Exits: newestFirst})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Script < result[j].Script })
+	return result
+}
+
+// recordExit adds the process to the exit history if it exited on its own.
+// The process must have exited.
+func (p *Process) recordExit() {
+	p.mu.RLock()
+	if p.stopping {
+		p.mu.RUnlock()
+		return
+	}
+	exit := ProcessExit{
+		Time:     p.exitedAt,
+		ExitCode: p.exitCode,
+		Signal:   p.exitSignal,
+		Core:     p.corePath,
+	}
+	if p.cmd != nil && p.cmd.Process != nil {
+		exit.PID = p.cmd.Process.Pid
+	}
+	p.mu.RUnlock()
+
+	if p.stderrTail != nil {
+		exit.Stderr = p.stderrTail.String()
+	}
+	exitHistory.record(p.scriptPath, exit)
+
+	env, config := p.context()
+	exitHistory.recordContext(p.scriptPath, exitContext{env: env, config: config})
+}
+
+// context returns the environment the process was started with and the
+// config of the transport that started it.
+func (p *Process) context() ([]string, json.RawMessage) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var env []string
+	if p.cmd != nil {
+		env = append([]string{}, p.cmd.Env...)
+	}
+	return env, p.config
+}
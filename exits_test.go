@@ -0,0 +1,117 @@
+package substrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestExitLog(t *testing.T) {
+	l := newExitLog()
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < exitHistorySize+2; i++ {
+		l.record("/srv/app.js", ProcessExit{Time: base.Add(time.Duration(i) * time.Second), ExitCode: i})
+	}
+	l.record("/srv/other.js", ProcessExit{Time: base, ExitCode: 1})
+
+	history := l.list("/srv/app.js")
+	if len(history) != 1 || history[0].Script != "/srv/app.js" {
+		t.Fatalf("Expected the history of one script, got %+v", history)
+	}
+	exits := history[0].Exits
+	if len(exits) != exitHistorySize {
+		t.Fatalf("Expected %d exits, got %d", exitHistorySize, len(exits))
+	}
+	if exits[0].ExitCode != exitHistorySize+1 || exits[len(exits)-1].ExitCode != 2 {
+		t.Errorf("Expected the latest exits, newest first, got %+v", exits)
+	}
+	if all := l.list(""); len(all) != 2 || all[1].Script != "/srv/other.js" {
+		t.Errorf("Expected both scripts, sorted, got %+v", all)
+	}
+
+	// The script that exited least recently is forgotten first
+	for i := 0; len(l.scripts) < maxExitScripts; i++ {
+		l.record(fmt.Sprintf("/srv/app%d.js", i), ProcessExit{Time: base.Add(time.Hour)})
+	}
+	l.record("/srv/new.js", ProcessExit{Time: base.Add(2 * time.Hour)})
+	if len(l.list("/srv/other.js")) != 0 || len(l.list("/srv/new.js")) != 1 {
+		t.Error("Expected the oldest script to make room for the new one")
+	}
+}
+
+func TestProcess_RecordsExits(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	tests := []struct {
+		name     string
+		runtime  string
+		exitCode int
+		signal   string
+		stderr   string
+	}{
+		{"exited", "echo 'uncaught error' >&2; exit 3", 3, "", "uncaught error"},
+		{"killed", "echo 'out of memory' >&2; kill -9 $$", -1, "SIGKILL", "out of memory"},
+	}
+	for _, tt := range tests {
+		// Stands in for deno
+		process := startStubProcess(t, pm, tt.runtime)
+		<-process.exitChan
+
+		history := exitHistory.list(process.scriptPath)
+		if len(history) != 1 || len(history[0].Exits) != 1 {
+			t.Fatalf("%s: expected one exit, got %+v", tt.name, history)
+		}
+		exit := history[0].Exits[0]
+		if exit.ExitCode != tt.exitCode || exit.Signal != tt.signal || exit.PID == 0 || exit.Time.IsZero() {
+			t.Errorf("%s: unexpected exit %+v", tt.name, exit)
+		}
+		if !strings.Contains(exit.Stderr, tt.stderr) {
+			t.Errorf("%s: expected the stderr tail, got %q", tt.name, exit.Stderr)
+		}
+	}
+
+	// Processes substrate stops are not recorded
+	process := startStubProcess(t, pm, "exec sleep 10")
+	process.Stop()
+	if history := exitHistory.list(process.scriptPath); len(history) != 0 {
+		t.Errorf("Expected a stopped process not to be recorded, got %+v", history)
+	}
+}
+
+func TestAdminAPI_Exits(t *testing.T) {
+	exitHistory.record("/srv/exits-listed.js", ProcessExit{Time: time.Now(), ExitCode: 1, Stderr: "boom\n"})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/substrate/exits?script="+url.QueryEscape("/srv/exits-listed.js"), nil)
+	if err := (adminAPI{}).handleExits(rec, req); err != nil {
+		t.Fatalf("handleExits failed: %v", err)
+	}
+
+	var history []ScriptExits
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil {
+		t.Fatalf("Failed to decode history: %v", err)
+	}
+	if len(history) != 1 || history[0].Script != "/srv/exits-listed.js" || history[0].Exits[0].Stderr != "boom\n" {
+		t.Errorf("Unexpected exit history: %+v", history)
+	}
+}
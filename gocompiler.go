@@ -0,0 +1,146 @@
+package substrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// GoCompiler builds Go main packages for `runtime go`. The package in a
+// script's directory is compiled into a binary named after the hash of its
+// sources, so unchanged sources reuse the binary, also across restarts.
+type GoCompiler struct {
+	rootDir string
+	logger  *zap.Logger
+	mu      sync.Mutex // serializes compiles from concurrent process starts
+}
+
+// NewGoCompiler creates a GoCompiler caching binaries in {cacheDir}/go/.
+// If cacheDir is empty, uses ~/.cache/substrate/ like the DenoManager.
+func NewGoCompiler(cacheDir string, logger *zap.Logger) *GoCompiler {
+	rootDir := cacheDir
+	if rootDir == "" {
+		homeDir, _ := os.UserHomeDir()
+		rootDir = filepath.Join(homeDir, ".cache/substrate")
+	}
+	return &GoCompiler{
+		rootDir: filepath.Join(rootDir, "go"),
+		logger:  logger,
+	}
+}
+
+// Get returns the binary for the Go package in the directory of file,
+// compiling it if its sources changed.
+func (gc *GoCompiler) Get(file string) (string, error) {
+	dir := filepath.Dir(file)
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	hash, err := goSourceHash(dir)
+	if err != nil {
+		return "", fmt.Errorf("hashing Go sources: %w", err)
+	}
+	binary := filepath.Join(gc.rootDir, hash)
+	if info, err := os.Stat(binary); err == nil && info.Mode().IsRegular() {
+		return binary, nil
+	}
+
+	if err := os.MkdirAll(gc.rootDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create Go cache directory: %w", err)
+	}
+
+	goPath, err := exec.LookPath("go")
+	if err != nil {
+		return "", fmt.Errorf("runtime go requires the go toolchain: %w", err)
+	}
+
+	// Build next to the final name, so a binary is only ever seen complete
+	tmpBinary := binary + ".tmp"
+	cmd := exec.Command(goPath, "build", "-o", tmpBinary, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOTOOLCHAIN=local", "GOFLAGS=-mod=readonly")
+	if os.Getenv("GOCACHE") == "" {
+		if _, err := os.UserCacheDir(); err != nil {
+			// Caddy often runs without a home directory
+			cmd.Env = append(cmd.Env, "GOCACHE="+filepath.Join(gc.rootDir, "cache"))
+		}
+	}
+
+	gc.logger.Info("compiling Go handler", zap.String("dir", dir))
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultBuildTimeout)
+	defer cancel()
+	output, err := runWithContext(ctx, cmd)
+	if err != nil {
+		os.Remove(tmpBinary)
+		return "", &BuildError{Err: fmt.Errorf("go build: %w", err), Output: string(output)}
+	}
+	if err := os.Chmod(tmpBinary, 0755); err != nil {
+		return "", fmt.Errorf("failed to make binary executable: %w", err)
+	}
+	if err := os.Rename(tmpBinary, binary); err != nil {
+		return "", fmt.Errorf("failed to store binary: %w", err)
+	}
+
+	gc.logger.Info("compiled Go handler",
+		zap.String("dir", dir),
+		zap.String("binary", binary),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return binary, nil
+}
+
+// goSourceHash hashes the Go sources, go.mod and go.sum under dir, along
+// with the target platform. Hidden directories and testdata are skipped.
+func goSourceHash(dir string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%s\x00", runtime.GOOS, runtime.GOARCH)
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			if path != dir && (strings.HasPrefix(name, ".") || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !(strings.HasSuffix(name, ".go") || name == "go.mod" || name == "go.sum") {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", rel, info.Size())
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
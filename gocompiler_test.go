@@ -0,0 +1,139 @@
+package substrate
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+const goHandler = `package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+)
+
+func main() {
+	listener, err := net.Listen("unix", os.Args[1])
+	if err != nil {
+		panic(err)
+	}
+	http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from go"))
+	}))
+}
+`
+
+func TestGoSourceHash(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.go", "package main")
+	write("go.mod", "module example.com/app")
+
+	hash := func() string {
+		t.Helper()
+		h, err := goSourceHash(dir)
+		if err != nil {
+			t.Fatalf("goSourceHash failed: %v", err)
+		}
+		return h
+	}
+	initial := hash()
+
+	write("README.md", "docs")
+	write(".git/main.go", "package ignored")
+	if got := hash(); got != initial {
+		t.Error("Files other than Go sources should not change the hash")
+	}
+
+	write("lib/util.go", "package lib")
+	if got := hash(); got == initial {
+		t.Error("A Go source in a subpackage should change the hash")
+	}
+}
+
+func TestProcessManager_GoRuntime_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	logger := zaptest.NewLogger(t)
+	compiler := NewGoCompiler(t.TempDir(), logger)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(5*time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{goCompiler: compiler},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(scriptPath, []byte(goHandler), 0644); err != nil {
+		t.Fatalf("Failed to write handler: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/handler\n\ngo 1.21\n"), 0644); err != nil {
+		t.Fatalf("Failed to write go.mod: %v", err)
+	}
+
+	socketPath, err := pm.getOrCreateHost(scriptPath, "")
+	if err != nil {
+		t.Fatalf("getOrCreateHost failed: %v", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://handler/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from go" {
+		t.Errorf("Unexpected response %q", body)
+	}
+
+	// Unchanged sources reuse the cached binary
+	first, err := compiler.Get(scriptPath)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	info, err := os.Stat(first)
+	if err != nil {
+		t.Fatalf("Cached binary missing: %v", err)
+	}
+	second, err := compiler.Get(scriptPath)
+	if err != nil || second != first {
+		t.Fatalf("Expected the cached binary %s, got %s (%v)", first, second, err)
+	}
+	if again, _ := os.Stat(second); !again.ModTime().Equal(info.ModTime()) {
+		t.Error("Cached binary should not be rebuilt")
+	}
+}
@@ -0,0 +1,69 @@
+package substrate
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// handoverPath is the path of the request asking a process about to be
+// recycled to save its state for its replacement.
+const handoverPath = "/.substrate/handover"
+
+// handoverTimeout bounds how long a process may take to save its state.
+const handoverTimeout = 10 * time.Second
+
+// requestHandover asks old to write its state to a file for its replacement.
+// The process gets a POST to handoverPath with the file path in
+// X-Substrate-Handover-File and answers 2xx once the file is written. It
+// returns the file path, or "" when the process declined, failed or wrote
+// nothing; the replacement then starts without state.
+func (pm *ProcessManager) requestHandover(old *Process) string {
+	statePath := strings.TrimSuffix(old.SocketPath, ".sock") + ".handover"
+	os.Remove(statePath)
+
+	client := socketClient(old.SocketPath, handoverTimeout)
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(pm.ctx, http.MethodPost, "http://substrate.localhost"+handoverPath, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("X-Substrate-Handover-File", statePath)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		pm.logger.Warn("handover request failed, starting replacement without state",
+			zap.String("script_path", old.scriptPath),
+			zap.Error(err),
+		)
+		return ""
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		pm.logger.Debug("process declined handover",
+			zap.String("script_path", old.scriptPath),
+			zap.Int("status_code", resp.StatusCode),
+		)
+		os.Remove(statePath)
+		return ""
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		pm.logger.Warn("process accepted handover but wrote no state file",
+			zap.String("script_path", old.scriptPath),
+			zap.String("state_file", statePath),
+		)
+		return ""
+	}
+
+	pm.logger.Info("process saved state for handover",
+		zap.String("script_path", old.scriptPath),
+		zap.String("state_file", statePath),
+	)
+	return statePath
+}
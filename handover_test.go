@@ -0,0 +1,86 @@
+package substrate
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRequestHandover(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{handover: true},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for a process: saves its state unless told to decline
+	serve := func(t *testing.T, status int, write bool) *Process {
+		socketPath := filepath.Join(t.TempDir(), "substrate-0123456789abcdef.sock")
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("Failed to listen on socket: %v", err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != handoverPath {
+				http.NotFound(w, r)
+				return
+			}
+			if write {
+				os.WriteFile(r.Header.Get("X-Substrate-Handover-File"), []byte(`{"count":3}`), 0600)
+			}
+			w.WriteHeader(status)
+		})}
+		go server.Serve(listener)
+		t.Cleanup(func() { server.Close() })
+		return &Process{scriptPath: "/app.js", SocketPath: socketPath}
+	}
+
+	t.Run("saved", func(t *testing.T) {
+		old := serve(t, http.StatusOK, true)
+		statePath := pm.requestHandover(old)
+		if want := filepath.Join(filepath.Dir(old.SocketPath), "substrate-0123456789abcdef.handover"); statePath != want {
+			t.Fatalf("Expected state file %q, got %q", want, statePath)
+		}
+		if data, err := os.ReadFile(statePath); err != nil || string(data) != `{"count":3}` {
+			t.Errorf("Expected the saved state, got %q, %v", data, err)
+		}
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		old := serve(t, http.StatusNotImplemented, true)
+		if statePath := pm.requestHandover(old); statePath != "" {
+			t.Errorf("Expected no handover when the process declines, got %q", statePath)
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(old.SocketPath), "substrate-0123456789abcdef.handover")); !os.IsNotExist(err) {
+			t.Errorf("Expected the state file of a declined handover to be removed, got %v", err)
+		}
+	})
+
+	t.Run("no state file", func(t *testing.T) {
+		if statePath := pm.requestHandover(serve(t, http.StatusOK, false)); statePath != "" {
+			t.Errorf("Expected no handover without a state file, got %q", statePath)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		old := &Process{scriptPath: "/app.js", SocketPath: filepath.Join(t.TempDir(), "gone.sock")}
+		if statePath := pm.requestHandover(old); statePath != "" {
+			t.Errorf("Expected no handover from an unreachable process, got %q", statePath)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package substrate
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// framingHeaders are the request headers that only apply to one connection
+// or that Go's HTTP client writes itself. Their casing can't be chosen.
+var framingHeaders = map[string]bool{
+	"Connection":          true,
+	"Content-Length":      true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"User-Agent":          true,
+}
+
+// validateHeaderCase checks header_case names: header names, not those
+// framing the request.
+func validateHeaderCase(names []string) error {
+	for _, name := range names {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("header_case: invalid header name %q", name)
+		}
+		if framingHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("header_case: the casing of %s can't be set", name)
+		}
+	}
+	return nil
+}
+
+// applyHeaderCase renames the headers in names to the casing they are given
+// in. Go stores header names canonicalized (X-Api-Key), the casing they are
+// written in, whatever casing the client used.
+func applyHeaderCase(header http.Header, names []string) {
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if name == canonical {
+			continue
+		}
+		if values, ok := header[canonical]; ok {
+			delete(header, canonical)
+			header[name] = values
+		}
+	}
+}
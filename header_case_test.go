@@ -0,0 +1,120 @@
+package substrate
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+// serveStubSocket points the stub process of transport at a new socket,
+// handing each connection to it to serve.
+func serveStubSocket(t *testing.T, transport *SubstrateTransport, serve func(conn net.Conn)) {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "raw.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on socket: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	for _, process := range transport.manager.processes.snapshot() {
+		process.SocketPath = socketPath
+	}
+}
+
+func TestApplyHeaderCase(t *testing.T) {
+	header := http.Header{"X-Api-Key": {"abc"}, "Accept": {"*/*"}}
+	applyHeaderCase(header, []string{"X-API-Key", "X-Missing-ID", "Accept"})
+	if got := header["X-API-Key"]; len(got) != 1 || got[0] != "abc" {
+		t.Errorf("Expected X-API-Key, got %v", header)
+	}
+	if _, ok := header["X-Api-Key"]; ok {
+		t.Error("Expected the canonical name removed")
+	}
+	if _, ok := header["X-Missing-ID"]; ok {
+		t.Error("Expected absent headers not to be added")
+	}
+	if header.Get("Accept") != "*/*" {
+		t.Error("Expected other headers kept")
+	}
+}
+
+func TestValidateHeaderCase(t *testing.T) {
+	if err := validateHeaderCase([]string{"X-API-Key", "SOAPAction"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"connection", "UPGRADE", "content-length", "TE", "X API Key", ""} {
+		if err := validateHeaderCase([]string{name}); err == nil {
+			t.Errorf("Expected an error for %q", name)
+		}
+	}
+}
+
+func TestRoundTrip_HeaderCase(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{HeaderCase: []string{"X-API-Key"}}, zaptest.NewLogger(t))
+	// Answers with the request head as the process received it
+	serveStubSocket(t, transport, func(conn net.Conn) {
+		var head strings.Builder
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			head.WriteString(line)
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: "+strconv.Itoa(head.Len())+"\r\n\r\n"+head.String())
+	})
+
+	req.Header.Set("X-Api-Key", "abc")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	head, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(head), "\r\nX-API-Key: abc\r\n") || strings.Contains(string(head), "X-Api-Key") {
+		t.Errorf("Expected the header sent as X-API-Key, got:\n%s", head)
+	}
+}
+
+func TestUnmarshalCaddyfile_HeaderCase(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		header_case X-API-Key SOAPAction
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(transport.HeaderCase, ",") != "X-API-Key,SOAPAction" {
+		t.Fatalf("Unexpected header_case: %v", transport.HeaderCase)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	transport.HeaderCase = []string{"connection"}
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for a hop-by-hop header")
+	}
+}
@@ -0,0 +1,72 @@
+package substrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// HostRoots serves each host from its own project directory, derived from
+// the request, so one site block can serve any number of sites without a
+// Caddyfile entry for each.
+type HostRoots struct {
+	// Dir is the project directory, e.g. "/srv/sites/{http.request.host}".
+	// Each placeholder must expand to a single path element; host
+	// placeholders are lowercased.
+	Dir string `json:"dir"`
+
+	// Script is the server script, relative to the project directory.
+	// Default server.js.
+	Script string `json:"script,omitempty"`
+}
+
+const defaultHostRootScript = "server.js"
+
+func (h *HostRoots) validate() error {
+	if !filepath.IsAbs(h.Dir) {
+		return fmt.Errorf("host_roots directory must be absolute, got %q", h.Dir)
+	}
+	if !strings.Contains(h.Dir, "{") {
+		return fmt.Errorf("host_roots directory %q has no placeholders; use root and the file matcher for a single site", h.Dir)
+	}
+	script := h.scriptName()
+	if filepath.IsAbs(script) || !filepath.IsLocal(script) {
+		return fmt.Errorf("host_roots script must be a path inside the project directory, got %q", script)
+	}
+	return nil
+}
+
+func (h *HostRoots) scriptName() string {
+	if h.Script != "" {
+		return h.Script
+	}
+	return defaultHostRootScript
+}
+
+// script returns the server script of the project directory for the
+// request, or "" when a placeholder expands to something that is not a
+// single path element or the script does not exist.
+func (h *HostRoots) script(repl *caddy.Replacer) string {
+	dir, err := repl.ReplaceFunc(h.Dir, func(variable string, val any) (any, error) {
+		element := caddy.ToString(val)
+		if element == "" || element == "." || element == ".." || strings.ContainsAny(element, `/\`) {
+			return nil, fmt.Errorf("placeholder %s is not a path element: %q", variable, element)
+		}
+		if strings.HasPrefix(variable, "http.request.host") {
+			element = strings.ToLower(element)
+		}
+		return element, nil
+	})
+	if err != nil {
+		return ""
+	}
+
+	script := filepath.Join(dir, h.scriptName())
+	if info, err := os.Stat(script); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	return script
+}
@@ -0,0 +1,107 @@
+package substrate
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestHostRoots_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		roots   HostRoots
+		wantErr bool
+	}{
+		{"host directory", HostRoots{Dir: "/srv/sites/{http.request.host}"}, false},
+		{"custom script", HostRoots{Dir: "/srv/sites/{http.request.host}", Script: "app/main.ts"}, false},
+		{"relative directory", HostRoots{Dir: "sites/{http.request.host}"}, true},
+		{"no placeholder", HostRoots{Dir: "/srv/sites/acme"}, true},
+		{"script outside directory", HostRoots{Dir: "/srv/sites/{http.request.host}", Script: "../server.js"}, true},
+		{"absolute script", HostRoots{Dir: "/srv/sites/{http.request.host}", Script: "/srv/server.js"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.roots.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostRoots_Script(t *testing.T) {
+	sites := t.TempDir()
+	script := filepath.Join(sites, "acme.example.com", "server.js")
+	if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("// stub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sites, "server.js"), []byte("// stub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	roots := &HostRoots{Dir: filepath.Join(sites, "{http.request.host}")}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"acme.example.com", script},
+		{"ACME.example.com", script},
+		{"globex.example.com", ""},
+		{"..", ""},
+		{".", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.host", tt.host)
+		if got := roots.script(repl); got != tt.want {
+			t.Errorf("host %q: got script %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTrip_HostRootsUnknownHost(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{
+		HostRoots: &HostRoots{Dir: filepath.Join(t.TempDir(), "{http.request.host}")},
+	}, zaptest.NewLogger(t))
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("http.request.host", "unknown.example.com")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a host without a project directory, got %d", resp.StatusCode)
+	}
+}
+
+func TestUnmarshalCaddyfile_HostRoots(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		host_roots /srv/sites/{http.request.host} app.ts
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.HostRoots == nil || transport.HostRoots.Dir != "/srv/sites/{http.request.host}" || transport.HostRoots.Script != "app.ts" {
+		t.Errorf("Unexpected host_roots %+v", transport.HostRoots)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	transport.Script = "{tenant_script}"
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error combining script and host_roots")
+	}
+}
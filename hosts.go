@@ -0,0 +1,121 @@
+package substrate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// systemHostsFile is the file the hosts entries are added to and mounted over.
+const systemHostsFile = "/etc/hosts"
+
+// validateHosts checks that every hosts entry maps a host name to an IP
+// address.
+func validateHosts(hosts map[string]string) error {
+	for name, addr := range hosts {
+		if name == "" || strings.ContainsAny(name, " \t\r\n#") {
+			return fmt.Errorf("hosts: invalid host name %q", name)
+		}
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("hosts: %s: %q is not an IP address", name, addr)
+		}
+	}
+	return nil
+}
+
+// hostsFileContent returns the hosts file processes see: the entries,
+// sorted by name, followed by the system file. Resolvers use the first line
+// naming a host, so an entry overrides the system's address for its name.
+func hostsFileContent(system []byte, hosts map[string]string) []byte {
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("# substrate hosts\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\t%s\n", hosts[name], name)
+	}
+	buf.WriteString("\n")
+	buf.Write(system)
+	return buf.Bytes()
+}
+
+// writeHostsFile writes the hosts file for a process to the system
+// temporary directory and returns its path. It is readable by everyone, so
+// the process can read it whatever user it runs as.
+func writeHostsFile(hosts map[string]string) (string, error) {
+	system, err := os.ReadFile(systemHostsFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "substrate-hosts-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(hostsFileContent(system, hosts))
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// isolateHosts runs cmd in its own user and mount namespaces, where the
+// buildCommand prelude can mount the process's hosts file over /etc/hosts
+// without touching the host. The process is root inside its namespace,
+// mapped to the user and group it would otherwise run as, so it has no more
+// rights on the host than before. Only the owner of the namespaces can
+// change groups, so supplementary groups are dropped when Caddy runs as root
+// and inherited otherwise.
+func isolateHosts(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+
+	uid, gid := os.Geteuid(), os.Getegid()
+	if attr.Credential != nil {
+		uid, gid = int(attr.Credential.Uid), int(attr.Credential.Gid)
+	}
+	privileged := os.Geteuid() == 0
+
+	attr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+	attr.GidMappingsEnableSetgroups = privileged
+	attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: !privileged}
+}
+
+// removeHostsFile deletes the process's hosts file, if any. The process must
+// have exited.
+func (p *Process) removeHostsFile() {
+	if p.hostsFile == "" {
+		return
+	}
+	if err := os.Remove(p.hostsFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		p.logger.Warn("failed to remove hosts file",
+			zap.String("script_path", p.scriptPath),
+			zap.String("hosts_file", p.hostsFile),
+			zap.Error(err),
+		)
+	}
+}
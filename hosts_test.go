@@ -0,0 +1,106 @@
+package substrate
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestValidateHosts(t *testing.T) {
+	if err := validateHosts(map[string]string{"api.example.com": "10.0.0.12", "db": "::1"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for name, addr := range map[string]string{
+		"api.example.com": "api.internal",
+		"db":              "10.0.0.300",
+		"two names":       "10.0.0.1",
+		"":                "10.0.0.1",
+	} {
+		if err := validateHosts(map[string]string{name: addr}); err == nil {
+			t.Errorf("Expected an error for %q %q", name, addr)
+		}
+	}
+}
+
+func TestHostsFileContent(t *testing.T) {
+	system := []byte("127.0.0.1\tlocalhost\n10.1.1.1\tapi.example.com\n")
+	got := string(hostsFileContent(system, map[string]string{"db.internal": "10.0.0.20", "api.example.com": "10.0.0.12"}))
+
+	api := strings.Index(got, "10.0.0.12\tapi.example.com\n")
+	db := strings.Index(got, "10.0.0.20\tdb.internal\n")
+	systemAPI := strings.Index(got, "10.1.1.1\tapi.example.com\n")
+	if api < 0 || db < 0 || systemAPI < 0 {
+		t.Fatalf("Missing entries in %q", got)
+	}
+	if !(api < db && db < systemAPI) {
+		t.Errorf("Expected sorted entries before the system file, got %q", got)
+	}
+}
+
+func TestProcess_Hosts(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{hosts: map[string]string{"api.example.com": "10.0.0.12"}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, printing the hosts file it sees
+	process := newStubProcess(t, pm, "cat /etc/hosts")
+	if err := process.start(); err != nil {
+		t.Skipf("user namespaces are not available: %v", err)
+	}
+	hostsFile := process.hostsFile
+	<-process.exitChan
+
+	if strings.Contains(process.startupStderr.String(), "mount") {
+		t.Skipf("cannot mount in a user namespace: %s", process.startupStderr.String())
+	}
+	if got := process.startupStdout.String(); !strings.Contains(got, "10.0.0.12\tapi.example.com") {
+		t.Errorf("Expected the hosts entry in the process's /etc/hosts, got %q", got)
+	}
+	if system, err := os.ReadFile(systemHostsFile); err == nil && strings.Contains(string(system), "10.0.0.12\tapi.example.com") {
+		t.Error("The hosts entry leaked into the system's /etc/hosts")
+	}
+	if _, err := os.Stat(hostsFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the hosts file to be removed, got %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfile_Hosts(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		hosts {
+			api.example.com 10.0.0.12
+			db.internal     10.0.0.20
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.Hosts) != 2 || transport.Hosts["db.internal"] != "10.0.0.20" {
+		t.Errorf("Unexpected hosts %v", transport.Hosts)
+	}
+
+	d = caddyfile.NewTestDispenser(`substrate {
+		hosts {
+			api.example.com
+		}
+	}`)
+	if err := (&SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for a host without an address")
+	}
+}
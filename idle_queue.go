@@ -0,0 +1,106 @@
+package substrate
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// idleQueue orders running processes by the time they become idle, so the
+// cleanup loop can sleep until exactly the next expiry instead of scanning
+// every process on a fixed tick.
+//
+// Entries are not updated when a process is used. Instead, an entry whose
+// process was used since it was queued is re-queued with its new expiry when
+// it comes due, which keeps the request path free of heap operations. Each
+// process has at most one entry.
+type idleQueue struct {
+	mu      sync.Mutex
+	entries idleHeap
+	queued  map[*Process]*idleEntry
+	wake    chan struct{}
+}
+
+type idleEntry struct {
+	key     string
+	process *Process
+	expiry  time.Time
+	index   int
+}
+
+func newIdleQueue() *idleQueue {
+	return &idleQueue{queued: make(map[*Process]*idleEntry), wake: make(chan struct{}, 1)}
+}
+
+// push queues process to be checked at expiry, moving its entry if it is
+// already queued, and wakes the cleanup loop if it is now the earliest entry.
+func (q *idleQueue) push(key string, process *Process, expiry time.Time) {
+	q.mu.Lock()
+	if entry, ok := q.queued[process]; ok {
+		entry.key, entry.expiry = key, expiry
+		heap.Fix(&q.entries, entry.index)
+	} else {
+		entry := &idleEntry{key: key, process: process, expiry: expiry}
+		heap.Push(&q.entries, entry)
+		q.queued[process] = entry
+	}
+	earliest := q.entries[0].process == process
+	q.mu.Unlock()
+
+	if earliest {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next returns the earliest expiry, or false if the queue is empty.
+func (q *idleQueue) next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.entries) == 0 {
+		return time.Time{}, false
+	}
+	return q.entries[0].expiry, true
+}
+
+// popDue removes and returns all entries expiring at or before now.
+func (q *idleQueue) popDue(now time.Time) []*idleEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []*idleEntry
+	for len(q.entries) > 0 && !q.entries[0].expiry.After(now) {
+		entry := heap.Pop(&q.entries).(*idleEntry)
+		delete(q.queued, entry.process)
+		due = append(due, entry)
+	}
+	return due
+}
+
+// idleHeap implements heap.Interface as a min-heap on expiry.
+type idleHeap []*idleEntry
+
+func (h idleHeap) Len() int           { return len(h) }
+func (h idleHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h idleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *idleHeap) Push(x any) {
+	entry := x.(*idleEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *idleHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return entry
+}
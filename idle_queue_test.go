@@ -0,0 +1,153 @@
+package substrate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestIdleQueue_PopDueInExpiryOrder(t *testing.T) {
+	q := newIdleQueue()
+	now := time.Now()
+
+	late := &Process{}
+	early := &Process{}
+	future := &Process{}
+	q.push("/srv/late.js", late, now.Add(-time.Second))
+	q.push("/srv/early.js", early, now.Add(-time.Minute))
+	q.push("/srv/future.js", future, now.Add(time.Minute))
+
+	due := q.popDue(now)
+	if len(due) != 2 {
+		t.Fatalf("Expected 2 due entries, got %d", len(due))
+	}
+	if due[0].process != early || due[1].process != late {
+		t.Error("Due entries should be returned in expiry order")
+	}
+
+	next, ok := q.next()
+	if !ok || !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected remaining entry to expire in a minute, got %v (ok=%v)", next, ok)
+	}
+}
+
+func TestIdleQueue_PushEarliestWakes(t *testing.T) {
+	q := newIdleQueue()
+	now := time.Now()
+
+	q.push("/srv/a.js", &Process{}, now.Add(time.Minute))
+	<-q.wake
+
+	q.push("/srv/b.js", &Process{}, now.Add(time.Hour))
+	select {
+	case <-q.wake:
+		t.Error("Pushing a later expiry should not wake the cleanup loop")
+	default:
+	}
+
+	q.push("/srv/c.js", &Process{}, now.Add(time.Second))
+	select {
+	case <-q.wake:
+	default:
+		t.Error("Pushing an earlier expiry should wake the cleanup loop")
+	}
+}
+
+func TestProcessManager_IdleExpiry(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(50*time.Millisecond),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	idle := &Process{scriptPath: "/srv/idle.js", logger: logger}
+	busy := &Process{scriptPath: "/srv/busy.js", logger: logger}
+	for _, p := range []*Process{idle, busy} {
+		p := p
+		pm.processes.acquire(p.scriptPath, func() (*Process, error) { return p, nil })
+		pm.processes.release(p.scriptPath, p, false)
+		pm.idle.push(p.scriptPath, p, time.Now().Add(50*time.Millisecond))
+	}
+
+	// Keep busy in use past its first expiry so it gets re-queued
+	stop := time.After(300 * time.Millisecond)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			busy.mu.Lock()
+			busy.lastUsed = time.Now()
+			busy.mu.Unlock()
+		case <-stop:
+			break loop
+		}
+	}
+
+	if pm.processes.get("/srv/idle.js") != nil {
+		t.Error("Idle process should have been removed")
+	}
+	if pm.processes.get("/srv/busy.js") != busy {
+		t.Error("Process in use should not have been removed")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for pm.processes.get("/srv/busy.js") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Process should be removed once it stops being used")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcessManager_IdleExpiryKeepsBusyProcess(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(50*time.Millisecond),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// A streaming request taken long before the idle timeout and still running
+	process := &Process{scriptPath: "/srv/stream.js", logger: logger}
+	pm.processes.acquire(process.scriptPath, func() (*Process, error) { return process, nil })
+	process.mu.Lock()
+	process.lastUsed = time.Now().Add(-time.Minute)
+	process.mu.Unlock()
+	pm.idle.push(process.scriptPath, process, time.Now())
+
+	time.Sleep(300 * time.Millisecond)
+	if pm.processes.get("/srv/stream.js") != process {
+		t.Fatal("Process serving a request should not be stopped as idle")
+	}
+
+	// Idle once the request ends
+	pm.releaseProcess(process.scriptPath, process, false)
+	deadline := time.Now().Add(time.Second)
+	for pm.processes.get("/srv/stream.js") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Process should be removed once its request ends and it stays idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,28 @@
+package substrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func validateIndex(index []string) error {
+	for _, name := range index {
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("index entry must be a path inside the directory, got %q", name)
+		}
+	}
+	return nil
+}
+
+// resolveIndex returns the first entry of index that is a regular file in
+// dir, or "" when there is none.
+func resolveIndex(dir string, index []string) string {
+	for _, name := range index {
+		script := filepath.Join(dir, name)
+		if info, err := os.Stat(script); err == nil && info.Mode().IsRegular() {
+			return script
+		}
+	}
+	return ""
+}
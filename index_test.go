@@ -0,0 +1,85 @@
+package substrate
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestResolveIndex(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"index.ts", "main.py"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("// stub"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "server.js"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := resolveIndex(dir, []string{"server.js", "index.ts", "main.py"}); got != filepath.Join(dir, "index.ts") {
+		t.Errorf("Expected the first present file, got %q", got)
+	}
+	if got := resolveIndex(dir, []string{"app.js"}); got != "" {
+		t.Errorf("Expected no entrypoint, got %q", got)
+	}
+}
+
+func TestValidateIndex(t *testing.T) {
+	if err := validateIndex([]string{"server.js", "app/main.ts"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"../server.js", "/srv/server.js", ""} {
+		if err := validateIndex([]string{name}); err == nil {
+			t.Errorf("Expected an error for %q", name)
+		}
+	}
+}
+
+func TestRoundTrip_Index(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{Index: []string{"server.js", "app.js"}}, zaptest.NewLogger(t))
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	scriptPath, _ := repl.GetString("http.matchers.file.absolute")
+	dir := filepath.Dir(scriptPath)
+
+	// The directory's app.js is the stub process
+	repl.Set("http.matchers.file.absolute", dir)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the index entrypoint to answer, got %d", resp.StatusCode)
+	}
+
+	repl.Set("http.matchers.file.absolute", t.TempDir())
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a directory without an entrypoint, got %d", resp.StatusCode)
+	}
+}
+
+func TestUnmarshalCaddyfile_Index(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		index server.js index.ts
+		index main.py
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.Index) != 3 || transport.Index[2] != "main.py" {
+		t.Errorf("Unexpected index %v", transport.Index)
+	}
+}
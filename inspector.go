@@ -0,0 +1,69 @@
+package substrate
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// inspectorAddress picks a free loopback address for a process's V8
+// inspector.
+func inspectorAddress() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to find a port for the inspector: %w", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr, nil
+}
+
+// inspectorPrefix is the admin route forwarding to process inspectors:
+// /substrate/inspector/<pid>/<inspector path>.
+const inspectorPrefix = "/substrate/inspector/"
+
+// handleInspector forwards a request, including WebSocket upgrades, to the
+// inspector of the process with the pid in the path. Access is controlled by
+// Caddy's admin endpoint like every other admin route.
+func (adminAPI) handleInspector(w http.ResponseWriter, r *http.Request) error {
+	pidText, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, inspectorPrefix), "/")
+	pid, err := strconv.Atoi(pidText)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("path must be %s<pid>/...", inspectorPrefix),
+		}
+	}
+
+	addr := ""
+	for _, pm := range registeredManagers() {
+		for _, process := range pm.processes.snapshot() {
+			if info := process.Info(); info.PID == pid && info.Inspector != "" {
+				addr = info.Inspector
+			}
+		}
+	}
+	if addr == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no process with pid %d has an inspector; enable debug on its transport", pid),
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = addr
+			pr.Out.URL.Path = "/" + rest
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = addr
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	return nil
+}
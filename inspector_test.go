@@ -0,0 +1,77 @@
+package substrate
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestAdminAPI_Inspector(t *testing.T) {
+	inspector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.Path)
+	}))
+	defer inspector.Close()
+	addr := strings.TrimPrefix(inspector.URL, "http://")
+
+	pm := newAdminTestManager(t)
+	process := &Process{
+		scriptPath: "/srv/app.js",
+		SocketPath: "/tmp/app.sock",
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: 4242}},
+		startedAt:  time.Now(),
+		inspector:  addr,
+		logger:     pm.logger,
+	}
+	pm.processes.acquire("/srv/app.js", func() (*Process, error) { return process, nil })
+	// The stub must not be signalled on cleanup
+	t.Cleanup(func() { pm.processes.remove("/srv/app.js", process) })
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleInspector(rec, httptest.NewRequest("GET", "/substrate/inspector/4242/json/list", nil)); err != nil {
+		t.Fatalf("handleInspector failed: %v", err)
+	}
+	if want := addr + " /json/list"; rec.Body.String() != want {
+		t.Errorf("Expected the request forwarded as %q, got %q", want, rec.Body.String())
+	}
+
+	err := (adminAPI{}).handleInspector(httptest.NewRecorder(), httptest.NewRequest("GET", "/substrate/inspector/1/json", nil))
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Errorf("Expected 404 for a process without inspector, got %v", err)
+	}
+}
+
+func TestProcess_InspectArgs(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{inspect: true},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, printing its arguments
+	process := startStubProcess(t, pm, "echo \"$@\"")
+	<-process.exitChan
+
+	if !strings.HasPrefix(process.inspector, "127.0.0.1:") {
+		t.Fatalf("Expected a loopback inspector address, got %q", process.inspector)
+	}
+	if args := process.startupStdout.String(); !strings.Contains(args, "--inspect="+process.inspector+" ") {
+		t.Errorf("Expected deno to get --inspect=%s, got %q", process.inspector, args)
+	}
+}
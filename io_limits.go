@@ -0,0 +1,75 @@
+package substrate
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// IOLimit throttles the disk I/O of processes on one block device with the
+// cgroup v2 io controller. Zero leaves a rate unlimited.
+type IOLimit struct {
+	// Device is a block device path such as /dev/sda, or its MAJ:MIN
+	// numbers. The io controller only throttles whole disks, not
+	// partitions.
+	Device string `json:"device"`
+
+	// ReadBPS and WriteBPS limit bytes per second.
+	ReadBPS  uint64 `json:"read_bps,omitempty"`
+	WriteBPS uint64 `json:"write_bps,omitempty"`
+
+	// ReadIOPS and WriteIOPS limit operations per second.
+	ReadIOPS  uint64 `json:"read_iops,omitempty"`
+	WriteIOPS uint64 `json:"write_iops,omitempty"`
+}
+
+var deviceNumbers = regexp.MustCompile(`^\d+:\d+$`)
+
+func (l *IOLimit) validate() error {
+	if l.Device == "" {
+		return fmt.Errorf("io_limit requires a device")
+	}
+	if l.ReadBPS == 0 && l.WriteBPS == 0 && l.ReadIOPS == 0 && l.WriteIOPS == 0 {
+		return fmt.Errorf("io_limit for %s sets no limit", l.Device)
+	}
+	return nil
+}
+
+// ioMax returns the io.max line for the limit, resolving a device path to its
+// numbers.
+func (l *IOLimit) ioMax() (string, error) {
+	device := l.Device
+	if !deviceNumbers.MatchString(device) {
+		info, err := os.Stat(device)
+		if err != nil {
+			return "", fmt.Errorf("io_limit device: %w", err)
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+			return "", fmt.Errorf("io_limit device %s is not a block device", device)
+		}
+		rdev := uint64(stat.Rdev)
+		device = fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev))
+	}
+
+	fields := []string{device}
+	for _, rate := range []struct {
+		key   string
+		value uint64
+	}{
+		{"rbps", l.ReadBPS},
+		{"wbps", l.WriteBPS},
+		{"riops", l.ReadIOPS},
+		{"wiops", l.WriteIOPS},
+	} {
+		if rate.value > 0 {
+			fields = append(fields, rate.key+"="+strconv.FormatUint(rate.value, 10))
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
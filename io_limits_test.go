@@ -0,0 +1,87 @@
+package substrate
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func TestIOLimit_IOMax(t *testing.T) {
+	limit := IOLimit{Device: "8:0", ReadBPS: 52428800, WriteIOPS: 500}
+	line, err := limit.ioMax()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "8:0 rbps=52428800 wiops=500" {
+		t.Errorf("Unexpected io.max line %q", line)
+	}
+
+	if _, err := (&IOLimit{Device: "/dev/null", ReadBPS: 1}).ioMax(); err == nil {
+		t.Error("Expected an error for a character device")
+	}
+	if _, err := (&IOLimit{Device: t.TempDir(), ReadBPS: 1}).ioMax(); err == nil {
+		t.Error("Expected an error for a directory")
+	}
+}
+
+func TestIOLimit_Validate(t *testing.T) {
+	if err := (&IOLimit{Device: "8:0", WriteBPS: 1}).validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := (&IOLimit{Device: "8:0"}).validate(); err == nil {
+		t.Error("Expected an error for a limit without rates")
+	}
+	if err := (&IOLimit{WriteBPS: 1}).validate(); err == nil {
+		t.Error("Expected an error for a limit without a device")
+	}
+}
+
+func TestProcess_ApplyIOLimits(t *testing.T) {
+	parent := fakeCgroupRoot(t)
+	process := &Process{
+		scriptPath: "/srv/app.js",
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: 4242}},
+		logger:     zap.NewNop(),
+		opts:       processOptions{ioMax: []string{"8:0 rbps=1048576"}},
+	}
+	process.applyLimitsLocked()
+
+	data, err := os.ReadFile(filepath.Join(parent, "substrate-4242", "io.max"))
+	if err != nil || string(data) != "8:0 rbps=1048576" {
+		t.Errorf("Expected io.max written, got %q (%v)", data, err)
+	}
+}
+
+func TestUnmarshalCaddyfile_IOLimit(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		io_limit 8:0 {
+			read_bps 50MiB
+			write_bps 20MB
+			read_iops 1000
+			write_iops 500
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	want := IOLimit{Device: "8:0", ReadBPS: 50 << 20, WriteBPS: 20000000, ReadIOPS: 1000, WriteIOPS: 500}
+	if len(transport.IOLimits) != 1 || transport.IOLimits[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, transport.IOLimits)
+	}
+
+	d = caddyfile.NewTestDispenser(`substrate {
+		io_limit 8:0 {
+			read_mbps 50
+		}
+	}`)
+	if err := (&SubstrateTransport{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for an unknown io_limit option")
+	}
+}
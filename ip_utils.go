@@ -2,6 +2,9 @@ package substrate
 
 import (
 	"net"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
 var privateIPBlocks []*net.IPNet
@@ -56,3 +59,16 @@ func isInternalIP(remoteAddr string) bool {
 
 	return false
 }
+
+// clientIP returns the client address of the request, honoring Caddy's
+// trusted_proxies resolution when available.
+func clientIP(req *http.Request) string {
+	if ip, ok := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,235 @@
+package substrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Job runs a script periodically, next to the scripts serving HTTP. It is
+// started like a process (deno run, the script's directory, its owner's
+// permissions and the app's env and deno_opts) but gets no socket argument
+// and is expected to exit.
+type Job struct {
+	Name   string `json:"name"`
+	Script string `json:"script"`
+
+	// Every is the time between the starts of two runs. A run that is still
+	// going when the next is due makes that run be skipped.
+	Every caddy.Duration `json:"every"`
+
+	// Timeout stops a run that takes longer. Defaults to Every.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Env is added to the app env for this job.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// jobStopGrace is how long a job gets to exit after SIGTERM before it is
+// killed.
+const jobStopGrace = 5 * time.Second
+
+func (j *Job) validate() error {
+	if j.Name == "" {
+		return fmt.Errorf("job needs a name")
+	}
+	if !filepath.IsAbs(j.Script) {
+		return fmt.Errorf("job %s: script must be an absolute path, got %q", j.Name, j.Script)
+	}
+	if j.Every <= 0 {
+		return fmt.Errorf("job %s: every must be positive", j.Name)
+	}
+	if j.Timeout < 0 {
+		return fmt.Errorf("job %s: timeout cannot be negative", j.Name)
+	}
+	return nil
+}
+
+// jobRunner schedules the jobs of the app.
+type jobRunner struct {
+	jobs     []Job
+	env      map[string]string
+	denoOpts string
+	runtime  func() (string, error) // returns the deno binary
+	logger   *zap.Logger
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// start runs every job on its schedule until stop is called.
+func (r *jobRunner) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	for _, job := range r.jobs {
+		r.wg.Add(1)
+		go r.schedule(ctx, job)
+	}
+}
+
+// stop ends the schedules and waits for running jobs, which are stopped.
+func (r *jobRunner) stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *jobRunner) schedule(ctx context.Context, job Job) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(job.Every))
+	defer ticker.Stop()
+
+	var running sync.WaitGroup
+	defer running.Wait()
+	busy := make(chan struct{}, 1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		select {
+		case busy <- struct{}{}:
+		default:
+			r.logger.Warn("skipping job run, previous run still going",
+				zap.String("job", job.Name),
+			)
+			continue
+		}
+
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer func() { <-busy }()
+			r.run(ctx, job)
+		}()
+	}
+}
+
+// run runs job once, logging its output and result.
+func (r *jobRunner) run(ctx context.Context, job Job) {
+	logger := r.logger.With(zap.String("job", job.Name), zap.String("script_path", job.Script))
+
+	denoPath, err := r.runtime()
+	if err != nil {
+		logger.Error("failed to get deno binary", zap.Error(err))
+		return
+	}
+
+	args := append([]string{"run", "--allow-all"}, strings.Fields(r.denoOpts)...)
+	args = append(args, job.Script)
+	cmd := buildCommand(denoPath, args, processOptions{})
+	cmd.Dir = filepath.Dir(job.Script)
+
+	cmd.Env = os.Environ()
+	for key, value := range r.env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	for key, value := range job.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Env = append(cmd.Env, "SUBSTRATE=true", "SUBSTRATE_JOB="+job.Name)
+
+	if err := configureProcessSecurity(cmd, job.Script, processOptions{}); err != nil {
+		logger.Error("failed to configure job security", zap.Error(err))
+		return
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logger.Error("failed to create stdout pipe", zap.Error(err))
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		logger.Error("failed to create stderr pipe", zap.Error(err))
+		return
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		logger.Error("failed to start job", zap.Error(err))
+		return
+	}
+	logger.Info("job started", zap.Int("pid", cmd.Process.Pid))
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go logJobOutput(&output, stdout, "stdout", zapcore.InfoLevel, logger)
+	go logJobOutput(&output, stderr, "stderr", zapcore.ErrorLevel, logger)
+
+	timeout := time.Duration(job.Timeout)
+	if timeout == 0 {
+		timeout = time.Duration(job.Every)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// The pipes must be drained before Wait closes them
+	done := make(chan error, 1)
+	go func() {
+		output.Wait()
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-timer.C:
+		logger.Warn("job timed out, stopping it", zap.Duration("timeout", timeout))
+		err = stopJob(cmd.Process, done)
+	case <-ctx.Done():
+		err = stopJob(cmd.Process, done)
+	}
+
+	if err != nil {
+		logger.Error("job failed",
+			zap.Duration("duration", time.Since(start)),
+			zap.Error(err),
+		)
+		return
+	}
+	logger.Info("job finished", zap.Duration("duration", time.Since(start)))
+}
+
+// stopJob asks a job to exit, killing it after jobStopGrace.
+func stopJob(proc *os.Process, done <-chan error) error {
+	proc.Signal(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(jobStopGrace):
+		proc.Kill()
+		return <-done
+	}
+}
+
+func logJobOutput(wg *sync.WaitGroup, pipe io.Reader, stream string, level zapcore.Level, logger *zap.Logger) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(pipe)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			logger.Log(level, "job output",
+				zap.String("stream", stream),
+				zap.String("output", line),
+			)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package substrate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeRuntime writes a shell script standing in for deno and returns a
+// runtime func for it.
+func fakeRuntime(t *testing.T, body string) func() (string, error) {
+	path := filepath.Join(t.TempDir(), "runtime")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatalf("Failed to write runtime: %v", err)
+	}
+	return func() (string, error) { return path, nil }
+}
+
+func TestJobRunner_RunsOnSchedule(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "cleanup.js")
+	if err := os.WriteFile(script, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	runs := filepath.Join(dir, "runs")
+
+	runner := &jobRunner{
+		jobs:    []Job{{Name: "cleanup", Script: script, Every: caddy.Duration(20 * time.Millisecond), Env: map[string]string{"TARGET": runs}}},
+		env:     map[string]string{"APP_ENV": "test"},
+		runtime: fakeRuntime(t, `echo "$SUBSTRATE_JOB $APP_ENV $(basename "$3") $PWD" >> "$TARGET"`),
+		logger:  zaptest.NewLogger(t),
+	}
+	runner.start()
+	time.Sleep(150 * time.Millisecond)
+	runner.stop()
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatalf("Job never ran: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 {
+		t.Errorf("Expected the job to run repeatedly, got %d runs", len(lines))
+	}
+	if want := "cleanup test cleanup.js " + dir; lines[0] != want {
+		t.Errorf("Expected run %q, got %q", want, lines[0])
+	}
+}
+
+func TestJobRunner_StopsLongRuns(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "slow.js")
+	if err := os.WriteFile(script, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	runner := &jobRunner{
+		jobs:    []Job{{Name: "slow", Script: script, Every: caddy.Duration(10 * time.Millisecond), Timeout: caddy.Duration(time.Hour)}},
+		runtime: fakeRuntime(t, "exec sleep 60"),
+		logger:  zaptest.NewLogger(t),
+	}
+	runner.start()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	runner.stop()
+	if elapsed := time.Since(start); elapsed > jobStopGrace {
+		t.Errorf("Stopping should end running jobs promptly, took %v", elapsed)
+	}
+}
+
+func TestParseGlobalOptions_Jobs(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		job cleanup /srv/jobs/cleanup.js {
+			every 1h
+			timeout 5m
+			env {
+				BATCH 100
+			}
+		}
+	}`)
+
+	val, err := parseGlobalOptions(d, nil)
+	if err != nil {
+		t.Fatalf("parseGlobalOptions failed: %v", err)
+	}
+	var app App
+	if err := json.Unmarshal(val.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatalf("Failed to decode app config: %v", err)
+	}
+	if len(app.Jobs) != 1 {
+		t.Fatalf("Expected one job, got %+v", app.Jobs)
+	}
+	job := app.Jobs[0]
+	if job.Name != "cleanup" || job.Script != "/srv/jobs/cleanup.js" || job.Every != caddy.Duration(time.Hour) ||
+		job.Timeout != caddy.Duration(5*time.Minute) || job.Env["BATCH"] != "100" {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+	if err := app.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	app.Jobs = append(app.Jobs, job)
+	if err := app.Validate(); err == nil {
+		t.Error("Duplicate job names should be rejected")
+	}
+	app.Jobs = []Job{{Name: "relative", Script: "jobs/cleanup.js", Every: caddy.Duration(time.Hour)}}
+	if err := app.Validate(); err == nil {
+		t.Error("Relative job script should be rejected")
+	}
+}
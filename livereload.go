@@ -0,0 +1,160 @@
+package substrate
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// liveReloadParam is the query parameter the live-reload client adds to the
+// page's own URL, so its event stream is routed to the same script.
+const liveReloadParam = "substrate-livereload"
+
+// liveReloadPoll is how often an open event stream checks its script for
+// changes.
+const liveReloadPoll = 500 * time.Millisecond
+
+// liveReloadClient is appended to HTML responses in dev mode. It reloads the
+// page when the stream sends a reload event.
+const liveReloadClient = `<script>(function () {
+  var url = new URL(location.href);
+  url.searchParams.set("` + liveReloadParam + `", "1");
+  var source = new EventSource(url);
+  source.addEventListener("reload", function () {
+    source.close();
+    location.reload();
+  });
+})();</script>
+`
+
+// reloadBroadcast wakes the live-reload streams of a script when its process
+// is replaced after the script changed.
+type reloadBroadcast struct {
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+func newReloadBroadcast() *reloadBroadcast {
+	return &reloadBroadcast{waiters: make(map[string]chan struct{})}
+}
+
+// wait returns a channel closed on the next notify for file.
+func (b *reloadBroadcast) wait(file string) <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch, ok := b.waiters[file]
+	if !ok {
+		ch = make(chan struct{})
+		b.waiters[file] = ch
+	}
+	return ch
+}
+
+// notify wakes everything waiting on file.
+func (b *reloadBroadcast) notify(file string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch, ok := b.waiters[file]; ok {
+		close(ch)
+		delete(b.waiters, file)
+	}
+}
+
+// isLiveReloadRequest reports whether req is the event stream of the
+// live-reload client.
+func isLiveReloadRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet && req.URL.Query().Has(liveReloadParam)
+}
+
+// liveReloadResponse streams a reload event once the process stored under
+// key is replaced because its script file changed. A script without a
+// running process, because it failed to start or runs one process per
+// request, reloads as soon as its modification time changes.
+func (t *SubstrateTransport) liveReloadResponse(req *http.Request, key, file string) *http.Response {
+	pm := t.manager
+	reloaded := pm.reloads.wait(key)
+	var modTime time.Time
+	if info, err := os.Stat(file); err == nil {
+		modTime = info.ModTime()
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer writer.Close()
+		// Reconnect quickly while Caddy reloads or the script restarts
+		if _, err := io.WriteString(writer, "retry: 1000\n\n"); err != nil {
+			return
+		}
+
+		ticker := time.NewTicker(liveReloadPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-pm.ctx.Done():
+				return
+			case <-reloaded:
+				io.WriteString(writer, "event: reload\ndata: \n\n")
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			process := pm.processes.get(key)
+			if process == nil {
+				if !info.ModTime().Equal(modTime) {
+					io.WriteString(writer, "event: reload\ndata: \n\n")
+					return
+				}
+				continue
+			}
+			// The replacement notifies once it is serving
+			if pm.opts.reloadOnChange && process.scriptChanged(info.ModTime()) {
+				pm.recycle(key, process, "script changed")
+			}
+		}
+	}()
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Body:          reader,
+		ContentLength: -1,
+		Header: http.Header{
+			"Content-Type":  []string{"text/event-stream"},
+			"Cache-Control": []string{"no-store"},
+		},
+		Request: req,
+	}
+}
+
+// injectLiveReload appends the live-reload client to an uncompressed HTML
+// response. Browsers run a script after the closing html tag, so the body is
+// streamed through unchanged.
+func injectLiveReload(req *http.Request, resp *http.Response) {
+	if req.Method == http.MethodHead || resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" {
+		return
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(resp.Body, strings.NewReader(liveReloadClient)), resp.Body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+}
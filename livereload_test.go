@@ -0,0 +1,110 @@
+package substrate
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestInjectLiveReload(t *testing.T) {
+	newResponse := func(contentType, encoding string) *http.Response {
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{contentType}, "Content-Length": []string{"23"}},
+			Body:          io.NopCloser(strings.NewReader("<html><p>hi</p></html>\n")),
+			ContentLength: 23,
+		}
+		if encoding != "" {
+			resp.Header.Set("Content-Encoding", encoding)
+		}
+		return resp
+	}
+	req := httptest.NewRequest("GET", "/app.js", nil)
+
+	resp := newResponse("text/html; charset=utf-8", "")
+	injectLiveReload(req, resp)
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(string(body), "<html><p>hi</p></html>\n") || !strings.Contains(string(body), liveReloadParam) {
+		t.Errorf("Expected the client appended to the page, got %q", body)
+	}
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Error("Injected responses should have an unknown length")
+	}
+
+	for _, resp := range []*http.Response{newResponse("application/json", ""), newResponse("text/html", "gzip")} {
+		injectLiveReload(req, resp)
+		body, _ := io.ReadAll(resp.Body)
+		if strings.Contains(string(body), liveReloadParam) || resp.ContentLength != 23 {
+			t.Errorf("Expected %q %q untouched, got %q", resp.Header.Get("Content-Type"), resp.Header.Get("Content-Encoding"), body)
+		}
+	}
+}
+
+// readEvent returns the next event name on an event stream.
+func readEvent(t *testing.T, body io.Reader) string {
+	t.Helper()
+	events := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				events <- name
+				return
+			}
+		}
+		close(events)
+	}()
+	select {
+	case name := <-events:
+		return name
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return ""
+	}
+}
+
+func TestRoundTrip_LiveReload(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{Dev: true}, zaptest.NewLogger(t))
+	streamReq := req.Clone(req.Context())
+	streamReq.URL.RawQuery = liveReloadParam + "=1"
+
+	resp, err := transport.RoundTrip(streamReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	var file string
+	for key := range transport.manager.processes.snapshot() {
+		file = key
+	}
+	transport.manager.reloads.notify(file)
+	if name := readEvent(t, resp.Body); name != "reload" {
+		t.Errorf("Expected a reload event, got %q", name)
+	}
+
+	// Without a running process, a change to the script reloads
+	transport.manager.processes.remove(file, transport.manager.processes.get(file))
+	resp, err = transport.RoundTrip(streamReq.Clone(streamReq.Context()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if name := readEvent(t, resp.Body); name != "reload" {
+		t.Errorf("Expected a reload event after the script changed, got %q", name)
+	}
+}
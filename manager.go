@@ -0,0 +1,180 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// ManagerOptions configures a ProcessManager created with NewManager. The
+// options are those of the transport with the same names; zero values take
+// the transport's defaults, except IdleTimeout.
+type ManagerOptions struct {
+	// IdleTimeout stops a process without requests for this long. Zero
+	// keeps processes until the manager stops; a negative value stops each
+	// once its last request is released.
+	IdleTimeout time.Duration
+
+	// StartupTimeout is how long a process has to listen on its socket.
+	// Default 3s.
+	StartupTimeout time.Duration
+
+	// Env is added to the environment of every process.
+	Env map[string]string
+
+	// DenoOpts are extra options passed to deno run.
+	DenoOpts string
+
+	// CacheDir is where deno is downloaded, ~/.cache/substrate by default.
+	CacheDir string
+
+	// SocketDir is where process sockets are created, os.TempDir() by
+	// default.
+	SocketDir string
+
+	// ReadyPath is requested from a starting process until it answers below
+	// 500; empty to only wait for its socket.
+	ReadyPath string
+
+	// Readiness chooses another readiness checker than ReadyPath's.
+	Readiness *ReadinessConfig
+
+	// ReloadOnChange replaces a process once its script is modified.
+	ReloadOnChange bool
+
+	// MaxStartsPerMinute bounds how many processes start each minute; 0 for
+	// no limit.
+	MaxStartsPerMinute int
+
+	// ColdStartQueueTimeout is how long Acquire waits for a process another
+	// caller is starting; 0 for its whole startup.
+	ColdStartQueueTimeout time.Duration
+
+	// StopTimeout is how long Stop waits for every process to exit. Default
+	// 10s.
+	StopTimeout time.Duration
+
+	// Logger receives the manager's logs; nil to discard them.
+	Logger *zap.Logger
+}
+
+// errManagerStopped is returned by Acquire once the manager is stopped.
+var errManagerStopped = errors.New("process manager stopped")
+
+// NewManager creates a ProcessManager for programs that supervise scripts
+// without the HTTP transport: they Acquire the process of a script, send
+// their requests to its socket, and Release it.
+func NewManager(opts ManagerOptions) (*ProcessManager, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	idleTimeout := caddy.Duration(opts.IdleTimeout)
+	if idleTimeout < 0 {
+		idleTimeout = -1
+	}
+	startupTimeout := caddy.Duration(opts.StartupTimeout)
+	if startupTimeout == 0 {
+		startupTimeout = caddy.Duration(3 * time.Second)
+	}
+
+	// Reuse the transport's option handling so processes are set up the same
+	t := &SubstrateTransport{
+		IdleTimeout:           idleTimeout,
+		StartupTimeout:        startupTimeout,
+		Env:                   opts.Env,
+		DenoOpts:              opts.DenoOpts,
+		CacheDir:              opts.CacheDir,
+		SocketDir:             opts.SocketDir,
+		ReadyPath:             opts.ReadyPath,
+		Readiness:             opts.Readiness,
+		ReloadOnChange:        opts.ReloadOnChange,
+		MaxStartsPerMinute:    opts.MaxStartsPerMinute,
+		ColdStartQueueTimeout: caddy.Duration(opts.ColdStartQueueTimeout),
+		StopTimeout:           caddy.Duration(opts.StopTimeout),
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	processOpts, err := t.processOptions()
+	if err != nil {
+		return nil, err
+	}
+	return newProcessManager(t.IdleTimeout, t.StartupTimeout, t.Env, t.DenoOpts, NewDenoManager(t.CacheDir, logger), logger, processOpts)
+}
+
+// Acquire returns the process running script, starting it if needed, and
+// counts a request on it until Release. It gives up when ctx is done before
+// the process is ready; a process started meanwhile is left to its idle
+// timeout.
+func (pm *ProcessManager) Acquire(ctx context.Context, script string) (*Process, error) {
+	if pm.ctx.Err() != nil {
+		return nil, errManagerStopped
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	script, err := filepath.Abs(script)
+	if err != nil {
+		return nil, err
+	}
+
+	type acquired struct {
+		process *Process
+		err     error
+	}
+	result := make(chan acquired, 1)
+	go func() {
+		process, _, err := pm.acquireHost(script, script, "", nil)
+		result <- acquired{process, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.process, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-result; r.err == nil {
+				pm.Release(r.process)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Release ends a request counted by Acquire. With a negative IdleTimeout, a
+// process left without requests is stopped before Release returns.
+func (pm *ProcessManager) Release(process *Process) {
+	pm.releaseProcess(process.key, process, pm.settings().idleTimeout == -1)
+}
+
+// Processes describes the running processes, by script path.
+func (pm *ProcessManager) Processes() []ProcessInfo {
+	infos := []ProcessInfo{}
+	for _, process := range pm.processes.snapshot() {
+		infos = append(infos, process.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Script < infos[j].Script })
+	return infos
+}
+
+// Shutdown stops the manager as Stop does, returning ctx's error if it is
+// done first; the processes are still stopped then, in the background.
+func (pm *ProcessManager) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		pm.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,117 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+// newStubManager returns a manager created with NewManager whose process for
+// a script is a stub, and the stub, which is ready once ready is closed.
+func newStubManager(t *testing.T, opts ManagerOptions, ready chan struct{}) (*ProcessManager, *Process) {
+	t.Helper()
+	pm, err := NewManager(opts)
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	t.Cleanup(func() { pm.Stop() })
+
+	scriptPath := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	process := &Process{
+		scriptPath: scriptPath,
+		SocketPath: "/tmp/stub.sock",
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: os.Getpid()}},
+		key:        scriptPath,
+		logger:     zaptest.NewLogger(t),
+		ready:      ready,
+	}
+	pm.processes.store(scriptPath, process)
+	// The stub must not be signalled when the manager stops
+	t.Cleanup(func() { pm.processes.remove(scriptPath, process) })
+	return pm, process
+}
+
+func TestNewManager(t *testing.T) {
+	pm, err := NewManager(ManagerOptions{IdleTimeout: -time.Second, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	defer pm.Stop()
+	if got := pm.settings().idleTimeout; got != -1 {
+		t.Errorf("Expected a negative idle timeout to mean one-shot, got %v", got)
+	}
+	if got := pm.settings().startupTimeout; got != caddy.Duration(3*time.Second) {
+		t.Errorf("Expected the default startup timeout, got %v", got)
+	}
+
+	if _, err := NewManager(ManagerOptions{StartupTimeout: -time.Second}); err == nil {
+		t.Error("Expected an error for a negative startup timeout")
+	}
+}
+
+func TestProcessManager_AcquireRelease(t *testing.T) {
+	ready := make(chan struct{})
+	close(ready)
+	pm, stub := newStubManager(t, ManagerOptions{CacheDir: t.TempDir()}, ready)
+
+	process, err := pm.Acquire(context.Background(), stub.ScriptPath())
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if process != stub {
+		t.Fatal("Expected the running process")
+	}
+	infos := pm.Processes()
+	if len(infos) != 1 || infos[0].Script != stub.ScriptPath() || infos[0].ActiveRequests != 1 {
+		t.Errorf("Expected the request counted, got %+v", infos)
+	}
+
+	pm.Release(process)
+	if got := process.Info().ActiveRequests; got != 0 {
+		t.Errorf("Expected the request released, got %d", got)
+	}
+}
+
+func TestProcessManager_AcquireCanceled(t *testing.T) {
+	ready := make(chan struct{})
+	pm, stub := newStubManager(t, ManagerOptions{CacheDir: t.TempDir()}, ready)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pm.Acquire(ctx, stub.ScriptPath()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the wait to end with the context, got %v", err)
+	}
+
+	// The request taken meanwhile is released once the process is ready
+	close(ready)
+	deadline := time.Now().Add(5 * time.Second)
+	for stub.inFlight() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the abandoned request released, %d in flight", stub.inFlight())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProcessManager_Shutdown(t *testing.T) {
+	pm, err := NewManager(ManagerOptions{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	if err := pm.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if _, err := pm.Acquire(context.Background(), "/srv/app.js"); err != errManagerStopped {
+		t.Errorf("Expected a stopped manager to refuse, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package substrate
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+func validateMethods(scripts map[string]string) error {
+	for method, script := range scripts {
+		if method != strings.ToUpper(method) || !httpguts.ValidHeaderFieldName(method) {
+			return fmt.Errorf("methods: %q is not an uppercase HTTP method", method)
+		}
+		if script == "" {
+			return fmt.Errorf("methods: %s has no script", method)
+		}
+	}
+	return nil
+}
+
+// methodScript returns the script for the method of req, relative to the
+// directory of script, or to script itself when the request targets a
+// directory, unless absolute. HEAD requests use the GET script unless HEAD
+// is listed; other methods without a script get script itself.
+func methodScript(req *http.Request, script string, scripts map[string]string) string {
+	alternate, ok := scripts[req.Method]
+	if !ok && req.Method == http.MethodHead {
+		alternate, ok = scripts[http.MethodGet]
+	}
+	if !ok {
+		return script
+	}
+	if info, err := os.Stat(script); err == nil && info.IsDir() && !filepath.IsAbs(alternate) {
+		return filepath.Join(script, alternate)
+	}
+	return siblingScript(script, alternate)
+}
@@ -0,0 +1,74 @@
+package substrate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestMethodScript(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "items.js")
+	scripts := map[string]string{
+		"GET":    "read.js",
+		"POST":   "write.js",
+		"DELETE": "/srv/admin/delete.js",
+	}
+
+	tests := []struct {
+		method string
+		script string
+		want   string
+	}{
+		{"GET", script, filepath.Join(dir, "read.js")},
+		{"HEAD", script, filepath.Join(dir, "read.js")},
+		{"POST", script, filepath.Join(dir, "write.js")},
+		{"DELETE", script, "/srv/admin/delete.js"},
+		{"PUT", script, script},
+		{"POST", dir, filepath.Join(dir, "write.js")},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/items", nil)
+		if got := methodScript(req, tt.script, scripts); got != tt.want {
+			t.Errorf("%s %s: got %s, want %s", tt.method, tt.script, got, tt.want)
+		}
+	}
+
+	scripts["HEAD"] = "head.js"
+	req := httptest.NewRequest(http.MethodHead, "/items", nil)
+	if got := methodScript(req, script, scripts); got != filepath.Join(dir, "head.js") {
+		t.Errorf("Expected a listed HEAD script to be used, got %s", got)
+	}
+}
+
+func TestValidateMethods(t *testing.T) {
+	if err := validateMethods(map[string]string{"GET": "read.js", "PROPFIND": "dav.js"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, scripts := range []map[string]string{{"get": "read.js"}, {"GET POST": "read.js"}, {"GET": ""}} {
+		if err := validateMethods(scripts); err == nil {
+			t.Errorf("Expected an error for %v", scripts)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfile_Methods(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		methods {
+			get  read.js
+			POST write.js
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.Methods) != 2 || transport.Methods["GET"] != "read.js" || transport.Methods["POST"] != "write.js" {
+		t.Errorf("Unexpected methods %v", transport.Methods)
+	}
+}
@@ -0,0 +1,245 @@
+package substrate
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MicroCache keeps recent responses of scripts in memory, so identical GET
+// and HEAD requests for hot endpoints don't reach (or, in one-shot mode,
+// spawn) a process. Responses are cached for the time their Cache-Control
+// header allows.
+type MicroCache struct {
+	// MaxEntries bounds the number of cached responses; the least recently
+	// used ones are evicted first. Default 1000.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// MaxBodySize is the largest response body cached, in bytes. Default 1MB.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+}
+
+const (
+	defaultMicroCacheEntries  = 1000
+	defaultMicroCacheBodySize = 1 << 20
+)
+
+func (c *MicroCache) validate() error {
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("micro_cache max_entries cannot be negative")
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("micro_cache max_body_size cannot be negative")
+	}
+	return nil
+}
+
+// responseCache is the LRU store behind MicroCache.
+type responseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBody    int64
+	entries    map[string]*list.Element
+	order      *list.List // most recently used first
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	trailer http.Header
+	stored  time.Time
+	expires time.Time
+}
+
+func newResponseCache(config *MicroCache) *responseCache {
+	c := &responseCache{
+		maxEntries: config.MaxEntries,
+		maxBody:    config.MaxBodySize,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+	if c.maxEntries == 0 {
+		c.maxEntries = defaultMicroCacheEntries
+	}
+	if c.maxBody == 0 {
+		c.maxBody = defaultMicroCacheBodySize
+	}
+	return c
+}
+
+// cacheKey returns the key for req to script, or "" when the request must
+// not be answered from the cache.
+func cacheKey(req *http.Request, script string) string {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return ""
+	}
+	// A protocol upgrade, such as a WebSocket handshake, needs the process
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Upgrade") != "" {
+		return ""
+	}
+	if directives := cacheControl(req.Header); directives["no-cache"] != "" || directives["no-store"] != "" {
+		return ""
+	}
+	return req.Method + " " + script + " " + req.URL.RequestURI()
+}
+
+// get returns the fresh entry for key, or nil.
+func (c *responseCache) get(key string, now time.Time) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cachedResponse)
+	if !now.Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry
+}
+
+// put stores entry, evicting the least recently used entries over the limit.
+func (c *responseCache) put(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// store caches resp under key if its headers allow it, and returns the
+// response to send on, whose body may have been buffered.
+func (c *responseCache) store(key string, resp *http.Response, now time.Time) *http.Response {
+	ttl := responseTTL(resp)
+	if ttl <= 0 {
+		return resp
+	}
+	body, ok := bufferBody(resp, c.maxBody)
+	if !ok {
+		return resp
+	}
+
+	c.put(&cachedResponse{
+		key:     key,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		trailer: resp.Trailer.Clone(),
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+
+	resp.Header.Set("X-Substrate-Cache", "MISS")
+	return resp
+}
+
+// bufferBody reads the body of resp into memory if it is at most limit
+// bytes, replacing resp.Body with the buffered copy; its trailers are then in
+// resp.Trailer. Otherwise, or if reading fails, resp is left to be passed on
+// as it came and ok is false.
+func bufferBody(resp *http.Response, limit int64) (body []byte, ok bool) {
+	if resp.ContentLength > limit {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil, false
+	}
+	resp.Body.Close()
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return body, true
+}
+
+// response builds the reply to req from the entry.
+func (e *cachedResponse) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.stored)/time.Second)))
+	header.Set("X-Substrate-Cache", "HIT")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Trailer:       e.trailer.Clone(),
+		Request:       req,
+	}
+}
+
+// responseTTL is how long resp may be cached: its s-maxage or max-age, or 0
+// when it must not be shared between clients.
+func responseTTL(resp *http.Response) time.Duration {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return 0
+	}
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") != "" {
+		return 0
+	}
+
+	directives := cacheControl(resp.Header)
+	if directives["private"] != "" || directives["no-store"] != "" || directives["no-cache"] != "" {
+		return 0
+	}
+	age := directives["s-maxage"]
+	if age == "" {
+		age = directives["max-age"]
+	}
+	seconds, err := strconv.Atoi(age)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cacheControl parses the Cache-Control header into its directives. A
+// directive without a value maps to its own name, so every present
+// directive is non-empty.
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if !found {
+				value = name
+			}
+			directives[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return directives
+}
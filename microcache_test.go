@@ -0,0 +1,158 @@
+package substrate
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestResponseTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		want   time.Duration
+	}{
+		{"max-age", 200, http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute},
+		{"s-maxage wins", 200, http.Header{"Cache-Control": {"max-age=60, s-maxage=5"}}, 5 * time.Second},
+		{"no header", 200, http.Header{}, 0},
+		{"private", 200, http.Header{"Cache-Control": {"private, max-age=60"}}, 0},
+		{"no-store", 200, http.Header{"Cache-Control": {"no-store"}}, 0},
+		{"set-cookie", 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, 0},
+		{"vary", 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}, 0},
+		{"not found", 404, http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		{"server error", 500, http.Header{"Cache-Control": {"max-age=60"}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := responseTTL(&http.Response{StatusCode: tt.status, Header: tt.header}); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/a?b=1", nil)
+	if got := cacheKey(req, "/srv/app.js"); got != "GET /srv/app.js /a?b=1" {
+		t.Errorf("Unexpected key %q", got)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/a", nil),
+		func() *http.Request {
+			r := httptest.NewRequest("GET", "/a", nil)
+			r.Header.Set("Authorization", "Bearer x")
+			return r
+		}(),
+		func() *http.Request {
+			r := httptest.NewRequest("GET", "/a", nil)
+			r.Header.Set("Cache-Control", "no-cache")
+			return r
+		}(),
+	} {
+		if got := cacheKey(req, "/srv/app.js"); got != "" {
+			t.Errorf("Expected %s %v to bypass the cache, got key %q", req.Method, req.Header, got)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	cache := newResponseCache(&MicroCache{MaxEntries: 2, MaxBodySize: 8})
+	now := time.Now()
+
+	response := func(body string) *http.Response {
+		return &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Cache-Control": {"max-age=10"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: -1,
+		}
+	}
+
+	resp := cache.store("a", response("alpha"), now)
+	if body, _ := io.ReadAll(resp.Body); string(body) != "alpha" || resp.Header.Get("X-Substrate-Cache") != "MISS" {
+		t.Errorf("Expected the stored response to be passed on, got %q %v", body, resp.Header)
+	}
+
+	// Bodies over the limit are passed through whole but not cached
+	resp = cache.store("big", response("0123456789"), now)
+	if body, _ := io.ReadAll(resp.Body); string(body) != "0123456789" {
+		t.Errorf("Expected a large body to be passed through, got %q", body)
+	}
+	if cache.get("big", now) != nil {
+		t.Error("A body over max_body_size should not be cached")
+	}
+
+	entry := cache.get("a", now.Add(3*time.Second))
+	if entry == nil {
+		t.Fatal("Expected a fresh entry")
+	}
+	hit := entry.response(httptest.NewRequest("GET", "/", nil), now.Add(3*time.Second))
+	if body, _ := io.ReadAll(hit.Body); string(body) != "alpha" || hit.Header.Get("Age") != "3" || hit.Header.Get("X-Substrate-Cache") != "HIT" {
+		t.Errorf("Unexpected cached response %q %v", body, hit.Header)
+	}
+	if cache.get("a", now.Add(10*time.Second)) != nil {
+		t.Error("An expired entry should not be returned")
+	}
+
+	// The least recently used entry is evicted
+	cache.store("a", response("a"), now)
+	cache.store("b", response("b"), now)
+	cache.get("a", now)
+	cache.store("c", response("c"), now)
+	if cache.get("b", now) != nil || cache.get("a", now) == nil || cache.get("c", now) == nil {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+}
+
+func TestRoundTrip_MicroCache(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{MicroCache: &MicroCache{}}, zaptest.NewLogger(t))
+
+	roundTrip := func(query string) string {
+		r := req.Clone(req.Context())
+		r.URL.RawQuery = query
+		resp, err := transport.RoundTrip(r)
+		if err != nil {
+			t.Fatalf("RoundTrip failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "OK" {
+			t.Errorf("Unexpected body %q", body)
+		}
+		return resp.Header.Get("X-Substrate-Cache")
+	}
+
+	if got := roundTrip("max_age=60"); got != "MISS" {
+		t.Errorf("Expected the first request to miss, got %q", got)
+	}
+	if got := roundTrip("max_age=60"); got != "HIT" {
+		t.Errorf("Expected the second request to hit, got %q", got)
+	}
+	if got := roundTrip(""); got != "" {
+		t.Errorf("Expected a response without max-age to bypass the cache, got %q", got)
+	}
+}
+
+func TestUnmarshalCaddyfile_MicroCache(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		micro_cache 500 {
+			max_body_size 64KB
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if want := (MicroCache{MaxEntries: 500, MaxBodySize: 64000}); transport.MicroCache == nil || *transport.MicroCache != want {
+		t.Errorf("Expected %+v, got %+v", want, transport.MicroCache)
+	}
+}
@@ -0,0 +1,214 @@
+package substrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Mirror sends a copy of a share of the requests for a script to an
+// alternate script, discarding its responses, so a new implementation can
+// be tried with production traffic without clients noticing.
+type Mirror struct {
+	// Script is the alternate script, relative to the matched script's
+	// directory unless absolute.
+	Script string `json:"script"`
+
+	// Percent of requests copied to Script, from 0 to 100.
+	Percent int `json:"percent"`
+}
+
+const (
+	// mirrorMaxBody is the largest request body copied; requests with
+	// larger bodies are not mirrored.
+	mirrorMaxBody = 1 << 20
+
+	// mirrorTimeout bounds a mirrored request, including a cold start of
+	// the mirror script.
+	mirrorTimeout = 30 * time.Second
+
+	// mirrorMaxInFlight bounds the mirrored requests in progress, so a slow
+	// mirror script never piles up requests; those over it are not sent.
+	mirrorMaxInFlight = 64
+
+	// mirrorClient is the client mirror processes are started for, so
+	// mirrored requests count against max_client_starts_per_minute apart from
+	// the clients whose requests they copy.
+	mirrorClient = "mirror"
+)
+
+func (m *Mirror) validate() error {
+	if m.Script == "" {
+		return fmt.Errorf("mirror requires a script")
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("mirror percent must be between 0 and 100, got %d", m.Percent)
+	}
+	return nil
+}
+
+// sample reports whether a request is mirrored.
+func (m *Mirror) sample() bool {
+	return rand.IntN(100) < m.Percent
+}
+
+// teeBody copies a request body for its mirror as the request reads it, so
+// the request is never held up by the mirror.
+type teeBody struct {
+	io.ReadCloser
+
+	mu       sync.Mutex
+	copied   bytes.Buffer
+	tooLarge bool
+	complete bool
+	finished bool
+	done     chan struct{} // closed once the body is read to its end or closed
+}
+
+func newTeeBody(body io.ReadCloser) *teeBody {
+	return &teeBody{ReadCloser: body, done: make(chan struct{})}
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.finished {
+		return n, err
+	}
+	if b.copied.Len()+n > mirrorMaxBody {
+		b.tooLarge = true
+		b.copied = bytes.Buffer{}
+	} else if !b.tooLarge {
+		b.copied.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.complete = true
+		b.finishLocked()
+	}
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	b.mu.Lock()
+	b.finishLocked()
+	b.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+func (b *teeBody) finishLocked() {
+	if !b.finished {
+		b.finished = true
+		close(b.done)
+	}
+}
+
+// body returns the copy of the body once the request is done with it. It
+// reports false when the body was too large to copy, or not read in full.
+func (b *teeBody) body() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tooLarge || !b.complete {
+		return nil, false
+	}
+	return b.copied.Bytes(), true
+}
+
+// mirror sends a copy of req to script in the background, starting a
+// process for it under key if needed. A request body is copied as req is
+// sent, and the copy is sent once req's body has been read in full.
+func (t *SubstrateTransport) mirror(req *http.Request, key, script string, startEnv map[string]string) {
+	if req.ContentLength > mirrorMaxBody {
+		t.logger.Debug("request body too large to mirror",
+			zap.String("mirror", script),
+		)
+		return
+	}
+	select {
+	case t.mirrors <- struct{}{}:
+	default:
+		t.logger.Debug("too many mirrored requests in progress, not mirroring",
+			zap.String("mirror", script),
+		)
+		return
+	}
+
+	var tee *teeBody
+	if req.Body != nil && req.Body != http.NoBody {
+		tee = newTeeBody(req.Body)
+		req.Body = tee
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	mirrored, err := http.NewRequestWithContext(ctx, req.Method, "http://substrate.localhost"+req.URL.RequestURI(), nil)
+	if err != nil {
+		cancel()
+		<-t.mirrors
+		return
+	}
+	mirrored.Header = req.Header.Clone()
+	mirrored.Header.Set("X-Substrate-Mirror", "1")
+	mirrored.Host = req.Host
+
+	go func() {
+		defer func() { <-t.mirrors }()
+		defer cancel()
+
+		if tee != nil {
+			select {
+			case <-tee.done:
+			case <-ctx.Done():
+				return
+			}
+			body, ok := tee.body()
+			if !ok {
+				t.logger.Debug("request body too large or not read in full, not mirroring",
+					zap.String("mirror", script),
+				)
+				return
+			}
+			mirrored.Body = io.NopCloser(bytes.NewReader(body))
+			mirrored.ContentLength = int64(len(body))
+		}
+
+		start := time.Now()
+		process, _, err := t.manager.getOrCreateHostFor(key, script, mirrorClient, startEnv)
+		if err != nil {
+			t.logger.Warn("failed to start mirror process",
+				zap.String("mirror", script),
+				zap.Error(err),
+			)
+			return
+		}
+		httpClient := socketClient(process.SocketPath, 0)
+		defer httpClient.CloseIdleConnections()
+		resp, err := httpClient.Do(mirrored)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		t.manager.releaseProcess(key, process, t.IdleTimeout == -1)
+		if err != nil {
+			t.logger.Warn("mirrored request failed",
+				zap.String("mirror", script),
+				zap.Duration("duration", time.Since(start)),
+				zap.Error(err),
+			)
+			return
+		}
+		if c := t.checkRequest(t.requestLevel, "mirrored request completed"); c != nil {
+			c.Write(
+				zap.String("mirror", script),
+				zap.Int("status_code", resp.StatusCode),
+				zap.Duration("duration", time.Since(start)),
+			)
+		}
+	}()
+}
@@ -0,0 +1,180 @@
+package substrate
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestTeeBody(t *testing.T) {
+	tee := newTeeBody(io.NopCloser(strings.NewReader("payload")))
+	select {
+	case <-tee.done:
+		t.Fatal("Expected the copy to wait for the request to read its body")
+	default:
+	}
+	if rest, _ := io.ReadAll(tee); string(rest) != "payload" {
+		t.Errorf("Expected the body passed on to the request, got %q", rest)
+	}
+	<-tee.done
+	if body, ok := tee.body(); !ok || string(body) != "payload" {
+		t.Errorf("Expected a copy of the body, got %q, %v", body, ok)
+	}
+
+	large := strings.Repeat("x", mirrorMaxBody+1)
+	tee = newTeeBody(io.NopCloser(strings.NewReader(large)))
+	if rest, _ := io.ReadAll(tee); string(rest) != large {
+		t.Errorf("Expected the whole body passed on, got %d bytes", len(rest))
+	}
+	if _, ok := tee.body(); ok {
+		t.Error("Expected a body over the limit not to be mirrored")
+	}
+
+	// Closed by a request that did not need all of it
+	tee = newTeeBody(io.NopCloser(strings.NewReader("payload")))
+	tee.Read(make([]byte, 3))
+	tee.Close()
+	<-tee.done
+	if _, ok := tee.body(); ok {
+		t.Error("Expected a body not read in full not to be mirrored")
+	}
+}
+
+func TestTransport_MirrorStartLimit(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(time.Minute),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{maxClientStartsPerMinute: 1},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	mirrorScript := filepath.Join(t.TempDir(), "next.js")
+	if err := os.WriteFile(mirrorScript, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	// Mirror starts have used up their own budget
+	if err := pm.limiter().allow(mirrorClient); err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &SubstrateTransport{manager: pm, logger: logger, mirrors: make(chan struct{}, mirrorMaxInFlight)}
+	req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+	transport.mirror(req, mirrorScript, mirrorScript, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(transport.mirrors) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The mirrored request never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := pm.limiter().allow(clientIP(req)); err != nil {
+		t.Errorf("Expected the client's own start budget untouched by the mirror, got %v", err)
+	}
+}
+
+func TestMirror_Sample(t *testing.T) {
+	for _, percent := range []int{0, 100} {
+		m := &Mirror{Script: "next.js", Percent: percent}
+		for i := 0; i < 100; i++ {
+			if m.sample() != (percent == 100) {
+				t.Fatalf("Percent %d: unexpected sample", percent)
+			}
+		}
+	}
+}
+
+func TestUnmarshalCaddyfile_Mirror(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		mirror server.next.js 5%
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Mirror{Script: "server.next.js", Percent: 5}); transport.Mirror == nil || *transport.Mirror != want {
+		t.Fatalf("Expected %+v, got %+v", want, transport.Mirror)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	transport.Mirror.Percent = 101
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for a percent over 100")
+	}
+	transport.Mirror = &Mirror{Percent: 5}
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error without a script")
+	}
+}
+
+func TestTransport_Mirror(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(time.Minute),
+		caddy.Duration(10*time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	dir := t.TempDir()
+	received := filepath.Join(dir, "received.txt")
+	mirrorScript := filepath.Join(dir, "next.js")
+	script := `Deno.serve({ path: Deno.args[0] }, async (req) => {
+  const body = await req.text();
+  await Deno.writeTextFile(` + "`" + received + "`" + `, req.headers.get("X-Substrate-Mirror") + " " + body);
+  return new Response("ignored", { status: 500 });
+});
+`
+	if err := os.WriteFile(mirrorScript, []byte(script), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	transport := &SubstrateTransport{manager: pm, logger: logger, mirrors: make(chan struct{}, mirrorMaxInFlight)}
+	req := httptest.NewRequest(http.MethodPost, "/app.js", strings.NewReader("order=1"))
+	transport.mirror(req, mirrorScript, mirrorScript, nil)
+	if rest, _ := io.ReadAll(req.Body); string(rest) != "order=1" {
+		t.Errorf("Expected the body left for the request, got %q", rest)
+	}
+
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		if data, err := os.ReadFile(received); err == nil && len(data) > 0 {
+			if string(data) != "1 order=1" {
+				t.Errorf("Expected the mirrored request, got %q", data)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("The mirror script never got the request")
+}
@@ -0,0 +1,88 @@
+package substrate
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func validateNegotiate(formats map[string]string) error {
+	for mediaType, format := range formats {
+		if parsed, _, err := mime.ParseMediaType(mediaType); err != nil || parsed != mediaType || strings.Contains(mediaType, "*") {
+			return fmt.Errorf("negotiate: %q is not a lowercase media type without parameters", mediaType)
+		}
+		if format == "" || strings.ContainsAny(format, `/\.`) {
+			return fmt.Errorf("negotiate: format %q for %s must be a file name part without dots or slashes", format, mediaType)
+		}
+	}
+	return nil
+}
+
+// negotiateScript returns the sibling of script for the representation req
+// accepts best, e.g. report.json.js for report.js and a request accepting
+// application/json when formats maps it to json. The script itself serves
+// requests without a listed type, and types without a sibling file.
+func negotiateScript(req *http.Request, script string, formats map[string]string) string {
+	ext := filepath.Ext(script)
+	base := strings.TrimSuffix(script, ext)
+
+	best := -1.0
+	chosen := script
+	for _, accepted := range acceptedTypes(req.Header.Values("Accept")) {
+		format, ok := formats[accepted.mediaType]
+		if !ok || accepted.q <= best {
+			continue
+		}
+		sibling := base + "." + format + ext
+		if info, err := os.Stat(sibling); err == nil && info.Mode().IsRegular() {
+			best, chosen = accepted.q, sibling
+		}
+	}
+	return chosen
+}
+
+type acceptedType struct {
+	mediaType string
+	q         float64
+}
+
+// acceptedTypes parses Accept header values in order, leaving out the types
+// refused with q=0.
+func acceptedTypes(values []string) []acceptedType {
+	var types []acceptedType
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if raw, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(raw, 64); err != nil {
+					continue
+				}
+			}
+			if q > 0 {
+				types = append(types, acceptedType{mediaType, q})
+			}
+		}
+	}
+	return types
+}
+
+// addVary adds name to the Vary header unless it is listed already.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
@@ -0,0 +1,111 @@
+package substrate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestNegotiateScript(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "report.js")
+	for _, name := range []string{"report.js", "report.json.js", "report.html.js"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("// stub"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	formats := map[string]string{
+		"application/json": "json",
+		"text/html":        "html",
+		"text/csv":         "csv",
+	}
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "report.js"},
+		{"application/json", "report.json.js"},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "report.html.js"},
+		{"text/html;q=0.5, application/json", "report.json.js"},
+		{"application/json, text/html", "report.json.js"},
+		{"application/json;q=0, text/html;q=0.1", "report.html.js"},
+		{"text/csv", "report.js"},
+		{"*/*", "report.js"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/report.js", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		if got := negotiateScript(req, script, formats); got != filepath.Join(dir, tt.want) {
+			t.Errorf("Accept %q: got %s, want %s", tt.accept, filepath.Base(got), tt.want)
+		}
+	}
+}
+
+func TestValidateNegotiate(t *testing.T) {
+	if err := validateNegotiate(map[string]string{"application/json": "json"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	invalid := []map[string]string{
+		{"application/*": "json"},
+		{"Application/JSON": "json"},
+		{"application/json; charset=utf-8": "json"},
+		{"application/json": "../json"},
+		{"application/json": "x.json"},
+		{"application/json": ""},
+	}
+	for _, formats := range invalid {
+		if err := validateNegotiate(formats); err == nil {
+			t.Errorf("Expected an error for %v", formats)
+		}
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	header := http.Header{"Vary": []string{"Accept-Encoding"}}
+	addVary(header, "Accept")
+	addVary(header, "accept")
+	if got := header.Values("Vary"); len(got) != 2 || got[1] != "Accept" {
+		t.Errorf("Expected Accept added once, got %v", got)
+	}
+}
+
+func TestRoundTrip_NegotiateVary(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{Negotiate: map[string]string{"application/json": "json"}}, zaptest.NewLogger(t))
+	req.Header.Set("Accept", "application/json")
+
+	// Without a report.json.js sibling, the matched script answers
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Vary") != "Accept" {
+		t.Errorf("Expected the matched script with Vary: Accept, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestUnmarshalCaddyfile_Negotiate(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		negotiate {
+			application/json json
+			text/html html
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.Negotiate) != 2 || transport.Negotiate["text/html"] != "html" {
+		t.Errorf("Unexpected negotiate %v", transport.Negotiate)
+	}
+}
@@ -0,0 +1,258 @@
+package substrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// NotifyConfig tells operators about scripts that keep failing. A script that
+// exits unexpectedly CrashLoopThreshold times within CrashLoopWindow is
+// reported to the webhook and/or command, at most once per Interval per
+// script, so a broken deployment produces one notification rather than one
+// per request.
+type NotifyConfig struct {
+	// Webhook receives a POST with the JSON Notification.
+	Webhook string `json:"webhook,omitempty"`
+
+	// Command is run with the JSON Notification on stdin.
+	Command []string `json:"command,omitempty"`
+
+	// CrashLoopThreshold is how many unexpected exits make a crash loop.
+	// Default 3.
+	CrashLoopThreshold int `json:"crash_loop_threshold,omitempty"`
+
+	// CrashLoopWindow is the period the exits are counted in. Default 1m.
+	CrashLoopWindow caddy.Duration `json:"crash_loop_window,omitempty"`
+
+	// Interval is the least time between notifications for a script.
+	// Default 10m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+// Notification is the payload sent to the notify webhook and command.
+type Notification struct {
+	Script   string    `json:"script"`
+	Reason   string    `json:"reason"`
+	Crashes  int       `json:"crashes"`
+	ExitCode int       `json:"exit_code"`
+	Stderr   string    `json:"stderr"`
+	Time     time.Time `json:"time"`
+
+	// Set for the slo_latency_p99 and slo_error_rate reasons
+	Requests     int     `json:"requests,omitempty"`
+	ErrorRate    float64 `json:"error_rate,omitempty"`
+	LatencyP99Ms int64   `json:"latency_p99_ms,omitempty"`
+}
+
+const (
+	notifyTimeout = 10 * time.Second
+	// stderrTailSize is how much of a process's latest stderr is kept for
+	// notifications.
+	stderrTailSize = 4096
+)
+
+func (c *NotifyConfig) validate() error {
+	if c.Webhook == "" && len(c.Command) == 0 {
+		return fmt.Errorf("notify requires a webhook or a command")
+	}
+	if c.CrashLoopThreshold < 0 || c.CrashLoopWindow < 0 || c.Interval < 0 {
+		return fmt.Errorf("notify settings cannot be negative")
+	}
+	return nil
+}
+
+// notifier counts crashes per script and sends crash loop notifications.
+type notifier struct {
+	config    NotifyConfig
+	threshold int
+	window    time.Duration
+	interval  time.Duration
+	logger    *zap.Logger
+	client    *http.Client
+
+	mu       sync.Mutex
+	crashes  map[string][]time.Time
+	lastSent map[string]time.Time
+	wg       sync.WaitGroup
+}
+
+func newNotifier(config *NotifyConfig, logger *zap.Logger) *notifier {
+	if config == nil {
+		return nil
+	}
+	n := &notifier{
+		config:    *config,
+		threshold: config.CrashLoopThreshold,
+		window:    time.Duration(config.CrashLoopWindow),
+		interval:  time.Duration(config.Interval),
+		logger:    logger,
+		client:    &http.Client{Timeout: notifyTimeout},
+		crashes:   make(map[string][]time.Time),
+		lastSent:  make(map[string]time.Time),
+	}
+	if n.threshold == 0 {
+		n.threshold = 3
+	}
+	if n.window == 0 {
+		n.window = time.Minute
+	}
+	if n.interval == 0 {
+		n.interval = 10 * time.Minute
+	}
+	return n
+}
+
+// crashed records an unexpected exit of script and notifies once the script
+// is crash looping, unless it was notified about within the interval.
+func (n *notifier) crashed(script string, exitCode int, stderr string) {
+	if n == nil {
+		return
+	}
+
+	now := time.Now()
+	n.mu.Lock()
+	recent := n.crashes[script][:0]
+	for _, at := range n.crashes[script] {
+		if now.Sub(at) < n.window {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+	n.crashes[script] = recent
+
+	if len(recent) < n.threshold || now.Sub(n.lastSent[script]) < n.interval {
+		n.mu.Unlock()
+		return
+	}
+	n.lastSent[script] = now
+	delete(n.crashes, script)
+	n.mu.Unlock()
+
+	n.send(Notification{
+		Script:   script,
+		Reason:   "crash_loop",
+		Crashes:  len(recent),
+		ExitCode: exitCode,
+		Stderr:   stderr,
+		Time:     now,
+	})
+}
+
+// sloViolated notifies that a script went over its SLO budget, unless it
+// was notified about the same budget within the interval.
+func (n *notifier) sloViolated(notification Notification) {
+	if n == nil {
+		return
+	}
+
+	key := notification.Script + " " + notification.Reason
+	n.mu.Lock()
+	if notification.Time.Sub(n.lastSent[key]) < n.interval {
+		n.mu.Unlock()
+		return
+	}
+	n.lastSent[key] = notification.Time
+	n.mu.Unlock()
+
+	n.send(notification)
+}
+
+// send delivers the notification in the background.
+func (n *notifier) send(notification Notification) {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		n.logger.Error("failed to encode notification", zap.Error(err))
+		return
+	}
+
+	n.logger.Warn("sending process notification",
+		zap.String("script_path", notification.Script),
+		zap.String("reason", notification.Reason),
+		zap.Int("crashes", notification.Crashes),
+	)
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+
+		if n.config.Webhook != "" {
+			if err := n.postWebhook(ctx, payload); err != nil {
+				n.logger.Error("notify webhook failed",
+					zap.String("webhook", n.config.Webhook),
+					zap.Error(err),
+				)
+			}
+		}
+		if len(n.config.Command) > 0 {
+			cmd := exec.CommandContext(ctx, n.config.Command[0], n.config.Command[1:]...)
+			cmd.Stdin = bytes.NewReader(payload)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				n.logger.Error("notify command failed",
+					zap.Strings("command", n.config.Command),
+					zap.ByteString("output", output),
+					zap.Error(err),
+				)
+			}
+		}
+	}()
+}
+
+func (n *notifier) postWebhook(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.config.Webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// wait blocks until notifications in flight are delivered.
+func (n *notifier) wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+}
+
+func (b *tailBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, data...)
+	if over := len(b.buf) - b.size; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	return len(data), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
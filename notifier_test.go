@@ -0,0 +1,168 @@
+package substrate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+// notificationServer records the notifications posted to it.
+func notificationServer(t *testing.T) (*httptest.Server, chan Notification) {
+	received := make(chan Notification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("Failed to decode notification: %v", err)
+		}
+		received <- n
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func TestNotifier_CrashLoop(t *testing.T) {
+	server, received := notificationServer(t)
+
+	n := newNotifier(&NotifyConfig{Webhook: server.URL}, zaptest.NewLogger(t))
+	n.crashed("/srv/app.js", 1, "first")
+	n.crashed("/srv/app.js", 1, "second")
+	n.crashed("/srv/other.js", 1, "other")
+	n.wait()
+
+	select {
+	case got := <-received:
+		t.Fatalf("Notified before the threshold: %+v", got)
+	default:
+	}
+
+	n.crashed("/srv/app.js", 2, "third")
+	n.wait()
+
+	select {
+	case got := <-received:
+		if got.Script != "/srv/app.js" || got.Reason != "crash_loop" || got.Crashes != 3 || got.ExitCode != 2 || got.Stderr != "third" {
+			t.Errorf("Unexpected notification: %+v", got)
+		}
+	default:
+		t.Fatal("Expected a crash loop notification")
+	}
+
+	// Further crashes within the interval are not reported again
+	for i := 0; i < 5; i++ {
+		n.crashed("/srv/app.js", 1, "again")
+	}
+	n.wait()
+	select {
+	case got := <-received:
+		t.Errorf("Expected notifications to saturate, got %+v", got)
+	default:
+	}
+}
+
+func TestNotifier_Command(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "notification.json")
+	n := newNotifier(&NotifyConfig{
+		Command:            []string{"/bin/sh", "-c", "cat > " + output},
+		CrashLoopThreshold: 1,
+	}, zaptest.NewLogger(t))
+
+	n.crashed("/srv/app.js", 1, "boom")
+	n.wait()
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Command did not receive the notification: %v", err)
+	}
+	var got Notification
+	if err := json.Unmarshal(data, &got); err != nil || got.Script != "/srv/app.js" {
+		t.Errorf("Unexpected command input %q: %v", data, err)
+	}
+}
+
+func TestNotifier_ProcessCrash(t *testing.T) {
+	server, received := notificationServer(t)
+
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{notify: &NotifyConfig{Webhook: server.URL, CrashLoopThreshold: 1}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, ignoring its arguments
+	process := startStubProcess(t, pm, "echo 'Uncaught Error: boom' >&2\nexit 1")
+	<-process.exitChan
+
+	select {
+	case got := <-received:
+		if got.Script != process.scriptPath || !strings.Contains(got.Stderr, "Uncaught Error: boom") {
+			t.Errorf("Unexpected notification: %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a notification for the crashed process")
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{size: 8}
+	b.Write([]byte("hello "))
+	b.Write([]byte("world"))
+	if got := b.String(); got != "lo world" {
+		t.Errorf("Expected the last 8 bytes, got %q", got)
+	}
+}
+
+func TestUnmarshalCaddyfile_Notify(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		notify {
+			webhook https://hooks.example.com/substrate
+			command /usr/local/bin/page oncall
+			crash_loop 5 2m
+			interval 30m
+		}
+	}`)
+
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	want := NotifyConfig{
+		Webhook:            "https://hooks.example.com/substrate",
+		Command:            []string{"/usr/local/bin/page", "oncall"},
+		CrashLoopThreshold: 5,
+		CrashLoopWindow:    caddy.Duration(2 * time.Minute),
+		Interval:           caddy.Duration(30 * time.Minute),
+	}
+	if transport.Notify == nil || transport.Notify.Webhook != want.Webhook ||
+		strings.Join(transport.Notify.Command, " ") != strings.Join(want.Command, " ") ||
+		transport.Notify.CrashLoopThreshold != want.CrashLoopThreshold ||
+		transport.Notify.CrashLoopWindow != want.CrashLoopWindow ||
+		transport.Notify.Interval != want.Interval {
+		t.Errorf("Expected %+v, got %+v", want, transport.Notify)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	transport.Notify = &NotifyConfig{Interval: caddy.Duration(time.Minute)}
+	if err := transport.Validate(); err == nil {
+		t.Error("notify without a webhook or command should be rejected")
+	}
+}
@@ -0,0 +1,118 @@
+package substrate
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// defaultMaxOpenFiles is the RLIMIT_NOFILE of processes when max_open_files
+// is not set: enough for busy servers, low enough that a script leaking
+// descriptors fails on its own before exhausting the host.
+const defaultMaxOpenFiles = 4096
+
+// A process holding this share of its open file limit is reported.
+const openFilesWarnRatio = 0.8
+
+// openFilesCheckInterval is how often the open files of processes are
+// counted.
+const openFilesCheckInterval = 10 * time.Second
+
+// openFilesNearLimit counts the times a process went over the warning share
+// of its open file limit.
+var openFilesNearLimit = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "caddy",
+	Subsystem: "substrate",
+	Name:      "open_files_near_limit_total",
+	Help:      "Times a process held over 80% of its max_open_files.",
+}, []string{"script"})
+
+// registerMetrics adds substrate's metrics to the config's registry.
+func registerMetrics(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	err := registry.Register(openFilesNearLimit)
+	if errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		return nil
+	}
+	return err
+}
+
+// capOpenFiles lowers limit to Caddy's own hard limit, which an unprivileged
+// process cannot raise.
+func capOpenFiles(limit int) int {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return limit
+	}
+	if uint64(limit) > rlimit.Max {
+		return int(rlimit.Max)
+	}
+	return limit
+}
+
+// countOpenFiles returns the number of descriptors pid has open.
+func countOpenFiles(pid int) (int, error) {
+	entries, err := os.ReadDir("/proc/" + strconv.Itoa(pid) + "/fd")
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// openFilesLoop reports processes getting close to their open file limit.
+func (pm *ProcessManager) openFilesLoop() {
+	defer pm.wg.Done()
+
+	ticker := time.NewTicker(openFilesCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pm.ctx.Done():
+			return
+		case <-ticker.C:
+			pm.checkOpenFiles()
+		}
+	}
+}
+
+// checkOpenFiles counts the open files of every process, warning once each
+// time a process goes over the warning share of its limit.
+func (pm *ProcessManager) checkOpenFiles() {
+	threshold := int(float64(pm.opts.maxOpenFiles) * openFilesWarnRatio)
+	for _, process := range pm.processes.snapshot() {
+		process.mu.Lock()
+		if process.startedAt.IsZero() || process.cmd == nil || process.cmd.Process == nil {
+			process.mu.Unlock()
+			continue
+		}
+		pid := process.cmd.Process.Pid
+		process.mu.Unlock()
+
+		count, err := countOpenFiles(pid)
+		if err != nil {
+			continue
+		}
+
+		process.mu.Lock()
+		crossed := count >= threshold && !process.nearFileLimit
+		process.nearFileLimit = count >= threshold
+		process.mu.Unlock()
+
+		if crossed {
+			openFilesNearLimit.WithLabelValues(process.scriptPath).Inc()
+			pm.logger.Warn("process is close to its open file limit",
+				zap.String("script_path", process.scriptPath),
+				zap.Int("pid", pid),
+				zap.Int("open_files", count),
+				zap.Int("max_open_files", pm.opts.maxOpenFiles),
+			)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package substrate
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestProcess_MaxOpenFiles(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{maxOpenFiles: 256},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, printing its open file limit
+	process := startStubProcess(t, pm, "ulimit -n")
+	<-process.exitChan
+
+	if got := strings.TrimSpace(process.startupStdout.String()); got != "256" {
+		t.Errorf("Expected an open file limit of 256, got %q", got)
+	}
+}
+
+func TestCapOpenFiles(t *testing.T) {
+	if got := capOpenFiles(64); got != 64 {
+		t.Errorf("Expected a low limit to be kept, got %d", got)
+	}
+	if got := capOpenFiles(1 << 40); got >= 1<<40 {
+		t.Errorf("Expected a limit above the hard limit to be capped, got %d", got)
+	}
+}
+
+func TestCheckOpenFiles(t *testing.T) {
+	if _, err := countOpenFiles(os.Getpid()); err != nil {
+		t.Skipf("Counting open files is not supported: %v", err)
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+	pm := &ProcessManager{
+		logger:    zap.New(core),
+		processes: newProcessMap(),
+		opts:      processOptions{maxOpenFiles: 1},
+	}
+	script := filepath.Join(t.TempDir(), "leaky.js")
+	process := &Process{
+		scriptPath: script,
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: os.Getpid()}},
+		startedAt:  time.Now(),
+	}
+	pm.processes.acquire(script, func() (*Process, error) { return process, nil })
+
+	// Reported once while it stays over the limit
+	pm.checkOpenFiles()
+	pm.checkOpenFiles()
+	if logs.FilterMessage("process is close to its open file limit").Len() != 1 {
+		t.Errorf("Expected one warning, got %v", logs.All())
+	}
+	if got := testutil.ToFloat64(openFilesNearLimit.WithLabelValues(script)); got != 1 {
+		t.Errorf("Expected the metric counted once, got %v", got)
+	}
+}
+
+func TestUnmarshalCaddyfile_MaxOpenFiles(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		max_open_files 1024
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.MaxOpenFiles != 1024 {
+		t.Errorf("Expected max_open_files 1024, got %d", transport.MaxOpenFiles)
+	}
+
+	transport.MaxOpenFiles = -2
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for max_open_files -2")
+	}
+}
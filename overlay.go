@@ -0,0 +1,149 @@
+package substrate
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// acceptsHTML reports whether the request asks for an HTML page, as a browser
+// navigating to the script does.
+func acceptsHTML(req *http.Request) bool {
+	for _, value := range req.Header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err == nil && mediaType == "text/html" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// secretEnvName matches environment variable names whose values are hidden in
+// the overlay.
+var secretEnvName = regexp.MustCompile(`(?i)(key|token|secret|passw|auth|credential|cookie|session|private)`)
+
+// redactEnv returns the KEY=value entries with the values of secret-looking
+// names replaced.
+func redactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, entry := range env {
+		name, _, _ := strings.Cut(entry, "=")
+		if secretEnvName.MatchString(name) {
+			entry = name + "=[redacted]"
+		}
+		redacted = append(redacted, entry)
+	}
+	return redacted
+}
+
+// sourceLocation matches file locations in runtime output, such as
+// file:///srv/app.js:3:7 or /srv/app.ts:12.
+var sourceLocation = regexp.MustCompile(`(?:file://)?(?:/[^\s:()'"]+)+:\d+(?::\d+)?`)
+
+// highlightOutput escapes process output for HTML, marking error lines, stack
+// frames and source locations.
+func highlightOutput(output string) template.HTML {
+	var b strings.Builder
+	for i, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		class := ""
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "at "):
+			class = "frame"
+		case strings.Contains(strings.ToLower(trimmed), "error"):
+			class = "error"
+		}
+		if class != "" {
+			b.WriteString(`<span class="` + class + `">`)
+		}
+		last := 0
+		for _, loc := range sourceLocation.FindAllStringIndex(line, -1) {
+			b.WriteString(html.EscapeString(line[last:loc[0]]))
+			b.WriteString(`<span class="loc">` + html.EscapeString(line[loc[0]:loc[1]]) + `</span>`)
+			last = loc[1]
+		}
+		b.WriteString(html.EscapeString(line[last:]))
+		if class != "" {
+			b.WriteString(`</span>`)
+		}
+	}
+	return template.HTML(b.String())
+}
+
+var overlayTemplate = template.Must(template.New("overlay").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Startup failed: {{.Script}}</title>
+<style>
+body { margin: 0; padding: 2rem; background: #1e1e1e; color: #ddd; font: 14px/1.5 system-ui, sans-serif; }
+h1 { margin: 0 0 .5rem; color: #ff6b6b; font-size: 1.4rem; }
+h2 { margin: 1.5rem 0 .5rem; color: #aaa; font-size: .9rem; text-transform: uppercase; }
+pre { margin: 0; padding: 1rem; background: #111; border-radius: 4px; overflow-x: auto; font: 13px/1.45 ui-monospace, monospace; white-space: pre-wrap; }
+.error { color: #ff6b6b; }
+.frame { color: #888; }
+.loc { color: #6cb6ff; text-decoration: underline; }
+button { margin-top: 1.5rem; padding: .5rem 1.5rem; font-size: 1rem; border: 0; border-radius: 4px; background: #6cb6ff; color: #111; cursor: pointer; }
+</style>
+</head>
+<body>
+<h1>{{.Script}} failed to start</h1>
+<div>{{.Err}} (exit code {{.ExitCode}})</div>
+{{if .Stderr}}<h2>Stderr</h2>
+<pre>{{.Stderr}}</pre>
+{{end}}{{if .Stdout}}<h2>Stdout</h2>
+<pre>{{.Stdout}}</pre>
+{{end}}{{if .Command}}<h2>Command</h2>
+<pre>{{.Command}}</pre>
+{{end}}{{if .Env}}<h2>Environment</h2>
+<pre>{{range .Env}}{{.}}
+{{end}}</pre>
+{{end}}<button onclick="location.reload()">Retry</button>
+{{.LiveReload}}</body>
+</html>
+`))
+
+// overlayResponse renders a startup failure as an HTML page for a browser in
+// dev mode.
+func overlayResponse(req *http.Request, startupErr *ProcessStartupError) *http.Response {
+	var body bytes.Buffer
+	err := overlayTemplate.Execute(&body, struct {
+		Script     string
+		Err        string
+		ExitCode   int
+		Stderr     template.HTML
+		Stdout     template.HTML
+		Command    string
+		Env        []string
+		LiveReload template.HTML
+	}{
+		Script:     startupErr.ScriptPath,
+		Err:        startupErr.Err.Error(),
+		ExitCode:   startupErr.ExitCode,
+		Stderr:     highlightOutput(startupErr.Stderr),
+		Stdout:     highlightOutput(startupErr.Stdout),
+		Command:    strings.Join(startupErr.Command, " "),
+		Env:        redactEnv(startupErr.Env),
+		LiveReload: liveReloadClient,
+	})
+	if err != nil {
+		return startErrorResponse(req, startupErr, true)
+	}
+
+	resp := textResponse(req, http.StatusBadGateway, "")
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Body = io.NopCloser(&body)
+	resp.ContentLength = int64(body.Len())
+	return resp
+}
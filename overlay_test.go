@@ -0,0 +1,103 @@
+package substrate
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestStartError_Overlay(t *testing.T) {
+	startupErr := &ProcessStartupError{
+		Err:        errors.New("process exited before socket became ready (exit code: 1)"),
+		ExitCode:   1,
+		Stderr:     "error: Uncaught SyntaxError: Unexpected token '<'\n    at file:///srv/app.js:3:7\n",
+		ScriptPath: "/srv/app.js",
+		Command:    []string{"deno", "run", "/srv/app.js"},
+		Env:        []string{"APP_ENV=dev", "API_TOKEN=hunter2"},
+	}
+	req := httptest.NewRequest("GET", "/app.js", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+
+	resp, err := (&SubstrateTransport{Dev: true}).startError(req, startupErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	page := string(body)
+	if resp.StatusCode != http.StatusBadGateway || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected an HTML 502, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"Unexpected token &#39;&lt;&#39;",
+		`<span class="loc">file:///srv/app.js:3:7</span>`,
+		`<span class="frame">`,
+		"deno run /srv/app.js",
+		"APP_ENV=dev",
+		"API_TOKEN=[redacted]",
+		"location.reload()",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Expected overlay to contain %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "hunter2") {
+		t.Error("Overlay should redact secret values")
+	}
+
+	// Without dev mode, or for clients not asking for HTML, the plain text
+	// response stays
+	resp, _ = (&SubstrateTransport{}).startError(req, startupErr)
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Error("Overlay should require dev mode")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, _ = (&SubstrateTransport{Dev: true}).startError(req, startupErr)
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Error("Overlay should require an HTML Accept header")
+	}
+}
+
+func TestProcess_StartupErrorCommand(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		map[string]string{"APP_ENV": "dev"},
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	process := startStubProcess(t, pm, "exit 1")
+	<-process.exitChan
+
+	startupErr := process.startupError(errors.New("exited"))
+	if len(startupErr.Command) == 0 || startupErr.Command[len(startupErr.Command)-1] != process.SocketPath {
+		t.Errorf("Expected the command line, got %v", startupErr.Command)
+	}
+	found := false
+	for _, entry := range startupErr.Env {
+		if entry == "APP_ENV=dev" {
+			found = true
+		}
+		if entry == "PATH="+os.Getenv("PATH") {
+			t.Error("Inherited variables should be left out")
+		}
+	}
+	if !found {
+		t.Errorf("Expected configured env, got %v", startupErr.Env)
+	}
+}
@@ -0,0 +1,66 @@
+package substrate
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// OverloadSignalConfig marks the responses of requests refused because the
+// node is overloaded, so a load balancer in front of Caddy can send traffic
+// to other nodes.
+type OverloadSignalConfig struct {
+	// Status replaces the status of these responses. Default 503.
+	Status int `json:"status,omitempty"`
+
+	// Header, if set, is added to these responses with the reason as its
+	// value: start_limit or cold_start_queue.
+	Header string `json:"header,omitempty"`
+}
+
+// Reasons a request is refused for overload.
+const (
+	overloadStartLimit     = "start_limit"
+	overloadColdStartQueue = "cold_start_queue"
+)
+
+func (c *OverloadSignalConfig) validate() error {
+	if c.Status != 0 && (c.Status < 400 || c.Status > 599) {
+		return fmt.Errorf("overload_signal status must be between 400 and 599, got %d", c.Status)
+	}
+	if c.Header != "" && !httpguts.ValidHeaderFieldName(c.Header) {
+		return fmt.Errorf("overload_signal: invalid header name %q", c.Header)
+	}
+	return nil
+}
+
+func (c *OverloadSignalConfig) status() int {
+	if c.Status == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return c.Status
+}
+
+// overloadReason returns why err refused a request for overload, or "" if
+// it did not. The per-client start limit is the client's doing, not the
+// node's, and a no_cold_starts window is planned, so neither counts.
+func overloadReason(err error) string {
+	if limitErr, ok := err.(*StartLimitError); ok && limitErr.Scope == "global" {
+		return overloadStartLimit
+	}
+	if err == errColdStartQueueTimeout {
+		return overloadColdStartQueue
+	}
+	return ""
+}
+
+// signal marks resp as refused for overload.
+func (c *OverloadSignalConfig) signal(resp *http.Response, reason string) {
+	status := c.status()
+	resp.StatusCode = status
+	resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	if c.Header != "" {
+		resp.Header.Set(c.Header, reason)
+	}
+}
@@ -0,0 +1,101 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestStartError_OverloadSignal(t *testing.T) {
+	transport := &SubstrateTransport{OverloadSignal: &OverloadSignalConfig{Header: "X-Overloaded"}}
+	req := httptest.NewRequest("GET", "/app.js", nil)
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		header string
+	}{
+		{"global start limit", &StartLimitError{Scope: "global", Limit: 10, RetryAfter: time.Second}, http.StatusServiceUnavailable, "start_limit"},
+		{"cold start queue", errColdStartQueueTimeout, http.StatusServiceUnavailable, "cold_start_queue"},
+		{"client start limit", &StartLimitError{Scope: "client", Limit: 2, RetryAfter: time.Second}, http.StatusTooManyRequests, ""},
+		{"schedule", &ColdStartsPausedError{RetryAfter: time.Minute}, http.StatusServiceUnavailable, ""},
+		{"startup failure", &ProcessStartupError{Err: errors.New("exited"), ExitCode: 1}, http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		resp, err := transport.startError(req, tt.err)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+		if resp.StatusCode != tt.status || resp.Header.Get("X-Overloaded") != tt.header {
+			t.Errorf("%s: expected %d with header %q, got %d with %q",
+				tt.name, tt.status, tt.header, resp.StatusCode, resp.Header.Get("X-Overloaded"))
+		}
+	}
+
+	// Retry-After is kept
+	resp, _ := transport.startError(req, &StartLimitError{Scope: "global", Limit: 10, RetryAfter: 3 * time.Second})
+	if resp.Header.Get("Retry-After") != "3" {
+		t.Errorf("Expected Retry-After to be kept, got %q", resp.Header.Get("Retry-After"))
+	}
+
+	// Without the option, the global limit is a 429
+	resp, _ = (&SubstrateTransport{}).startError(req, &StartLimitError{Scope: "global", Limit: 10})
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 without overload_signal, got %d", resp.StatusCode)
+	}
+}
+
+func TestStartError_OverloadSignalHandleErrors(t *testing.T) {
+	transport := &SubstrateTransport{
+		ErrorHandling:  "handle_errors",
+		OverloadSignal: &OverloadSignalConfig{Status: 529},
+	}
+	repl := caddy.NewReplacer()
+	req := httptest.NewRequest("GET", "/app.js", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+	_, err := transport.startError(req, errColdStartQueueTimeout)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != 529 {
+		t.Fatalf("Expected a 529 HandlerError, got %v", err)
+	}
+	if reason, _ := repl.GetString("substrate.overloaded"); reason != "cold_start_queue" {
+		t.Errorf("Expected the overloaded placeholder, got %q", reason)
+	}
+}
+
+func TestUnmarshalCaddyfile_OverloadSignal(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		overload_signal {
+			status 503
+			header X-Substrate-Overloaded
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.OverloadSignal == nil || transport.OverloadSignal.Status != 503 || transport.OverloadSignal.Header != "X-Substrate-Overloaded" {
+		t.Fatalf("Unexpected overload_signal %+v", transport.OverloadSignal)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	transport.OverloadSignal.Status = 200
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for a success status")
+	}
+	transport.OverloadSignal = &OverloadSignalConfig{Header: "X Overloaded"}
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for an invalid header name")
+	}
+}
@@ -0,0 +1,107 @@
+package substrate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// connStash holds connections opened to a process socket right after startup,
+// so the first requests to a fresh process reuse them instead of dialing.
+type connStash struct {
+	conns map[string][]net.Conn // keyed by socket path
+	mu    sync.Mutex
+}
+
+func newConnStash() *connStash {
+	return &connStash{conns: make(map[string][]net.Conn)}
+}
+
+// fill dials n connections to socketPath and stashes them. Failures are
+// logged and simply leave fewer connections prewarmed.
+func (s *connStash) fill(socketPath string, n int, logger *zap.Logger) {
+	conns := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := net.DialTimeout("unix", socketPath, 500*time.Millisecond)
+		if err != nil {
+			logger.Debug("failed to prewarm connection",
+				zap.String("socket_path", socketPath),
+				zap.Error(err),
+			)
+			break
+		}
+		conns = append(conns, conn)
+	}
+
+	s.mu.Lock()
+	s.conns[socketPath] = append(s.conns[socketPath], conns...)
+	s.mu.Unlock()
+
+	logger.Debug("prewarmed connections",
+		zap.String("socket_path", socketPath),
+		zap.Int("count", len(conns)),
+	)
+}
+
+// take removes and returns a stashed connection to socketPath, or nil.
+func (s *connStash) take(socketPath string) net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := s.conns[socketPath]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(s.conns, socketPath)
+	} else {
+		s.conns[socketPath] = conns[:len(conns)-1]
+	}
+	return conn
+}
+
+// drop closes every stashed connection to socketPath.
+func (s *connStash) drop(socketPath string) {
+	s.mu.Lock()
+	conns := s.conns[socketPath]
+	delete(s.conns, socketPath)
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// dialContext wraps dial so that unix socket dials are served from the stash
+// first.
+func (s *connStash) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if dialInfo, ok := reverseproxy.GetDialInfo(ctx); ok && dialInfo.Network == "unix" {
+			if conn := s.take(dialInfo.Address); conn != nil {
+				return conn, nil
+			}
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// socketClient returns an HTTP client for substrate's own requests to the
+// process listening on socketPath, such as warm-up requests. timeout bounds
+// each request, 0 for none. Callers close its idle connections when done.
+func socketClient(socketPath string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: timeout,
+	}
+}
@@ -0,0 +1,49 @@
+package substrate
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestConnStash(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "prewarm.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	stash := newConnStash()
+	stash.fill(socketPath, 2, zaptest.NewLogger(t))
+
+	for i := 0; i < 2; i++ {
+		if conn := stash.take(socketPath); conn == nil {
+			t.Fatalf("Expected prewarmed connection %d", i+1)
+		} else {
+			conn.Close()
+		}
+	}
+
+	if conn := stash.take(socketPath); conn != nil {
+		t.Error("Stash should be empty after taking all connections")
+	}
+
+	stash.fill(socketPath, 3, zaptest.NewLogger(t))
+	stash.drop(socketPath)
+	if conn := stash.take(socketPath); conn != nil {
+		t.Error("Dropped stash should not return connections")
+	}
+}
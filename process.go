@@ -6,55 +6,208 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/sys/unix"
 )
 
+// ProcessManager supervises the processes running scripts: it starts them
+// on demand, shares them between requests, restarts them when their scripts
+// change and stops them once idle. The transport has one for its scripts and
+// the app one for its services; other programs create theirs with NewManager.
 type ProcessManager struct {
-	idleTimeout    caddy.Duration
-	startupTimeout caddy.Duration
-	env            map[string]string
-	denoOpts       string
-	logger         *zap.Logger
-	processes      map[string]*Process
-	mu             sync.RWMutex
-	ctx            context.Context
-	cancel         context.CancelFunc
-	wg             sync.WaitGroup
-	deno           *DenoManager
+	// Settings a config reload may change, see reconfigure
+	settingsMu   sync.RWMutex
+	live         liveSettings
+	startLimiter *startLimiter
+	config       json.RawMessage // of the transport, for crash bundles
+
+	denoOpts    string
+	logger      *zap.Logger
+	processes   *processMap
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	deno        *DenoManager
+	opts        processOptions
+	conns       *connStash
+	drains      *drainSet
+	reloads     *reloadBroadcast
+	idle        *idleQueue
+	isolatedSeq atomic.Uint64 // numbers the keys of isolated processes
+	notifier    *notifier
+	builder     *builder
+	failures    *failureCache
+
+	scheduleOnce sync.Once // starts scheduleLoop
+
+	since time.Time // when the manager was created, see takeoverState
 }
 
+// processOptions holds optional settings that apply to every process spawned
+// by a ProcessManager.
+type processOptions struct {
+	scriptPolicy *ScriptPolicy
+	umask        string   // octal umask applied before exec, empty to inherit
+	gid          *uint32  // primary group override, nil to use the file's group
+	groups       []uint32 // supplementary groups
+
+	maxOpenFiles   int      // RLIMIT_NOFILE applied before exec, 0 to inherit
+	maxProcesses   int      // pids.max of the process's cgroup, 0 for no limit
+	ioMax          []string // io.max lines of the process's cgroup
+	explicitLimits bool     // cgroup limits were configured, not defaults
+
+	maxStartsPerMinute       int // global cold start budget, 0 for unlimited
+	maxClientStartsPerMinute int // per-client cold start budget, 0 for unlimited
+
+	schedule []scheduleWindow // scale_to_zero and no_cold_starts windows
+
+	prewarmConns int // connections to open once a process socket is ready
+
+	warmup *Warmup // requests sent before a process receives traffic, nil for none
+
+	readiness *ReadinessConfig // how a process is found ready once its socket connects, nil to only wait for the socket
+
+	reloadOnChange bool // recycle a process when its script is modified
+
+	handover bool // ask a recycled process to save its state for its replacement
+
+	socketDir string // directory for process sockets, empty for os.TempDir()
+
+	coldStartQueueTimeout time.Duration // wait for another request's cold start, 0 for the whole startup
+
+	startupFailureTTL time.Duration // how long a failed start is answered from the cache, 0 to not cache
+
+	notify *NotifyConfig // where crash loops are reported, nil to not report them
+
+	privateTmp bool // give each process its own TMPDIR, removed when it exits
+
+	inspect   bool // run deno with the inspector on a loopback port
+	typeCheck bool // run deno with --check
+
+	egress *EgressPolicy // hosts deno lets scripts connect to, nil for any
+
+	hosts map[string]string // extra /etc/hosts entries, host name to address
+
+	maxExtend time.Duration // how long past its idle expiry a process may keep itself, 0 for no limit
+
+	persistUsage bool // save script usage to Caddy's storage
+
+	readOnlyProject bool   // deny writes to the script's directory
+	dataDir         string // writable directory exported as SUBSTRATE_DATA_DIR, empty for none
+
+	coreDumpDir string // enable core dumps and collect them here, empty to inherit RLIMIT_CORE
+
+	build *BuildConfig // build step run before a process starts, nil for none
+
+	goCompiler *GoCompiler // compiles scripts' Go packages for runtime go, nil for deno
+
+	stopTimeout time.Duration // overall deadline for stopping all processes, 0 for defaultStopTimeout
+
+	socketPollInterval time.Duration // between tries of a starting process's socket, 0 for defaultSocketPollInterval
+	socketDialTimeout  time.Duration // for each try, 0 for defaultSocketDialTimeout
+
+	takeoverState string // file listing running processes for another instance to adopt, empty for none
+}
+
+// Process is a script process of a ProcessManager, serving HTTP on the unix
+// socket at SocketPath. Its state is read through its methods, which are
+// safe to call while the manager runs it; Info reports all of it at once.
 type Process struct {
-	ScriptPath string
+	scriptPath string
 	SocketPath string
-	DenoPath   string // Path to the deno binary
-	DenoOpts   string // Extra deno options (e.g., "--config=/path/to/deno.json")
-	Cmd        *exec.Cmd
-	LastUsed   time.Time
+	key        string // process map key, see ProcessManager.newProcess
+	denoPath   string // Path to the deno binary
+	denoOpts   string // Extra deno options (e.g., "--config=/path/to/deno.json")
+	cmd        *exec.Cmd
+	lastUsed   time.Time
 	exitCode   int
+	exitSignal string          // name of the signal that ended the process, if any
+	config     json.RawMessage // of the transport that started it, for crash bundles
+	corePath   string          // where its core dump was collected, if any
+	exitedAt   time.Time       // when monitor saw the process exit
 	onExit     func()
+	onDrain    func()
 	mu         sync.RWMutex
 	logger     *zap.Logger
 	env        map[string]string
+	opts       processOptions
+	// Idle timeout when the process was created, see formatIdleTimeout
+	idleTimeout caddy.Duration
 	// Startup output buffers (only used during startup)
-	startupStdout *bytes.Buffer
-	startupStderr *bytes.Buffer
+	startupStdout *startupBuffer
+	startupStderr *startupBuffer
+	// Done once the output readers have seen the end of both streams
+	output sync.WaitGroup
+	// Program and arguments run instead of deno for command services; the
+	// socket path is appended and scriptPath is the working directory
+	command []string
+	// Private temporary directory, removed when the process exits
+	tmpDir string
+	// Hosts file mounted over /etc/hosts, removed when the process exits
+	hostsFile string
+	// Server for the control socket, closed when the process exits
+	control *http.Server
+	// Latest health reported on the control socket, nil before any
+	health *ProcessHealth
+	// The process asked not to be stopped as idle before this time
+	keepUntil time.Time
+	// Called when the process asks to be recycled, may be nil
+	onRecycle func()
+	// Loopback address of the V8 inspector, with processOptions.inspect
+	inspector string
+	// cgroup the process was moved to when first frozen, removed when it
+	// exits, and whether it is frozen now
+	cgroupDir string
+	frozen    bool
+	// Variables from the request the process was started for, such as
+	// SUBSTRATE_REQUEST and the matched path segments
+	startEnv map[string]string
+	// Latest stderr output, kept for crash notifications
+	stderrTail *tailBuffer
+	// Called after an unexpected exit, may be nil
+	onCrash func(exitCode int)
 	// Track intentional stops to avoid logging them as crashes
 	stopping       bool
 	exitChan       chan struct{}
 	activeRequests int // Reference counting for one-shot mode
+	// Closed when startup finishes; startErr is set before if it failed
+	ready    chan struct{}
+	startErr error
+	// How long the start took, set before ready is closed
+	startupTime time.Duration
+	// Script modification time when the process was created
+	modTime time.Time
+	// Set while a replacement is being started
+	recycling bool
+	// Set once the process is about to be stopped, see drain
+	draining  bool
+	startedAt time.Time
+	// Requests the process failed to answer, reported by the admin API
+	fails int
+	// Set while the process holds most of its open file limit
+	nearFileLimit bool
+	// Started by another Caddy instance and adopted; replaced by a process
+	// of this instance once it serves a request here
+	adopted bool
+	// When the pid started, recorded for takeover_state; see processStartTime
+	pidStart uint64
 }
 
 // ProcessStartupError contains detailed information about process startup failures
@@ -64,13 +217,19 @@ type ProcessStartupError struct {
 	Stdout     string
 	Stderr     string
 	ScriptPath string
+	// Command is the command line the process was started with, and Env the
+	// variables it got on top of Caddy's own environment.
+	Command []string
+	Env     []string
 }
 
 func (e *ProcessStartupError) Error() string {
 	return e.Err.Error()
 }
 
-func NewProcessManager(idleTimeout, startupTimeout caddy.Duration, env map[string]string, denoOpts string, deno *DenoManager, logger *zap.Logger) (*ProcessManager, error) {
+// newProcessManager creates the process manager of a transport or app, with
+// the options they configure. Programs embedding substrate use NewManager.
+func newProcessManager(idleTimeout, startupTimeout caddy.Duration, env map[string]string, denoOpts string, deno *DenoManager, logger *zap.Logger, opts processOptions) (*ProcessManager, error) {
 	logger.Info("creating new process manager",
 		zap.Duration("idle_timeout", time.Duration(idleTimeout)),
 		zap.Duration("startup_timeout", time.Duration(startupTimeout)),
@@ -81,15 +240,35 @@ func NewProcessManager(idleTimeout, startupTimeout caddy.Duration, env map[strin
 	ctx, cancel := context.WithCancel(context.Background())
 
 	pm := &ProcessManager{
-		idleTimeout:    idleTimeout,
-		startupTimeout: startupTimeout,
-		env:            env,
-		denoOpts:       denoOpts,
-		logger:         logger,
-		processes:      make(map[string]*Process),
-		ctx:            ctx,
-		cancel:         cancel,
-		deno:           deno,
+		live: liveSettings{
+			idleTimeout:              idleTimeout,
+			startupTimeout:           startupTimeout,
+			env:                      env,
+			maxStartsPerMinute:       opts.maxStartsPerMinute,
+			maxClientStartsPerMinute: opts.maxClientStartsPerMinute,
+			coldStartQueueTimeout:    opts.coldStartQueueTimeout,
+			startupFailureTTL:        opts.startupFailureTTL,
+			stopTimeout:              opts.stopTimeout,
+			socketPollInterval:       opts.socketPollInterval,
+			socketDialTimeout:        opts.socketDialTimeout,
+			schedule:                 opts.schedule,
+		},
+		denoOpts:     denoOpts,
+		logger:       logger,
+		processes:    newProcessMap(),
+		ctx:          ctx,
+		cancel:       cancel,
+		deno:         deno,
+		opts:         opts,
+		startLimiter: newStartLimiter(opts.maxStartsPerMinute, opts.maxClientStartsPerMinute),
+		conns:        newConnStash(),
+		drains:       newDrainSet(),
+		reloads:      newReloadBroadcast(),
+		idle:         newIdleQueue(),
+		notifier:     newNotifier(opts.notify, logger),
+		builder:      newBuilder(opts.build, env, opts, logger),
+		failures:     newFailureCache(),
+		since:        time.Now(),
 	}
 
 	if idleTimeout > 0 {
@@ -101,37 +280,68 @@ func NewProcessManager(idleTimeout, startupTimeout caddy.Duration, env map[strin
 			zap.Duration("idle_timeout", time.Duration(idleTimeout)))
 	}
 
+	if opts.maxOpenFiles > 0 {
+		pm.wg.Add(1)
+		go pm.openFilesLoop()
+	}
+
+	if len(opts.schedule) > 0 {
+		pm.startScheduleLoop()
+	}
+
+	if opts.persistUsage {
+		pm.wg.Add(1)
+		go pm.usageLoop()
+	}
+
+	if opts.takeoverState != "" {
+		pm.adopt()
+		pm.wg.Add(1)
+		go pm.takeoverLoop()
+	}
+
 	return pm, nil
 }
 
 func validateFilePath(filePath string) error {
+	_, err := statScript(filePath)
+	return err
+}
+
+// statScript validates filePath like validateFilePath and returns the file's
+// info, so callers can track changes to the script.
+func statScript(filePath string) (os.FileInfo, error) {
 	cleanPath := filepath.Clean(filePath)
 
 	if strings.Contains(cleanPath, "..") {
-		return fmt.Errorf("path traversal not allowed: %s", filePath)
+		return nil, fmt.Errorf("path traversal not allowed: %s", filePath)
 	}
 
 	if !filepath.IsAbs(cleanPath) {
-		return fmt.Errorf("file path must be absolute: %s", filePath)
+		return nil, fmt.Errorf("file path must be absolute: %s", filePath)
 	}
 
 	fileInfo, err := os.Stat(cleanPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("file does not exist: %s", cleanPath)
+			return nil, fmt.Errorf("file does not exist: %s", cleanPath)
 		}
-		return fmt.Errorf("failed to stat file %s: %w", cleanPath, err)
+		return nil, fmt.Errorf("failed to stat file %s: %w", cleanPath, err)
 	}
 
 	if !fileInfo.Mode().IsRegular() {
-		return fmt.Errorf("path is not a regular file: %s", cleanPath)
+		return nil, fmt.Errorf("path is not a regular file: %s", cleanPath)
 	}
 
-	return nil
+	return fileInfo, nil
 }
 
 // getSocketPath generates a unique Unix domain socket path using random hex strings
-func getSocketPath() (string, error) {
+func getSocketPath(dir string) (string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
 	const maxAttempts = 10
 
 	for attempt := 0; attempt < maxAttempts; attempt++ {
@@ -142,7 +352,7 @@ func getSocketPath() (string, error) {
 		}
 		hexString := hex.EncodeToString(randomBytes)
 
-		socketPath := filepath.Join(os.TempDir(), fmt.Sprintf("substrate-%s.sock", hexString))
+		socketPath := filepath.Join(dir, fmt.Sprintf("substrate-%s.sock", hexString))
 
 		// Check if file already exists
 		if _, err := os.Stat(socketPath); os.IsNotExist(err) {
@@ -154,58 +364,222 @@ func getSocketPath() (string, error) {
 	return "", fmt.Errorf("failed to generate unique socket path after %d attempts", maxAttempts)
 }
 
-func (pm *ProcessManager) getOrCreateHost(file string) (string, error) {
-	if err := validateFilePath(file); err != nil {
+// getOrCreateHost returns the socket of the process serving file, starting one
+// if needed. client identifies the requesting client for start rate limiting.
+//
+// Concurrent requests for a script that is starting wait for the same startup
+// and share its result; requests for other scripts are not blocked.
+func (pm *ProcessManager) getOrCreateHost(file, client string) (string, error) {
+	process, _, err := pm.acquireHost(file, file, client, nil)
+	if err != nil {
+		return "", err
+	}
+	return process.SocketPath, nil
+}
+
+// getOrCreateHostFor is getOrCreateHost for the process stored under key,
+// with variables from the request: a process started for it gets startEnv
+// added to its environment. It returns the process, which the caller passes
+// to releaseProcess once the request is done, and the cold start the request
+// waited for, if any.
+func (pm *ProcessManager) getOrCreateHostFor(key, file, client string, startEnv map[string]string) (*Process, *coldStart, error) {
+	return pm.acquireHost(key, file, client, startEnv)
+}
+
+// namespacedKey is the key of the process running file in namespace.
+func namespacedKey(file, namespace string) string {
+	return file + "@" + namespace
+}
+
+// keysFor returns the keys of the shared processes running file, in any
+// namespace.
+func (pm *ProcessManager) keysFor(file string) []string {
+	var keys []string
+	for key := range pm.processes.snapshot() {
+		if key == file || strings.HasPrefix(key, file+"@") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// coldStart describes a process start a request had to wait for.
+type coldStart struct {
+	startup time.Duration // from launch until the socket was ready
+}
+
+// awaitStart starts process if this request created it, or waits for another
+// request's start otherwise. The result is nil when the process was already
+// running.
+func (pm *ProcessManager) awaitStart(key string, process *Process, created bool) (*coldStart, error) {
+	cold := created
+	if created {
+		pm.startProcess(process)
+		pm.cacheFailure(process)
+	} else {
+		select {
+		case <-process.ready:
+		default:
+			cold = true
+		}
+		if err := pm.waitForStart(key, process); err != nil {
+			return nil, err
+		}
+	}
+
+	if process.startErr != nil {
+		return nil, process.startErr
+	}
+	if !cold {
+		return nil, nil
+	}
+	return &coldStart{startup: process.startupTime}, nil
+}
+
+// errColdStartQueueTimeout is returned to a request that gave up waiting for
+// a process another request is starting.
+var errColdStartQueueTimeout = errors.New("timed out waiting for process to start")
+
+// waitForStart waits for a process that another request is starting. With a
+// cold start queue timeout it gives up after that long, releasing the
+// reference taken on the process.
+func (pm *ProcessManager) waitForStart(key string, process *Process) error {
+	queueTimeout := pm.settings().coldStartQueueTimeout
+	if queueTimeout <= 0 {
+		<-process.ready
+		return nil
+	}
+
+	select {
+	case <-process.ready:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-process.ready:
+		return nil
+	case <-timer.C:
+		pm.processes.release(key, process, false)
+		return errColdStartQueueTimeout
+	}
+}
+
+// startIsolated starts a process for file that no other request shares. It
+// returns the process and its key, which the caller passes to
+// releaseProcess once the request is done.
+// startEnv is passed to the process as in getOrCreateHostFor.
+func (pm *ProcessManager) startIsolated(file, client string, startEnv map[string]string) (key string, process *Process, cold *coldStart, err error) {
+	key = file + "#" + strconv.FormatUint(pm.isolatedSeq.Add(1), 10)
+	process, cold, err = pm.acquireHost(key, file, client, startEnv)
+	return key, process, cold, err
+}
+
+// acquireHost returns the process stored under key, starting one for file if
+// there is none, and the cold start the caller waited for. The process counts
+// a request in progress until releaseProcess. A started process gets startEnv
+// added to its environment.
+func (pm *ProcessManager) acquireHost(key, file, client string, startEnv map[string]string) (*Process, *coldStart, error) {
+	info, err := statScript(file)
+	if err != nil {
 		pm.logger.Error("file path validation failed",
 			zap.String("file", file),
 			zap.Error(err),
 		)
-		return "", err
+		return nil, nil, err
 	}
 
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+	if startupErr := pm.failures.get(file, info.ModTime(), time.Now()); startupErr != nil {
+		pm.logger.Debug("serving cached startup failure",
+			zap.String("file", file),
+		)
+		return nil, nil, startupErr
+	}
 
-	// Try to reuse existing process (works for all modes including one-shot)
-	if process, exists := pm.processes[file]; exists {
-		process.mu.Lock()
-		process.LastUsed = time.Now()
-		process.activeRequests++
-		socketPath := process.SocketPath
-		pid := process.Cmd.Process.Pid
-		activeCount := process.activeRequests
-		process.mu.Unlock()
+	process, created, err := pm.processes.acquire(key, func() (*Process, error) {
+		process, err := pm.newProcess(key, file, client, info.ModTime())
+		if err == nil {
+			process.startEnv = startEnv
+		}
+		return process, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cold, err := pm.awaitStart(key, process, created)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// This request stays on the current process; later ones move over once
+	// the replacement is ready
+	if !created && pm.opts.reloadOnChange && process.scriptChanged(info.ModTime()) {
+		pm.recycle(key, process, "script changed")
+	}
+	// Now that this instance takes traffic, its own process replaces the
+	// adopted one
+	if !created && process.adopted {
+		pm.recycle(key, process, "adopted from another instance")
+	}
+
+	if !created {
+		if c := pm.logger.Check(zapcore.DebugLevel, "reusing existing process"); c != nil {
+			process.mu.RLock()
+			pid := process.cmd.Process.Pid
+			activeCount := process.activeRequests
+			process.mu.RUnlock()
+
+			c.Write(
+				zap.String("file", file),
+				zap.String("socket_path", process.SocketPath),
+				zap.Int("pid", pid),
+				zap.Int("active_requests", activeCount),
+			)
+		}
+	}
+	return process, cold, nil
+}
 
-		pm.logger.Debug("reusing existing process",
+// newProcess checks whether a process may be started for file and returns it
+// unstarted. It runs with the process map shard locked, so it must be quick.
+// The process is stored under key, which is file unless the process is
+// isolated. modTime is the script's modification time the process will run.
+func (pm *ProcessManager) newProcess(key, file, client string, modTime time.Time) (*Process, error) {
+	if err := pm.opts.scriptPolicy.check(file); err != nil {
+		pm.logger.Warn("script rejected by policy",
 			zap.String("file", file),
-			zap.String("socket_path", socketPath),
-			zap.Int("pid", pid),
-			zap.Int("active_requests", activeCount),
+			zap.Error(err),
 		)
-		return socketPath, nil
+		return nil, err
 	}
 
-	pm.logger.Info("creating new process",
-		zap.String("file", file),
-	)
+	if err := pm.coldStartsPaused(time.Now()); err != nil {
+		pm.logger.Debug("process start refused by schedule",
+			zap.String("file", file),
+		)
+		return nil, err
+	}
 
-	// Get deno binary path
-	denoPath, err := pm.deno.Get()
-	if err != nil {
-		pm.logger.Error("failed to get deno binary",
+	if err := pm.limiter().allow(client); err != nil {
+		pm.logger.Warn("process start rate limited",
 			zap.String("file", file),
+			zap.String("client", client),
 			zap.Error(err),
 		)
-		return "", fmt.Errorf("failed to get deno binary: %w", err)
+		return nil, err
 	}
 
-	socketPath, err := getSocketPath()
+	socketPath, err := getSocketPath(pm.opts.socketDir)
 	if err != nil {
 		pm.logger.Error("failed to generate socket path",
 			zap.String("file", file),
 			zap.Error(err),
 		)
-		return "", fmt.Errorf("failed to generate socket path: %w", err)
+		return nil, fmt.Errorf("failed to generate socket path: %w", err)
 	}
 
 	pm.logger.Debug("generated socket path",
@@ -213,19 +587,235 @@ func (pm *ProcessManager) getOrCreateHost(file string) (string, error) {
 		zap.String("socket_path", socketPath),
 	)
 
+	settings := pm.settings()
 	process := &Process{
-		ScriptPath:     file,
-		SocketPath:     socketPath,
-		DenoPath:       denoPath,
-		DenoOpts:       pm.denoOpts,
-		LastUsed:       time.Now(),
-		onExit:         func() { pm.removeProcess(file) },
-		logger:         pm.logger,
-		env:            pm.env,
-		startupStdout:  &bytes.Buffer{},
-		startupStderr:  &bytes.Buffer{},
-		activeRequests: 1, // Start with 1 active request
-		exitChan:       make(chan struct{}),
+		scriptPath:    file,
+		SocketPath:    socketPath,
+		key:           key,
+		denoOpts:      pm.denoOpts,
+		lastUsed:      time.Now(),
+		modTime:       modTime,
+		exitCode:      -1,
+		logger:        pm.logger,
+		env:           settings.env,
+		opts:          pm.opts,
+		idleTimeout:   settings.idleTimeout,
+		config:        pm.transportConfig(),
+		startupStdout: &startupBuffer{},
+		startupStderr: &startupBuffer{},
+		stderrTail:    &tailBuffer{size: stderrTailSize},
+		exitChan:      make(chan struct{}),
+		ready:         make(chan struct{}),
+	}
+	pm.track(process)
+	return process, nil
+}
+
+// track sets the callbacks that keep the manager up to date with process.
+func (pm *ProcessManager) track(process *Process) {
+	file, key, socketPath := process.scriptPath, process.key, process.SocketPath
+	process.onDrain = func() {
+		pm.conns.drop(socketPath)
+		pm.drains.start(socketPath)
+	}
+	process.onExit = func() {
+		process.mu.RLock()
+		lastUsed := process.lastUsed
+		process.mu.RUnlock()
+		scriptUsage.used(file, lastUsed)
+		pm.conns.drop(socketPath)
+		pm.drains.done(socketPath)
+		pm.removeProcess(key, process)
+	}
+	process.onCrash = func(exitCode int) {
+		pm.notifier.crashed(file, exitCode, process.stderrTail.String())
+	}
+	process.onRecycle = func() {
+		pm.recycle(key, process, "requested by the process")
+	}
+}
+
+// startProcess launches a process created by newProcess and waits for its
+// socket. Waiting requests are released once ready is closed; on failure the
+// process is removed from the map and startErr is reported to all of them.
+func (pm *ProcessManager) startProcess(process *Process) {
+	defer close(process.ready)
+
+	began := time.Now()
+	if err := pm.launch(process); err != nil {
+		process.startErr = err
+		pm.processes.remove(process.key, process)
+		return
+	}
+	process.startupTime = time.Since(began)
+	scriptUsage.started(process.scriptPath, process.startupTime, began)
+
+	if idleTimeout := pm.settings().idleTimeout; idleTimeout > 0 {
+		pm.idle.push(process.key, process, time.Now().Add(time.Duration(idleTimeout)))
+	}
+}
+
+// recycleDrainTimeout is how long a recycled process keeps running after new
+// requests moved to its replacement, so in-flight requests can finish.
+const recycleDrainTimeout = 10 * time.Second
+
+// recycle replaces old, stored under key, with a fresh process for its
+// script without a gap in service: the replacement is started while old keeps serving, new requests
+// switch to it once its socket is ready, and old is stopped after giving its
+// in-flight requests recycleDrainTimeout to finish. Concurrent calls for the
+// same process are ignored. If the replacement fails to start, old keeps
+// serving and a later call may try again. The replacement gets the
+// variables old was started with.
+func (pm *ProcessManager) recycle(key string, old *Process, reason string) {
+	if pm.ctx.Err() != nil {
+		return
+	}
+	file := old.scriptPath
+
+	old.mu.Lock()
+	if old.recycling || old.stopping {
+		old.mu.Unlock()
+		return
+	}
+	old.recycling = true
+	old.mu.Unlock()
+
+	pm.logger.Info("recycling process",
+		zap.String("file", file),
+		zap.String("reason", reason),
+		zap.String("socket_path", old.SocketPath),
+	)
+
+	pm.wg.Add(1)
+	go func() {
+		defer pm.wg.Done()
+
+		startEnv := old.startEnv
+		if pm.opts.handover {
+			if statePath := pm.requestHandover(old); statePath != "" {
+				startEnv = make(map[string]string, len(old.startEnv)+1)
+				for name, value := range old.startEnv {
+					startEnv[name] = value
+				}
+				startEnv["SUBSTRATE_HANDOVER_FILE"] = statePath
+				// The replacement reads the state while it starts
+				defer os.Remove(statePath)
+			}
+		}
+
+		replacement, modTime, err := pm.startReplacement(key, file, startEnv)
+		if err != nil {
+			pm.logger.Error("failed to start replacement process, keeping current one",
+				zap.String("file", file),
+				zap.Error(err),
+			)
+			// Don't retry the same broken script on every request
+			old.mu.Lock()
+			old.recycling = false
+			if !modTime.IsZero() {
+				old.modTime = modTime
+			}
+			old.mu.Unlock()
+			return
+		}
+
+		if !pm.processes.replace(key, old, replacement) {
+			// old exited or was stopped meanwhile; the next request starts
+			// a fresh process
+			replacement.Stop()
+			return
+		}
+		// Requests still in flight to old close their connections
+		old.drain()
+
+		if idleTimeout := pm.settings().idleTimeout; idleTimeout > 0 {
+			pm.idle.push(key, replacement, time.Now().Add(time.Duration(idleTimeout)))
+		}
+
+		pm.logger.Info("switched to replacement process",
+			zap.String("file", file),
+			zap.String("old_socket_path", old.SocketPath),
+			zap.String("socket_path", replacement.SocketPath),
+		)
+		if reason == "script changed" {
+			pm.reloads.notify(key)
+		}
+
+		select {
+		case <-time.After(recycleDrainTimeout):
+		case <-pm.ctx.Done():
+		}
+
+		if err := old.Stop(); err != nil {
+			pm.logger.Error("failed to stop recycled process",
+				zap.String("file", file),
+				zap.Error(err),
+			)
+		}
+	}()
+}
+
+// startReplacement starts a process for file outside the process map, for
+// recycle to swap in once it is ready, with startEnv added to its
+// environment. It also returns the modification time of the script it tried
+// to start.
+func (pm *ProcessManager) startReplacement(key, file string, startEnv map[string]string) (*Process, time.Time, error) {
+	info, err := statScript(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	process, err := pm.newProcess(key, file, "", info.ModTime())
+	if err != nil {
+		return nil, info.ModTime(), err
+	}
+	process.startEnv = startEnv
+	defer close(process.ready)
+
+	if err := pm.launch(process); err != nil {
+		process.startErr = err
+		return nil, info.ModTime(), err
+	}
+	return process, info.ModTime(), nil
+}
+
+func (pm *ProcessManager) launch(process *Process) error {
+	file := process.scriptPath
+	socketPath := process.SocketPath
+
+	pm.logger.Info("creating new process",
+		zap.String("file", file),
+	)
+
+	if err := pm.builder.ensure(file); err != nil {
+		return buildStartupError(file, err)
+	}
+
+	if pm.opts.goCompiler != nil {
+		binary, err := pm.opts.goCompiler.Get(file)
+		if err != nil {
+			pm.logger.Error("failed to compile Go handler",
+				zap.String("file", file),
+				zap.Error(err),
+			)
+			return buildStartupError(file, err)
+		}
+		process.command = []string{binary}
+	}
+
+	// Get deno binary path, unless the process runs its own command
+	if len(process.command) == 0 {
+		denoPath, err := pm.deno.Get()
+		if err != nil {
+			pm.logger.Error("failed to get deno binary",
+				zap.String("file", file),
+				zap.Error(err),
+			)
+			return fmt.Errorf("failed to get deno binary: %w", err)
+		}
+		process.mu.Lock()
+		process.denoPath = denoPath
+		process.mu.Unlock()
 	}
 
 	pm.logger.Debug("starting process",
@@ -239,182 +829,310 @@ func (pm *ProcessManager) getOrCreateHost(file string) (string, error) {
 			zap.String("socket_path", socketPath),
 			zap.Error(err),
 		)
-		return "", &ProcessStartupError{
-			Err:        fmt.Errorf("failed to start process: %w", err),
-			ExitCode:   -1,
-			Stdout:     process.startupStdout.String(),
-			Stderr:     process.startupStderr.String(),
-			ScriptPath: file,
-		}
+		return process.startupError(fmt.Errorf("failed to start process: %w", err))
 	}
 
-	pm.processes[file] = process
-
 	pm.logger.Info("started process",
 		zap.String("file", file),
 		zap.String("socket_path", socketPath),
-		zap.Int("pid", process.Cmd.Process.Pid),
+		zap.Int("pid", process.cmd.Process.Pid),
 	)
+	if process.inspector != "" {
+		pm.logger.Info("process inspector listening",
+			zap.String("file", file),
+			zap.String("address", process.inspector),
+			zap.String("admin_path", inspectorPrefix+strconv.Itoa(process.cmd.Process.Pid)+"/"),
+		)
+	}
 
-	if err := pm.waitForSocketReady(socketPath, time.Duration(pm.startupTimeout), process); err != nil {
-		// Check if process already exited before we try to stop it
-		exitCode := -1
-		processAlreadyExited := false
-		if process.Cmd != nil && process.Cmd.ProcessState != nil && process.Cmd.ProcessState.Exited() {
-			exitCode = process.Cmd.ProcessState.ExitCode()
-			processAlreadyExited = true
-			pm.logger.Info("process already exited during startup",
-				zap.Int("exit_code", exitCode),
+	if err := pm.waitForSocketReady(socketPath, time.Duration(pm.settings().startupTimeout), process); err != nil {
+		// Both failure modes end with the process gone, so the exit code and
+		// output are reported the same way
+		select {
+		case <-process.exitChan:
+			pm.logger.Info("process exited during startup",
 				zap.String("file", file),
+				zap.Int("exit_code", process.ExitCode()),
 			)
-		}
-
-		// Process failed to start properly - clean up and return error
-		if !processAlreadyExited {
-			// Process is still running but failed to bind socket in time
+		default:
+			// Still running but never bound the socket
 			process.Stop()
-			// Get exit code after Stop() completes
-			exitCode = process.getExitCode()
+			pm.logger.Info("process stopped after failed startup",
+				zap.String("file", file),
+				zap.Int("exit_code", process.ExitCode()),
+			)
 		}
 
-		delete(pm.processes, file)
+		return process.startupError(fmt.Errorf("process startup failed: %w", err))
+	}
 
-		return "", &ProcessStartupError{
-			Err:        fmt.Errorf("process startup failed: %w", err),
-			ExitCode:   exitCode,
-			Stdout:     process.startupStdout.String(),
-			Stderr:     process.startupStderr.String(),
-			ScriptPath: file,
-		}
+	if pm.opts.warmup != nil {
+		pm.warmUp(process, pm.opts.warmup, time.Duration(pm.settings().startupTimeout))
 	}
-	return socketPath, nil
+
+	if pm.opts.prewarmConns > 0 {
+		pm.conns.fill(socketPath, pm.opts.prewarmConns, pm.logger)
+	}
+	return nil
 }
 
+// defaultStopTimeout is how long processes get to exit after SIGTERM before
+// they are killed.
+const defaultStopTimeout = 10 * time.Second
+
+// Stop stops every process, giving those serving requests the longest to
+// finish, and the manager's background work. The manager is not used again.
 func (pm *ProcessManager) Stop() error {
 	pm.cancel()
 	pm.wg.Wait()
+	defer pm.notifier.wait()
+	if pm.opts.persistUsage {
+		defer pm.saveUsage(context.Background())
+	}
 
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+	// Processes are stopped in parallel, so shutdown takes at most the stop
+	// timeout (plus the kill of stragglers) however many processes there are,
+	// and fits in Caddy's grace period on reload. Idle processes are signalled
+	// first; processes with requests in flight get SIGTERM once the idle ones
+	// are gone, or half the timeout has passed, and the rest of the time to
+	// finish them.
+	grace := pm.settings().stopTimeout
+	if grace <= 0 {
+		grace = defaultStopTimeout
+	}
+	start := time.Now()
+	deadline := start.Add(grace)
 
-	var errors []error
-	for scriptPath, process := range pm.processes {
-		if err := process.Stop(); err != nil {
-			pm.logger.Warn("process stop returned error (may be expected during shutdown)",
-				zap.String("script_path", scriptPath),
-				zap.Error(err),
+	var idle, active []*Process
+	takenOver := pm.takenOverPIDs()
+	for _, process := range pm.processes.drain() {
+		process.mu.Lock()
+		pid := 0
+		if process.cmd != nil && process.cmd.Process != nil {
+			pid = process.cmd.Process.Pid
+		}
+		if takenOver[pid] && pid != 0 {
+			// Its exit is no longer ours to report
+			process.stopping = true
+			process.mu.Unlock()
+			pm.logger.Info("leaving process to the instance that took it over",
+				zap.String("script_path", process.scriptPath),
+				zap.Int("pid", pid),
 			)
-			errors = append(errors, fmt.Errorf("failed to stop process %s: %w", scriptPath, err))
+			continue
+		}
+		process.mu.Unlock()
+		if process.inFlight() > 0 {
+			active = append(active, process)
+		} else {
+			idle = append(idle, process)
 		}
 	}
 
-	// Clear the processes map regardless of errors since we've attempted to stop all processes
-	pm.processes = make(map[string]*Process)
+	reports := make(chan processStopReport, len(idle)+len(active))
+	var all sync.WaitGroup
+	stopAll := func(processes []*Process, phase string) *sync.WaitGroup {
+		var wg sync.WaitGroup
+		for _, process := range processes {
+			wg.Add(1)
+			all.Add(1)
+			go func() {
+				defer all.Done()
+				defer wg.Done()
+				reports <- process.stopReport(phase, deadline)
+			}()
+		}
+		return &wg
+	}
+
+	idleStopped := make(chan struct{})
+	go func() {
+		stopAll(idle, "idle").Wait()
+		close(idleStopped)
+	}()
+	if len(active) > 0 {
+		select {
+		case <-idleStopped:
+		case <-time.After(grace / 2):
+		}
+		stopAll(active, "active")
+	}
+	<-idleStopped
+	all.Wait()
+	close(reports)
 
 	// Don't return an error for process termination issues during shutdown
 	// as they are expected and shouldn't prevent Caddy from shutting down cleanly
-	if len(errors) > 0 {
-		pm.logger.Info("process manager stopped with some process cleanup warnings",
-			zap.Int("process_count", len(errors)),
-		)
-	} else {
-		pm.logger.Info("process manager stopped cleanly")
+	var killed, failed int
+	for report := range reports {
+		fields := []zap.Field{
+			zap.String("script_path", report.scriptPath),
+			zap.Int("pid", report.pid),
+			zap.String("phase", report.phase),
+			zap.String("signal", report.signal),
+			zap.Duration("duration", report.duration),
+		}
+		if report.err != nil {
+			failed++
+			pm.logger.Warn("process stop returned error (may be expected during shutdown)",
+				append(fields, zap.Error(report.err))...,
+			)
+			continue
+		}
+		if report.signal == "SIGKILL" {
+			killed++
+		}
+		pm.logger.Info("process stopped", fields...)
 	}
 
+	pm.logger.Info("process manager stopped",
+		zap.Int("idle", len(idle)),
+		zap.Int("active", len(active)),
+		zap.Int("killed", killed),
+		zap.Int("errors", failed),
+		zap.Duration("duration", time.Since(start)),
+	)
+
 	return nil
 }
 
+// cleanupLoop stops idle processes. It sleeps until the earliest expiry in
+// the idle queue, or until a process with an earlier expiry is queued.
 func (pm *ProcessManager) cleanupLoop() {
 	defer pm.wg.Done()
 
-	idleTimeout := time.Duration(pm.idleTimeout)
-	cleanupInterval := time.Hour
-	if idleTimeout < cleanupInterval {
-		cleanupInterval = idleTimeout
-	}
 	pm.logger.Debug("cleanup loop started",
-		zap.Duration("cleanup_interval", cleanupInterval),
-		zap.Duration("idle_timeout", idleTimeout),
+		zap.Duration("idle_timeout", time.Duration(pm.settings().idleTimeout)),
 	)
 
-	ticker := time.NewTicker(cleanupInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
 
 	for {
+		wait := time.Hour
+		if expiry, ok := pm.idle.next(); ok {
+			wait = time.Until(expiry)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
 		select {
 		case <-pm.ctx.Done():
 			pm.logger.Debug("cleanup loop stopped")
 			return
-		case <-ticker.C:
-			pm.logger.Debug("running periodic cleanup")
+		case <-pm.idle.wake:
+		case <-timer.C:
 			pm.cleanupIdleProcesses()
 		}
 	}
 }
 
-func (pm *ProcessManager) removeProcess(scriptPath string) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	if _, exists := pm.processes[scriptPath]; exists {
+// removeProcess drops an exited process from the pool, unless it has already
+// been replaced by a newer process for the same script.
+func (pm *ProcessManager) removeProcess(scriptPath string, process *Process) {
+	if pm.processes.remove(scriptPath, process) {
 		pm.logger.Info("removing exited process from pool",
 			zap.String("script_path", scriptPath),
 		)
-		delete(pm.processes, scriptPath)
 	}
 }
 
-func (pm *ProcessManager) closeProcessAfterRequest(file string) {
-	pm.mu.Lock()
-	process, exists := pm.processes[file]
-	if !exists {
-		pm.mu.Unlock()
-		return
-	}
+// stopProcess stops the processes running file, in every namespace. The
+// next request for file starts a new one.
+func (pm *ProcessManager) stopProcess(file string) bool {
+	stopped := false
+	for _, key := range pm.keysFor(file) {
+		process := pm.processes.get(key)
+		if process == nil || !pm.processes.remove(key, process) {
+			continue
+		}
+		stopped = true
 
-	process.mu.Lock()
-	process.activeRequests--
-	remaining := process.activeRequests
-	process.mu.Unlock()
+		if err := process.Stop(); err != nil {
+			pm.logger.Error("failed to stop process",
+				zap.String("script_path", file),
+				zap.Error(err),
+			)
+		}
+	}
+	return stopped
+}
 
-	// Remove from map immediately if last request
-	if remaining == 0 {
-		delete(pm.processes, file)
+// restartProcess replaces the processes running file with fresh ones, in
+// every namespace.
+func (pm *ProcessManager) restartProcess(file string) bool {
+	restarted := false
+	for _, key := range pm.keysFor(file) {
+		if process := pm.processes.get(key); process != nil {
+			pm.recycle(key, process, "restart requested")
+			restarted = true
+		}
 	}
-	pm.mu.Unlock()
+	return restarted
+}
 
-	// Kill process outside the lock
-	if remaining == 0 {
+// releaseProcess ends a request to process, stored under key, that
+// acquireHost or getOrCreateService counted. A process replaced meanwhile
+// is released all the same, so its count stays that of the requests it is
+// serving. In one-shot mode a process left without requests is stopped.
+func (pm *ProcessManager) releaseProcess(key string, process *Process, oneShot bool) {
+	// Kill process outside the lock if this was its last request
+	if pm.processes.release(key, process, oneShot) {
 		process.Stop()
 	}
 }
 
+// cleanupIdleProcesses stops processes whose idle queue entry is due and that
+// have not been used since. Processes used in the meantime, or still serving
+// a request, are re-queued; entries for processes that already exited are
+// dropped.
 func (pm *ProcessManager) cleanupIdleProcesses() {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	idleTimeout := time.Duration(pm.idleTimeout)
+	idleTimeout := time.Duration(pm.settings().idleTimeout)
 	now := time.Now()
 
-	for scriptPath, process := range pm.processes {
+	for _, entry := range pm.idle.popDue(now) {
+		process := entry.process
+
 		process.mu.RLock()
-		lastUsed := process.LastUsed
+		lastUsed := process.lastUsed
+		expiry := process.idleExpiryLocked(idleTimeout)
 		process.mu.RUnlock()
 
-		if now.Sub(lastUsed) > idleTimeout {
-			pm.logger.Info("stopping idle process",
-				zap.String("script_path", scriptPath),
-				zap.Duration("idle_time", now.Sub(lastUsed)),
-			)
+		if expiry.After(now) {
+			if pm.processes.get(entry.key) == process {
+				pm.idle.push(entry.key, process, expiry)
+			}
+			continue
+		}
 
-			if err := process.Stop(); err != nil {
-				pm.logger.Error("failed to stop idle process",
-					zap.String("script_path", scriptPath),
-					zap.Error(err),
-				)
-			} else {
-				delete(pm.processes, scriptPath)
+		// Remove only if no request picked the process up in the meantime
+		removed := pm.processes.removeWhen(entry.key, process, func(p *Process) bool {
+			// A process still serving a request that outlasted the timeout,
+			// or frozen for investigation, is kept
+			return p.idleExpiryLocked(idleTimeout).Before(now) && p.activeRequests == 0 && !p.frozen
+		})
+		if !removed {
+			if pm.processes.get(entry.key) == process {
+				pm.idle.push(entry.key, process, now.Add(idleTimeout))
 			}
+			continue
+		}
+
+		pm.logger.Info("stopping idle process",
+			zap.String("script_path", entry.key),
+			zap.Duration("idle_time", now.Sub(lastUsed)),
+		)
+
+		if err := process.Stop(); err != nil {
+			pm.logger.Error("failed to stop idle process",
+				zap.String("script_path", entry.key),
+				zap.Error(err),
+			)
 		}
 	}
 }
@@ -425,81 +1143,200 @@ func (p *Process) start() error {
 
 	// Run script via deno: deno run --allow-all [extra opts] script.js socketPath
 	args := []string{"run", "--allow-all"}
-	if p.DenoOpts != "" {
+	if p.opts.egress != nil {
+		args = append([]string{"run"}, p.opts.egress.denoPermissions()...)
+	}
+	if p.opts.readOnlyProject {
+		projectDir := filepath.Dir(p.scriptPath)
+		// Deny rules win over allow rules, so the data dir can't be carved
+		// out of a read-only project
+		if p.opts.dataDir != "" && isWithin(p.opts.dataDir, projectDir) {
+			return fmt.Errorf("data_dir %s is inside the read-only project directory %s", p.opts.dataDir, projectDir)
+		}
+		args = append(args, "--deny-write="+projectDir)
+	}
+	if p.opts.inspect && len(p.command) == 0 {
+		addr, err := inspectorAddress()
+		if err != nil {
+			return err
+		}
+		p.inspector = addr
+		args = append(args, "--inspect="+addr)
+	}
+	if p.opts.typeCheck {
+		args = append(args, "--check")
+	}
+	if p.denoOpts != "" {
 		// Split deno_opts by whitespace to get individual arguments
-		for _, opt := range strings.Fields(p.DenoOpts) {
+		for _, opt := range strings.Fields(p.denoOpts) {
 			args = append(args, opt)
 		}
 	}
-	args = append(args, p.ScriptPath, p.SocketPath)
-	p.Cmd = exec.Command(p.DenoPath, args...)
-	p.Cmd.Dir = filepath.Dir(p.ScriptPath)
+	args = append(args, p.scriptPath, p.SocketPath)
+	p.cmd = buildCommand(p.denoPath, args, p.opts)
+	p.cmd.Dir = filepath.Dir(p.scriptPath)
+	if len(p.command) > 0 {
+		commandArgs := append(p.command[1:len(p.command):len(p.command)], p.SocketPath)
+		p.cmd = buildCommand(p.command[0], commandArgs, p.opts)
+		// Service commands run in their directory, which scriptPath names;
+		// compiled Go handlers run in their script's directory
+		if p.opts.goCompiler == nil {
+			p.cmd.Dir = p.scriptPath
+		}
+	}
 
 	// Set up environment variables
-	p.Cmd.Env = os.Environ() // Start with parent environment
+	p.cmd.Env = os.Environ() // Start with parent environment
 	for key, value := range p.env {
-		p.Cmd.Env = append(p.Cmd.Env, fmt.Sprintf("%s=%s", key, value))
+		p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+	// Add SUBSTRATE=true to indicate the process is running in substrate, who
+	// this instance is and how it is run. There is one replica per script,
+	// so its index is always 0. The request that started the process adds
+	// SUBSTRATE_ROOT and SUBSTRATE_URL_PREFIX through startEnv.
+	p.cmd.Env = append(p.cmd.Env,
+		"SUBSTRATE=true",
+		"SUBSTRATE_INSTANCE_ID="+p.instanceID(),
+		"SUBSTRATE_REPLICA_INDEX=0",
+		"SUBSTRATE_SOCKET="+p.SocketPath,
+		"SUBSTRATE_IDLE_TIMEOUT="+formatIdleTimeout(p.idleTimeout),
+	)
+	for key, value := range p.startEnv {
+		p.cmd.Env = append(p.cmd.Env, key+"="+value)
 	}
-	// Add SUBSTRATE=true to indicate the process is running in substrate
-	p.Cmd.Env = append(p.Cmd.Env, "SUBSTRATE=true")
 
 	p.logger.Debug("configuring process command",
-		zap.String("script_path", p.ScriptPath),
+		zap.String("script_path", p.scriptPath),
 		zap.Strings("args", args),
-		zap.String("working_dir", p.Cmd.Dir),
+		zap.String("working_dir", p.cmd.Dir),
 		zap.String("socket_path", p.SocketPath),
 		zap.Any("env", p.env),
 	)
 
-	if err := configureProcessSecurity(p.Cmd, p.ScriptPath); err != nil {
+	if err := configureProcessSecurity(p.cmd, p.scriptPath, p.opts); err != nil {
 		p.logger.Error("failed to configure process security",
-			zap.String("script_path", p.ScriptPath),
+			zap.String("script_path", p.scriptPath),
 			zap.Error(err),
 		)
 		return fmt.Errorf("failed to configure process security: %w", err)
 	}
 
-	// Set up output capture before starting the process
-	stdout, err := p.Cmd.StdoutPipe()
+	if p.opts.dataDir != "" {
+		if err := prepareDataDir(p.cmd, p.opts.dataDir); err != nil {
+			p.logger.Error("failed to prepare data directory",
+				zap.String("script_path", p.scriptPath),
+				zap.String("data_dir", p.opts.dataDir),
+				zap.Error(err),
+			)
+			return fmt.Errorf("failed to prepare data directory: %w", err)
+		}
+		p.cmd.Env = append(p.cmd.Env, "SUBSTRATE_DATA_DIR="+p.opts.dataDir)
+	}
+
+	if p.opts.privateTmp {
+		tmpDir, err := createPrivateTmp(p.cmd)
+		if err != nil {
+			p.logger.Error("failed to create private temporary directory",
+				zap.String("script_path", p.scriptPath),
+				zap.Error(err),
+			)
+			return fmt.Errorf("failed to create private temporary directory: %w", err)
+		}
+		p.tmpDir = tmpDir
+		p.cmd.Env = append(p.cmd.Env, "TMPDIR="+tmpDir, "TMP="+tmpDir, "TEMP="+tmpDir)
+	}
+
+	if err := p.openControlLocked(); err != nil {
+		p.logger.Error("failed to open control socket",
+			zap.String("script_path", p.scriptPath),
+			zap.Error(err),
+		)
+		p.removeTmpDir()
+		return fmt.Errorf("failed to open control socket: %w", err)
+	}
+
+	if len(p.opts.hosts) > 0 {
+		hostsFile, err := writeHostsFile(p.opts.hosts)
+		if err != nil {
+			p.logger.Error("failed to write hosts file",
+				zap.String("script_path", p.scriptPath),
+				zap.Error(err),
+			)
+			p.removeTmpDir()
+			p.closeControl()
+			return fmt.Errorf("failed to write hosts file: %w", err)
+		}
+		p.hostsFile = hostsFile
+		isolateHosts(p.cmd)
+		// The buildCommand prelude mounts it from here
+		p.cmd.Env = append(p.cmd.Env, "SUBSTRATE_HOSTS_FILE="+hostsFile)
+	}
+
+	// Set up output capture before starting the process. The pipes are ours
+	// rather than cmd's, so Wait doesn't close them before the readers have
+	// drained what the process wrote last.
+	stdout, stdoutW, err := os.Pipe()
 	if err != nil {
 		p.logger.Warn("failed to create stdout pipe, output will not be logged",
-			zap.String("script_path", p.ScriptPath),
+			zap.String("script_path", p.scriptPath),
 			zap.Error(err),
 		)
+	} else {
+		p.cmd.Stdout = stdoutW
+		defer stdoutW.Close()
 	}
 
-	stderr, err := p.Cmd.StderrPipe()
+	stderr, stderrW, err := os.Pipe()
 	if err != nil {
 		p.logger.Warn("failed to create stderr pipe, error output will not be logged",
-			zap.String("script_path", p.ScriptPath),
+			zap.String("script_path", p.scriptPath),
 			zap.Error(err),
 		)
+	} else {
+		p.cmd.Stderr = stderrW
+		defer stderrW.Close()
 	}
 
 	p.logger.Debug("starting process",
-		zap.String("script_path", p.ScriptPath),
+		zap.String("script_path", p.scriptPath),
 		zap.String("socket_path", p.SocketPath),
 	)
 
-	if err := p.Cmd.Start(); err != nil {
+	if err := p.cmd.Start(); err != nil {
 		p.logger.Error("failed to start process",
-			zap.String("script_path", p.ScriptPath),
+			zap.String("script_path", p.scriptPath),
 			zap.Error(err),
 		)
+		if stdout != nil {
+			stdout.Close()
+		}
+		if stderr != nil {
+			stderr.Close()
+		}
+		p.removeTmpDir()
+		p.removeHostsFile()
+		p.closeControl()
 		return fmt.Errorf("failed to start process: %w", err)
 	}
+	p.startedAt = time.Now()
+	if p.opts.takeoverState != "" {
+		p.pidStart, _ = processStartTime(p.cmd.Process.Pid)
+	}
+	p.applyLimitsLocked()
 
 	// Start output logging and buffering goroutines after successful process start
 	if stdout != nil {
+		p.output.Add(1)
 		go p.logAndBufferOutput(stdout, "stdout", zap.InfoLevel, p.startupStdout)
 	}
 	if stderr != nil {
-		go p.logAndBufferOutput(stderr, "stderr", zap.ErrorLevel, p.startupStderr)
+		p.output.Add(1)
+		go p.logAndBufferOutput(stderr, "stderr", zap.ErrorLevel, io.MultiWriter(p.startupStderr, p.stderrTail))
 	}
 
 	p.logger.Info("process started successfully",
-		zap.String("script_path", p.ScriptPath),
-		zap.Int("pid", p.Cmd.Process.Pid),
+		zap.String("script_path", p.scriptPath),
+		zap.Int("pid", p.cmd.Process.Pid),
 		zap.String("socket_path", p.SocketPath),
 	)
 
@@ -508,7 +1345,8 @@ func (p *Process) start() error {
 	return nil
 }
 
-func (p *Process) logAndBufferOutput(pipe io.ReadCloser, streamType string, logLevel zapcore.Level, buffer *bytes.Buffer) {
+func (p *Process) logAndBufferOutput(pipe io.ReadCloser, streamType string, logLevel zapcore.Level, buffer io.Writer) {
+	defer p.output.Done()
 	defer pipe.Close()
 
 	// Create a tee reader to both log and buffer the output
@@ -519,8 +1357,8 @@ func (p *Process) logAndBufferOutput(pipe io.ReadCloser, streamType string, logL
 		line := strings.TrimSpace(scanner.Text())
 		if line != "" {
 			p.logger.Log(logLevel, "process output",
-				zap.String("script_path", p.ScriptPath),
-				zap.Int("pid", p.Cmd.Process.Pid),
+				zap.String("script_path", p.scriptPath),
+				zap.Int("pid", p.cmd.Process.Pid),
 				zap.String("stream", streamType),
 				zap.String("output", line),
 			)
@@ -529,36 +1367,225 @@ func (p *Process) logAndBufferOutput(pipe io.ReadCloser, streamType string, logL
 
 	if err := scanner.Err(); err != nil && err != io.EOF {
 		p.logger.Error("error reading process output",
-			zap.String("script_path", p.ScriptPath),
-			zap.Int("pid", p.Cmd.Process.Pid),
+			zap.String("script_path", p.scriptPath),
+			zap.Int("pid", p.cmd.Process.Pid),
 			zap.String("stream", streamType),
 			zap.Error(err),
 		)
 	}
 }
 
-// getExitCode returns the current exit code of the process, or -1 if not available
-func (p *Process) getExitCode() int {
+// scriptChanged reports whether the script was modified since the process
+// was created.
+func (p *Process) scriptChanged(modTime time.Time) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !modTime.Equal(p.modTime)
+}
+
+// retain records the start of a request served by the process.
+func (p *Process) retain() {
+	p.mu.Lock()
+	p.lastUsed = time.Now()
+	p.activeRequests++
+	p.mu.Unlock()
+}
+
+// Exited is closed once the process has exited.
+func (p *Process) Exited() <-chan struct{} {
+	return p.exitChan
+}
+
+// ExitCode returns the exit code of the process, or -1 while it runs or when
+// a signal ended it.
+func (p *Process) ExitCode() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	return p.exitCode
 }
 
+// ScriptPath returns the path of the script the process runs, or the
+// directory of a service command.
+func (p *Process) ScriptPath() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.scriptPath
+}
+
+// Cmd returns the command the process was started with, nil before it
+// starts. It must not be changed.
+func (p *Process) Cmd() *exec.Cmd {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cmd
+}
+
+// LastUsed returns when the process last took a request, or finished its
+// last one.
+func (p *Process) LastUsed() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastUsed
+}
+
+// DenoPath returns the deno binary the process runs with, empty for a
+// service command.
+func (p *Process) DenoPath() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.denoPath
+}
+
+// DenoOpts returns the extra options passed to deno run.
+func (p *Process) DenoOpts() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.denoOpts
+}
+
+// formatIdleTimeout returns the idle timeout in seconds, as exported in
+// SUBSTRATE_IDLE_TIMEOUT: "0" when idle processes are kept and "-1" when
+// each process serves a single request.
+func formatIdleTimeout(d caddy.Duration) string {
+	if d < 0 {
+		return "-1"
+	}
+	return strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64)
+}
+
+// StartupOutput returns what the process wrote to stdout and stderr while it
+// started. Both are empty once it is ready.
+func (p *Process) StartupOutput() (stdout, stderr string) {
+	return p.startupStdout.String(), p.startupStderr.String()
+}
+
 // clearStartupBuffers clears the startup output buffers to free memory after successful startup
 func (p *Process) clearStartupBuffers() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.startupStdout.Reset()
-	p.startupStderr.Reset()
+	p.startupStdout.stop()
+	p.startupStderr.stop()
+}
+
+// removeTmpDir deletes the private temporary directory, if any. The process
+// must have exited.
+func (p *Process) removeTmpDir() {
+	if p.tmpDir == "" {
+		return
+	}
+	if err := os.RemoveAll(p.tmpDir); err != nil {
+		p.logger.Warn("failed to remove private temporary directory",
+			zap.String("script_path", p.scriptPath),
+			zap.String("tmp_dir", p.tmpDir),
+			zap.Error(err),
+		)
+	}
+}
+
+// outputDrainTimeout bounds how long an exited process's output is read
+// before exitChan is closed. Children of the script can keep the pipes open
+// indefinitely.
+const outputDrainTimeout = time.Second
+
+// startupError describes a failed startup. The process must have exited, so
+// its exit code and output are final.
+func (p *Process) startupError(err error) *ProcessStartupError {
+	startupErr := &ProcessStartupError{
+		Err:        err,
+		ExitCode:   p.ExitCode(),
+		Stdout:     p.startupStdout.String(),
+		Stderr:     p.startupStderr.String(),
+		ScriptPath: p.scriptPath,
+	}
+	if p.cmd != nil {
+		startupErr.Command = p.cmd.Args
+		inherited := make(map[string]bool)
+		for _, entry := range os.Environ() {
+			inherited[entry] = true
+		}
+		for _, entry := range p.cmd.Env {
+			if !inherited[entry] {
+				startupErr.Env = append(startupErr.Env, entry)
+			}
+		}
+	}
+	return startupErr
+}
+
+// buildStartupError reports a failed build step like a failed start, with the
+// build's output as stderr.
+func buildStartupError(file string, err error) *ProcessStartupError {
+	startupErr := &ProcessStartupError{Err: err, ExitCode: -1, ScriptPath: file}
+	var buildErr *BuildError
+	if errors.As(err, &buildErr) {
+		startupErr.Stderr = buildErr.Output
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		startupErr.ExitCode = exitErr.ExitCode()
+	}
+	return startupErr
+}
+
+// startupBuffer collects process output until startup is over. It is written
+// by the output readers while startup failures read it.
+type startupBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	stopped bool
+}
+
+func (b *startupBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.stopped {
+		b.buf.Write(data)
+	}
+	return len(data), nil
+}
+
+func (b *startupBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// stop frees the buffer and discards later output.
+func (b *startupBuffer) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	b.buf = bytes.Buffer{}
 }
 
 func (p *Process) monitor() {
-	err := p.Cmd.Wait()
+	err := p.cmd.Wait()
+
+	// Let the readers take in the last output, so it is in the startup buffers
+	// before anyone waiting on exitChan reads them
+	drained := make(chan struct{})
+	go func() {
+		p.output.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(outputDrainTimeout):
+	}
+
+	p.removeTmpDir()
+	p.removeHostsFile()
+	p.closeControl()
+	p.removeCgroup()
 
+	coreDumped := false
 	p.mu.Lock()
+	p.exitedAt = time.Now()
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			p.exitCode = exitError.ExitCode()
+			if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				p.exitSignal = unix.SignalName(status.Signal())
+				coreDumped = status.CoreDump()
+			}
 		} else {
 			p.exitCode = -1
 		}
@@ -567,19 +1594,45 @@ func (p *Process) monitor() {
 	}
 
 	stopping := p.stopping
-	scriptPath := p.ScriptPath
+	scriptPath := p.scriptPath
 	exitCode := p.exitCode
+	pid, startedAt := p.cmd.Process.Pid, p.startedAt
 	p.mu.Unlock()
 
+	var corePath string
+	if coreDumped && p.opts.coreDumpDir != "" {
+		path, err := p.collectCore(pid, startedAt)
+		if err != nil {
+			p.logger.Warn("failed to collect core dump",
+				zap.String("script_path", scriptPath),
+				zap.Int("pid", pid),
+				zap.Error(err),
+			)
+		}
+		p.mu.Lock()
+		p.corePath = path
+		p.mu.Unlock()
+		corePath = path
+	}
+
+	// Recorded first, so whoever waits on exitChan finds the exit
+	p.recordExit()
 	close(p.exitChan)
 
 	// Only log unexpected exits as errors
 	if exitCode != 0 && !stopping {
-		p.logger.Error("process crashed",
+		fields := []zap.Field{
 			zap.String("script_path", scriptPath),
 			zap.Int("exit_code", exitCode),
 			zap.Error(err),
-		)
+		}
+		if corePath != "" {
+			fields = append(fields, zap.String("core", corePath))
+		}
+		p.logger.Error("process crashed", fields...)
+		if p.onCrash != nil {
+			p.onCrash(exitCode)
+		}
 	} else if exitCode == 0 && !stopping {
 		p.logger.Info("process exited normally",
 			zap.String("script_path", scriptPath),
@@ -589,116 +1642,225 @@ func (p *Process) monitor() {
 	p.onExit()
 }
 
+// instanceID identifies the process among all processes of the host: the
+// random part of its socket name.
+func (p *Process) instanceID() string {
+	name := strings.TrimSuffix(filepath.Base(p.SocketPath), ".sock")
+	return strings.TrimPrefix(name, "substrate-")
+}
+
+// drain marks the process as about to be stopped: its stashed and idle pooled
+// connections are closed, and requests still routed to it are sent with
+// Connection: close, so clients never get a reset from a keep-alive
+// connection the process drops on exit.
+func (p *Process) drain() {
+	p.mu.Lock()
+	if p.draining {
+		p.mu.Unlock()
+		return
+	}
+	p.draining = true
+	onDrain := p.onDrain
+	p.mu.Unlock()
+
+	if onDrain != nil {
+		onDrain()
+	}
+}
+
+// Stop sends the process SIGTERM and kills it if it has not exited within
+// 10 seconds.
 func (p *Process) Stop() error {
+	_, err := p.stopUntil(time.Now().Add(defaultStopTimeout))
+	return err
+}
+
+// processStopReport describes how a process was stopped on shutdown.
+type processStopReport struct {
+	scriptPath string
+	pid        int
+	phase      string // "idle" or "active", see ProcessManager.Stop
+	signal     string // the last signal sent
+	duration   time.Duration
+	err        error
+}
+
+func (p *Process) stopReport(phase string, deadline time.Time) processStopReport {
+	report := processStopReport{scriptPath: p.scriptPath, phase: phase, signal: "SIGTERM"}
+	p.mu.RLock()
+	if p.cmd != nil && p.cmd.Process != nil {
+		report.pid = p.cmd.Process.Pid
+	}
+	p.mu.RUnlock()
+
+	start := time.Now()
+	killed, err := p.stopUntil(deadline)
+	report.duration = time.Since(start)
+	report.err = err
+	if killed {
+		report.signal = "SIGKILL"
+	}
+	return report
+}
+
+// inFlight returns the number of requests the process is serving.
+func (p *Process) inFlight() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.activeRequests
+}
+
+// stopUntil sends SIGTERM and kills the process if it has not exited by
+// deadline, reporting whether it had to be killed.
+func (p *Process) stopUntil(deadline time.Time) (killed bool, err error) {
 	p.mu.Lock()
-	if p.Cmd == nil || p.Cmd.Process == nil {
+	if p.cmd == nil || p.cmd.Process == nil {
 		p.mu.Unlock()
-		return nil
+		return false, nil
 	}
 
 	p.stopping = true
-	pid := p.Cmd.Process.Pid
+	pid := p.cmd.Process.Pid
+	p.mu.Unlock()
+
+	p.drain()
+
+	p.mu.Lock()
 	exitChan := p.exitChan
+	// A frozen process could not handle SIGTERM
+	if err := p.thawLocked(); err != nil {
+		p.logger.Warn("failed to thaw process before stopping it",
+			zap.String("script_path", p.scriptPath),
+			zap.Error(err),
+		)
+	}
 	p.mu.Unlock()
 
 	p.logger.Info("stopping process",
-		zap.String("script_path", p.ScriptPath),
+		zap.String("script_path", p.scriptPath),
 		zap.Int("pid", pid),
 	)
 
 	// Send SIGTERM
 	p.mu.Lock()
-	proc := p.Cmd.Process
+	proc := p.cmd.Process
 	p.mu.Unlock()
 
 	if proc != nil {
 		if err := proc.Signal(syscall.SIGTERM); err != nil {
-			return fmt.Errorf("failed to send SIGTERM: %w", err)
+			return false, fmt.Errorf("failed to send SIGTERM: %w", err)
 		}
 	}
 
 	// Wait for exit with timeout
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
 	select {
-	case <-time.After(10 * time.Second):
+	case <-timer.C:
 		p.logger.Warn("process did not exit, force killing",
-			zap.String("script_path", p.ScriptPath),
+			zap.String("script_path", p.scriptPath),
 			zap.Int("pid", pid),
 		)
 		p.mu.Lock()
-		proc := p.Cmd.Process
+		proc := p.cmd.Process
 		p.mu.Unlock()
 		if proc != nil {
 			proc.Kill()
 		}
 		<-exitChan
+		killed = true
 	case <-exitChan:
 	}
 
 	// Clean up socket
 	os.Remove(p.SocketPath)
-	return nil
+	return killed, nil
 }
 
+// How often a starting process's socket is tried, and how long each try may
+// take, unless socket_poll_interval and socket_dial_timeout say otherwise.
+const (
+	defaultSocketPollInterval = 10 * time.Millisecond
+	defaultSocketDialTimeout  = 500 * time.Millisecond
+)
+
+// waitForSocketReady polls the readiness checker, by default one that dials
+// the process socket, until the process passes it. It fails when the timeout
+// passes or as soon as the process exits.
 func (pm *ProcessManager) waitForSocketReady(socketPath string, timeout time.Duration, process *Process) error {
-	deadline := time.Now().Add(timeout)
 	start := time.Now()
 
+	// The readiness check gets what is left of the timeout
+	probeCtx, cancelProbe := context.WithDeadline(pm.ctx, start.Add(timeout))
+	defer cancelProbe()
+	checker, err := pm.opts.readiness.checker()
+	if err != nil {
+		return err
+	}
+	if closer, ok := checker.(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	pm.logger.Info("waiting for socket to become ready",
 		zap.String("socket_path", socketPath),
 		zap.Duration("timeout", timeout),
-		zap.String("script_path", process.ScriptPath),
+		zap.String("script_path", process.scriptPath),
 	)
 
-	ticker := time.NewTicker(10 * time.Millisecond)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	settings := pm.settings()
+	pollInterval, dialTimeout := settings.socketPollInterval, settings.socketDialTimeout
+	if pollInterval <= 0 {
+		pollInterval = defaultSocketPollInterval
+	}
+	if dialTimeout <= 0 {
+		dialTimeout = defaultSocketDialTimeout
+	}
+	if socket, ok := checker.(*socketReadiness); ok {
+		socket.dialTimeout = dialTimeout
+	}
+	var notReady error // last readiness check failure
+	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
 	attemptCount := 0
 	for {
-		// Simple timeout check at the start of each iteration
-		if time.Now().After(deadline) {
+		select {
+		case <-deadline.C:
 			pm.logger.Error("timeout waiting for socket to become ready",
 				zap.String("socket_path", socketPath),
 				zap.Duration("timeout", timeout),
 				zap.Duration("elapsed", time.Since(start)),
 				zap.Int("attempts", attemptCount),
-				zap.String("script_path", process.ScriptPath),
+				zap.String("script_path", process.scriptPath),
 			)
+			if notReady != nil {
+				return fmt.Errorf("timeout waiting for socket %s to become ready after %v: %w", socketPath, timeout, notReady)
+			}
 			return fmt.Errorf("timeout waiting for socket %s to become ready after %v", socketPath, timeout)
-		}
-
-		select {
-		case <-time.After(time.Until(deadline)):
-			pm.logger.Error("timeout waiting for socket to become ready (select case)",
+		case <-process.exitChan:
+			// monitor sets the exit code before closing exitChan
+			exitCode := process.ExitCode()
+			pm.logger.Error("process exited before socket became ready",
 				zap.String("socket_path", socketPath),
-				zap.Duration("timeout", timeout),
-				zap.Duration("elapsed", time.Since(start)),
+				zap.Int("exit_code", exitCode),
+				zap.String("script_path", process.scriptPath),
 				zap.Int("attempts", attemptCount),
-				zap.String("script_path", process.ScriptPath),
 			)
-			return fmt.Errorf("timeout waiting for socket %s to become ready after %v", socketPath, timeout)
+			return fmt.Errorf("process exited before socket became ready (exit code: %d)", exitCode)
 		case <-ticker.C:
 			attemptCount++
 
-			// Check if process is still alive before trying to connect
-			if process.Cmd.ProcessState != nil && process.Cmd.ProcessState.Exited() {
-				pm.logger.Error("process exited before socket became ready",
-					zap.String("socket_path", socketPath),
-					zap.Int("exit_code", process.Cmd.ProcessState.ExitCode()),
-					zap.String("script_path", process.ScriptPath),
-					zap.Int("attempts", attemptCount),
-				)
-				return fmt.Errorf("process exited before socket became ready (exit code: %d)", process.Cmd.ProcessState.ExitCode())
-			}
-
-			conn, err := net.DialTimeout("unix", socketPath, 500*time.Millisecond)
+			err := checker.Ready(probeCtx, process)
+			notReady = err
 			if err == nil {
-				conn.Close()
 				waitTime := time.Since(start)
 				pm.logger.Info("socket became ready",
 					zap.String("socket_path", socketPath),
 					zap.Duration("wait_time", waitTime),
 					zap.Int("attempts", attemptCount),
-					zap.String("script_path", process.ScriptPath),
+					zap.String("script_path", process.scriptPath),
 				)
 				// Clear startup buffers to free memory after successful startup
 				process.clearStartupBuffers()
@@ -710,7 +1872,6 @@ func (pm *ProcessManager) waitForSocketReady(socketPath string, timeout time.Dur
 				pm.logger.Info("still waiting for socket to become ready",
 					zap.String("socket_path", socketPath),
 					zap.Duration("elapsed", time.Since(start)),
-					zap.Duration("remaining", time.Until(deadline)),
 					zap.Int("attempts", attemptCount),
 					zap.String("last_error", err.Error()),
 				)
@@ -0,0 +1,49 @@
+package substrate
+
+import (
+	"strconv"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultMaxProcesses is the pids.max of a process's cgroup when
+// max_processes is not set: far above what a server needs, far below what a
+// fork bomb reaches.
+const defaultMaxProcesses = 512
+
+// cgroupLimits returns the cgroup v2 limits of a process.
+func (opts processOptions) cgroupLimits() []cgroupLimit {
+	var limits []cgroupLimit
+	if opts.maxProcesses > 0 {
+		limits = append(limits, cgroupLimit{"pids.max", strconv.Itoa(opts.maxProcesses)})
+	}
+	for _, line := range opts.ioMax {
+		limits = append(limits, cgroupLimit{"io.max", line})
+	}
+	return limits
+}
+
+// applyLimitsLocked moves a just started process into its own cgroup with
+// the configured limits. Without a writable cgroup v2 hierarchy the process
+// runs unlimited; that is a warning only when the limits were configured
+// explicitly. p.mu must be held.
+func (p *Process) applyLimitsLocked() {
+	limits := p.opts.cgroupLimits()
+	if len(limits) == 0 {
+		return
+	}
+	if err := p.ensureCgroupLocked(limits); err != nil {
+		level := zapcore.DebugLevel
+		if p.opts.explicitLimits {
+			level = zapcore.WarnLevel
+		}
+		if c := p.logger.Check(level, "failed to apply process limits, running without them"); c != nil {
+			c.Write(
+				zap.String("script_path", p.scriptPath),
+				zap.Any("limits", limits),
+				zap.Error(err),
+			)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package substrate
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeCgroupRoot points the cgroup code at a fake cgroup v2 hierarchy with
+// Caddy in /system.slice/caddy.service, and returns Caddy's cgroup in it.
+func fakeCgroupRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	selfCgroup := filepath.Join(t.TempDir(), "cgroup")
+	if err := os.WriteFile(selfCgroup, []byte("0::/system.slice/caddy.service\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "system.slice/caddy.service"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldRoot, oldSelf := cgroupRoot, selfCgroupFile
+	cgroupRoot, selfCgroupFile = root, selfCgroup
+	t.Cleanup(func() { cgroupRoot, selfCgroupFile = oldRoot, oldSelf })
+	return filepath.Join(root, "system.slice/caddy.service")
+}
+
+func TestProcess_ApplyLimits(t *testing.T) {
+	parent := fakeCgroupRoot(t)
+	process := &Process{
+		scriptPath: "/srv/app.js",
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: 4242}},
+		startedAt:  time.Now(),
+		logger:     zap.NewNop(),
+		opts:       processOptions{maxProcesses: 64},
+	}
+	process.applyLimitsLocked()
+
+	cgroup := filepath.Join(parent, "substrate-4242")
+	if process.cgroupDir != cgroup {
+		t.Fatalf("Expected the process in %s, got %q", cgroup, process.cgroupDir)
+	}
+	for name, want := range map[string]string{"pids.max": "64", "cgroup.procs": "4242"} {
+		data, err := os.ReadFile(filepath.Join(cgroup, name))
+		if err != nil || string(data) != want {
+			t.Errorf("Expected %s %q, got %q (%v)", name, want, data, err)
+		}
+	}
+
+	// Freezing reuses the cgroup
+	if err := process.freeze(); err != nil {
+		t.Fatalf("freeze failed: %v", err)
+	}
+	if process.cgroupDir != cgroup {
+		t.Errorf("Expected freeze to keep cgroup %s, got %s", cgroup, process.cgroupDir)
+	}
+}
+
+func TestProcess_ApplyLimitsWithoutCgroups(t *testing.T) {
+	oldSelf := selfCgroupFile
+	selfCgroupFile = filepath.Join(t.TempDir(), "missing")
+	t.Cleanup(func() { selfCgroupFile = oldSelf })
+
+	for _, explicit := range []bool{false, true} {
+		core, logs := observer.New(zapcore.DebugLevel)
+		process := &Process{
+			scriptPath: "/srv/app.js",
+			cmd:        &exec.Cmd{Process: &os.Process{Pid: 4242}},
+			logger:     zap.New(core),
+			opts:       processOptions{maxProcesses: 64, explicitLimits: explicit},
+		}
+		process.applyLimitsLocked()
+
+		entries := logs.FilterMessage("failed to apply process limits, running without them").All()
+		if len(entries) != 1 {
+			t.Fatalf("Expected one log entry, got %v", logs.All())
+		}
+		if want := map[bool]zapcore.Level{false: zapcore.DebugLevel, true: zapcore.WarnLevel}[explicit]; entries[0].Level != want {
+			t.Errorf("explicit %v: expected level %v, got %v", explicit, want, entries[0].Level)
+		}
+		if process.cgroupDir != "" {
+			t.Errorf("Expected no cgroup, got %s", process.cgroupDir)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfile_MaxProcesses(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		max_processes 128
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.MaxProcesses != 128 {
+		t.Errorf("Expected max_processes 128, got %d", transport.MaxProcesses)
+	}
+
+	transport.MaxProcesses = -2
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for max_processes -2")
+	}
+}
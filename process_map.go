@@ -0,0 +1,196 @@
+package substrate
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// processShardCount is the number of independently locked shards in a
+// processMap. Requests for different scripts rarely contend on the same lock.
+const processShardCount = 32
+
+// processMap is a sharded map from script path to its running Process. Each
+// shard has its own RWMutex, so lookups for different scripts proceed in
+// parallel and a process starting up never blocks the whole map.
+type processMap struct {
+	shards [processShardCount]processShard
+}
+
+type processShard struct {
+	mu        sync.RWMutex
+	processes map[string]*Process
+}
+
+func newProcessMap() *processMap {
+	m := &processMap{}
+	for i := range m.shards {
+		m.shards[i].processes = make(map[string]*Process)
+	}
+	return m
+}
+
+func (m *processMap) shard(key string) *processShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &m.shards[h.Sum32()%processShardCount]
+}
+
+// get returns the process for key, or nil.
+func (m *processMap) get(key string) *Process {
+	s := m.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.processes[key]
+}
+
+// acquire returns the process for key with one more active request recorded
+// on it. When no process exists, create is called with the shard locked and
+// its result is stored; created reports whether that happened. The caller that
+// created the process is responsible for starting it.
+func (m *processMap) acquire(key string, create func() (*Process, error)) (process *Process, created bool, err error) {
+	s := m.shard(key)
+
+	s.mu.RLock()
+	if process = s.processes[key]; process != nil {
+		process.retain()
+		s.mu.RUnlock()
+		return process, false, nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Another request may have created it while we waited for the write lock
+	if process = s.processes[key]; process != nil {
+		process.retain()
+		return process, false, nil
+	}
+
+	process, err = create()
+	if err != nil {
+		return nil, false, err
+	}
+	process.retain()
+	s.processes[key] = process
+	return process, true, nil
+}
+
+// store adds process under key unless key already has one, reporting
+// whether it was added.
+func (m *processMap) store(key string, process *Process) bool {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processes[key] != nil {
+		return false
+	}
+	s.processes[key] = process
+	return true
+}
+
+// release records the end of a request on process. When removeIfIdle is set
+// and no requests remain, the process is removed from the map while the shard
+// is still locked, so no new request can pick it up; removed reports this.
+func (m *processMap) release(key string, process *Process, removeIfIdle bool) (removed bool) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	process.mu.Lock()
+	if process.activeRequests > 0 {
+		process.activeRequests--
+	}
+	remaining := process.activeRequests
+	if remaining == 0 {
+		// The idle timeout counts from the end of the last request
+		process.lastUsed = time.Now()
+	}
+	process.mu.Unlock()
+
+	if removeIfIdle && remaining == 0 && s.processes[key] == process {
+		delete(s.processes, key)
+		return true
+	}
+	return false
+}
+
+// remove deletes key only if it still maps to process, so a late exit of an
+// old process never evicts its replacement.
+func (m *processMap) remove(key string, process *Process) bool {
+	return m.removeWhen(key, process, nil)
+}
+
+// replace swaps old for replacement under key, only if key still maps to old.
+func (m *processMap) replace(key string, old, replacement *Process) bool {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processes[key] != old {
+		return false
+	}
+	s.processes[key] = replacement
+	return true
+}
+
+// removeWhen deletes key if it still maps to process and match (if non-nil)
+// returns true. match runs with the shard and the process locked, so no
+// request can acquire the process while it decides.
+func (m *processMap) removeWhen(key string, process *Process, match func(*Process) bool) bool {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.processes[key] != process {
+		return false
+	}
+	if match != nil {
+		process.mu.RLock()
+		ok := match(process)
+		process.mu.RUnlock()
+		if !ok {
+			return false
+		}
+	}
+	delete(s.processes, key)
+	return true
+}
+
+// removeIf deletes and returns every process for which match returns true.
+func (m *processMap) removeIf(match func(key string, process *Process) bool) map[string]*Process {
+	removed := make(map[string]*Process)
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		for key, process := range s.processes {
+			if match(key, process) {
+				delete(s.processes, key)
+				removed[key] = process
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// drain removes and returns every process.
+func (m *processMap) drain() map[string]*Process {
+	return m.removeIf(func(string, *Process) bool { return true })
+}
+
+// snapshot returns a copy of the current contents.
+func (m *processMap) snapshot() map[string]*Process {
+	result := make(map[string]*Process)
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		for key, process := range s.processes {
+			result[key] = process
+		}
+		s.mu.RUnlock()
+	}
+	return result
+}
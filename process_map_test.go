@@ -0,0 +1,129 @@
+package substrate
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProcessMap_AcquireCreatesOnce(t *testing.T) {
+	m := newProcessMap()
+
+	var creates atomic.Int32
+	var wg sync.WaitGroup
+	results := make([]*Process, 50)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			process, _, err := m.acquire("/srv/app.js", func() (*Process, error) {
+				creates.Add(1)
+				return &Process{scriptPath: "/srv/app.js"}, nil
+			})
+			if err != nil {
+				t.Errorf("acquire failed: %v", err)
+			}
+			results[i] = process
+		}(i)
+	}
+	wg.Wait()
+
+	if creates.Load() != 1 {
+		t.Errorf("Expected exactly one create, got %d", creates.Load())
+	}
+	for _, process := range results {
+		if process != results[0] {
+			t.Fatal("All concurrent acquires should share the same process")
+		}
+	}
+	if results[0].activeRequests != len(results) {
+		t.Errorf("Expected %d active requests, got %d", len(results), results[0].activeRequests)
+	}
+}
+
+func TestProcessMap_CreateError(t *testing.T) {
+	m := newProcessMap()
+
+	_, created, err := m.acquire("/srv/app.js", func() (*Process, error) {
+		return nil, fmt.Errorf("rejected")
+	})
+	if err == nil || created {
+		t.Errorf("Expected create error to be returned, got created=%v err=%v", created, err)
+	}
+	if m.get("/srv/app.js") != nil {
+		t.Error("Failed create should not leave an entry")
+	}
+}
+
+func TestProcessMap_RemoveOnlyMatchingProcess(t *testing.T) {
+	m := newProcessMap()
+	old := &Process{}
+	replacement := &Process{}
+
+	m.acquire("/srv/app.js", func() (*Process, error) { return old, nil })
+	if !m.remove("/srv/app.js", old) {
+		t.Fatal("Removing the current process should succeed")
+	}
+
+	m.acquire("/srv/app.js", func() (*Process, error) { return replacement, nil })
+	if m.remove("/srv/app.js", old) {
+		t.Error("Removing a stale process must not evict its replacement")
+	}
+	if m.get("/srv/app.js") != replacement {
+		t.Error("Replacement process should still be in the map")
+	}
+}
+
+func TestProcessMap_ReleaseRemovesIdle(t *testing.T) {
+	m := newProcessMap()
+	process, _, _ := m.acquire("/srv/app.js", func() (*Process, error) { return &Process{}, nil })
+	m.acquire("/srv/app.js", nil)
+
+	if m.release("/srv/app.js", process, true) {
+		t.Error("Process with a remaining request should not be removed")
+	}
+	if !m.release("/srv/app.js", process, true) {
+		t.Error("Process should be removed after its last request")
+	}
+	if m.get("/srv/app.js") != nil {
+		t.Error("Released process should no longer be in the map")
+	}
+}
+
+func BenchmarkProcessMap_Acquire(b *testing.B) {
+	m := newProcessMap()
+	keys := make([]string, 256)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("/srv/site/script-%d.js", i)
+		m.acquire(keys[i], func() (*Process, error) { return &Process{}, nil })
+	}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			process, _, _ := m.acquire(key, nil)
+			m.release(key, process, false)
+			i++
+		}
+	})
+}
+
+func TestProcessMap_ReplaceOnlyMatchingProcess(t *testing.T) {
+	m := newProcessMap()
+	old := &Process{}
+	replacement := &Process{}
+
+	m.acquire("/srv/app.js", func() (*Process, error) { return old, nil })
+	if !m.replace("/srv/app.js", old, replacement) {
+		t.Fatal("Replacing the current process should succeed")
+	}
+	if m.get("/srv/app.js") != replacement {
+		t.Error("Replacement should be in the map")
+	}
+	if m.replace("/srv/app.js", old, &Process{}) {
+		t.Error("Replacing a stale process must fail")
+	}
+}
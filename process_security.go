@@ -5,6 +5,9 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -18,14 +21,22 @@ import (
 //
 // This implements "your script runs as you" - file ownership controls execution privileges.
 // No executable permission check is needed since scripts run via Deno.
-func configureProcessSecurity(cmd *exec.Cmd, filePath string) error {
+//
+// A configured group or supplementary group list replaces the file's group and
+// the (empty) supplementary list. Changing groups requires running as root.
+func configureProcessSecurity(cmd *exec.Cmd, filePath string, opts processOptions) error {
 	currentUser, err := user.Current()
 	if err != nil {
 		return fmt.Errorf("failed to get current user: %w", err)
 	}
 
+	hasGroupOverride := opts.gid != nil || len(opts.groups) > 0
+
 	// Only drop privileges if running as root
 	if currentUser.Uid != "0" {
+		if hasGroupOverride {
+			return fmt.Errorf("group and supplementary_groups require running as root")
+		}
 		return nil
 	}
 
@@ -41,9 +52,12 @@ func configureProcessSecurity(cmd *exec.Cmd, filePath string) error {
 
 	fileUID := stat.Uid
 	fileGID := stat.Gid
+	if opts.gid != nil {
+		fileGID = *opts.gid
+	}
 
 	// Don't drop privileges if file is owned by root
-	if fileUID == 0 {
+	if fileUID == 0 && !hasGroupOverride {
 		return nil
 	}
 
@@ -52,8 +66,9 @@ func configureProcessSecurity(cmd *exec.Cmd, filePath string) error {
 	}
 
 	cmd.SysProcAttr.Credential = &syscall.Credential{
-		Uid: fileUID,
-		Gid: fileGID,
+		Uid:    fileUID,
+		Gid:    fileGID,
+		Groups: opts.groups,
 	}
 
 	cmd.SysProcAttr.Setpgid = true
@@ -61,3 +76,222 @@ func configureProcessSecurity(cmd *exec.Cmd, filePath string) error {
 
 	return nil
 }
+
+// createPrivateTmp creates a temporary directory only the process can use,
+// owned by the user and group cmd will run as.
+func createPrivateTmp(cmd *exec.Cmd) (string, error) {
+	dir, err := os.MkdirTemp("", "substrate-tmp-")
+	if err != nil {
+		return "", err
+	}
+
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		cred := cmd.SysProcAttr.Credential
+		if err := os.Chown(dir, int(cred.Uid), int(cred.Gid)); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// prepareDataDir creates dir if needed and hands it to the user and group
+// cmd will run as, so the process can write to it.
+func prepareDataDir(cmd *exec.Cmd, dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		cred := cmd.SysProcAttr.Credential
+		return os.Chown(dir, int(cred.Uid), int(cred.Gid))
+	}
+	return nil
+}
+
+// isWithin reports whether path is dir or inside it.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// buildCommand returns the command that launches the runtime. Settings that
+// exec.Cmd cannot express, such as the umask, are applied by a small /bin/sh
+// prelude that then execs the runtime in place, keeping the same pid. With
+// hosts entries, the prelude runs in the namespaces set up by isolateHosts
+// and mounts the file named by SUBSTRATE_HOSTS_FILE over /etc/hosts.
+func buildCommand(path string, args []string, opts processOptions) *exec.Cmd {
+	var prelude []string
+	if len(opts.hosts) > 0 {
+		prelude = append(prelude, `mount --bind "$SUBSTRATE_HOSTS_FILE" `+systemHostsFile)
+	}
+	if opts.umask != "" {
+		prelude = append(prelude, "umask "+opts.umask)
+	}
+	if opts.maxOpenFiles > 0 {
+		prelude = append(prelude, "ulimit -n "+strconv.Itoa(opts.maxOpenFiles))
+	}
+	if opts.coreDumpDir != "" {
+		prelude = append(prelude, "ulimit -c unlimited")
+	}
+
+	if len(prelude) == 0 {
+		return exec.Command(path, args...)
+	}
+
+	script := strings.Join(prelude, " && ") + ` && exec "$@"`
+	shArgs := append([]string{"-c", script, "substrate", path}, args...)
+	return exec.Command("/bin/sh", shArgs...)
+}
+
+// parseUmask validates an octal umask such as "0027".
+func parseUmask(umask string) (string, error) {
+	value, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || value > 0777 {
+		return "", fmt.Errorf("invalid umask %q: must be an octal value between 0000 and 0777", umask)
+	}
+	return fmt.Sprintf("%04o", value), nil
+}
+
+// lookupGID resolves a group name or numeric gid string.
+func lookupGID(group string) (uint32, error) {
+	if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q: %w", group, err)
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gid %q for group %q", g.Gid, group)
+	}
+	return uint32(gid), nil
+}
+
+// Script policy rule names, reported in ScriptPolicyError.Rule.
+const (
+	RuleWorldWritable = "world_writable"
+	RuleOwner         = "owner"
+	RuleStickyDir     = "sticky_dir"
+)
+
+// ScriptPolicy describes ownership and permission rules a script must satisfy
+// before substrate will run it. The zero value allows every script.
+type ScriptPolicy struct {
+	// RejectWorldWritable refuses scripts that any user on the host can modify.
+	RejectWorldWritable bool `json:"reject_world_writable,omitempty"`
+
+	// RejectStickyDirs refuses scripts located anywhere below a sticky-bit
+	// directory such as /tmp, where other users can plant files.
+	RejectStickyDirs bool `json:"reject_sticky_dirs,omitempty"`
+
+	// AllowedOwners restricts scripts to those owned by one of the listed
+	// users, given as user names or numeric uids.
+	AllowedOwners []string `json:"allowed_owners,omitempty"`
+
+	allowedUIDs map[uint32]struct{}
+}
+
+// ScriptPolicyError reports which policy rule a script violated.
+type ScriptPolicyError struct {
+	Rule       string
+	ScriptPath string
+	Detail     string
+}
+
+func (e *ScriptPolicyError) Error() string {
+	return fmt.Sprintf("script policy violation (%s): %s: %s", e.Rule, e.ScriptPath, e.Detail)
+}
+
+// provision resolves AllowedOwners into uids.
+func (p *ScriptPolicy) provision() error {
+	if len(p.AllowedOwners) == 0 {
+		return nil
+	}
+
+	p.allowedUIDs = make(map[uint32]struct{}, len(p.AllowedOwners))
+	for _, owner := range p.AllowedOwners {
+		uid, err := lookupUID(owner)
+		if err != nil {
+			return fmt.Errorf("allowed_owners: %w", err)
+		}
+		p.allowedUIDs[uid] = struct{}{}
+	}
+	return nil
+}
+
+// check verifies that filePath satisfies the policy. Symlinks are followed, so
+// the rules apply to the file that will actually be executed.
+func (p *ScriptPolicy) check(filePath string) error {
+	if p == nil {
+		return nil
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", filePath, err)
+	}
+
+	if p.RejectWorldWritable && fileInfo.Mode().Perm()&0002 != 0 {
+		return &ScriptPolicyError{
+			Rule:       RuleWorldWritable,
+			ScriptPath: filePath,
+			Detail:     fmt.Sprintf("file mode %04o is world-writable", fileInfo.Mode().Perm()),
+		}
+	}
+
+	if p.allowedUIDs != nil {
+		stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("failed to get file system info for %s", filePath)
+		}
+		if _, allowed := p.allowedUIDs[stat.Uid]; !allowed {
+			return &ScriptPolicyError{
+				Rule:       RuleOwner,
+				ScriptPath: filePath,
+				Detail:     fmt.Sprintf("owner uid %d is not in allowed_owners", stat.Uid),
+			}
+		}
+	}
+
+	if p.RejectStickyDirs {
+		resolved, err := filepath.EvalSymlinks(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", filePath, err)
+		}
+		for dir := filepath.Dir(resolved); ; dir = filepath.Dir(dir) {
+			dirInfo, err := os.Stat(dir)
+			if err != nil {
+				return fmt.Errorf("failed to stat directory %s: %w", dir, err)
+			}
+			if dirInfo.Mode()&os.ModeSticky != 0 {
+				return &ScriptPolicyError{
+					Rule:       RuleStickyDir,
+					ScriptPath: filePath,
+					Detail:     fmt.Sprintf("located below sticky directory %s", dir),
+				}
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// lookupUID resolves a user name or numeric uid string.
+func lookupUID(owner string) (uint32, error) {
+	if uid, err := strconv.ParseUint(owner, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, fmt.Errorf("unknown user %q: %w", owner, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid uid %q for user %q", u.Uid, owner)
+	}
+	return uint32(uid), nil
+}
@@ -1,10 +1,17 @@
 package substrate
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 )
 
 func TestConfigureProcessSecurity_NonRoot(t *testing.T) {
@@ -22,7 +29,7 @@ func TestConfigureProcessSecurity_NonRoot(t *testing.T) {
 	}
 
 	cmd := exec.Command("deno", "run", filePath)
-	err = configureProcessSecurity(cmd, filePath)
+	err = configureProcessSecurity(cmd, filePath, processOptions{})
 
 	if err != nil {
 		t.Errorf("Unexpected error when not running as root: %v", err)
@@ -59,7 +66,7 @@ func TestConfigureProcessSecurity_FilePermissions(t *testing.T) {
 			}
 
 			cmd := exec.Command("deno", "run", filePath)
-			err = configureProcessSecurity(cmd, filePath)
+			err = configureProcessSecurity(cmd, filePath, processOptions{})
 
 			if err != nil {
 				t.Errorf("Unexpected error for file with mode %o: %v", tc.mode, err)
@@ -78,7 +85,7 @@ func TestConfigureProcessSecurity_NonExistentFile(t *testing.T) {
 	nonExistentPath := "/path/that/does/not/exist.js"
 
 	cmd := exec.Command("deno", "run", nonExistentPath)
-	err := configureProcessSecurity(cmd, nonExistentPath)
+	err := configureProcessSecurity(cmd, nonExistentPath, processOptions{})
 
 	if err == nil {
 		t.Errorf("Expected error for non-existent file when running as root, but got none")
@@ -106,9 +113,196 @@ func TestConfigureProcessSecurity_Symlink(t *testing.T) {
 	}
 
 	cmd := exec.Command("deno", "run", symlinkPath)
-	err = configureProcessSecurity(cmd, symlinkPath)
+	err = configureProcessSecurity(cmd, symlinkPath, processOptions{})
 
 	if err != nil {
 		t.Errorf("Unexpected error for symlinked file: %v", err)
 	}
 }
+
+func TestScriptPolicy_WorldWritable(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "script.js")
+	if err := os.WriteFile(filePath, []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	policy := &ScriptPolicy{RejectWorldWritable: true}
+	if err := policy.check(filePath); err != nil {
+		t.Errorf("Unexpected error for 0644 file: %v", err)
+	}
+
+	// Chmod explicitly since WriteFile is subject to umask
+	if err := os.Chmod(filePath, 0666); err != nil {
+		t.Fatalf("Failed to chmod test file: %v", err)
+	}
+
+	err := policy.check(filePath)
+	policyErr, ok := err.(*ScriptPolicyError)
+	if !ok {
+		t.Fatalf("Expected ScriptPolicyError for world-writable file, got %v", err)
+	}
+	if policyErr.Rule != RuleWorldWritable {
+		t.Errorf("Expected rule %q, got %q", RuleWorldWritable, policyErr.Rule)
+	}
+}
+
+func TestScriptPolicy_AllowedOwners(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "script.js")
+	if err := os.WriteFile(filePath, []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	owner := &ScriptPolicy{AllowedOwners: []string{strconv.Itoa(os.Getuid())}}
+	if err := owner.provision(); err != nil {
+		t.Fatalf("Failed to provision policy: %v", err)
+	}
+	if err := owner.check(filePath); err != nil {
+		t.Errorf("Unexpected error for file owned by current user: %v", err)
+	}
+
+	other := &ScriptPolicy{AllowedOwners: []string{strconv.Itoa(os.Getuid() + 1)}}
+	if err := other.provision(); err != nil {
+		t.Fatalf("Failed to provision policy: %v", err)
+	}
+	err := other.check(filePath)
+	if policyErr, ok := err.(*ScriptPolicyError); !ok || policyErr.Rule != RuleOwner {
+		t.Errorf("Expected owner policy violation, got %v", err)
+	}
+
+	unknown := &ScriptPolicy{AllowedOwners: []string{"substrate-no-such-user"}}
+	if err := unknown.provision(); err == nil {
+		t.Error("Expected error for unknown user in allowed_owners")
+	}
+}
+
+func TestScriptPolicy_StickyDirs(t *testing.T) {
+	tmpDir := t.TempDir()
+	stickyDir := filepath.Join(tmpDir, "shared")
+	if err := os.Mkdir(stickyDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Chmod(stickyDir, 0777|os.ModeSticky); err != nil {
+		t.Fatalf("Failed to set sticky bit: %v", err)
+	}
+
+	filePath := filepath.Join(stickyDir, "nested", "script.js")
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filePath, []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	policy := &ScriptPolicy{RejectStickyDirs: true}
+	err := policy.check(filePath)
+	if policyErr, ok := err.(*ScriptPolicyError); !ok || policyErr.Rule != RuleStickyDir {
+		t.Errorf("Expected sticky_dir policy violation, got %v", err)
+	}
+
+	var nilPolicy *ScriptPolicy
+	if err := nilPolicy.check(filePath); err != nil {
+		t.Errorf("Nil policy should allow every script: %v", err)
+	}
+}
+
+func TestBuildCommand_Umask(t *testing.T) {
+	cmd := buildCommand("/bin/sh", []string{"-c", "umask"}, processOptions{})
+	if cmd.Path != "/bin/sh" || len(cmd.Args) != 3 {
+		t.Errorf("Command without umask should not be wrapped, got %v", cmd.Args)
+	}
+
+	cmd = buildCommand("/bin/sh", []string{"-c", "umask"}, processOptions{umask: "0027"})
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Failed to run wrapped command: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "0027" {
+		t.Errorf("Expected umask 0027 in child, got %q", got)
+	}
+}
+
+func TestParseUmask(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"0027", "0027", true},
+		{"22", "0022", true},
+		{"777", "0777", true},
+		{"1000", "", false},
+		{"0089", "", false},
+		{"abc", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseUmask(tt.input)
+		if tt.valid && (err != nil || got != tt.expected) {
+			t.Errorf("parseUmask(%q) = %q, %v; want %q", tt.input, got, err, tt.expected)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("parseUmask(%q) should fail", tt.input)
+		}
+	}
+}
+
+func TestConfigureProcessSecurity_GroupRequiresRoot(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("Test should not be run as root")
+	}
+
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "test_script.js")
+	if err := os.WriteFile(filePath, []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	gid := uint32(os.Getgid())
+	cmd := exec.Command("deno", "run", filePath)
+	if err := configureProcessSecurity(cmd, filePath, processOptions{gid: &gid}); err == nil {
+		t.Error("Expected error when overriding group without root")
+	}
+}
+
+func TestProvision_GroupRequiresRoot(t *testing.T) {
+	gid := strconv.Itoa(os.Getgid())
+	d := caddyfile.NewTestDispenser(`substrate {
+		group ` + gid + `
+		supplementary_groups ` + gid + `
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Expected the config to adapt as any user, got %v", err)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Expected the config to validate as any user, got %v", err)
+	}
+
+	if os.Getuid() == 0 {
+		t.Skip("Test should not be run as root")
+	}
+	err := transport.Provision(caddy.Context{Context: context.Background()})
+	if err == nil || !strings.Contains(err.Error(), "require running Caddy as root") {
+		t.Errorf("Expected provisioning without root to fail, got %v", err)
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		path, dir string
+		want      bool
+	}{
+		{"/srv/app", "/srv/app", true},
+		{"/srv/app/data", "/srv/app", true},
+		{"/srv/app-data", "/srv/app", false},
+		{"/srv", "/srv/app", false},
+		{"/var/lib/app", "/srv/app", false},
+	}
+	for _, tt := range tests {
+		if got := isWithin(tt.path, tt.dir); got != tt.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", tt.path, tt.dir, got, tt.want)
+		}
+	}
+}
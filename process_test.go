@@ -1,16 +1,54 @@
 package substrate
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"go.uber.org/zap/zaptest"
 )
 
+// newStubProcess returns a process of pm for a script in a directory of its
+// own, run by a shell script with body instead of deno. It is not started.
+func newStubProcess(t *testing.T, pm *ProcessManager, body string) *Process {
+	t.Helper()
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	runtime := filepath.Join(dir, "runtime")
+	if err := os.WriteFile(runtime, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatalf("Failed to write runtime: %v", err)
+	}
+
+	process, err := pm.newProcess(scriptPath, scriptPath, "", time.Now())
+	if err != nil {
+		t.Fatalf("newProcess failed: %v", err)
+	}
+	process.denoPath = runtime
+	return process
+}
+
+// startStubProcess starts a process as newStubProcess returns it.
+func startStubProcess(t *testing.T, pm *ProcessManager, body string) *Process {
+	t.Helper()
+	process := newStubProcess(t, pm, body)
+	if err := process.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	return process
+}
+
 func TestProcessManager_ProcessExitCleanup(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
@@ -18,13 +56,14 @@ func TestProcessManager_ProcessExitCleanup(t *testing.T) {
 
 	logger := zaptest.NewLogger(t)
 	deno := NewDenoManager("", logger)
-	pm, err := NewProcessManager(
+	pm, err := newProcessManager(
 		caddy.Duration(time.Minute),   // idle timeout
 		caddy.Duration(1*time.Second), // startup timeout
 		nil,                           // no env vars for this test
 		"",                            // no deno opts
 		deno,
 		logger,
+		processOptions{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to create process manager: %v", err)
@@ -50,15 +89,13 @@ setTimeout(() => {
 	}
 
 	// Get socket path for the script - this will start the process
-	socketPath, err := pm.getOrCreateHost(exitScript)
+	socketPath, err := pm.getOrCreateHost(exitScript, "")
 	if err != nil {
 		t.Fatalf("Failed to get socket path: %v", err)
 	}
 
 	// Verify the process was added to the map
-	pm.mu.RLock()
-	_, exists := pm.processes[exitScript]
-	pm.mu.RUnlock()
+	exists := pm.processes.get(exitScript) != nil
 
 	if !exists {
 		t.Error("Process should exist in processes map")
@@ -70,9 +107,7 @@ setTimeout(() => {
 	start := time.Now()
 
 	for time.Since(start) < maxWait {
-		pm.mu.RLock()
-		_, stillExists := pm.processes[exitScript]
-		pm.mu.RUnlock()
+		stillExists := pm.processes.get(exitScript) != nil
 
 		if !stillExists {
 			break // Process was cleaned up
@@ -81,9 +116,7 @@ setTimeout(() => {
 	}
 
 	// Final verification that the process was removed
-	pm.mu.RLock()
-	_, stillExists := pm.processes[exitScript]
-	pm.mu.RUnlock()
+	stillExists := pm.processes.get(exitScript) != nil
 
 	if stillExists {
 		t.Error("Exited process should be removed from processes map")
@@ -102,13 +135,14 @@ func TestProcessManager_NormalExitCleanup(t *testing.T) {
 
 	logger := zaptest.NewLogger(t)
 	deno := NewDenoManager("", logger)
-	pm, err := NewProcessManager(
+	pm, err := newProcessManager(
 		caddy.Duration(time.Minute),   // idle timeout
 		caddy.Duration(3*time.Second), // startup timeout
 		nil,                           // no env vars for this test
 		"",                            // no deno opts
 		deno,
 		logger,
+		processOptions{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to create process manager: %v", err)
@@ -139,15 +173,13 @@ setTimeout(() => {
 	}
 
 	// Get socket path for the script - this will start the process
-	socketPath, err := pm.getOrCreateHost(normalScript)
+	socketPath, err := pm.getOrCreateHost(normalScript, "")
 	if err != nil {
 		t.Fatalf("Failed to get socket path: %v", err)
 	}
 
 	// Verify the process was added to the map
-	pm.mu.RLock()
-	_, exists := pm.processes[normalScript]
-	pm.mu.RUnlock()
+	exists := pm.processes.get(normalScript) != nil
 
 	if !exists {
 		t.Error("Process should exist in processes map")
@@ -159,9 +191,7 @@ setTimeout(() => {
 	start := time.Now()
 
 	for time.Since(start) < maxWait {
-		pm.mu.RLock()
-		_, stillExists := pm.processes[normalScript]
-		pm.mu.RUnlock()
+		stillExists := pm.processes.get(normalScript) != nil
 
 		if !stillExists {
 			break // Process was cleaned up
@@ -170,9 +200,7 @@ setTimeout(() => {
 	}
 
 	// Verify even normally exited processes are removed from the map
-	pm.mu.RLock()
-	_, stillExists := pm.processes[normalScript]
-	pm.mu.RUnlock()
+	stillExists := pm.processes.get(normalScript) != nil
 
 	if stillExists {
 		t.Error("Normally exited process should also be removed from processes map")
@@ -229,13 +257,14 @@ func TestValidateFilePath(t *testing.T) {
 func TestProcessManager_GetOrCreateHost_FileValidation(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 	deno := NewDenoManager("", logger)
-	pm, err := NewProcessManager(
+	pm, err := newProcessManager(
 		caddy.Duration(time.Minute),   // idle timeout
 		caddy.Duration(3*time.Second), // startup timeout
 		nil,                           // no env vars for this test
 		"",                            // no deno opts
 		deno,
 		logger,
+		processOptions{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to create process manager: %v", err)
@@ -243,20 +272,20 @@ func TestProcessManager_GetOrCreateHost_FileValidation(t *testing.T) {
 	defer pm.Stop()
 
 	// Test with non-existent file
-	_, err = pm.getOrCreateHost("/nonexistent/file.js")
+	_, err = pm.getOrCreateHost("/nonexistent/file.js", "")
 	if err == nil {
 		t.Error("getOrCreateHost should fail for non-existent file")
 	}
 
 	// Test with relative path
-	_, err = pm.getOrCreateHost("relative/path.js")
+	_, err = pm.getOrCreateHost("relative/path.js", "")
 	if err == nil {
 		t.Error("getOrCreateHost should fail for relative path")
 	}
 
 	// Test with directory
 	tmpDir := t.TempDir()
-	_, err = pm.getOrCreateHost(tmpDir)
+	_, err = pm.getOrCreateHost(tmpDir, "")
 	if err == nil {
 		t.Error("getOrCreateHost should fail for directory")
 	}
@@ -267,9 +296,9 @@ func TestProcess_CrashDetection(t *testing.T) {
 
 	// Create a process that will crash (exit with code 1)
 	process := &Process{
-		ScriptPath: "sh",
+		scriptPath: "sh",
 		SocketPath: "/tmp/test.sock",
-		LastUsed:   time.Now(),
+		lastUsed:   time.Now(),
 		onExit:     func() {},
 		logger:     logger,
 		exitChan:   make(chan struct{}),
@@ -278,11 +307,11 @@ func TestProcess_CrashDetection(t *testing.T) {
 	// Override the command args to make it crash
 	process.mu.Lock()
 	// We need to manually set this up since start() would construct normal socket path args
-	process.Cmd = exec.Command("sh", "-c", "exit 1")
+	process.cmd = exec.Command("sh", "-c", "exit 1")
 	process.mu.Unlock()
 
 	// Start the command directly
-	if err := process.Cmd.Start(); err != nil {
+	if err := process.cmd.Start(); err != nil {
 		t.Fatalf("Failed to start process: %v", err)
 	}
 
@@ -359,3 +388,693 @@ func TestValidateFilePath_Symlink(t *testing.T) {
 		t.Errorf("Symlink to text file should pass validateFilePath: %v", err)
 	}
 }
+
+func TestWaitForSocketReady_FailureReporting(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	tests := []struct {
+		name     string
+		runtime  string
+		exitCode int
+		stdout   string
+		stderr   string
+	}{
+		{"exited", "echo started; echo failing >&2; exit 3", 3, "started", "failing"},
+		{"killed after timeout", "echo started; echo waiting >&2; exec sleep 10", -1, "started", "waiting"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Stands in for deno, ignoring its arguments
+			process := startStubProcess(t, pm, tt.runtime)
+
+			if err := pm.waitForSocketReady(process.SocketPath, 200*time.Millisecond, process); err == nil {
+				t.Fatal("Expected startup to fail")
+			}
+			select {
+			case <-process.exitChan:
+			default:
+				process.Stop()
+			}
+
+			startupErr := process.startupError(errors.New("startup failed"))
+			if startupErr.ExitCode != tt.exitCode {
+				t.Errorf("Expected exit code %d, got %d", tt.exitCode, startupErr.ExitCode)
+			}
+			if !strings.Contains(startupErr.Stdout, tt.stdout) || !strings.Contains(startupErr.Stderr, tt.stderr) {
+				t.Errorf("Expected startup output to be captured, got stdout %q, stderr %q", startupErr.Stdout, startupErr.Stderr)
+			}
+		})
+	}
+}
+
+func TestProcess_RequestSummaryEnv(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, printing the request it was started for
+	process := newStubProcess(t, pm, "echo \"$SUBSTRATE_REQUEST\"")
+	process.startEnv = map[string]string{"SUBSTRATE_REQUEST": `{"method":"POST"}`}
+	if err := process.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	<-process.exitChan
+
+	if stdout := process.startupStdout.String(); strings.TrimSpace(stdout) != `{"method":"POST"}` {
+		t.Errorf("Expected SUBSTRATE_REQUEST in the environment, got %q", stdout)
+	}
+}
+
+func TestProcess_InstanceEnv(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, printing its identity
+	process := startStubProcess(t, pm, "echo \"$SUBSTRATE_INSTANCE_ID $SUBSTRATE_REPLICA_INDEX $SUBSTRATE_SOCKET\"")
+	<-process.exitChan
+
+	id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(process.SocketPath), "substrate-"), ".sock")
+	want := id + " 0 " + process.SocketPath
+	if got := strings.TrimSpace(process.startupStdout.String()); got != want {
+		t.Errorf("Expected identity %q in the environment, got %q", want, got)
+	}
+	if len(id) != 16 {
+		t.Errorf("Expected the socket's random part as instance ID, got %q", id)
+	}
+}
+
+func TestProcess_ContractEnv(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(90*time.Second),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, printing how it is run
+	process := newStubProcess(t, pm, "echo \"$SUBSTRATE $SUBSTRATE_IDLE_TIMEOUT $SUBSTRATE_ROOT $SUBSTRATE_URL_PREFIX\"")
+	dir := filepath.Dir(process.scriptPath)
+	process.startEnv = map[string]string{"SUBSTRATE_ROOT": dir, "SUBSTRATE_URL_PREFIX": "/app.js"}
+	if err := process.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	<-process.exitChan
+
+	want := "true 90 " + dir + " /app.js"
+	if got := strings.TrimSpace(process.startupStdout.String()); got != want {
+		t.Errorf("Expected %q from the environment, got %q", want, got)
+	}
+}
+
+func TestFormatIdleTimeout(t *testing.T) {
+	tests := map[caddy.Duration]string{
+		0:                                       "0",
+		-1:                                      "-1",
+		caddy.Duration(5 * time.Minute):         "300",
+		caddy.Duration(1500 * time.Millisecond): "1.5",
+	}
+	for d, want := range tests {
+		if got := formatIdleTimeout(d); got != want {
+			t.Errorf("formatIdleTimeout(%v) = %q, want %q", time.Duration(d), got, want)
+		}
+	}
+}
+
+func TestProcess_PrivateTmp(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{privateTmp: true},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, using its temporary directory
+	process := startStubProcess(t, pm, "echo \"$TMPDIR\"\ntouch \"$TMPDIR/scratch\" || exit 1")
+	<-process.exitChan
+
+	tmpDir := strings.TrimSpace(process.startupStdout.String())
+	if tmpDir == "" || tmpDir == os.TempDir() {
+		t.Fatalf("Expected a private TMPDIR, got %q", tmpDir)
+	}
+	if code := process.ExitCode(); code != 0 {
+		t.Errorf("Process could not write to its TMPDIR, exit code %d", code)
+	}
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("Private TMPDIR should be removed when the process exits, stat returned %v", err)
+	}
+}
+
+func TestProcess_ReadOnlyProject(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	dataDir := filepath.Join(t.TempDir(), "data")
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{readOnlyProject: true, dataDir: dataDir},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Stands in for deno, printing its arguments and data dir
+	process := startStubProcess(t, pm, "echo \"$@\"\necho \"$SUBSTRATE_DATA_DIR\"")
+	<-process.exitChan
+
+	dir := filepath.Dir(process.scriptPath)
+	output := process.startupStdout.String()
+	if !strings.Contains(output, "--deny-write="+dir) {
+		t.Errorf("Expected writes to the project directory to be denied, got %q", output)
+	}
+	if !strings.Contains(output, dataDir) {
+		t.Errorf("Expected SUBSTRATE_DATA_DIR to be exported, got %q", output)
+	}
+	if info, err := os.Stat(dataDir); err != nil || !info.IsDir() {
+		t.Errorf("Expected data dir to be created: %v", err)
+	}
+
+	// A data dir inside the project can't be writable
+	pm.opts.dataDir = filepath.Join(dir, "data")
+	scriptPath, runtime := process.scriptPath, process.denoPath
+	process, err = pm.newProcess(scriptPath, scriptPath, "", time.Now())
+	if err != nil {
+		t.Fatalf("newProcess failed: %v", err)
+	}
+	process.denoPath = runtime
+	if err := process.start(); err == nil {
+		t.Error("Expected a data dir inside the read-only project to be rejected")
+	}
+}
+
+func TestProcessManager_ColdStartQueueTimeout(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(5*time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{coldStartQueueTimeout: 50 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	scriptPath := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	// A process still starting on behalf of another request
+	process := &Process{
+		scriptPath: scriptPath,
+		SocketPath: "/tmp/stub.sock",
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: os.Getpid()}},
+		key:        scriptPath,
+		logger:     logger,
+		ready:      make(chan struct{}),
+	}
+	pm.processes.acquire(scriptPath, func() (*Process, error) { return process, nil })
+	defer pm.processes.remove(scriptPath, process)
+
+	start := time.Now()
+	if _, err := pm.getOrCreateHost(scriptPath, ""); err != errColdStartQueueTimeout {
+		t.Fatalf("Expected cold start queue timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Queued request should give up after the queue timeout, waited %v", elapsed)
+	}
+
+	process.mu.RLock()
+	active := process.activeRequests
+	process.mu.RUnlock()
+	if active != 1 {
+		t.Errorf("Timed out request should release its reference, got %d active requests", active)
+	}
+
+	close(process.ready)
+	socket, err := pm.getOrCreateHost(scriptPath, "")
+	if err != nil || socket != process.SocketPath {
+		t.Errorf("Expected started process to be used, got %q, %v", socket, err)
+	}
+}
+
+func TestProcessManager_ColdStartReported(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(5*time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	scriptPath := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	// A process still starting on behalf of another request
+	process := &Process{
+		scriptPath: scriptPath,
+		SocketPath: "/tmp/stub.sock",
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: os.Getpid()}},
+		key:        scriptPath,
+		logger:     logger,
+		ready:      make(chan struct{}),
+	}
+	pm.processes.acquire(scriptPath, func() (*Process, error) { return process, nil })
+	defer pm.processes.remove(scriptPath, process)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		process.startupTime = 1500 * time.Millisecond
+		close(process.ready)
+	}()
+
+	_, cold, err := pm.getOrCreateHostFor(scriptPath, scriptPath, "", nil)
+	if err != nil {
+		t.Fatalf("getOrCreateHostFor failed: %v", err)
+	}
+	if cold == nil || cold.startup != 1500*time.Millisecond {
+		t.Errorf("Expected a waiting request to report the 1.5s start, got %+v", cold)
+	}
+
+	_, cold, err = pm.getOrCreateHostFor(scriptPath, scriptPath, "", nil)
+	if err != nil {
+		t.Fatalf("getOrCreateHostFor failed: %v", err)
+	}
+	if cold != nil {
+		t.Errorf("Expected no cold start for a running process, got %+v", cold)
+	}
+}
+
+func TestProcessManager_ReleaseProcess(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(5*time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	key := "/srv/app.js"
+	old := &Process{scriptPath: key, key: key, logger: logger}
+	replacement := &Process{scriptPath: key, key: key, logger: logger}
+	pm.processes.acquire(key, func() (*Process, error) { return old, nil })
+	pm.processes.acquire(key, func() (*Process, error) { return old, nil })
+	defer pm.processes.remove(key, replacement)
+
+	pm.releaseProcess(key, old, false)
+	if old.inFlight() != 1 || pm.processes.get(key) != old {
+		t.Errorf("Expected one request left on the kept process, got %d", old.inFlight())
+	}
+
+	// A request to a process replaced meanwhile still ends on that process
+	pm.processes.replace(key, old, replacement)
+	pm.processes.acquire(key, func() (*Process, error) { return replacement, nil })
+	pm.releaseProcess(key, old, false)
+	if old.inFlight() != 0 || replacement.inFlight() != 1 {
+		t.Errorf("Expected the replaced process released, got %d and %d", old.inFlight(), replacement.inFlight())
+	}
+}
+
+func TestProcessManager_StartIsolated_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(time.Minute),
+		caddy.Duration(5*time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	scriptPath := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(scriptPath, []byte(simpleServerScript), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	// Overlapping requests each get their own process
+	key1, process1, _, err := pm.startIsolated(scriptPath, "", nil)
+	if err != nil {
+		t.Fatalf("startIsolated failed: %v", err)
+	}
+	key2, process2, _, err := pm.startIsolated(scriptPath, "", nil)
+	if err != nil {
+		t.Fatalf("startIsolated failed: %v", err)
+	}
+	if key1 == key2 || process1.SocketPath == process2.SocketPath {
+		t.Fatal("Isolated requests should not share a process")
+	}
+
+	if pm.processes.get(key1) != process1 || process1.scriptPath != scriptPath {
+		t.Fatal("Isolated process should be stored under its key and run the script")
+	}
+	if pm.processes.get(scriptPath) != nil {
+		t.Error("Isolated processes should not be shared under the script path")
+	}
+
+	pm.releaseProcess(key1, process1, true)
+	if pm.processes.get(key1) != nil {
+		t.Error("Isolated process should be removed after its request")
+	}
+	if pm.processes.get(key2) == nil {
+		t.Error("Closing one isolated process should not affect another")
+	}
+}
+
+func TestProcessManager_ReloadOnChange_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(time.Minute),
+		caddy.Duration(5*time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{reloadOnChange: true},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	scriptPath := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(scriptPath, []byte(simpleServerScript), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	oldSocket, err := pm.getOrCreateHost(scriptPath, "")
+	if err != nil {
+		t.Fatalf("getOrCreateHost failed: %v", err)
+	}
+	old := pm.processes.get(scriptPath)
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(scriptPath, later, later); err != nil {
+		t.Fatalf("Failed to touch script: %v", err)
+	}
+
+	// The request that notices the change is still served by the old process
+	socket, err := pm.getOrCreateHost(scriptPath, "")
+	if err != nil {
+		t.Fatalf("getOrCreateHost failed: %v", err)
+	}
+	if socket != oldSocket {
+		t.Error("Request should not wait for the replacement process")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for socket == oldSocket {
+		if time.Now().After(deadline) {
+			t.Fatal("Replacement process was never switched in")
+		}
+		time.Sleep(50 * time.Millisecond)
+		if socket, err = pm.getOrCreateHost(scriptPath, ""); err != nil {
+			t.Fatalf("getOrCreateHost failed: %v", err)
+		}
+	}
+
+	// The old process drains instead of being stopped at the switch
+	old.mu.RLock()
+	stopping := old.stopping
+	old.mu.RUnlock()
+	if stopping {
+		t.Error("Old process should keep running while draining")
+	}
+}
+
+func TestProcessManager_StopInParallel(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{stopTimeout: 300 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+
+	const count = 5
+	var processes []*Process
+	for i := 0; i < count; i++ {
+		// Stands in for deno, ignoring SIGTERM
+		process := newStubProcess(t, pm, "trap '' TERM\necho ready\nwhile :; do sleep 0.1; done")
+		pm.processes.acquire(process.key, func() (*Process, error) { return process, nil })
+		if err := process.start(); err != nil {
+			t.Fatalf("start failed: %v", err)
+		}
+		processes = append(processes, process)
+	}
+	// Wait for the trap to be installed before stopping
+	for _, process := range processes {
+		for !strings.Contains(process.startupStdout.String(), "ready") {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	start := time.Now()
+	pm.Stop()
+	elapsed := time.Since(start)
+
+	// Stopped one after the other, they would take count * stopTimeout
+	if elapsed > count*300*time.Millisecond {
+		t.Errorf("Expected processes to be stopped in parallel, Stop took %v", elapsed)
+	}
+	for _, process := range processes {
+		select {
+		case <-process.exitChan:
+		default:
+			t.Errorf("Process for %s was not stopped", process.scriptPath)
+		}
+	}
+}
+
+func TestProcessManager_StopIdleFirst(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{stopTimeout: 5 * time.Second},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+
+	order := filepath.Join(t.TempDir(), "order")
+	start := func(name string, busy bool) *Process {
+		t.Helper()
+		// Stands in for deno, recording when it is asked to stop
+		process := newStubProcess(t, pm, fmt.Sprintf("trap 'echo %s >> %s; exit 0' TERM\necho ready\nwhile :; do sleep 0.05; done", name, order))
+		pm.processes.acquire(process.key, func() (*Process, error) { return process, nil })
+		if !busy {
+			pm.processes.release(process.key, process, false)
+		}
+		if err := process.start(); err != nil {
+			t.Fatalf("start failed: %v", err)
+		}
+		for !strings.Contains(process.startupStdout.String(), "ready") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return process
+	}
+	start("busy", true)
+	start("idle", false)
+
+	pm.Stop()
+
+	data, err := os.ReadFile(order)
+	if err != nil {
+		t.Fatalf("No process recorded its stop: %v", err)
+	}
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "idle busy" {
+		t.Errorf("Expected the idle process to be stopped first, got %v", got)
+	}
+}
+
+func TestProcess_TypeCheck(t *testing.T) {
+	for _, typeCheck := range []bool{false, true} {
+		logger := zaptest.NewLogger(t)
+		pm, err := newProcessManager(
+			caddy.Duration(0),
+			caddy.Duration(time.Second),
+			nil,
+			"",
+			NewDenoManager("", logger),
+			logger,
+			processOptions{typeCheck: typeCheck},
+		)
+		if err != nil {
+			t.Fatalf("Failed to create process manager: %v", err)
+		}
+		defer pm.Stop()
+
+		// Stands in for deno, printing its arguments
+		process := startStubProcess(t, pm, "echo \"$@\"")
+		<-process.exitChan
+
+		args := strings.Fields(process.startupStdout.String())
+		if got := slices.Contains(args, "--check"); got != typeCheck {
+			t.Errorf("type_check %v: got args %v", typeCheck, args)
+		}
+	}
+}
+
+func TestWaitForSocketReady_PollInterval(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{socketPollInterval: 300 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on socket: %v", err)
+	}
+	defer listener.Close()
+	process := &Process{
+		scriptPath:    "/app.js",
+		SocketPath:    socketPath,
+		exitChan:      make(chan struct{}),
+		startupStdout: &startupBuffer{},
+		startupStderr: &startupBuffer{},
+	}
+
+	// The socket is ready from the start, but only tried after the interval
+	if err := pm.waitForSocketReady(socketPath, 100*time.Millisecond, process); err == nil {
+		t.Error("Expected the socket not to be tried before the poll interval")
+	}
+	start := time.Now()
+	if err := pm.waitForSocketReady(socketPath, time.Second, process); err != nil {
+		t.Fatalf("Expected the socket to be ready, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Expected the first try after 300ms, got %v", elapsed)
+	}
+}
+
+func TestUnmarshalCaddyfile_SocketPolling(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		socket_poll_interval 50ms
+		socket_dial_timeout 2s
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.SocketPollInterval != caddy.Duration(50*time.Millisecond) || transport.SocketDialTimeout != caddy.Duration(2*time.Second) {
+		t.Errorf("Unexpected socket polling: %v, %v", transport.SocketPollInterval, transport.SocketDialTimeout)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	transport.SocketDialTimeout = caddy.Duration(-time.Second)
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for a negative socket_dial_timeout")
+	}
+}
@@ -0,0 +1,236 @@
+package substrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxReadinessBody bounds how much of a readiness response is read, so the
+// connection can be reused for the next attempt.
+const maxReadinessBody = 64 << 10
+
+// ReadinessConfig chooses how a starting process is found ready. The checker
+// replaces the socket check, so a process found ready by stdout_line or file
+// need not have its socket open yet.
+type ReadinessConfig struct {
+	// Checker names a registered readiness checker: socket (the default,
+	// the socket accepting connections), http, stdout_line, file, or one a
+	// module added with RegisterReadinessChecker.
+	Checker string `json:"checker"`
+
+	// Args are the checker's arguments: the path for http, a regular
+	// expression for stdout_line and a path for file.
+	Args []string `json:"args,omitempty"`
+}
+
+// ReadinessChecker decides whether a starting process is ready for
+// requests. It is created for each start of a process.
+type ReadinessChecker interface {
+	// Ready returns nil once process is ready, or why it is not yet. It is
+	// called every socket_poll_interval until it succeeds, the process exits
+	// or ctx ends with the startup timeout. A checker that is also an
+	// io.Closer is closed once the wait is over.
+	Ready(ctx context.Context, process *Process) error
+}
+
+// ReadinessCheckerFunc adapts a function to ReadinessChecker.
+type ReadinessCheckerFunc func(ctx context.Context, process *Process) error
+
+func (f ReadinessCheckerFunc) Ready(ctx context.Context, process *Process) error {
+	return f(ctx, process)
+}
+
+// NewReadinessChecker creates a checker from the arguments it was
+// configured with. It is also called to validate the config.
+type NewReadinessChecker func(args []string) (ReadinessChecker, error)
+
+var (
+	readinessMu       sync.RWMutex
+	readinessCheckers = map[string]NewReadinessChecker{
+		"socket":      newSocketReadiness,
+		"http":        newHTTPReadiness,
+		"stdout_line": newStdoutLineReadiness,
+		"file":        newFileReadiness,
+	}
+)
+
+// RegisterReadinessChecker makes a readiness checker available to the
+// readiness option under name. Modules call it from init; it panics if name
+// is taken.
+func RegisterReadinessChecker(name string, create NewReadinessChecker) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	if _, ok := readinessCheckers[name]; ok {
+		panic(fmt.Sprintf("readiness checker %q already registered", name))
+	}
+	readinessCheckers[name] = create
+}
+
+// readinessCheckerNames lists the registered checkers, for errors.
+func readinessCheckerNames() string {
+	readinessMu.RLock()
+	defer readinessMu.RUnlock()
+	names := make([]string, 0, len(readinessCheckers))
+	for name := range readinessCheckers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// checker creates the checker for one start of a process. A nil config
+// takes the socket checker.
+func (c *ReadinessConfig) checker() (ReadinessChecker, error) {
+	if c == nil {
+		return &socketReadiness{}, nil
+	}
+	readinessMu.RLock()
+	create, ok := readinessCheckers[c.Checker]
+	readinessMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown readiness checker %q, expected one of %s", c.Checker, readinessCheckerNames())
+	}
+	checker, err := create(c.Args)
+	if err != nil {
+		return nil, fmt.Errorf("readiness %s: %w", c.Checker, err)
+	}
+	return checker, nil
+}
+
+func (c *ReadinessConfig) validate() error {
+	_, err := c.checker()
+	return err
+}
+
+// socketReadiness dials the process socket, which is enough once it accepts
+// connections.
+type socketReadiness struct {
+	// Bounds each dial, set from socket_dial_timeout by waitForSocketReady
+	dialTimeout time.Duration
+}
+
+func newSocketReadiness(args []string) (ReadinessChecker, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("takes no arguments")
+	}
+	return &socketReadiness{}, nil
+}
+
+func (r *socketReadiness) Ready(ctx context.Context, process *Process) error {
+	dialer := net.Dialer{Timeout: r.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "unix", process.SocketPath)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// httpReadiness sends GET requests for path over the process socket.
+type httpReadiness struct {
+	path   string
+	client *http.Client
+}
+
+func newHTTPReadiness(args []string) (ReadinessChecker, error) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "/") {
+		return nil, fmt.Errorf("expects a path starting with /")
+	}
+	return &httpReadiness{path: args[0]}, nil
+}
+
+func (r *httpReadiness) Ready(ctx context.Context, process *Process) error {
+	if r.client == nil {
+		r.client = socketClient(process.SocketPath, 0)
+	}
+	return probeReady(ctx, r.client, r.path)
+}
+
+func (r *httpReadiness) Close() error {
+	if r.client != nil {
+		r.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// probeReady sends a readiness request for path to the process behind
+// client. The process is ready once it answers below 500; a 5xx means it
+// bound its socket but cannot serve yet, or at all.
+func probeReady(ctx context.Context, client *http.Client, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://substrate.localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Substrate-Readiness", "1")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("readiness check GET %s: %w", path, err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxReadinessBody))
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("readiness check GET %s returned %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+// newStdoutLineReadiness waits for the process to print a line matching a
+// regular expression, such as its own "listening" message.
+func newStdoutLineReadiness(args []string) (ReadinessChecker, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expects a regular expression")
+	}
+	pattern, err := regexp.Compile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return ReadinessCheckerFunc(func(_ context.Context, process *Process) error {
+		stdout, _ := process.StartupOutput()
+		scanner := bufio.NewScanner(strings.NewReader(stdout))
+		for scanner.Scan() {
+			if pattern.MatchString(scanner.Text()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no line of stdout matches %q", pattern)
+	}), nil
+}
+
+// newFileReadiness waits for the process to write a file, relative to its
+// script's directory. A file older than the process is left from an earlier
+// one.
+func newFileReadiness(args []string) (ReadinessChecker, error) {
+	if len(args) != 1 || args[0] == "" {
+		return nil, fmt.Errorf("expects a file path")
+	}
+	return ReadinessCheckerFunc(func(_ context.Context, process *Process) error {
+		path := args[0]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(process.scriptPath), path)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("readiness file: %w", err)
+		}
+		process.mu.RLock()
+		started := process.startedAt
+		process.mu.RUnlock()
+		// File systems may only keep whole seconds
+		if info.ModTime().Before(started.Truncate(time.Second)) {
+			return fmt.Errorf("readiness file %s predates the process", path)
+		}
+		return nil
+	}), nil
+}
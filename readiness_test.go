@@ -0,0 +1,292 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+// serveReadiness serves the readiness path on a socket, answering with the
+// status status returns, and returns the process it stands in for.
+func serveReadiness(t *testing.T, status func() int) *Process {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on socket: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Header.Get("X-Substrate-Readiness") != "1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status())
+	})}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return &Process{
+		scriptPath:    "/app.js",
+		SocketPath:    socketPath,
+		exitChan:      make(chan struct{}),
+		startupStdout: &startupBuffer{},
+		startupStderr: &startupBuffer{},
+	}
+}
+
+func TestWaitForSocketReady_ReadyPath(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{readiness: &ReadinessConfig{Checker: "http", Args: []string{"/healthz"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	// Failing until the third check
+	var checks atomic.Int32
+	process := serveReadiness(t, func() int {
+		if checks.Add(1) < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	if err := pm.waitForSocketReady(process.SocketPath, time.Second, process); err != nil {
+		t.Errorf("Expected the process to become ready, got %v", err)
+	}
+	if got := checks.Load(); got != 3 {
+		t.Errorf("Expected 3 readiness checks, got %d", got)
+	}
+
+	// Bound but broken
+	process = serveReadiness(t, func() int { return http.StatusInternalServerError })
+	err = pm.waitForSocketReady(process.SocketPath, 200*time.Millisecond, process)
+	if err == nil || !strings.Contains(err.Error(), "readiness check GET /healthz returned 500") {
+		t.Errorf("Expected startup to fail on the readiness check, got %v", err)
+	}
+
+	// Client errors mean the process serves
+	process = serveReadiness(t, func() int { return http.StatusUnauthorized })
+	if err := pm.waitForSocketReady(process.SocketPath, time.Second, process); err != nil {
+		t.Errorf("Expected a 401 to count as ready, got %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfile_ReadyPath(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		ready_path /healthz
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.ReadyPath != "/healthz" {
+		t.Errorf("Expected ready_path /healthz, got %q", transport.ReadyPath)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	transport.ReadyPath = "healthz"
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for a ready_path not starting with /")
+	}
+}
+
+func newReadinessManager(t *testing.T, readiness *ReadinessConfig) *ProcessManager {
+	t.Helper()
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{readiness: readiness},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	t.Cleanup(func() { pm.Stop() })
+	return pm
+}
+
+func TestReadinessConfig_Checker(t *testing.T) {
+	if checker, err := (*ReadinessConfig)(nil).checker(); err != nil {
+		t.Errorf("Unexpected error without a config: %v", err)
+	} else if _, ok := checker.(*socketReadiness); !ok {
+		t.Errorf("Expected the socket checker without a config, got %T", checker)
+	}
+	for _, config := range []*ReadinessConfig{
+		{Checker: "socket"},
+		{Checker: "http", Args: []string{"/healthz"}},
+		{Checker: "stdout_line", Args: []string{`^listening on \d+`}},
+		{Checker: "file", Args: []string{"ready"}},
+	} {
+		if err := config.validate(); err != nil {
+			t.Errorf("Unexpected error for %+v: %v", config, err)
+		}
+	}
+	for _, config := range []*ReadinessConfig{
+		{Checker: "tcp"},
+		{Checker: "socket", Args: []string{"x"}},
+		{Checker: "http", Args: []string{"healthz"}},
+		{Checker: "stdout_line", Args: []string{"("}},
+		{Checker: "file"},
+	} {
+		if err := config.validate(); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+}
+
+func TestRegisterReadinessChecker(t *testing.T) {
+	var checked atomic.Int32
+	RegisterReadinessChecker("test_counting", func(args []string) (ReadinessChecker, error) {
+		return ReadinessCheckerFunc(func(context.Context, *Process) error {
+			if checked.Add(1) < 2 {
+				return errors.New("warming up")
+			}
+			return nil
+		}), nil
+	})
+	t.Cleanup(func() {
+		readinessMu.Lock()
+		delete(readinessCheckers, "test_counting")
+		readinessMu.Unlock()
+	})
+	pm := newReadinessManager(t, &ReadinessConfig{Checker: "test_counting"})
+	process := serveReadiness(t, func() int { return http.StatusOK })
+	if err := pm.waitForSocketReady(process.SocketPath, time.Second, process); err != nil {
+		t.Errorf("Expected the process to become ready, got %v", err)
+	}
+	if got := checked.Load(); got != 2 {
+		t.Errorf("Expected 2 checks, got %d", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a taken name to panic")
+		}
+	}()
+	RegisterReadinessChecker("http", newHTTPReadiness)
+}
+
+func TestWaitForSocketReady_StdoutLine(t *testing.T) {
+	pm := newReadinessManager(t, &ReadinessConfig{Checker: "stdout_line", Args: []string{`^listening on \d+$`}})
+
+	process := serveReadiness(t, func() int { return http.StatusOK })
+	process.startupStdout.Write([]byte("compiling\n"))
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		process.startupStdout.Write([]byte("listening on 8000\n"))
+	}()
+	if err := pm.waitForSocketReady(process.SocketPath, time.Second, process); err != nil {
+		t.Errorf("Expected the process to become ready, got %v", err)
+	}
+
+	process = serveReadiness(t, func() int { return http.StatusOK })
+	process.startupStdout.Write([]byte("listening on port 8000\n"))
+	err := pm.waitForSocketReady(process.SocketPath, 100*time.Millisecond, process)
+	if err == nil || !strings.Contains(err.Error(), "no line of stdout matches") {
+		t.Errorf("Expected startup to fail on the readiness check, got %v", err)
+	}
+}
+
+func TestWaitForSocketReady_File(t *testing.T) {
+	pm := newReadinessManager(t, &ReadinessConfig{Checker: "file", Args: []string{"ready"}})
+
+	process := serveReadiness(t, func() int { return http.StatusOK })
+	dir := t.TempDir()
+	process.scriptPath = filepath.Join(dir, "app.js")
+	process.startedAt = time.Now()
+
+	// Left by an earlier process
+	ready := filepath.Join(dir, "ready")
+	if err := os.WriteFile(ready, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(ready, old, old)
+	if err := pm.waitForSocketReady(process.SocketPath, 100*time.Millisecond, process); err == nil {
+		t.Error("Expected a stale file not to count")
+	}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		os.WriteFile(ready, nil, 0644)
+	}()
+	if err := pm.waitForSocketReady(process.SocketPath, time.Second, process); err != nil {
+		t.Errorf("Expected the process to become ready, got %v", err)
+	}
+}
+
+func TestWaitForSocketReady_FileWithoutSocket(t *testing.T) {
+	// A process that never listens on its socket
+	dir := t.TempDir()
+	process := &Process{
+		scriptPath:    filepath.Join(dir, "app.js"),
+		SocketPath:    filepath.Join(dir, "app.sock"),
+		exitChan:      make(chan struct{}),
+		startupStdout: &startupBuffer{},
+		startupStderr: &startupBuffer{},
+		startedAt:     time.Now(),
+	}
+
+	pm := newReadinessManager(t, nil)
+	err := pm.waitForSocketReady(process.SocketPath, 100*time.Millisecond, process)
+	if err == nil || !strings.Contains(err.Error(), "timeout waiting for socket") {
+		t.Errorf("Expected the socket checker to time out, got %v", err)
+	}
+
+	// The file checker replaces the socket check
+	pm = newReadinessManager(t, &ReadinessConfig{Checker: "file", Args: []string{"ready"}})
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		os.WriteFile(filepath.Join(dir, "ready"), nil, 0644)
+	}()
+	if err := pm.waitForSocketReady(process.SocketPath, time.Second, process); err != nil {
+		t.Errorf("Expected the process to become ready through its file, got %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfile_Readiness(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		readiness stdout_line "^listening on"
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	got := transport.Readiness
+	if got == nil || got.Checker != "stdout_line" || len(got.Args) != 1 || got.Args[0] != "^listening on" {
+		t.Fatalf("Unexpected readiness: %+v", got)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	transport.ReadyPath = "/healthz"
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error with both ready_path and readiness")
+	}
+}
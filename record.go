@@ -0,0 +1,418 @@
+package substrate
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RecordConfig records the requests proxied to scripts and the responses
+// they got, for caddy substrate replay to send again to a process started
+// locally. Secrets are redacted: header values, query parameters and JSON
+// or form fields whose names suggest one, and the passwords of URLs.
+type RecordConfig struct {
+	// Dir holds a recording file per script. Must be absolute.
+	Dir string `json:"dir"`
+
+	// MaxEntries is how many exchanges are kept per script (default 100).
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// MaxBody is the most of each request and response body kept, in bytes
+	// (default 64KiB).
+	MaxBody int64 `json:"max_body,omitempty"`
+
+	// RedactHeaders lists more headers whose values are not recorded, on
+	// top of those like Authorization and Cookie.
+	RedactHeaders []string `json:"redact_headers,omitempty"`
+}
+
+const (
+	defaultRecordMaxEntries = 100
+	defaultRecordMaxBody    = 64 << 10
+
+	// redacted replaces the secrets in recordings.
+	redacted = "[redacted]"
+)
+
+func (c *RecordConfig) validate() error {
+	if !filepath.IsAbs(c.Dir) {
+		return fmt.Errorf("record dir must be an absolute path, got %q", c.Dir)
+	}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("record max_entries must not be negative")
+	}
+	if c.MaxBody < 0 {
+		return fmt.Errorf("record max_body must not be negative")
+	}
+	return nil
+}
+
+func (c *RecordConfig) maxEntries() int {
+	if c.MaxEntries == 0 {
+		return defaultRecordMaxEntries
+	}
+	return c.MaxEntries
+}
+
+func (c *RecordConfig) maxBody() int64 {
+	if c.MaxBody == 0 {
+		return defaultRecordMaxBody
+	}
+	return c.MaxBody
+}
+
+// recordingPath returns the file recording the exchanges of script.
+func (c *RecordConfig) recordingPath(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return filepath.Join(c.Dir, safeFileName(filepath.Base(script))+"-"+hex.EncodeToString(sum[:4])+".jsonl")
+}
+
+// recordedExchange is a line of a recording file.
+type recordedExchange struct {
+	Time       time.Time        `json:"time"`
+	Script     string           `json:"script"`
+	DurationMs int64            `json:"duration_ms"`
+	Request    recordedRequest  `json:"request"`
+	Response   recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method        string      `json:"method"`
+	URI           string      `json:"uri"`
+	Host          string      `json:"host"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+type recordedResponse struct {
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+// recorder appends exchanges to the recording files. Each file is rotated
+// to a .1 file once it holds MaxEntries exchanges, so a recording keeps
+// between MaxEntries and twice as many.
+type recorder struct {
+	config *RecordConfig
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	counts map[string]int // exchanges in each file written to
+}
+
+func newRecorder(config *RecordConfig, logger *zap.Logger) *recorder {
+	return &recorder{config: config, logger: logger, counts: make(map[string]int)}
+}
+
+// write appends exchange to the recording of its script.
+func (r *recorder) write(exchange recordedExchange) {
+	data, err := json.Marshal(exchange)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	path := r.config.recordingPath(exchange.Script)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count, ok := r.counts[path]
+	if !ok {
+		count = countLines(path)
+	}
+	if count >= r.config.maxEntries() {
+		os.Rename(path, path+".1")
+		count = 0
+	}
+	err = os.MkdirAll(r.config.Dir, 0700)
+	if err == nil {
+		err = appendFile(path, data)
+	}
+	if err != nil {
+		r.logger.Warn("failed to record request",
+			zap.String("recording", path),
+			zap.Error(err),
+		)
+		return
+	}
+	r.counts[path] = count + 1
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// countLines returns the number of lines in the file at path, 0 if there is
+// none.
+func countLines(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	return bytes.Count(data, []byte{'\n'})
+}
+
+// readRecording returns the exchanges of a recording file, oldest first,
+// including those of its rotated .1 file.
+func readRecording(path string) ([]recordedExchange, error) {
+	var exchanges []recordedExchange
+	for _, file := range []string{path + ".1", path} {
+		f, err := os.Open(file)
+		if errors.Is(err, fs.ErrNotExist) && file != path {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var exchange recordedExchange
+			if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+			}
+			exchanges = append(exchanges, exchange)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return exchanges, nil
+}
+
+// capturedBody keeps the first max bytes read through it.
+type capturedBody struct {
+	io.ReadCloser
+	max     int64
+	onClose func()
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+	once      sync.Once
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if room := b.max - int64(b.buf.Len()); int64(n) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+	} else {
+		b.buf.Write(p[:n])
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+func (b *capturedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.onClose != nil {
+		b.once.Do(b.onClose)
+	}
+	return err
+}
+
+// captured returns what was kept of the body, and whether there was more.
+func (b *capturedBody) captured() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes()), b.truncated
+}
+
+// recordRequest starts recording req, keeping what the process reads of
+// its body.
+func (t *SubstrateTransport) recordRequest(req *http.Request) *capturedBody {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	body := &capturedBody{ReadCloser: req.Body, max: t.Record.maxBody()}
+	req.Body = body
+	return body
+}
+
+// recordResponse records the exchange of req and resp once the body of resp
+// is closed. reqBody is what recordRequest returned for req.
+func (t *SubstrateTransport) recordResponse(req *http.Request, reqBody *capturedBody, resp *http.Response, script string, start time.Time) {
+	// The body of an upgraded connection is the connection
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	exchange := recordedExchange{
+		Time:   start,
+		Script: script,
+		Request: recordedRequest{
+			Method: req.Method,
+			URI:    redactURI(req.URL.RequestURI()),
+			Host:   req.Host,
+			Header: redactHeader(req.Header, t.Record.RedactHeaders),
+		},
+		Response: recordedResponse{
+			Status: resp.StatusCode,
+			Header: redactHeader(resp.Header, t.Record.RedactHeaders),
+		},
+	}
+	reqType, respType := req.Header.Get("Content-Type"), resp.Header.Get("Content-Type")
+	body := &capturedBody{ReadCloser: resp.Body, max: t.Record.maxBody()}
+	body.onClose = func() {
+		exchange.DurationMs = time.Since(start).Milliseconds()
+		if reqBody != nil {
+			data, truncated := reqBody.captured()
+			exchange.Request.Body, exchange.Request.BodyTruncated = redactBody(data, truncated, reqType)
+		}
+		data, truncated := body.captured()
+		exchange.Response.Body, exchange.Response.BodyTruncated = redactBody(data, truncated, respType)
+		t.recorder.write(exchange)
+	}
+	resp.Body = body
+}
+
+// redactHeader returns a copy of header without the values of secret
+// headers and those in extra.
+func redactHeader(header http.Header, extra []string) http.Header {
+	result := header.Clone()
+	for name, values := range result {
+		secret := secretEnvName.MatchString(name)
+		for _, e := range extra {
+			secret = secret || strings.EqualFold(name, e)
+		}
+		if secret {
+			for i := range values {
+				values[i] = redacted
+			}
+		}
+	}
+	return result
+}
+
+// redactURI removes the values of secret query parameters from uri.
+func redactURI(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil || !redactValues(values) {
+		return uri
+	}
+	return path + "?" + values.Encode()
+}
+
+// redactValues replaces the secrets in values, reporting whether there
+// were any.
+func redactValues(values url.Values) bool {
+	found := false
+	for name, list := range values {
+		for i, value := range list {
+			if secretEnvName.MatchString(name) {
+				list[i] = redacted
+			} else {
+				list[i] = redactValue(value)
+			}
+			found = found || list[i] != value
+		}
+	}
+	return found
+}
+
+// redactBody removes the secrets from a JSON or form body of contentType.
+// Such a body that can't be parsed, as when it was truncated, is dropped.
+func redactBody(data []byte, truncated bool, contentType string) ([]byte, bool) {
+	if len(data) == 0 {
+		return data, truncated
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(data))
+		if err != nil {
+			return nil, true
+		}
+		if !redactValues(values) {
+			return data, truncated
+		}
+		return []byte(values.Encode()), truncated
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var doc any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, true
+		}
+		result, err := json.Marshal(redactJSONValue(doc))
+		if err != nil {
+			return nil, true
+		}
+		return result, truncated
+	}
+	return data, truncated
+}
+
+// replayRequest returns the request of exchange to send to a process, with
+// headers set from override.
+func (e *recordedExchange) replayRequest(override http.Header) (*http.Request, error) {
+	req, err := http.NewRequest(e.Request.Method, "http://localhost"+e.Request.URI, bytes.NewReader(e.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = e.Request.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for name, values := range override {
+		req.Header[name] = values
+	}
+	req.Host = e.Request.Host
+	return req, nil
+}
+
+// replayDiff describes how a replayed response differs from the recorded
+// one, "" if it doesn't. The body is redacted like the recorded one; a
+// recorded body that was truncated is compared with the start of body, and
+// one that was dropped is not compared.
+func (e *recordedExchange) replayDiff(status int, body []byte) string {
+	if status != e.Response.Status {
+		return fmt.Sprintf("status %d, recorded %d", status, e.Response.Status)
+	}
+	recorded := e.Response.Body
+	if e.Response.BodyTruncated {
+		if recorded == nil {
+			return ""
+		}
+		body = body[:min(len(body), len(recorded))]
+	} else {
+		body, _ = redactBody(body, false, e.Response.Header.Get("Content-Type"))
+	}
+	if !bytes.Equal(body, recorded) {
+		return fmt.Sprintf("body differs (%d bytes, recorded %d)", len(body), len(recorded))
+	}
+	return ""
+}
@@ -0,0 +1,230 @@
+package substrate
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRedactHeader(t *testing.T) {
+	header := http.Header{
+		"Authorization": {"Bearer abc"},
+		"Cookie":        {"session=1"},
+		"X-Tenant":      {"acme"},
+		"Accept":        {"text/html"},
+	}
+	got := redactHeader(header, []string{"x-tenant"})
+	for _, name := range []string{"Authorization", "Cookie", "X-Tenant"} {
+		if got.Get(name) != redacted {
+			t.Errorf("Expected %s redacted, got %q", name, got.Get(name))
+		}
+	}
+	if got.Get("Accept") != "text/html" {
+		t.Errorf("Expected Accept kept, got %q", got.Get("Accept"))
+	}
+	if header.Get("Authorization") != "Bearer abc" {
+		t.Error("The original header should not be modified")
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	tests := map[string]string{
+		"/app.js":                  "/app.js",
+		"/app.js?page=2&sort=name": "/app.js?page=2&sort=name",
+		"/app.js?page=2&api_key=x": "/app.js?api_key=%5Bredacted%5D&page=2",
+	}
+	for uri, want := range tests {
+		if got := redactURI(uri); got != want {
+			t.Errorf("redactURI(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	body, truncated := redactBody([]byte(`{"user":"ann","password":"hunter2"}`), false, "application/json; charset=utf-8")
+	if string(body) != `{"password":"[redacted]","user":"ann"}` || truncated {
+		t.Errorf("Expected the password redacted, got %s, %v", body, truncated)
+	}
+
+	body, _ = redactBody([]byte("user=ann&token=abc"), false, "application/x-www-form-urlencoded")
+	if string(body) != "token=%5Bredacted%5D&user=ann" {
+		t.Errorf("Expected the token redacted, got %s", body)
+	}
+
+	// Truncated JSON can't be redacted, so it is not kept
+	body, truncated = redactBody([]byte(`{"password":"hun`), true, "application/json")
+	if body != nil || !truncated {
+		t.Errorf("Expected the body dropped, got %q, %v", body, truncated)
+	}
+
+	body, _ = redactBody([]byte("<p>hello</p>"), false, "text/html")
+	if string(body) != "<p>hello</p>" {
+		t.Errorf("Expected other bodies kept, got %q", body)
+	}
+}
+
+func TestCapturedBody(t *testing.T) {
+	closed := 0
+	body := &capturedBody{ReadCloser: io.NopCloser(strings.NewReader("hello world")), max: 5, onClose: func() { closed++ }}
+	data, err := io.ReadAll(body)
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected the body read in full, got %q, %v", data, err)
+	}
+	body.Close()
+	body.Close()
+	if got, truncated := body.captured(); string(got) != "hello" || !truncated {
+		t.Errorf("Expected the start of the body kept, got %q, %v", got, truncated)
+	}
+	if closed != 1 {
+		t.Errorf("Expected onClose called once, got %d", closed)
+	}
+}
+
+func TestRecorder_Rotates(t *testing.T) {
+	config := &RecordConfig{Dir: t.TempDir(), MaxEntries: 2}
+	r := newRecorder(config, zaptest.NewLogger(t))
+	script := "/srv/app.js"
+	for i := 0; i < 5; i++ {
+		r.write(recordedExchange{Script: script, Request: recordedRequest{Method: "GET", URI: "/" + string(rune('a'+i))}})
+	}
+
+	exchanges, err := readRecording(config.recordingPath(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uris []string
+	for _, exchange := range exchanges {
+		uris = append(uris, exchange.Request.URI)
+	}
+	if strings.Join(uris, " ") != "/c /d /e" {
+		t.Errorf("Expected the latest exchanges kept, got %v", uris)
+	}
+
+	// A new recorder carries on counting the entries of the file
+	r = newRecorder(config, zaptest.NewLogger(t))
+	r.write(recordedExchange{Script: script, Request: recordedRequest{URI: "/f"}})
+	r.write(recordedExchange{Script: script, Request: recordedRequest{URI: "/g"}})
+	exchanges, _ = readRecording(config.recordingPath(script))
+	if len(exchanges) != 3 || exchanges[0].Request.URI != "/e" || exchanges[2].Request.URI != "/g" {
+		t.Errorf("Expected the file rotated, got %+v", exchanges)
+	}
+}
+
+func TestTransport_Record(t *testing.T) {
+	config := &RecordConfig{Dir: t.TempDir()}
+	transport := &SubstrateTransport{Record: config, recorder: newRecorder(config, zaptest.NewLogger(t))}
+
+	req := httptest.NewRequest("POST", "http://example.com/app.js?x=1", strings.NewReader(`{"name":"ann","secret":"s"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer abc")
+	reqBody := transport.recordRequest(req)
+	io.ReadAll(req.Body)
+
+	resp := &http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("created")),
+	}
+	transport.recordResponse(req, reqBody, resp, "/srv/app.js", time.Now())
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	exchanges, err := readRecording(config.recordingPath("/srv/app.js"))
+	if err != nil || len(exchanges) != 1 {
+		t.Fatalf("Expected one exchange, got %+v, %v", exchanges, err)
+	}
+	e := exchanges[0]
+	if e.Script != "/srv/app.js" || e.Request.Method != "POST" || e.Request.URI != "/app.js?x=1" || e.Request.Host != "example.com" {
+		t.Errorf("Unexpected request: %+v", e.Request)
+	}
+	if e.Request.Header.Get("Authorization") != redacted || string(e.Request.Body) != `{"name":"ann","secret":"[redacted]"}` {
+		t.Errorf("Expected the request redacted, got %v %s", e.Request.Header, e.Request.Body)
+	}
+	if e.Response.Status != http.StatusCreated || string(e.Response.Body) != "created" {
+		t.Errorf("Unexpected response: %+v", e.Response)
+	}
+
+	// The recorded request is sent again as it was, with the overrides
+	replay, err := e.replayRequest(http.Header{"Authorization": {"Bearer local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(replay.Body)
+	if replay.Method != "POST" || replay.URL.RequestURI() != "/app.js?x=1" || replay.Host != "example.com" || replay.Header.Get("Authorization") != "Bearer local" || string(body) != string(e.Request.Body) {
+		t.Errorf("Unexpected replayed request: %+v", replay)
+	}
+	if diff := e.replayDiff(http.StatusCreated, []byte("created")); diff != "" {
+		t.Errorf("Expected the same response to match, got %q", diff)
+	}
+	if diff := e.replayDiff(http.StatusInternalServerError, nil); diff == "" {
+		t.Error("Expected a different status to be reported")
+	}
+	if diff := e.replayDiff(http.StatusCreated, []byte("exists")); diff == "" {
+		t.Error("Expected a different body to be reported")
+	}
+}
+
+func TestRecordedExchange_ReplayDiffTruncated(t *testing.T) {
+	e := recordedExchange{Response: recordedResponse{Status: 200, Body: []byte("hel"), BodyTruncated: true}}
+	if diff := e.replayDiff(200, []byte("hello")); diff != "" {
+		t.Errorf("Expected the start of the body compared, got %q", diff)
+	}
+	e.Response.Body = nil
+	if diff := e.replayDiff(200, []byte("anything")); diff != "" {
+		t.Errorf("Expected a dropped body not compared, got %q", diff)
+	}
+}
+
+func TestUnmarshalCaddyfile_Record(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		record /var/lib/caddy/recordings {
+			max_entries 20
+			max_body 1KB
+			redact_header X-Tenant X-Account
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	got := transport.Record
+	if got == nil || got.Dir != "/var/lib/caddy/recordings" || got.MaxEntries != 20 || got.MaxBody != 1000 || strings.Join(got.RedactHeaders, ",") != "X-Tenant,X-Account" {
+		t.Fatalf("Unexpected record config: %+v", got)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	transport.Record = &RecordConfig{Dir: "recordings"}
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected an error for a relative dir")
+	}
+}
+
+func TestCmdReplay_EmptyRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.js.jsonl")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := pflag.NewFlagSet("replay", pflag.ContinueOnError)
+	fs.String("script", "", "")
+	fs.StringArrayP("header", "H", nil, "")
+	if err := fs.Parse([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+	code, err := cmdReplay(caddycmd.Flags{FlagSet: fs})
+	if err == nil || code != caddy.ExitCodeFailedStartup {
+		t.Errorf("Expected an empty recording to fail, got code=%d err=%v", code, err)
+	}
+}
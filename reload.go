@@ -0,0 +1,268 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// managerPool keeps process managers across config reloads. A transport in
+// the new config whose process options match a transport of the old one
+// takes over its manager, and so its running processes; the manager is
+// stopped once no transport uses it.
+var managerPool = caddy.NewUsagePool()
+
+// pooledManager is a ProcessManager in the managerPool.
+type pooledManager struct {
+	*ProcessManager
+	fingerprint map[string]any
+	config      context.Context // of the config that created the manager
+}
+
+func (m pooledManager) Destruct() error {
+	unregisterManager(m.ProcessManager)
+	return m.Stop()
+}
+
+// processFingerprint returns the options that running processes depend on.
+// Changing any of them on reload starts a new manager, and new processes;
+// the other options are applied to running processes by reconfigure.
+func (t *SubstrateTransport) processFingerprint() map[string]any {
+	idleMode := "timeout"
+	switch {
+	case t.IdleTimeout == 0:
+		idleMode = "never"
+	case t.IdleTimeout < 0:
+		idleMode = "one-shot"
+	}
+	return map[string]any{
+		"idle_timeout mode":    idleMode,
+		"deno_opts":            t.DenoOpts,
+		"cache_dir":            t.CacheDir,
+		"socket_dir":           t.SocketDir,
+		"script_policy":        t.ScriptPolicy,
+		"umask":                t.Umask,
+		"max_open_files":       t.MaxOpenFiles,
+		"max_processes":        t.MaxProcesses,
+		"io_limits":            t.IOLimits,
+		"group":                t.Group,
+		"supplementary_groups": t.SupplementaryGroups,
+		"prewarm_connections":  t.PrewarmConnections,
+		"reload_on_change":     t.ReloadOnChange,
+		"handover":             t.Handover,
+		"notify":               t.Notify,
+		"private_tmp":          t.PrivateTmp,
+		"read_only_project":    t.ReadOnlyProject,
+		"data_dir":             t.DataDir,
+		"core_dump_dir":        t.CoreDumpDir,
+		"takeover_state":       t.TakeoverState,
+		"build":                t.Build,
+		"warmup":               t.Warmup,
+		"ready_path":           t.ReadyPath,
+		"readiness":            t.Readiness,
+		"debug":                t.Debug,
+		"type_check":           t.TypeCheck,
+		"egress":               t.Egress,
+		"hosts":                t.Hosts,
+		"max_extend":           t.MaxExtend,
+		"persist_usage":        t.PersistUsage,
+		"runtime":              t.Runtime,
+	}
+}
+
+// provisionOrdinals numbers the transports with the same fingerprint within
+// one config, so each keeps its own manager and takes over the manager of
+// the transport in the same position of the previous config.
+var provisionOrdinals = struct {
+	sync.Mutex
+	configs map[context.Context]map[string]int
+}{configs: make(map[context.Context]map[string]int)}
+
+// poolKey returns the managerPool key for a transport with fingerprint in
+// the config being loaded by ctx.
+func poolKey(ctx caddy.Context, fingerprint map[string]any) (string, error) {
+	encoded, err := json.Marshal(fingerprint)
+	if err != nil {
+		return "", fmt.Errorf("encoding process options: %w", err)
+	}
+	key := string(encoded)
+
+	provisionOrdinals.Lock()
+	defer provisionOrdinals.Unlock()
+	ordinals := provisionOrdinals.configs[ctx.Context]
+	if ordinals == nil {
+		ordinals = make(map[string]int)
+		provisionOrdinals.configs[ctx.Context] = ordinals
+		config := ctx.Context
+		context.AfterFunc(config, func() {
+			provisionOrdinals.Lock()
+			delete(provisionOrdinals.configs, config)
+			provisionOrdinals.Unlock()
+		})
+	}
+	ordinal := ordinals[key]
+	ordinals[key]++
+	return key + "#" + strconv.Itoa(ordinal), nil
+}
+
+// sharedPoolKey returns the managerPool key for a transport sharing its
+// manager. Transports share only when their whole configs are equal, so no
+// transport changes the settings another one relies on, or the config its
+// processes report.
+func sharedPoolKey(config json.RawMessage) string {
+	return "shared:" + string(config)
+}
+
+// restartReasons names the options in which fingerprint differs from the
+// closest one of the managers created by previous configs, or returns nil
+// when there are none, as on the first config load.
+func restartReasons(ctx caddy.Context, fingerprint map[string]any) []string {
+	var closest []string
+	managerPool.Range(func(_, value any) bool {
+		if value.(pooledManager).config == ctx.Context {
+			return true
+		}
+		other := value.(pooledManager).fingerprint
+		var differ []string
+		for option, current := range fingerprint {
+			if !reflect.DeepEqual(current, other[option]) {
+				differ = append(differ, option)
+			}
+		}
+		if closest == nil || len(differ) < len(closest) {
+			closest = differ
+		}
+		return true
+	})
+	sort.Strings(closest)
+	return closest
+}
+
+// liveSettings are the manager settings a config reload changes without
+// restarting processes.
+type liveSettings struct {
+	idleTimeout              caddy.Duration
+	startupTimeout           caddy.Duration
+	env                      map[string]string
+	maxStartsPerMinute       int
+	maxClientStartsPerMinute int
+	coldStartQueueTimeout    time.Duration
+	startupFailureTTL        time.Duration
+	stopTimeout              time.Duration
+	socketPollInterval       time.Duration
+	socketDialTimeout        time.Duration
+	schedule                 []scheduleWindow
+}
+
+// liveSettings returns the transport's live settings. Env values with
+// {http.*} placeholders are left out, as they are expanded per request.
+func (t *SubstrateTransport) liveSettings() liveSettings {
+	return liveSettings{
+		idleTimeout:              t.IdleTimeout,
+		startupTimeout:           t.StartupTimeout,
+		env:                      t.staticEnv,
+		maxStartsPerMinute:       t.MaxStartsPerMinute,
+		maxClientStartsPerMinute: t.MaxClientStartsPerMinute,
+		coldStartQueueTimeout:    time.Duration(t.ColdStartQueueTimeout),
+		startupFailureTTL:        max(time.Duration(t.StartupFailureTTL), 0),
+		stopTimeout:              time.Duration(t.StopTimeout),
+		socketPollInterval:       time.Duration(t.SocketPollInterval),
+		socketDialTimeout:        time.Duration(t.SocketDialTimeout),
+		schedule:                 t.schedule,
+	}
+}
+
+// settings returns the current live settings.
+func (pm *ProcessManager) settings() liveSettings {
+	pm.settingsMu.RLock()
+	defer pm.settingsMu.RUnlock()
+	return pm.live
+}
+
+// setTransportConfig keeps the JSON config of the transport using the
+// manager, included in crash bundles of its scripts.
+func (pm *ProcessManager) setTransportConfig(config json.RawMessage) {
+	pm.settingsMu.Lock()
+	pm.config = config
+	pm.settingsMu.Unlock()
+}
+
+func (pm *ProcessManager) transportConfig() json.RawMessage {
+	pm.settingsMu.RLock()
+	defer pm.settingsMu.RUnlock()
+	return pm.config
+}
+
+func (pm *ProcessManager) limiter() *startLimiter {
+	pm.settingsMu.RLock()
+	defer pm.settingsMu.RUnlock()
+	return pm.startLimiter
+}
+
+// reconfigure applies live settings from a reloaded config. It returns the
+// settings that changed and, of those, the ones that only take effect when
+// a process restarts. The idle mode (never, one-shot or a timeout) is part
+// of the fingerprint and does not change here.
+func (pm *ProcessManager) reconfigure(live liveSettings) (changed, onRestart []string) {
+	pm.settingsMu.Lock()
+	old := pm.live
+	pm.live = live
+	if live.maxStartsPerMinute != old.maxStartsPerMinute || live.maxClientStartsPerMinute != old.maxClientStartsPerMinute {
+		// Starts already counted are forgotten
+		pm.startLimiter = newStartLimiter(live.maxStartsPerMinute, live.maxClientStartsPerMinute)
+	}
+	pm.settingsMu.Unlock()
+
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{"idle_timeout", live.idleTimeout != old.idleTimeout},
+		{"startup_timeout", live.startupTimeout != old.startupTimeout},
+		{"env", !reflect.DeepEqual(live.env, old.env)},
+		{"max_starts_per_minute", live.maxStartsPerMinute != old.maxStartsPerMinute},
+		{"max_client_starts_per_minute", live.maxClientStartsPerMinute != old.maxClientStartsPerMinute},
+		{"cold_start_queue_timeout", live.coldStartQueueTimeout != old.coldStartQueueTimeout},
+		{"startup_failure_ttl", live.startupFailureTTL != old.startupFailureTTL},
+		{"stop_timeout", live.stopTimeout != old.stopTimeout},
+		{"socket_poll_interval", live.socketPollInterval != old.socketPollInterval},
+		{"socket_dial_timeout", live.socketDialTimeout != old.socketDialTimeout},
+		{"schedule", !reflect.DeepEqual(live.schedule, old.schedule)},
+	} {
+		if setting.changed {
+			changed = append(changed, setting.name)
+		}
+	}
+	// Any change may have fixed the scripts that failed to start
+	if len(changed) > 0 {
+		pm.failures.clear()
+	}
+	// Running processes keep the environment they were started with
+	if !reflect.DeepEqual(live.env, old.env) {
+		onRestart = append(onRestart, "env")
+	}
+	// A manager created without a schedule has no loop enforcing one yet
+	if len(live.schedule) > 0 {
+		pm.startScheduleLoop()
+	}
+	shorterIdle := live.idleTimeout < old.idleTimeout
+
+	// Queued expiries use the old timeout; a longer one is handled when they
+	// come due, a shorter one moves each process to its new expiry
+	if shorterIdle && live.idleTimeout > 0 {
+		for key, process := range pm.processes.snapshot() {
+			process.mu.RLock()
+			lastUsed := process.lastUsed
+			process.mu.RUnlock()
+			pm.idle.push(key, process, lastUsed.Add(time.Duration(live.idleTimeout)))
+		}
+	}
+	return changed, onRestart
+}
@@ -0,0 +1,215 @@
+package substrate
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestProvision_KeepsProcessesAcrossReload(t *testing.T) {
+	newConfig := func() caddy.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return caddy.Context{Context: ctx}
+	}
+	provision := func(ctx caddy.Context, transport *SubstrateTransport) *SubstrateTransport {
+		t.Helper()
+		transport.StartupTimeout = caddy.Duration(time.Second)
+		if err := transport.Provision(ctx); err != nil {
+			t.Fatalf("Provision failed: %v", err)
+		}
+		return transport
+	}
+
+	socketDir := t.TempDir()
+	old := provision(newConfig(), &SubstrateTransport{
+		IdleTimeout: caddy.Duration(time.Hour),
+		SocketDir:   socketDir,
+		Env:         map[string]string{"VERSION": "1"},
+	})
+	// A running process, queued to become idle after the old timeout
+	process := &Process{scriptPath: "/srv/app.js"}
+	lastUsed := time.Now()
+	process.lastUsed = lastUsed
+	old.manager.processes.store(process.scriptPath, process)
+	old.manager.idle.push(process.scriptPath, process, lastUsed.Add(time.Hour))
+
+	reloaded := newConfig()
+	kept := provision(reloaded, &SubstrateTransport{
+		IdleTimeout:        caddy.Duration(30 * time.Minute),
+		SocketDir:          socketDir,
+		Env:                map[string]string{"VERSION": "2"},
+		MaxStartsPerMinute: 10,
+	})
+	// Same process options, but another transport of the same config
+	second := provision(reloaded, &SubstrateTransport{
+		IdleTimeout: caddy.Duration(time.Hour),
+		SocketDir:   socketDir,
+	})
+	restarted := provision(reloaded, &SubstrateTransport{
+		IdleTimeout: caddy.Duration(time.Hour),
+		SocketDir:   t.TempDir(),
+	})
+
+	if kept.manager != old.manager {
+		t.Fatal("Expected the reloaded transport to take over the process manager")
+	}
+	if second.manager == old.manager || restarted.manager == old.manager {
+		t.Error("Expected other transports to get their own process managers")
+	}
+
+	settings := kept.manager.settings()
+	if settings.idleTimeout != caddy.Duration(30*time.Minute) || settings.env["VERSION"] != "2" || kept.manager.limiter() == nil {
+		t.Errorf("Expected the reloaded settings to be applied, got %+v", settings)
+	}
+	kept.manager.idle.mu.Lock()
+	queued := append([]*idleEntry(nil), kept.manager.idle.entries...)
+	kept.manager.idle.mu.Unlock()
+	if len(queued) != 1 || !queued[0].expiry.Equal(lastUsed.Add(30*time.Minute)) {
+		t.Errorf("Expected the queued process moved to its new expiry, got %d entries", len(queued))
+	}
+	kept.manager.processes.remove(process.scriptPath, process)
+
+	old.Cleanup()
+	select {
+	case <-kept.manager.ctx.Done():
+		t.Fatal("Cleanup of the old transport stopped the manager taken over")
+	default:
+	}
+
+	for _, transport := range []*SubstrateTransport{kept, second, restarted} {
+		transport.Cleanup()
+	}
+	select {
+	case <-kept.manager.ctx.Done():
+	default:
+		t.Error("Expected the manager to be stopped once no transport uses it")
+	}
+}
+
+func TestProvision_ReloadTemplatedEnv(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socketDir := t.TempDir()
+	old := &SubstrateTransport{
+		SocketDir:      socketDir,
+		IdleTimeout:    -1,
+		StartupTimeout: caddy.Duration(time.Second),
+		Env:            map[string]string{"VERSION": "1"},
+	}
+	if err := old.Provision(caddy.Context{Context: ctx}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer old.Cleanup()
+
+	reloaded, cancelReloaded := context.WithCancel(context.Background())
+	defer cancelReloaded()
+	kept := &SubstrateTransport{
+		SocketDir:      socketDir,
+		IdleTimeout:    -1,
+		StartupTimeout: caddy.Duration(time.Second),
+		Env:            map[string]string{"VERSION": "2", "TENANT": "{http.request.host}"},
+	}
+	if err := kept.Provision(caddy.Context{Context: reloaded}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer kept.Cleanup()
+	if kept.manager != old.manager {
+		t.Fatal("Expected the reloaded transport to take over the process manager")
+	}
+
+	// Processes started after the reload get the template expanded per
+	// request, not the placeholder
+	env := kept.manager.settings().env
+	if env["VERSION"] != "2" {
+		t.Errorf("Expected the reloaded env to be applied, got %v", env)
+	}
+	if _, ok := env["TENANT"]; ok {
+		t.Errorf("Expected the templated env var to be left to requests, got %v", env)
+	}
+}
+
+func TestRestartReasons(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// A socket_dir of its own sets the manager apart from other tests'
+	socketDir := t.TempDir()
+	first := &SubstrateTransport{
+		SocketDir:      socketDir,
+		IdleTimeout:    caddy.Duration(time.Hour),
+		StartupTimeout: caddy.Duration(time.Second),
+		DenoOpts:       "--v8-flags=--max-old-space-size=256",
+	}
+	if err := first.Provision(caddy.Context{Context: ctx}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer first.Cleanup()
+
+	// A new idle_timeout is applied live, new deno_opts need new processes
+	changed := &SubstrateTransport{
+		SocketDir:   socketDir,
+		IdleTimeout: caddy.Duration(2 * time.Hour),
+		DenoOpts:    "--v8-flags=--max-old-space-size=512",
+	}
+	got := restartReasons(caddy.Context{Context: context.Background()}, changed.processFingerprint())
+	if len(got) != 1 || got[0] != "deno_opts" {
+		t.Errorf("Expected deno_opts to require a restart, got %v", got)
+	}
+
+	if got := restartReasons(caddy.Context{Context: ctx}, changed.processFingerprint()); got != nil {
+		t.Errorf("Managers of the same config should not be compared, got %v", got)
+	}
+}
+
+func TestProvision_ShareProcesses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socketDir := t.TempDir()
+	provision := func(share bool, env map[string]string, stripHeaders ...string) *SubstrateTransport {
+		t.Helper()
+		transport := &SubstrateTransport{
+			IdleTimeout:    caddy.Duration(time.Hour),
+			StartupTimeout: caddy.Duration(time.Second),
+			SocketDir:      socketDir,
+			Env:            env,
+			StripHeaders:   stripHeaders,
+			ShareProcesses: share,
+		}
+		if err := transport.Provision(caddy.Context{Context: ctx}); err != nil {
+			t.Fatalf("Provision failed: %v", err)
+		}
+		return transport
+	}
+
+	first := provision(true, map[string]string{"SITE": "shared"})
+	second := provision(true, map[string]string{"SITE": "shared"})
+	otherEnv := provision(true, map[string]string{"SITE": "other"})
+	unshared := provision(false, map[string]string{"SITE": "shared"})
+	otherConfig := provision(true, map[string]string{"SITE": "shared"}, "X-Debug")
+	for _, transport := range []*SubstrateTransport{second, otherEnv, unshared, otherConfig} {
+		t.Cleanup(func() { transport.Cleanup() })
+	}
+
+	if first.manager != second.manager {
+		t.Error("Expected transports with the same options to share a process manager")
+	}
+	if otherEnv.manager == first.manager || unshared.manager == first.manager {
+		t.Error("Expected different settings, or not sharing, to get their own process manager")
+	}
+	// Sharing would overwrite the config the manager reports for first
+	if otherConfig.manager == first.manager {
+		t.Error("Expected a transport with another config to get its own process manager")
+	}
+	if config := string(first.manager.transportConfig()); strings.Contains(config, "X-Debug") {
+		t.Errorf("Expected the shared manager to keep its config, got %s", config)
+	}
+
+	// The manager outlives the first transport using it
+	first.Cleanup()
+	if second.manager.ctx.Err() != nil {
+		t.Error("A shared manager should keep running while a transport uses it")
+	}
+}
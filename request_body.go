@@ -0,0 +1,215 @@
+package substrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// spoolMemoryLimit is how much of a spooled request body is kept in memory
+// before the rest is written to a temporary file.
+const spoolMemoryLimit = 1 << 20
+
+// bodyWaitTimeout is how long a request sent with Expect: 100-continue is
+// held for its body to start arriving.
+const bodyWaitTimeout = 30 * time.Second
+
+// maxEmptyBodyReads is how many reads in a row may return neither data nor
+// an error before waiting for a body gives up, as bufio does.
+const maxEmptyBodyReads = 100
+
+// errRequestBodyTooLarge is returned when a request body exceeds max_request_body.
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// errRequestBodyTimeout is returned when a held request body doesn't start
+// arriving within bodyWaitTimeout.
+var errRequestBodyTimeout = errors.New("timed out waiting for request body")
+
+// prepareRequestBody enforces the request body policy before any process is
+// started for req. Bodies that declare a length over maxBytes are rejected
+// immediately. When spool is set, the whole body is read up front (spilling
+// to disk past spoolMemoryLimit), so bodies of unknown length are also checked
+// before committing to a cold start and the process never waits on a slow
+// uploader. Without spooling, the body is only capped while it streams.
+//
+// A client sending Expect: 100-continue waits to be told to go ahead before
+// sending the body, which reading it does, and may give up instead. Its
+// request is held until the body starts arriving, so an abandoned upload
+// never starts a process, and the process isn't asked for a 100 Continue
+// of its own. The hold ends with the request context, or with an error after
+// bodyWaitTimeout.
+func prepareRequestBody(req *http.Request, maxBytes int64, spool bool) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	if maxBytes > 0 && req.ContentLength > maxBytes {
+		return errRequestBodyTooLarge
+	}
+
+	continues := httpguts.HeaderValuesContainsToken(req.Header["Expect"], "100-continue")
+	if continues {
+		req.Header.Del("Expect")
+	}
+
+	if !spool {
+		if continues {
+			if err := awaitBody(req, bodyWaitTimeout); err != nil {
+				return err
+			}
+		}
+		if maxBytes > 0 {
+			req.Body = &limitedBody{ReadCloser: req.Body, remaining: maxBytes}
+		}
+		return nil
+	}
+
+	body, size, err := spoolBody(req.Body, maxBytes)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	req.Body = body
+	req.ContentLength = size
+	req.TransferEncoding = nil
+	return nil
+}
+
+// awaitBody blocks until the body of req starts arriving, or ends. It gives
+// up when req is canceled, after timeout, or after maxEmptyBodyReads reads
+// in a row return nothing. A read still blocked then ends with the
+// connection, and req.Body must not be used again.
+func awaitBody(req *http.Request, timeout time.Duration) error {
+	type result struct {
+		n   int
+		err error
+	}
+	first := make([]byte, 1)
+	read := make(chan result, 1)
+	go func() {
+		for range maxEmptyBodyReads {
+			n, err := req.Body.Read(first)
+			if n > 0 || err != nil {
+				read <- result{n, err}
+				return
+			}
+		}
+		read <- result{0, io.ErrNoProgress}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-read:
+		if r.n == 0 && r.err != io.EOF {
+			return fmt.Errorf("waiting for request body: %w", r.err)
+		}
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(first[:r.n]), req.Body), req.Body}
+		return nil
+	case <-req.Context().Done():
+		return fmt.Errorf("waiting for request body: %w", context.Cause(req.Context()))
+	case <-timer.C:
+		return errRequestBodyTimeout
+	}
+}
+
+// spoolBody reads r completely, keeping up to spoolMemoryLimit bytes in memory
+// and the remainder in a temporary file that is removed when the returned body
+// is closed.
+func spoolBody(r io.Reader, maxBytes int64) (io.ReadCloser, int64, error) {
+	memLimit := int64(spoolMemoryLimit)
+	if maxBytes > 0 && maxBytes+1 < memLimit {
+		memLimit = maxBytes + 1
+	}
+
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, memLimit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading request body: %w", err)
+	}
+	if maxBytes > 0 && n > maxBytes {
+		return nil, 0, errRequestBodyTooLarge
+	}
+	if n < memLimit {
+		return io.NopCloser(&buf), n, nil
+	}
+
+	file, err := os.CreateTemp("", "substrate-body-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating request body spool file: %w", err)
+	}
+	spooled := &spooledBody{File: file}
+
+	rest := r
+	if maxBytes > 0 {
+		rest = io.LimitReader(r, maxBytes+1-n)
+	}
+	written, err := io.Copy(file, rest)
+	if err != nil {
+		spooled.Close()
+		return nil, 0, fmt.Errorf("spooling request body: %w", err)
+	}
+	size := n + written
+	if maxBytes > 0 && size > maxBytes {
+		spooled.Close()
+		return nil, 0, errRequestBodyTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, 0, fmt.Errorf("rewinding request body spool file: %w", err)
+	}
+
+	spooled.reader = io.MultiReader(&buf, file)
+	return spooled, size, nil
+}
+
+// spooledBody reads a request body from memory and a temporary file, removing
+// the file on Close.
+type spooledBody struct {
+	*os.File
+	reader io.Reader
+}
+
+func (b *spooledBody) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.File.Name())
+	return err
+}
+
+// limitedBody fails reads once more than remaining bytes have been read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		return n, errRequestBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,209 @@
+package substrate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrepareRequestBody_DeclaredLengthTooLarge(t *testing.T) {
+	req := httptest.NewRequest("POST", "/upload.js", strings.NewReader(strings.Repeat("x", 100)))
+
+	if err := prepareRequestBody(req, 10, false); err != errRequestBodyTooLarge {
+		t.Errorf("Expected errRequestBodyTooLarge, got %v", err)
+	}
+}
+
+func TestPrepareRequestBody_StreamingLimit(t *testing.T) {
+	req := httptest.NewRequest("POST", "/upload.js", io.NopCloser(strings.NewReader(strings.Repeat("x", 100))))
+	req.ContentLength = -1
+
+	if err := prepareRequestBody(req, 10, false); err != nil {
+		t.Fatalf("Unknown length body should not be rejected up front: %v", err)
+	}
+
+	data, err := io.ReadAll(req.Body)
+	if err != errRequestBodyTooLarge {
+		t.Errorf("Expected errRequestBodyTooLarge while streaming, got %v", err)
+	}
+	if len(data) != 10 {
+		t.Errorf("Expected exactly 10 bytes before the limit, got %d", len(data))
+	}
+}
+
+func TestPrepareRequestBody_SpoolUnknownLength(t *testing.T) {
+	req := httptest.NewRequest("POST", "/upload.js", io.NopCloser(strings.NewReader(strings.Repeat("x", 100))))
+	req.ContentLength = -1
+
+	if err := prepareRequestBody(req, 10, true); err != errRequestBodyTooLarge {
+		t.Errorf("Spooling should reject oversized body of unknown length, got %v", err)
+	}
+
+	body := "hello substrate"
+	req = httptest.NewRequest("POST", "/upload.js", io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+
+	if err := prepareRequestBody(req, 1024, true); err != nil {
+		t.Fatalf("Small body should be accepted: %v", err)
+	}
+	if req.ContentLength != int64(len(body)) {
+		t.Errorf("Expected ContentLength %d after spooling, got %d", len(body), req.ContentLength)
+	}
+	data, _ := io.ReadAll(req.Body)
+	if string(data) != body {
+		t.Errorf("Expected spooled body %q, got %q", body, data)
+	}
+}
+
+func TestPrepareRequestBody_SpoolToDisk(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), (spoolMemoryLimit/16)+1024)
+	req := httptest.NewRequest("POST", "/upload.js", bytes.NewReader(payload))
+
+	if err := prepareRequestBody(req, 0, true); err != nil {
+		t.Fatalf("Failed to spool body: %v", err)
+	}
+
+	spooled, ok := req.Body.(*spooledBody)
+	if !ok {
+		t.Fatalf("Expected body larger than memory limit to be spooled to disk, got %T", req.Body)
+	}
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("Failed to read spooled body: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Error("Spooled body does not match original payload")
+	}
+
+	req.Body.Close()
+	if _, err := os.Stat(spooled.Name()); !os.IsNotExist(err) {
+		t.Errorf("Spool file should be removed on close, stat returned %v", err)
+	}
+}
+
+// expectContinueServer serves prepareRequestBody to raw clients, sending
+// on started when a process would be started, and on failed when the body
+// policy rejects the request.
+func expectContinueServer(t *testing.T) (addr string, started chan string, failed chan error) {
+	t.Helper()
+	started, failed = make(chan string, 1), make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := prepareRequestBody(r, 0, false); err != nil {
+			failed <- err
+			return
+		}
+		started <- r.Header.Get("Expect")
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String(), started, failed
+}
+
+func TestPrepareRequestBody_ExpectContinue(t *testing.T) {
+	addr, started, _ := expectContinueServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "POST /upload.js HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	if line, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(line, "HTTP/1.1 100") {
+		t.Fatalf("Expected 100 Continue, got %q, %v", line, err)
+	}
+	br.ReadString('\n')
+
+	// Nothing is started until the body arrives
+	select {
+	case <-started:
+		t.Fatal("Expected the request held until the body arrives")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	io.WriteString(conn, "hello")
+	select {
+	case expect := <-started:
+		if expect != "" {
+			t.Errorf("Expected Expect removed for the process, got %q", expect)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to go on once the body arrived")
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Errorf("Expected the whole body passed on, got %q", body)
+	}
+}
+
+func TestPrepareRequestBody_ExpectContinueAbandoned(t *testing.T) {
+	addr, started, failed := expectContinueServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "POST /upload.js HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	case <-started:
+		t.Fatal("Expected no process for an abandoned upload")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the abandoned upload noticed")
+	}
+}
+
+// emptyReader returns neither data nor an error, like a broken body.
+type emptyReader struct{}
+
+func (emptyReader) Read([]byte) (int, error) { return 0, nil }
+
+func TestAwaitBody_Bounded(t *testing.T) {
+	// A client that never sends its body
+	stalled, writer := io.Pipe()
+	defer writer.Close()
+	req := httptest.NewRequest("POST", "/upload.js", stalled)
+	if err := awaitBody(req, 20*time.Millisecond); err != errRequestBodyTimeout {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req = httptest.NewRequest("POST", "/upload.js", stalled).WithContext(ctx)
+	if err := awaitBody(req, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the canceled request to stop waiting, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/upload.js", io.NopCloser(emptyReader{}))
+	if err := awaitBody(req, time.Minute); !errors.Is(err, io.ErrNoProgress) {
+		t.Errorf("Expected empty reads to fail, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/upload.js", strings.NewReader("hello"))
+	if err := awaitBody(req, time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != "hello" {
+		t.Errorf("Expected the whole body kept, got %q", body)
+	}
+}
@@ -0,0 +1,64 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var (
+	// errResponseTooLarge aborts a response over max_response_bytes.
+	errResponseTooLarge = errors.New("response exceeded max_response_bytes")
+
+	// errResponseTooSlow aborts a response still streaming after
+	// max_response_duration.
+	errResponseTooSlow = errors.New("response exceeded max_response_duration")
+)
+
+// limitedResponseBody enforces the response limits on a process response body. A
+// read past maxBytes, or failing because ctx reached its deadline, returns
+// the matching error, which makes reverse_proxy abort the response; onLimit
+// is told once.
+type limitedResponseBody struct {
+	io.ReadCloser
+	maxBytes int64 // 0 for no limit
+	read     int64
+	ctx      context.Context // nil for no time limit
+	cancel   context.CancelFunc
+	onLimit  func(err error)
+}
+
+func (b *limitedResponseBody) Read(p []byte) (int, error) {
+	// Read at most one byte past the limit, enough to notice it
+	if b.maxBytes > 0 && int64(len(p)) > b.maxBytes-b.read+1 {
+		p = p[:b.maxBytes-b.read+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.maxBytes > 0 && b.read > b.maxBytes {
+		over := int(b.read - b.maxBytes)
+		b.read = b.maxBytes
+		return n - over, b.limit(errResponseTooLarge)
+	}
+	if err != nil && err != io.EOF && b.ctx != nil && b.ctx.Err() == context.DeadlineExceeded {
+		return n, b.limit(errResponseTooSlow)
+	}
+	return n, err
+}
+
+func (b *limitedResponseBody) limit(err error) error {
+	if b.onLimit != nil {
+		b.onLimit(err)
+		b.onLimit = nil
+	}
+	return err
+}
+
+func (b *limitedResponseBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLimitedResponseBody_Bytes(t *testing.T) {
+	var reported []error
+	body := &limitedResponseBody{
+		ReadCloser: io.NopCloser(strings.NewReader("0123456789")),
+		maxBytes:   4,
+		onLimit:    func(err error) { reported = append(reported, err) },
+	}
+
+	data, err := io.ReadAll(body)
+	if !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("Expected errResponseTooLarge, got %v", err)
+	}
+	if string(data) != "0123" {
+		t.Errorf("Expected the body up to the limit, got %q", data)
+	}
+	body.Read(make([]byte, 4))
+	if len(reported) != 1 {
+		t.Errorf("Expected the limit to be reported once, got %d", len(reported))
+	}
+
+	// A body within the limit is read whole
+	body = &limitedResponseBody{ReadCloser: io.NopCloser(strings.NewReader("0123")), maxBytes: 4}
+	if data, err := io.ReadAll(body); err != nil || string(data) != "0123" {
+		t.Errorf("Expected the whole body, got %q, %v", data, err)
+	}
+}
+
+// ctxReader blocks until its context is done, like a response body whose
+// request context expires.
+type ctxReader struct{ ctx context.Context }
+
+func (r ctxReader) Read([]byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func TestLimitedResponseBody_Duration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	canceled := false
+	body := &limitedResponseBody{
+		ReadCloser: io.NopCloser(ctxReader{ctx}),
+		ctx:        ctx,
+		cancel:     func() { canceled = true; cancel() },
+	}
+
+	if _, err := io.ReadAll(body); !errors.Is(err, errResponseTooSlow) {
+		t.Errorf("Expected errResponseTooSlow, got %v", err)
+	}
+	body.Close()
+	if !canceled {
+		t.Error("Expected Close to release the response context")
+	}
+}
+
+func TestRoundTrip_MaxResponseBytes(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{MaxResponseBytes: 1}, zaptest.NewLogger(t))
+
+	if _, err := transport.RoundTrip(req); !errors.Is(err, errResponseTooLarge) {
+		t.Errorf("Expected a response over the limit to be rejected, got %v", err)
+	}
+}
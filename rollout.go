@@ -0,0 +1,133 @@
+package substrate
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Canary sends a share of the requests for a script to an alternate version
+// of it, e.g. server.next.js next to server.js, for gradual rollouts. Each
+// client is assigned a bucket from 0 to 99, kept in a cookie, and is sent to
+// the canary while its bucket is below Percent, so raising the percentage
+// only moves more clients over and setting it to 0 moves everyone back.
+type Canary struct {
+	// Script is the alternate script, relative to the matched script's
+	// directory unless absolute.
+	Script string `json:"script"`
+
+	// Percent of clients routed to Script, from 0 to 100.
+	Percent int `json:"percent"`
+
+	// Cookie holds the client's bucket. Default substrate_canary.
+	Cookie string `json:"cookie,omitempty"`
+}
+
+const defaultCanaryCookie = "substrate_canary"
+
+// canaryCookieMaxAge is how long a client keeps its bucket.
+const canaryCookieMaxAge = 30 * 24 * time.Hour
+
+func (c *Canary) validate() error {
+	if c.Script == "" {
+		return fmt.Errorf("canary requires a script")
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100, got %d", c.Percent)
+	}
+	return nil
+}
+
+func (c *Canary) cookieName() string {
+	if c.Cookie != "" {
+		return c.Cookie
+	}
+	return defaultCanaryCookie
+}
+
+// route returns the script serving req in place of script, and the cookie to
+// set when the client had no valid bucket yet.
+func (c *Canary) route(req *http.Request, script string) (string, *http.Cookie) {
+	var setCookie *http.Cookie
+	bucket := -1
+	if cookie, err := req.Cookie(c.cookieName()); err == nil {
+		if n, err := strconv.Atoi(cookie.Value); err == nil && n >= 0 && n < 100 {
+			bucket = n
+		}
+	}
+	if bucket < 0 {
+		bucket = rand.IntN(100)
+		setCookie = &http.Cookie{
+			Name:     c.cookieName(),
+			Value:    strconv.Itoa(bucket),
+			Path:     "/",
+			MaxAge:   int(canaryCookieMaxAge / time.Second),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+	}
+
+	if bucket >= c.Percent {
+		return script, setCookie
+	}
+	return siblingScript(script, c.Script), setCookie
+}
+
+// siblingScript resolves alternate relative to the directory of script.
+func siblingScript(script, alternate string) string {
+	if filepath.IsAbs(alternate) {
+		return alternate
+	}
+	return filepath.Join(filepath.Dir(script), alternate)
+}
+
+// Variants picks an alternate script from a request header or cookie, e.g.
+// for A/B tests or previews. Each variant runs in its own process; requests
+// without a listed value get the matched script.
+type Variants struct {
+	// Header is the request header holding the variant. Exactly one of
+	// Header and Cookie is set.
+	Header string `json:"header,omitempty"`
+
+	// Cookie is the request cookie holding the variant.
+	Cookie string `json:"cookie,omitempty"`
+
+	// Scripts maps variant values to scripts, relative to the matched
+	// script's directory unless absolute.
+	Scripts map[string]string `json:"scripts"`
+}
+
+func (v *Variants) validate() error {
+	if (v.Header == "") == (v.Cookie == "") {
+		return fmt.Errorf("variants require either a header or a cookie")
+	}
+	if len(v.Scripts) == 0 {
+		return fmt.Errorf("variants require at least one value and script")
+	}
+	for value, script := range v.Scripts {
+		if script == "" {
+			return fmt.Errorf("variant %q has no script", value)
+		}
+	}
+	return nil
+}
+
+// route returns the script for the variant req asks for, and whether it
+// asked for one.
+func (v *Variants) route(req *http.Request, script string) (string, bool) {
+	var value string
+	if v.Header != "" {
+		value = req.Header.Get(v.Header)
+	} else if cookie, err := req.Cookie(v.Cookie); err == nil {
+		value = cookie.Value
+	}
+
+	alternate, ok := v.Scripts[value]
+	if !ok || value == "" {
+		return script, false
+	}
+	return siblingScript(script, alternate), true
+}
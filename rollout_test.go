@@ -0,0 +1,152 @@
+package substrate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCanary_Route(t *testing.T) {
+	canary := &Canary{Script: "server.next.js", Percent: 10}
+
+	tests := []struct {
+		name   string
+		bucket string
+		want   string
+	}{
+		{"below percent", "3", "/srv/app/server.next.js"},
+		{"at percent", "10", "/srv/app/server.js"},
+		{"above percent", "99", "/srv/app/server.js"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(&http.Cookie{Name: defaultCanaryCookie, Value: tt.bucket})
+			script, setCookie := canary.route(req, "/srv/app/server.js")
+			if script != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, script)
+			}
+			if setCookie != nil {
+				t.Errorf("Expected the client's bucket to be kept, got cookie %v", setCookie)
+			}
+		})
+	}
+
+	// New and invalid buckets are assigned and stored
+	for _, value := range []string{"", "100", "x"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if value != "" {
+			req.AddCookie(&http.Cookie{Name: defaultCanaryCookie, Value: value})
+		}
+		script, setCookie := canary.route(req, "/srv/app/server.js")
+		if setCookie == nil || setCookie.Name != defaultCanaryCookie {
+			t.Fatalf("Expected a bucket cookie for %q, got %v", value, setCookie)
+		}
+		bucket, err := strconv.Atoi(setCookie.Value)
+		if err != nil || bucket < 0 || bucket > 99 {
+			t.Errorf("Expected a bucket from 0 to 99, got %q", setCookie.Value)
+		}
+		if want := bucket < 10; want != (script == "/srv/app/server.next.js") {
+			t.Errorf("Bucket %d routed to %q", bucket, script)
+		}
+	}
+
+	// An absolute alternate is used as is
+	absolute := &Canary{Script: "/srv/next/server.js", Percent: 100}
+	if script, _ := absolute.route(httptest.NewRequest("GET", "/", nil), "/srv/app/server.js"); script != "/srv/next/server.js" {
+		t.Errorf("Expected the absolute canary script, got %q", script)
+	}
+}
+
+func TestUnmarshalCaddyfile_Canary(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		canary server.next.js 25% rollout
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if want := (Canary{Script: "server.next.js", Percent: 25, Cookie: "rollout"}); transport.Canary == nil || *transport.Canary != want {
+		t.Fatalf("Expected %+v, got %+v", want, transport.Canary)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	transport.Canary.Percent = 101
+	if err := transport.Validate(); err == nil {
+		t.Error("A canary percent above 100 should be rejected")
+	}
+}
+
+func TestVariants_Route(t *testing.T) {
+	variants := &Variants{Header: "X-Variant", Scripts: map[string]string{
+		"beta": "server.beta.js",
+		"v2":   "/srv/v2/server.js",
+	}}
+
+	tests := []struct {
+		header      string
+		want        string
+		wantVariant bool
+	}{
+		{"beta", "/srv/app/server.beta.js", true},
+		{"v2", "/srv/v2/server.js", true},
+		{"gamma", "/srv/app/server.js", false},
+		{"", "/srv/app/server.js", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			req.Header.Set("X-Variant", tt.header)
+		}
+		script, variant := variants.route(req, "/srv/app/server.js")
+		if script != tt.want || variant != tt.wantVariant {
+			t.Errorf("%q: expected %q (%v), got %q (%v)", tt.header, tt.want, tt.wantVariant, script, variant)
+		}
+	}
+
+	byCookie := &Variants{Cookie: "ab", Scripts: map[string]string{"b": "server.b.js"}}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "ab", Value: "b"})
+	if script, _ := byCookie.route(req, "/srv/app/server.js"); script != "/srv/app/server.b.js" {
+		t.Errorf("Expected the cookie's variant, got %q", script)
+	}
+}
+
+func TestUnmarshalCaddyfile_Variants(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		variants cookie ab {
+			b    server.b.js
+			beta server.beta.js
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	v := transport.Variants
+	if v == nil || v.Cookie != "ab" || v.Scripts["b"] != "server.b.js" || v.Scripts["beta"] != "server.beta.js" {
+		t.Fatalf("Unexpected variants: %+v", v)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	v.Header = "X-Variant"
+	if err := transport.Validate(); err == nil {
+		t.Error("Variants by both header and cookie should be rejected")
+	}
+
+	d = caddyfile.NewTestDispenser(`substrate {
+		variants query ab
+	}`)
+	if err := (&SubstrateTransport{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Variants by anything but header or cookie should be rejected")
+	}
+}
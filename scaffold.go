@@ -0,0 +1,207 @@
+package substrate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+// scaffold is the starting point caddy substrate init writes for a runtime:
+// a server listening on the socket path substrate passes, and a Caddyfile
+// serving it. %[1]s in the Caddyfile is replaced by the directory.
+type scaffold struct {
+	script    string
+	source    string
+	caddyfile string
+}
+
+var scaffolds = map[string]scaffold{
+	"deno": {
+		script: "hello.js",
+		source: `// Started by substrate with the socket path to listen on as its argument
+const [socketPath] = Deno.args;
+
+Deno.serve({ path: socketPath }, (req) => {
+  return new Response("Hello from Substrate!\n");
+});
+
+Deno.addSignalListener("SIGTERM", () => {
+  Deno.exit(0);
+});
+`,
+		caddyfile: `localhost {
+	root * "%[1]s"
+
+	# Every .js file under the root is an endpoint: /hello.js runs hello.js
+	substrate_run *.js {
+		dev on
+	}
+}
+`,
+	},
+	"node": {
+		script: "server.js",
+		source: `// Started by substrate with the socket path to listen on as its last argument
+const http = require("node:http");
+
+const socketPath = process.argv[process.argv.length - 1];
+
+const server = http.createServer((req, res) => {
+  res.setHeader("Content-Type", "text/plain; charset=utf-8");
+  res.end("Hello from Substrate!\n");
+});
+server.listen(socketPath);
+
+process.on("SIGTERM", () => {
+  server.close(() => process.exit(0));
+});
+`,
+		caddyfile: `{
+	substrate {
+		service app {
+			command node server.js
+			dir "%[1]s"
+		}
+	}
+}
+
+localhost {
+	reverse_proxy {
+		transport substrate {
+			service app
+		}
+	}
+}
+`,
+	},
+	"python": {
+		script: "server.py",
+		source: `# Started by substrate with the socket path to listen on as its last argument
+import signal
+import sys
+from http.server import BaseHTTPRequestHandler
+from socketserver import ThreadingMixIn, UnixStreamServer
+
+
+class Handler(BaseHTTPRequestHandler):
+    protocol_version = "HTTP/1.1"
+
+    def do_GET(self):
+        body = b"Hello from Substrate!\n"
+        self.send_response(200)
+        self.send_header("Content-Type", "text/plain; charset=utf-8")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def address_string(self):
+        # Unix socket clients have no address
+        return "substrate"
+
+
+class Server(ThreadingMixIn, UnixStreamServer):
+    daemon_threads = True
+
+
+signal.signal(signal.SIGTERM, lambda *_: sys.exit(0))
+Server(sys.argv[-1], Handler).serve_forever()
+`,
+		caddyfile: `{
+	substrate {
+		service app {
+			command python3 server.py
+			dir "%[1]s"
+		}
+	}
+}
+
+localhost {
+	reverse_proxy {
+		transport substrate {
+			service app
+		}
+	}
+}
+`,
+	},
+}
+
+// writeScaffold writes the scaffold for runtime into dir and returns the
+// files it created. Existing files are never overwritten.
+func writeScaffold(dir, runtime string) ([]string, error) {
+	s, ok := scaffolds[runtime]
+	if !ok {
+		names := make([]string, 0, len(scaffolds))
+		for name := range scaffolds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown runtime %q, must be one of %s", runtime, strings.Join(names, ", "))
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{s.script, s.source},
+		{"Caddyfile", fmt.Sprintf(s.caddyfile, dir)},
+	}
+	for _, file := range files {
+		if _, err := os.Lstat(filepath.Join(dir, file.name)); err == nil {
+			return nil, fmt.Errorf("%s already exists, not overwriting it", file.name)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	var written []string
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return written, err
+		}
+		_, err = f.WriteString(file.content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+func cmdInit(fl caddycmd.Flags) (int, error) {
+	runtime := "deno"
+	if fl.NArg() > 0 {
+		runtime = fl.Arg(0)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	written, err := writeScaffold(dir, runtime)
+	for _, path := range written {
+		fmt.Printf("Wrote %s\n", path)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	fmt.Println("Start Caddy with: caddy run")
+	if runtime == "deno" {
+		fmt.Println("Then try: curl https://localhost/hello.js")
+	} else {
+		fmt.Println("Then try: curl https://localhost/")
+	}
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,55 @@
+package substrate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestWriteScaffold(t *testing.T) {
+	for runtime, s := range scaffolds {
+		t.Run(runtime, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "my app")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			written, err := writeScaffold(dir, runtime)
+			if err != nil {
+				t.Fatalf("writeScaffold failed: %v", err)
+			}
+			if len(written) != 2 || filepath.Base(written[0]) != s.script {
+				t.Errorf("Expected %s and a Caddyfile, got %v", s.script, written)
+			}
+
+			caddyfileData, err := os.ReadFile(filepath.Join(dir, "Caddyfile"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(caddyfileData), dir) {
+				t.Errorf("Expected the Caddyfile to name %s:\n%s", dir, caddyfileData)
+			}
+			if _, _, err := (caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}).Adapt(caddyfileData, nil); err != nil {
+				t.Errorf("Generated Caddyfile does not adapt: %v", err)
+			}
+
+			// A second run leaves the files alone
+			if err := os.WriteFile(written[0], []byte("mine"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := writeScaffold(dir, runtime); err == nil {
+				t.Error("Expected existing files to be refused")
+			}
+			if data, _ := os.ReadFile(written[0]); string(data) != "mine" {
+				t.Error("Existing file was overwritten")
+			}
+		})
+	}
+
+	if _, err := writeScaffold(t.TempDir(), "cobol"); err == nil || !strings.Contains(err.Error(), "deno, node, python") {
+		t.Errorf("Expected an unknown runtime error listing the runtimes, got %v", err)
+	}
+}
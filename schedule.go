@@ -0,0 +1,260 @@
+package substrate
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Schedule window actions.
+const (
+	ScheduleScaleToZero  = "scale_to_zero"
+	ScheduleNoColdStarts = "no_cold_starts"
+)
+
+// scheduleCheckInterval is how often scale_to_zero windows are enforced.
+const scheduleCheckInterval = 30 * time.Second
+
+// ScheduleWindow is a recurring time of the week in which the transport
+// scales to zero or refuses cold starts, such as nightly maintenance or
+// quiet hours.
+type ScheduleWindow struct {
+	// Action is scale_to_zero, which stops every process without requests
+	// in flight throughout the window, or no_cold_starts, which answers
+	// requests that would start a process with 503 Service Unavailable while
+	// running processes keep serving.
+	Action string `json:"action"`
+
+	// Start and End are times of day as HH:MM. A window whose End is not
+	// after its Start runs past midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Days limits the window to the days it starts on, as mon to sun or a
+	// range such as mon-fri. Empty is every day.
+	Days []string `json:"days,omitempty"`
+
+	// Timezone is the IANA time zone of Start and End. Empty uses Caddy's
+	// local time.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// scheduleWindow is a validated ScheduleWindow. It holds only values, so
+// liveSettings that contain it can be compared and printed.
+type scheduleWindow struct {
+	action     string
+	start, end int     // minutes since midnight
+	days       [7]bool // indexed by time.Weekday
+	timezone   string
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compileSchedule validates windows for use in liveSettings.
+func compileSchedule(windows []ScheduleWindow) ([]scheduleWindow, error) {
+	compiled := make([]scheduleWindow, 0, len(windows))
+	for _, w := range windows {
+		c, err := w.compile()
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s %s-%s: %w", w.Action, w.Start, w.End, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func (w ScheduleWindow) compile() (scheduleWindow, error) {
+	c := scheduleWindow{action: w.Action, timezone: w.Timezone}
+	if w.Action != ScheduleScaleToZero && w.Action != ScheduleNoColdStarts {
+		return c, fmt.Errorf("action must be %s or %s", ScheduleScaleToZero, ScheduleNoColdStarts)
+	}
+
+	var err error
+	if c.start, err = parseClock(w.Start); err != nil {
+		return c, err
+	}
+	if c.end, err = parseClock(w.End); err != nil {
+		return c, err
+	}
+	if _, err := scheduleLocation(w.Timezone); err != nil {
+		return c, fmt.Errorf("invalid timezone: %w", err)
+	}
+
+	if len(w.Days) == 0 {
+		for day := range c.days {
+			c.days[day] = true
+		}
+	}
+	for _, spec := range w.Days {
+		first, last, isRange := strings.Cut(strings.ToLower(spec), "-")
+		from, ok := weekdays[first]
+		to := from
+		if isRange {
+			to, ok = weekdays[last]
+		}
+		if !ok {
+			return c, fmt.Errorf("invalid day %q: use mon to sun, or a range such as mon-fri", spec)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			c.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return c, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight.
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: use HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+var scheduleLocations sync.Map // time zone name to *time.Location
+
+// scheduleLocation loads a time zone once; empty is the local time zone.
+func scheduleLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	if loc, ok := scheduleLocations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	scheduleLocations.Store(name, loc)
+	return loc, nil
+}
+
+// activeUntil reports whether the window is active at now, and when it ends.
+func (w scheduleWindow) activeUntil(now time.Time) (time.Time, bool) {
+	loc, err := scheduleLocation(w.timezone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	at := func(days, minutes int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day()+days, 0, minutes, 0, 0, loc)
+	}
+
+	if w.start < w.end {
+		if w.days[today] && minute >= w.start && minute < w.end {
+			return at(0, w.end), true
+		}
+		return time.Time{}, false
+	}
+	// Past midnight: the evening part belongs to today's window, the
+	// morning part to yesterday's
+	if w.days[today] && minute >= w.start {
+		return at(1, w.end), true
+	}
+	if w.days[(today+6)%7] && minute < w.end {
+		return at(0, w.end), true
+	}
+	return time.Time{}, false
+}
+
+// activeWindow returns the latest end of the windows with action that are
+// active at now, and whether there is one.
+func activeWindow(windows []scheduleWindow, action string, now time.Time) (time.Time, bool) {
+	var until time.Time
+	active := false
+	for _, w := range windows {
+		if w.action != action {
+			continue
+		}
+		if end, ok := w.activeUntil(now); ok {
+			active = true
+			if end.After(until) {
+				until = end
+			}
+		}
+	}
+	return until, active
+}
+
+// ColdStartsPausedError is returned when a no_cold_starts window refuses to
+// start a process.
+type ColdStartsPausedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ColdStartsPausedError) Error() string {
+	return "process starts are paused by the schedule"
+}
+
+// coldStartsPaused returns a *ColdStartsPausedError while a no_cold_starts
+// window is active.
+func (pm *ProcessManager) coldStartsPaused(now time.Time) error {
+	until, ok := activeWindow(pm.settings().schedule, ScheduleNoColdStarts, now)
+	if !ok {
+		return nil
+	}
+	return &ColdStartsPausedError{RetryAfter: until.Sub(now)}
+}
+
+// startScheduleLoop starts enforcing scale_to_zero windows, once.
+func (pm *ProcessManager) startScheduleLoop() {
+	pm.scheduleOnce.Do(func() {
+		pm.wg.Add(1)
+		go pm.scheduleLoop()
+	})
+}
+
+func (pm *ProcessManager) scheduleLoop() {
+	defer pm.wg.Done()
+
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		pm.scaleToZero(time.Now())
+		select {
+		case <-pm.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scaleToZero stops every process without requests in flight while a
+// scale_to_zero window is active. Frozen processes are kept for
+// investigation, as by the idle timeout.
+func (pm *ProcessManager) scaleToZero(now time.Time) {
+	if _, ok := activeWindow(pm.settings().schedule, ScheduleScaleToZero, now); !ok {
+		return
+	}
+
+	for key, process := range pm.processes.snapshot() {
+		removed := pm.processes.removeWhen(key, process, func(p *Process) bool {
+			return p.activeRequests == 0 && !p.frozen
+		})
+		if !removed {
+			continue
+		}
+
+		pm.logger.Info("stopping process for scheduled scale to zero",
+			zap.String("script_path", key),
+		)
+		if err := process.Stop(); err != nil {
+			pm.logger.Error("failed to stop process",
+				zap.String("script_path", key),
+				zap.Error(err),
+			)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package substrate
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestScheduleWindow_Compile(t *testing.T) {
+	valid := ScheduleWindow{Action: ScheduleScaleToZero, Start: "22:00", End: "06:30", Days: []string{"mon-fri", "Sun"}, Timezone: "UTC"}
+	w, err := valid.compile()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := [7]bool{true, true, true, true, true, true, false}; w.days != want || w.start != 22*60 || w.end != 6*60+30 {
+		t.Errorf("Unexpected window %+v", w)
+	}
+
+	for name, window := range map[string]ScheduleWindow{
+		"action":   {Action: "pause", Start: "01:00", End: "02:00"},
+		"start":    {Action: ScheduleNoColdStarts, Start: "25:00", End: "02:00"},
+		"end":      {Action: ScheduleNoColdStarts, Start: "01:00", End: "2am"},
+		"day":      {Action: ScheduleNoColdStarts, Start: "01:00", End: "02:00", Days: []string{"monday"}},
+		"range":    {Action: ScheduleNoColdStarts, Start: "01:00", End: "02:00", Days: []string{"mon-"}},
+		"timezone": {Action: ScheduleNoColdStarts, Start: "01:00", End: "02:00", Timezone: "Mars/Olympus"},
+	} {
+		if _, err := window.compile(); err == nil {
+			t.Errorf("Expected an error for an invalid %s", name)
+		}
+	}
+}
+
+func TestScheduleWindow_ActiveUntil(t *testing.T) {
+	date := func(day, hour, minute int) time.Time {
+		// 2024-01-01 is a Monday
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	compile := func(start, end string, days ...string) scheduleWindow {
+		w, err := ScheduleWindow{Action: ScheduleScaleToZero, Start: start, End: end, Days: days, Timezone: "UTC"}.compile()
+		if err != nil {
+			t.Fatalf("compile failed: %v", err)
+		}
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		window scheduleWindow
+		now    time.Time
+		until  time.Time
+		active bool
+	}{
+		{"inside", compile("02:00", "04:00"), date(1, 3, 0), date(1, 4, 0), true},
+		{"at end", compile("02:00", "04:00"), date(1, 4, 0), time.Time{}, false},
+		{"evening of overnight", compile("22:00", "06:00"), date(1, 23, 0), date(2, 6, 0), true},
+		{"morning of overnight", compile("22:00", "06:00"), date(2, 5, 59), date(2, 6, 0), true},
+		{"between overnight", compile("22:00", "06:00"), date(2, 12, 0), time.Time{}, false},
+		{"morning after its day", compile("22:00", "02:00", "fri"), date(6, 1, 0), date(6, 2, 0), true},
+		{"morning after other day", compile("22:00", "02:00", "fri"), date(7, 1, 0), time.Time{}, false},
+		{"whole day", compile("00:00", "00:00", "sat-sun"), date(7, 12, 0), date(8, 0, 0), true},
+		{"weekday range", compile("09:00", "17:00", "mon-fri"), date(6, 12, 0), time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, active := tt.window.activeUntil(tt.now)
+			if active != tt.active || !until.Equal(tt.until) {
+				t.Errorf("activeUntil(%v) = %v, %v; want %v, %v", tt.now, until, active, tt.until, tt.active)
+			}
+		})
+	}
+}
+
+// allDay returns a window with action that is active at any time.
+func allDay(t *testing.T, action string) []scheduleWindow {
+	t.Helper()
+	schedule, err := compileSchedule([]ScheduleWindow{{Action: action, Start: "00:00", End: "00:00"}})
+	if err != nil {
+		t.Fatalf("compileSchedule failed: %v", err)
+	}
+	return schedule
+}
+
+func TestProcessManager_NoColdStarts(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{schedule: allDay(t, ScheduleNoColdStarts)},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	_, err = pm.newProcess("/srv/app.js", "/srv/app.js", "", time.Now())
+	pausedErr, ok := err.(*ColdStartsPausedError)
+	if !ok {
+		t.Fatalf("Expected a *ColdStartsPausedError, got %v", err)
+	}
+	if pausedErr.RetryAfter <= 0 || pausedErr.RetryAfter > 24*time.Hour {
+		t.Errorf("Unexpected RetryAfter %v", pausedErr.RetryAfter)
+	}
+
+	resp := startErrorResponse(httptest.NewRequest("GET", "/app.js", nil), err, false)
+	if resp.StatusCode != 503 || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestProcessManager_ScaleToZero(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	idle := &Process{scriptPath: "/srv/idle.js", logger: logger}
+	busy := &Process{scriptPath: "/srv/busy.js", logger: logger}
+	for _, p := range []*Process{idle, busy} {
+		pm.processes.acquire(p.scriptPath, func() (*Process, error) { return p, nil })
+	}
+	pm.processes.release(idle.scriptPath, idle, false)
+
+	// Outside a window nothing is stopped
+	pm.scaleToZero(time.Now())
+	if pm.processes.get("/srv/idle.js") != idle {
+		t.Fatal("Expected the idle process to be kept without a scale_to_zero window")
+	}
+
+	pm.settingsMu.Lock()
+	pm.live.schedule = allDay(t, ScheduleScaleToZero)
+	pm.settingsMu.Unlock()
+	pm.scaleToZero(time.Now())
+
+	if pm.processes.get("/srv/idle.js") != nil {
+		t.Error("Expected the idle process to be stopped")
+	}
+	if pm.processes.get("/srv/busy.js") != busy {
+		t.Error("Expected the process serving a request to be kept")
+	}
+}
+
+func TestUnmarshalCaddyfile_Schedule(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		schedule scale_to_zero 22:00-06:00 mon-fri
+		schedule no_cold_starts 02:00-03:00 sun {
+			timezone Europe/Berlin
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.Schedule) != 2 {
+		t.Fatalf("Expected 2 windows, got %+v", transport.Schedule)
+	}
+	first, second := transport.Schedule[0], transport.Schedule[1]
+	if first.Action != ScheduleScaleToZero || first.Start != "22:00" || first.End != "06:00" || len(first.Days) != 1 {
+		t.Errorf("Unexpected first window %+v", first)
+	}
+	if second.Action != ScheduleNoColdStarts || second.Timezone != "Europe/Berlin" || second.Days[0] != "sun" {
+		t.Errorf("Unexpected second window %+v", second)
+	}
+
+	d = caddyfile.NewTestDispenser(`substrate {
+		schedule scale_to_zero 22:00
+	}`)
+	if err := (&SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for a window without an end")
+	}
+}
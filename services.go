@@ -0,0 +1,89 @@
+package substrate
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Service is a named process defined in the substrate app. Every transport
+// that refers to it with `service <name>` shares the one process, whichever
+// file the request matched. A service is started by its first request and
+// restarted by the next request after it exits; it is never stopped for
+// being idle.
+type Service struct {
+	// Script is the Deno script the service runs, started like a request
+	// process.
+	Script string `json:"script,omitempty"`
+
+	// Command runs a program instead of a Deno script. The socket path is
+	// appended to its arguments. It runs in Dir, with the permissions of
+	// Dir's owner when Caddy runs as root.
+	Command []string `json:"command,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+
+	// Env is added to the app env for this service.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+func (s *Service) validate(name string) error {
+	switch {
+	case s.Script != "" && len(s.Command) > 0:
+		return fmt.Errorf("service %s: script and command are mutually exclusive", name)
+	case s.Script != "":
+		if !filepath.IsAbs(s.Script) {
+			return fmt.Errorf("service %s: script must be an absolute path, got %q", name, s.Script)
+		}
+	case len(s.Command) > 0:
+		if !filepath.IsAbs(s.Dir) {
+			return fmt.Errorf("service %s: command requires an absolute dir, got %q", name, s.Dir)
+		}
+	default:
+		return fmt.Errorf("service %s: needs a script or a command", name)
+	}
+	return nil
+}
+
+// getOrCreateService returns the named service's process, starting it if
+// needed, and the cold start the caller waited for. The caller passes the
+// process to releaseProcess once its request is done.
+func (pm *ProcessManager) getOrCreateService(name string, svc *Service) (*Process, *coldStart, error) {
+	key := serviceKey(name)
+	process, created, err := pm.processes.acquire(key, func() (*Process, error) {
+		file := svc.Script
+		if len(svc.Command) > 0 {
+			file = svc.Dir
+		}
+		process, err := pm.newProcess(key, file, "", time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		process.command = svc.Command
+		if len(svc.Env) > 0 {
+			baseEnv := pm.settings().env
+			env := make(map[string]string, len(baseEnv)+len(svc.Env))
+			for k, v := range baseEnv {
+				env[k] = v
+			}
+			for k, v := range svc.Env {
+				env[k] = v
+			}
+			process.env = env
+		}
+		return process, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cold, err := pm.awaitStart(key, process, created)
+	if err != nil {
+		return nil, nil, err
+	}
+	return process, cold, nil
+}
+
+// serviceKey is the key a service's process is stored under.
+func serviceKey(name string) string {
+	return "service:" + name
+}
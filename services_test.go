@@ -0,0 +1,136 @@
+package substrate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestService_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		service Service
+		valid   bool
+	}{
+		{"script", Service{Script: "/srv/api/main.ts"}, true},
+		{"command", Service{Command: []string{"./server"}, Dir: "/srv/api"}, true},
+		{"empty", Service{}, false},
+		{"both", Service{Script: "/srv/api/main.ts", Command: []string{"./server"}, Dir: "/srv/api"}, false},
+		{"relative script", Service{Script: "api/main.ts"}, false},
+		{"command without dir", Service{Command: []string{"./server"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.service.validate("api")
+			if tt.valid && err != nil {
+				t.Errorf("Expected valid service, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestProcessManager_CommandService(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		map[string]string{"SHARED": "app"},
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "started")
+	// Records how it was started, then exits without serving
+	server := filepath.Join(dir, "server")
+	script := "#!/bin/sh\necho \"$PWD $SHARED $ROLE $*\" > " + output + "\n"
+	if err := os.WriteFile(server, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write server: %v", err)
+	}
+
+	svc := &Service{Command: []string{server, "--port"}, Dir: dir, Env: map[string]string{"ROLE": "api"}}
+	if _, _, err := pm.getOrCreateService("api", svc); err == nil {
+		t.Fatal("Expected a startup error from a service that exits")
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Service command did not run: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 5 || fields[0] != dir || fields[1] != "app" || fields[2] != "api" ||
+		fields[3] != "--port" || !strings.HasSuffix(fields[4], ".sock") {
+		t.Errorf("Unexpected service start: %q", data)
+	}
+}
+
+func TestParseGlobalOptions_Services(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		service api {
+			script /srv/api/main.ts
+			env {
+				MODE shared
+			}
+		}
+		service search {
+			command ./search --threads 4
+			dir /srv/search
+		}
+	}`)
+
+	val, err := parseGlobalOptions(d, nil)
+	if err != nil {
+		t.Fatalf("parseGlobalOptions failed: %v", err)
+	}
+	var app App
+	if err := json.Unmarshal(val.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatalf("Failed to decode app config: %v", err)
+	}
+	if api := app.Services["api"]; api == nil || api.Script != "/srv/api/main.ts" || api.Env["MODE"] != "shared" {
+		t.Errorf("Unexpected api service: %+v", api)
+	}
+	if search := app.Services["search"]; search == nil || strings.Join(search.Command, " ") != "./search --threads 4" || search.Dir != "/srv/search" {
+		t.Errorf("Unexpected search service: %+v", search)
+	}
+	if err := app.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfile_Service(t *testing.T) {
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`substrate {
+		service api
+	}`)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if transport.Service != "api" {
+		t.Errorf("Expected service api, got %q", transport.Service)
+	}
+
+	err := transport.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`substrate {
+		service api
+		idle_timeout -1
+	}`))
+	if err == nil {
+		t.Error("service with idle_timeout -1 should be rejected")
+	}
+}
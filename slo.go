@@ -0,0 +1,362 @@
+package substrate
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// SLOConfig sets a latency and error budget for each script. Requests are
+// tracked per script over a rolling window; a script going over its budget
+// is logged and reported like a crash loop when Notify is set, and logged
+// again once it is back within it.
+type SLOConfig struct {
+	// The budget of every script without one in Scripts.
+	SLOBudget
+
+	// Window is the rolling period the budget is checked over. Default 5m.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// MinRequests is how many requests a script must get within Window for
+	// its budget to be checked. Default 20.
+	MinRequests int `json:"min_requests,omitempty"`
+
+	// Scripts gives scripts budgets of their own. The first whose Match
+	// matches a script applies; what it leaves unset comes from the default
+	// budget.
+	Scripts []SLOScriptBudget `json:"scripts,omitempty"`
+}
+
+// SLOBudget is the latency and error rate a script may not exceed. Zero
+// values are not checked.
+type SLOBudget struct {
+	// LatencyP99 is the most time 99% of requests may take to get their
+	// response headers.
+	LatencyP99 caddy.Duration `json:"latency_p99,omitempty"`
+
+	// ErrorRate is the largest share of requests, from 0 to 1, that may fail
+	// with a 5xx response, a failed start or no response at all.
+	ErrorRate float64 `json:"error_rate,omitempty"`
+}
+
+// SLOScriptBudget is the budget of the scripts Match selects.
+type SLOScriptBudget struct {
+	// Match is a glob pattern for the absolute script path, or for the
+	// script's file name if it has no slash.
+	Match string `json:"match"`
+
+	SLOBudget
+}
+
+const (
+	defaultSLOWindow      = 5 * time.Minute
+	defaultSLOMinRequests = 20
+
+	// minSLOWindow is the shortest window, giving slots of 100ms.
+	minSLOWindow = time.Second
+
+	// sloSlots is how many parts the window is tracked in; budgets are
+	// checked as each starts.
+	sloSlots = 10
+
+	// sloBuckets are the latency histogram buckets: bucket i holds
+	// latencies up to 2^(i/4) ms, so the p99 is known within 19%. A script
+	// is over its latency budget once its p99 is in a bucket above the
+	// budget's.
+	sloBuckets = 96
+
+	sloLatency   = "latency_p99"
+	sloErrorRate = "error_rate"
+)
+
+func (c *SLOConfig) validate() error {
+	if c.Window < 0 || c.MinRequests < 0 {
+		return fmt.Errorf("slo window and min_requests cannot be negative")
+	}
+	if c.Window != 0 && time.Duration(c.Window) < minSLOWindow {
+		return fmt.Errorf("slo window must be at least %s, got %s", minSLOWindow, time.Duration(c.Window))
+	}
+	budgets := []SLOBudget{c.SLOBudget}
+	for _, s := range c.Scripts {
+		if s.Match == "" {
+			return fmt.Errorf("slo script budget requires a match pattern")
+		}
+		if _, err := filepath.Match(s.Match, ""); err != nil {
+			return fmt.Errorf("slo script pattern %q: %w", s.Match, err)
+		}
+		budgets = append(budgets, s.SLOBudget)
+	}
+	set := false
+	for _, b := range budgets {
+		if b.LatencyP99 < 0 {
+			return fmt.Errorf("slo latency_p99 cannot be negative")
+		}
+		if b.ErrorRate < 0 || b.ErrorRate > 1 {
+			return fmt.Errorf("slo error_rate must be between 0 and 1, got %v", b.ErrorRate)
+		}
+		set = set || b.LatencyP99 > 0 || b.ErrorRate > 0
+	}
+	if !set {
+		return fmt.Errorf("slo requires latency_p99 or error_rate")
+	}
+	return nil
+}
+
+func (c *SLOConfig) window() time.Duration {
+	if c.Window == 0 {
+		return defaultSLOWindow
+	}
+	return time.Duration(c.Window)
+}
+
+func (c *SLOConfig) minRequests() int {
+	if c.MinRequests == 0 {
+		return defaultSLOMinRequests
+	}
+	return c.MinRequests
+}
+
+// budget returns the budget of script.
+func (c *SLOConfig) budget(script string) SLOBudget {
+	budget := c.SLOBudget
+	for _, s := range c.Scripts {
+		name := script
+		if !strings.Contains(s.Match, "/") {
+			name = filepath.Base(script)
+		}
+		if ok, _ := filepath.Match(s.Match, name); !ok {
+			continue
+		}
+		if s.LatencyP99 > 0 {
+			budget.LatencyP99 = s.LatencyP99
+		}
+		if s.ErrorRate > 0 {
+			budget.ErrorRate = s.ErrorRate
+		}
+		break
+	}
+	return budget
+}
+
+// parseRate parses an error rate given as a fraction or a percentage.
+func parseRate(s string) (float64, error) {
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		value, err := strconv.ParseFloat(percent, 64)
+		return value / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// sloStartFailure reports whether a failure to start a process counts
+// against the script's error budget; refusals to start more processes are
+// not the script's failures.
+func sloStartFailure(err error) bool {
+	var limitErr *StartLimitError
+	return !errors.As(err, &limitErr) && !errors.Is(err, errColdStartQueueTimeout)
+}
+
+// sloBucket returns the histogram bucket of latency.
+func sloBucket(latency time.Duration) int {
+	ms := float64(latency) / float64(time.Millisecond)
+	if ms <= 1 {
+		return 0
+	}
+	return min(int(math.Ceil(4*math.Log2(ms))), sloBuckets-1)
+}
+
+// sloBucketLatency returns the largest latency in bucket i.
+func sloBucketLatency(i int) time.Duration {
+	return time.Duration(math.Exp2(float64(i)/4) * float64(time.Millisecond))
+}
+
+// sloSlot counts the requests of a part of the window.
+type sloSlot struct {
+	start     time.Time
+	requests  int
+	errors    int
+	latencies [sloBuckets]int
+}
+
+// sloScript is what is tracked of a script.
+type sloScript struct {
+	budget    SLOBudget
+	slots     [sloSlots]sloSlot
+	evaluated time.Time       // start of the slot the budget was last checked in
+	violated  map[string]bool // budgets the script is over
+}
+
+// sloStatus is a script's performance over the window.
+type sloStatus struct {
+	requests   int
+	errorRate  float64
+	latencyP99 time.Duration
+}
+
+// sloTracker tracks the requests of each script against its budget.
+type sloTracker struct {
+	config   *SLOConfig
+	window   time.Duration
+	slot     time.Duration
+	logger   *zap.Logger
+	notifier *notifier
+
+	mu      sync.Mutex
+	scripts map[string]*sloScript
+}
+
+func newSLOTracker(config *SLOConfig, logger *zap.Logger, n *notifier) *sloTracker {
+	window := config.window()
+	return &sloTracker{
+		config:   config,
+		window:   window,
+		slot:     window / sloSlots,
+		logger:   logger,
+		notifier: n,
+		scripts:  make(map[string]*sloScript),
+	}
+}
+
+// observe records a request to script that took latency to get its
+// response headers, or failed. A negative latency is not tracked, for
+// requests that never reached a process.
+func (t *sloTracker) observe(script string, latency time.Duration, failed bool, now time.Time) {
+	t.mu.Lock()
+	s := t.scripts[script]
+	if s == nil {
+		s = &sloScript{budget: t.config.budget(script), violated: make(map[string]bool)}
+		t.scripts[script] = s
+	}
+
+	start := now.Truncate(t.slot)
+	slot := &s.slots[int(start.UnixNano()/int64(t.slot))%sloSlots]
+	if !slot.start.Equal(start) {
+		*slot = sloSlot{start: start}
+	}
+	slot.requests++
+	if failed {
+		slot.errors++
+	}
+	if latency >= 0 {
+		slot.latencies[sloBucket(latency)]++
+	}
+
+	// The budget is checked once per slot, as it starts
+	if start.Equal(s.evaluated) {
+		t.mu.Unlock()
+		return
+	}
+	s.evaluated = start
+	status := s.status(now.Add(-t.window))
+	if status.requests < t.config.minRequests() {
+		t.mu.Unlock()
+		return
+	}
+	over := map[string]bool{
+		sloLatency:   s.budget.LatencyP99 > 0 && status.latencyP99 > sloBucketLatency(sloBucket(time.Duration(s.budget.LatencyP99))),
+		sloErrorRate: s.budget.ErrorRate > 0 && status.errorRate > s.budget.ErrorRate,
+	}
+	var violated, recovered []string
+	for _, reason := range []string{sloLatency, sloErrorRate} {
+		if over[reason] && !s.violated[reason] {
+			violated = append(violated, reason)
+		} else if !over[reason] && s.violated[reason] {
+			recovered = append(recovered, reason)
+		}
+		s.violated[reason] = over[reason]
+	}
+	budget := s.budget
+	t.mu.Unlock()
+
+	fields := []zap.Field{
+		zap.String("script_path", script),
+		zap.Int("requests", status.requests),
+		zap.Float64("error_rate", status.errorRate),
+		zap.Duration("latency_p99", status.latencyP99),
+		zap.Float64("error_rate_budget", budget.ErrorRate),
+		zap.Duration("latency_p99_budget", time.Duration(budget.LatencyP99)),
+		zap.Duration("window", t.window),
+	}
+	for _, reason := range violated {
+		t.logger.Warn("script over its SLO budget", append(fields, zap.String("budget", reason))...)
+		t.notifier.sloViolated(Notification{
+			Script:       script,
+			Reason:       "slo_" + reason,
+			Requests:     status.requests,
+			ErrorRate:    status.errorRate,
+			LatencyP99Ms: status.latencyP99.Milliseconds(),
+			Time:         now,
+		})
+	}
+	for _, reason := range recovered {
+		t.logger.Info("script back within its SLO budget", append(fields, zap.String("budget", reason))...)
+	}
+}
+
+// status sums the slots started after since.
+func (s *sloScript) status(since time.Time) sloStatus {
+	var status sloStatus
+	var latencies [sloBuckets]int
+	measured := 0
+	for i := range s.slots {
+		slot := &s.slots[i]
+		if !slot.start.After(since) {
+			continue
+		}
+		status.requests += slot.requests
+		status.errorRate += float64(slot.errors)
+		for b, n := range slot.latencies {
+			latencies[b] += n
+			measured += n
+		}
+	}
+	if status.requests > 0 {
+		status.errorRate /= float64(status.requests)
+	}
+	// The p99 is the bound of the bucket the 99th percentile falls in
+	rank := int(math.Ceil(0.99 * float64(measured)))
+	for b, n := range latencies {
+		rank -= n
+		if n > 0 && rank <= 0 {
+			status.latencyP99 = sloBucketLatency(b)
+			break
+		}
+	}
+	return status
+}
+
+// unmarshalSLOBudget parses the budget option d is on.
+func unmarshalSLOBudget(d *caddyfile.Dispenser, budget *SLOBudget) error {
+	option := d.Val()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	switch option {
+	case "latency_p99":
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("parsing slo latency_p99: %v", err)
+		}
+		budget.LatencyP99 = caddy.Duration(dur)
+	case "error_rate":
+		rate, err := parseRate(d.Val())
+		if err != nil {
+			return d.Errf("parsing slo error_rate: %v", err)
+		}
+		budget.ErrorRate = rate
+	default:
+		return d.Errf("unknown slo budget option: %s", option)
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package substrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSLOBucket(t *testing.T) {
+	for _, latency := range []time.Duration{0, time.Millisecond, 7 * time.Millisecond, 450 * time.Millisecond, 3 * time.Second} {
+		b := sloBucket(latency)
+		if latency > sloBucketLatency(b) {
+			t.Errorf("%v is over the bound of its bucket, %v", latency, sloBucketLatency(b))
+		}
+		if b > 0 && latency <= sloBucketLatency(b-1) {
+			t.Errorf("%v belongs in a lower bucket than %d", latency, b)
+		}
+	}
+	if b := sloBucket(24 * time.Hour); b != sloBuckets-1 {
+		t.Errorf("Expected the longest latencies in the last bucket, got %d", b)
+	}
+}
+
+func TestSLOConfig_Budget(t *testing.T) {
+	config := &SLOConfig{
+		SLOBudget: SLOBudget{LatencyP99: caddy.Duration(300 * time.Millisecond), ErrorRate: 0.01},
+		Scripts: []SLOScriptBudget{
+			{Match: "/srv/reports/*.js", SLOBudget: SLOBudget{LatencyP99: caddy.Duration(5 * time.Second)}},
+			{Match: "upload.js", SLOBudget: SLOBudget{ErrorRate: 0.1}},
+		},
+	}
+	tests := map[string]SLOBudget{
+		"/srv/app.js":           config.SLOBudget,
+		"/srv/reports/daily.js": {LatencyP99: caddy.Duration(5 * time.Second), ErrorRate: 0.01},
+		"/srv/api/upload.js":    {LatencyP99: caddy.Duration(300 * time.Millisecond), ErrorRate: 0.1},
+	}
+	for script, want := range tests {
+		if got := config.budget(script); got != want {
+			t.Errorf("budget(%q) = %+v, want %+v", script, got, want)
+		}
+	}
+}
+
+func TestSLOStartFailure(t *testing.T) {
+	if sloStartFailure(&StartLimitError{Scope: "client"}) || sloStartFailure(fmt.Errorf("queued: %w", errColdStartQueueTimeout)) {
+		t.Error("Expected refusals to start not to count")
+	}
+	if !sloStartFailure(errors.New("exited before its socket was ready")) {
+		t.Error("Expected failed starts to count")
+	}
+}
+
+func TestSLOTracker(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	config := &SLOConfig{
+		SLOBudget:   SLOBudget{LatencyP99: caddy.Duration(100 * time.Millisecond), ErrorRate: 0.05},
+		Window:      caddy.Duration(time.Minute),
+		MinRequests: 10,
+	}
+	dir := t.TempDir()
+	output := filepath.Join(dir, "notifications")
+	n := newNotifier(&NotifyConfig{Command: []string{"sh", "-c", "cat >> " + output + "; echo >> " + output}}, zap.New(core))
+	tracker := newSLOTracker(config, zap.New(core), n)
+	now := time.Unix(1_700_000_000, 0)
+
+	// Fast requests, but one in ten fails
+	for i := 0; i < 20; i++ {
+		tracker.observe("/srv/app.js", 20*time.Millisecond, i%10 == 0, now)
+	}
+	// The budget is checked as the next part of the window starts
+	now = now.Add(tracker.slot)
+	tracker.observe("/srv/app.js", 20*time.Millisecond, false, now)
+	n.wait()
+
+	over := logs.FilterMessage("script over its SLO budget").All()
+	if len(over) != 1 || over[0].ContextMap()["budget"] != sloErrorRate {
+		t.Fatalf("Expected the error rate reported, got %+v", over)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Expected a notification: %v", err)
+	}
+	var notification Notification
+	if err := json.Unmarshal([]byte(strings.TrimSpace(string(data))), &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.Reason != "slo_error_rate" || notification.Requests != 21 || notification.ErrorRate < 0.09 {
+		t.Errorf("Unexpected notification: %+v", notification)
+	}
+
+	// Still over the budget: nothing more is reported
+	now = now.Add(tracker.slot)
+	tracker.observe("/srv/app.js", 20*time.Millisecond, false, now)
+	if n := logs.FilterMessage("script over its SLO budget").Len(); n != 1 {
+		t.Errorf("Expected one report while over the budget, got %d", n)
+	}
+
+	// Once the failures are out of the window, the script is back within it
+	// and slow requests are what is reported
+	now = now.Add(time.Minute)
+	for i := 0; i < 20; i++ {
+		tracker.observe("/srv/app.js", 400*time.Millisecond, false, now)
+	}
+	now = now.Add(tracker.slot)
+	tracker.observe("/srv/app.js", 400*time.Millisecond, false, now)
+	n.wait()
+
+	if recovered := logs.FilterMessage("script back within its SLO budget").All(); len(recovered) != 1 || recovered[0].ContextMap()["budget"] != sloErrorRate {
+		t.Errorf("Expected the error rate recovered, got %+v", recovered)
+	}
+	over = logs.FilterMessage("script over its SLO budget").All()
+	if len(over) != 2 || over[1].ContextMap()["budget"] != sloLatency {
+		t.Errorf("Expected the latency reported, got %+v", over)
+	}
+}
+
+func TestSLOTracker_MinRequests(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	config := &SLOConfig{SLOBudget: SLOBudget{ErrorRate: 0.01}}
+	tracker := newSLOTracker(config, zap.New(core), nil)
+	now := time.Unix(1_700_000_000, 0)
+	for i := 0; i < 5; i++ {
+		tracker.observe("/srv/app.js", -1, true, now)
+	}
+	tracker.observe("/srv/app.js", -1, true, now.Add(tracker.slot))
+	if logs.Len() != 0 {
+		t.Errorf("Expected too few requests not to be checked, got %+v", logs.All())
+	}
+}
+
+func TestUnmarshalCaddyfile_SLO(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		slo {
+			latency_p99 300ms
+			error_rate 1%
+			window 10m
+			min_requests 50
+			script /srv/reports/*.js {
+				latency_p99 5s
+			}
+		}
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	got := transport.SLO
+	if got == nil || got.LatencyP99 != caddy.Duration(300*time.Millisecond) || got.ErrorRate != 0.01 || got.Window != caddy.Duration(10*time.Minute) || got.MinRequests != 50 {
+		t.Fatalf("Unexpected slo config: %+v", got)
+	}
+	if len(got.Scripts) != 1 || got.Scripts[0].Match != "/srv/reports/*.js" || got.Scripts[0].LatencyP99 != caddy.Duration(5*time.Second) {
+		t.Fatalf("Unexpected script budgets: %+v", got.Scripts)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	for _, config := range []*SLOConfig{
+		{},
+		{SLOBudget: SLOBudget{ErrorRate: 1.5}},
+		{SLOBudget: SLOBudget{ErrorRate: 0.01}, Window: caddy.Duration(time.Nanosecond)},
+		{SLOBudget: SLOBudget{ErrorRate: 0.01}, Window: caddy.Duration(500 * time.Millisecond)},
+		{SLOBudget: SLOBudget{ErrorRate: 0.01}, Scripts: []SLOScriptBudget{{Match: "[", SLOBudget: SLOBudget{ErrorRate: 0.1}}}},
+	} {
+		transport.SLO = config
+		if err := transport.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package substrate
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// SlowRequestConfig logs requests a process takes long to answer, optionally
+// with diagnostics the process reports about itself while the request is
+// still running.
+type SlowRequestConfig struct {
+	// Threshold after which a request still in progress is logged.
+	Threshold caddy.Duration `json:"threshold"`
+
+	// DebugPath, if set, is requested from the process (GET, on its socket)
+	// when a request becomes slow, e.g. an endpoint dumping stack traces.
+	// Its output is attached to the log entry.
+	DebugPath string `json:"debug_path,omitempty"`
+}
+
+// slowRequestDebugTimeout bounds the request to the debug endpoint.
+const slowRequestDebugTimeout = 5 * time.Second
+
+// slowRequestDebugLimit is the most debug output attached to a log entry.
+const slowRequestDebugLimit = 64 << 10
+
+func (c *SlowRequestConfig) validate() error {
+	if c.Threshold <= 0 {
+		return fmt.Errorf("slow_request threshold must be positive")
+	}
+	if c.DebugPath != "" && !strings.HasPrefix(c.DebugPath, "/") {
+		return fmt.Errorf("slow_request debug path must start with /, got %q", c.DebugPath)
+	}
+	return nil
+}
+
+// watchSlowRequest logs req to the process on socketPath once it has taken
+// longer than the threshold. The returned function marks the request done;
+// a request that was logged as slow is then logged again with its total
+// duration.
+func (t *SubstrateTransport) watchSlowRequest(req *http.Request, filePath, socketPath string, start time.Time) func() {
+	config := t.SlowRequest
+	method, uri := req.Method, req.URL.RequestURI()
+	fired := make(chan struct{})
+	timer := time.AfterFunc(time.Duration(config.Threshold), func() {
+		defer close(fired)
+		fields := []zap.Field{
+			zap.String("method", method),
+			zap.String("uri", uri),
+			zap.String("file_path", filePath),
+			zap.String("socket_path", socketPath),
+			zap.Duration("elapsed", time.Since(start)),
+		}
+		if config.DebugPath != "" {
+			output, err := fetchDebugOutput(socketPath, config.DebugPath)
+			if err != nil {
+				fields = append(fields, zap.NamedError("debug_error", err))
+			} else {
+				fields = append(fields, zap.String("debug_output", output))
+			}
+		}
+		t.logger.Warn("slow request", fields...)
+	})
+
+	return func() {
+		if timer.Stop() {
+			return
+		}
+		<-fired
+		t.logger.Info("slow request completed",
+			zap.String("method", method),
+			zap.String("uri", uri),
+			zap.String("file_path", filePath),
+			zap.Duration("duration", time.Since(start)),
+		)
+	}
+}
+
+// fetchDebugOutput requests path from the process on socketPath and returns
+// the start of its response body.
+func fetchDebugOutput(socketPath, path string) (string, error) {
+	client := socketClient(socketPath, slowRequestDebugTimeout)
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("http://substrate.localhost" + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, slowRequestDebugLimit))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("debug endpoint answered %d", resp.StatusCode)
+	}
+	return string(body), nil
+}
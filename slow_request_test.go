@@ -0,0 +1,95 @@
+package substrate
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWatchSlowRequest(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on socket: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/__stack" {
+			io.WriteString(w, "goroutine 1 [running]")
+			return
+		}
+		http.NotFound(w, r)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	transport := &SubstrateTransport{
+		SlowRequest: &SlowRequestConfig{Threshold: caddy.Duration(10 * time.Millisecond), DebugPath: "/__stack"},
+		logger:      zap.New(core),
+	}
+	req := httptest.NewRequest("GET", "/report?id=1", nil)
+
+	// Fast requests are not logged
+	transport.watchSlowRequest(req, "/srv/app.js", socketPath, time.Now())()
+	time.Sleep(30 * time.Millisecond)
+	if logs.Len() != 0 {
+		t.Fatalf("Expected no log for a fast request, got %v", logs.All())
+	}
+
+	done := transport.watchSlowRequest(req, "/srv/app.js", socketPath, time.Now())
+	time.Sleep(50 * time.Millisecond)
+	done()
+
+	slow := logs.FilterMessage("slow request").All()
+	if len(slow) != 1 {
+		t.Fatalf("Expected one slow request entry, got %v", logs.All())
+	}
+	fields := slow[0].ContextMap()
+	if fields["uri"] != "/report?id=1" || fields["debug_output"] != "goroutine 1 [running]" {
+		t.Errorf("Unexpected slow request fields %v", fields)
+	}
+	if logs.FilterMessage("slow request completed").Len() != 1 {
+		t.Errorf("Expected the completion of the slow request to be logged, got %v", logs.All())
+	}
+
+	// A failing debug endpoint is reported in the entry
+	logs.TakeAll()
+	transport.SlowRequest.DebugPath = "/missing"
+	done = transport.watchSlowRequest(req, "/srv/app.js", socketPath, time.Now())
+	time.Sleep(50 * time.Millisecond)
+	done()
+	if slow := logs.FilterMessage("slow request").All(); len(slow) != 1 || slow[0].ContextMap()["debug_error"] == nil {
+		t.Errorf("Expected the debug endpoint error in the entry, got %v", logs.All())
+	}
+}
+
+func TestUnmarshalCaddyfile_SlowRequest(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		slow_request 2s /__stack
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if want := (SlowRequestConfig{Threshold: caddy.Duration(2 * time.Second), DebugPath: "/__stack"}); transport.SlowRequest == nil || *transport.SlowRequest != want {
+		t.Errorf("Expected %+v, got %+v", want, transport.SlowRequest)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	transport.SlowRequest.DebugPath = "__stack"
+	if err := transport.Validate(); err == nil {
+		t.Error("A debug path without a leading / should be rejected")
+	}
+}
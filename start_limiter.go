@@ -0,0 +1,122 @@
+package substrate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StartLimitError is returned when starting a new process would exceed the
+// configured cold start rate.
+type StartLimitError struct {
+	Scope      string // "global" or "client"
+	Limit      int    // starts per minute
+	RetryAfter time.Duration
+}
+
+func (e *StartLimitError) Error() string {
+	return fmt.Sprintf("%s process start limit of %d per minute exceeded", e.Scope, e.Limit)
+}
+
+// startLimiter bounds how often new processes may be started, globally and per
+// client, so requests for many distinct scripts can't force cold start storms.
+// Each limit is a token bucket holding up to one minute's worth of starts.
+type startLimiter struct {
+	globalLimit int
+	clientLimit int
+	global      *tokenBucket
+	clients     map[string]*tokenBucket
+	lastPrune   time.Time
+	mu          sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newStartLimiter(globalLimit, clientLimit int) *startLimiter {
+	if globalLimit <= 0 && clientLimit <= 0 {
+		return nil
+	}
+	now := time.Now()
+	l := &startLimiter{
+		globalLimit: globalLimit,
+		clientLimit: clientLimit,
+		clients:     make(map[string]*tokenBucket),
+		lastPrune:   now,
+	}
+	if globalLimit > 0 {
+		l.global = &tokenBucket{tokens: float64(globalLimit), last: now}
+	}
+	return l
+}
+
+// allow consumes a start token for client, or returns a *StartLimitError if
+// either the client or the global budget is exhausted. An empty client is
+// only subject to the global limit.
+func (l *startLimiter) allow(client string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	var clientBucket *tokenBucket
+	if l.clientLimit > 0 && client != "" {
+		clientBucket = l.clients[client]
+		if clientBucket == nil {
+			clientBucket = &tokenBucket{tokens: float64(l.clientLimit), last: now}
+			l.clients[client] = clientBucket
+		}
+		if !clientBucket.refill(now, l.clientLimit) {
+			return &StartLimitError{Scope: "client", Limit: l.clientLimit, RetryAfter: clientBucket.wait(l.clientLimit)}
+		}
+	}
+
+	if l.global != nil && !l.global.refill(now, l.globalLimit) {
+		return &StartLimitError{Scope: "global", Limit: l.globalLimit, RetryAfter: l.global.wait(l.globalLimit)}
+	}
+
+	if clientBucket != nil {
+		clientBucket.tokens--
+	}
+	if l.global != nil {
+		l.global.tokens--
+	}
+	return nil
+}
+
+// prune drops client buckets that have been idle long enough to be full again.
+func (l *startLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for client, bucket := range l.clients {
+		if now.Sub(bucket.last) >= time.Minute {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// refill adds the tokens earned since the last refill and reports whether at
+// least one token is available.
+func (b *tokenBucket) refill(now time.Time, perMinute int) bool {
+	b.tokens += now.Sub(b.last).Minutes() * float64(perMinute)
+	if b.tokens > float64(perMinute) {
+		b.tokens = float64(perMinute)
+	}
+	b.last = now
+	return b.tokens >= 1
+}
+
+// wait returns how long until the next token is available.
+func (b *tokenBucket) wait(perMinute int) time.Duration {
+	missing := 1 - b.tokens
+	return time.Duration(missing / float64(perMinute) * float64(time.Minute))
+}
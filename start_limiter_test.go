@@ -0,0 +1,69 @@
+package substrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartLimiter_PerClient(t *testing.T) {
+	limiter := newStartLimiter(0, 2)
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.allow("10.0.0.1"); err != nil {
+			t.Fatalf("Start %d should be allowed: %v", i+1, err)
+		}
+	}
+
+	err := limiter.allow("10.0.0.1")
+	limitErr, ok := err.(*StartLimitError)
+	if !ok {
+		t.Fatalf("Expected StartLimitError after exhausting client budget, got %v", err)
+	}
+	if limitErr.Scope != "client" {
+		t.Errorf("Expected client scope, got %q", limitErr.Scope)
+	}
+	if limitErr.RetryAfter <= 0 || limitErr.RetryAfter > time.Minute {
+		t.Errorf("Unexpected RetryAfter %v", limitErr.RetryAfter)
+	}
+
+	// Other clients have their own budget
+	if err := limiter.allow("10.0.0.2"); err != nil {
+		t.Errorf("Different client should be allowed: %v", err)
+	}
+}
+
+func TestStartLimiter_Global(t *testing.T) {
+	limiter := newStartLimiter(3, 0)
+
+	for _, client := range []string{"a", "b", "c"} {
+		if err := limiter.allow(client); err != nil {
+			t.Fatalf("Start for %s should be allowed: %v", client, err)
+		}
+	}
+
+	err := limiter.allow("d")
+	if limitErr, ok := err.(*StartLimitError); !ok || limitErr.Scope != "global" {
+		t.Errorf("Expected global StartLimitError, got %v", err)
+	}
+}
+
+func TestStartLimiter_Refill(t *testing.T) {
+	limiter := newStartLimiter(60, 0)
+	limiter.global.tokens = 0
+	limiter.global.last = time.Now().Add(-2 * time.Second)
+
+	// 60 per minute refills one token per second
+	if err := limiter.allow(""); err != nil {
+		t.Errorf("Start should be allowed after refill: %v", err)
+	}
+}
+
+func TestStartLimiter_Disabled(t *testing.T) {
+	limiter := newStartLimiter(0, 0)
+	if limiter != nil {
+		t.Fatal("Limiter should be nil when no limits are configured")
+	}
+	if err := limiter.allow("client"); err != nil {
+		t.Errorf("Nil limiter should allow every start: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package substrate
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultStartupFailureTTL is how long a failed start is answered from the
+// cache unless startup_failure_ttl says otherwise.
+const defaultStartupFailureTTL = 5 * time.Second
+
+// failureCache remembers the scripts that failed to start, so requests
+// within the TTL get the same error at once instead of starting the script
+// again and waiting for it to fail. Entries are per script file, whatever
+// namespace or request started it, and dropped once the file is modified.
+type failureCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedFailure
+}
+
+type cachedFailure struct {
+	err     *ProcessStartupError
+	modTime time.Time // of the script that failed
+	until   time.Time
+}
+
+func newFailureCache() *failureCache {
+	return &failureCache{entries: make(map[string]cachedFailure)}
+}
+
+// get returns the failure cached for file at modTime, or nil.
+func (c *failureCache) get(file string, modTime, now time.Time) *ProcessStartupError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[file]
+	if !ok {
+		return nil
+	}
+	if !entry.modTime.Equal(modTime) || !now.Before(entry.until) {
+		delete(c.entries, file)
+		return nil
+	}
+	return entry.err
+}
+
+// put caches the failure of file at modTime until until.
+func (c *failureCache) put(file string, modTime time.Time, err *ProcessStartupError, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Failures of scripts that are not requested again expire here
+	for name, entry := range c.entries {
+		if !entry.until.After(time.Now()) {
+			delete(c.entries, name)
+		}
+	}
+	c.entries[file] = cachedFailure{err: err, modTime: modTime, until: until}
+}
+
+// clear forgets every failure, for settings that may have fixed them.
+func (c *failureCache) clear() {
+	c.mu.Lock()
+	c.entries = make(map[string]cachedFailure)
+	c.mu.Unlock()
+}
+
+// cacheFailure caches the startup failure of a process this request
+// started, if the TTL allows.
+func (pm *ProcessManager) cacheFailure(process *Process) {
+	startupErr, ok := process.startErr.(*ProcessStartupError)
+	if !ok {
+		return
+	}
+	ttl := pm.settings().startupFailureTTL
+	if ttl <= 0 {
+		return
+	}
+	pm.failures.put(process.scriptPath, process.modTime, startupErr, time.Now().Add(ttl))
+}
@@ -0,0 +1,138 @@
+package substrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestFailureCache(t *testing.T) {
+	c := newFailureCache()
+	modTime := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := time.Now()
+	failure := &ProcessStartupError{Err: errors.New("boom"), ScriptPath: "/srv/app.js"}
+
+	c.put("/srv/app.js", modTime, failure, now.Add(5*time.Second))
+	if got := c.get("/srv/app.js", modTime, now); got != failure {
+		t.Errorf("Expected the cached failure, got %v", got)
+	}
+	if got := c.get("/srv/other.js", modTime, now); got != nil {
+		t.Errorf("Expected no failure for another script, got %v", got)
+	}
+	if got := c.get("/srv/app.js", modTime, now.Add(5*time.Second)); got != nil {
+		t.Errorf("Expected the failure to expire, got %v", got)
+	}
+
+	c.put("/srv/app.js", modTime, failure, now.Add(5*time.Second))
+	if got := c.get("/srv/app.js", modTime.Add(time.Millisecond), now); got != nil {
+		t.Errorf("Expected a modified script to start again, got %v", got)
+	}
+	if got := c.get("/srv/app.js", modTime, now); got != nil {
+		t.Error("Expected the failure of the old script to be dropped")
+	}
+
+	c.put("/srv/app.js", modTime, failure, now.Add(5*time.Second))
+	c.clear()
+	if got := c.get("/srv/app.js", modTime, now); got != nil {
+		t.Errorf("Expected clear to forget the failure, got %v", got)
+	}
+}
+
+func newFailingManager(t *testing.T, ttl time.Duration) *ProcessManager {
+	t.Helper()
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{
+			build:              &BuildConfig{Command: []string{"/bin/sh", "-c", "echo 'syntax error' >&2; exit 3"}},
+			startupFailureTTL:  ttl,
+			maxStartsPerMinute: 1,
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	t.Cleanup(func() { pm.Stop() })
+	return pm
+}
+
+func TestProcessManager_CachesStartupFailures(t *testing.T) {
+	pm := newFailingManager(t, time.Minute)
+
+	scriptPath := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	// The only start allowed fails; the next request gets the same failure
+	// without trying to start the script again
+	_, first := pm.getOrCreateHost(scriptPath, "")
+	var startupErr *ProcessStartupError
+	if !errors.As(first, &startupErr) {
+		t.Fatalf("Expected a ProcessStartupError, got %v", first)
+	}
+	if _, err := pm.getOrCreateHost(scriptPath, ""); err != first {
+		t.Errorf("Expected the cached failure, got %v", err)
+	}
+
+	// A modified script is started again, which the limiter refuses here
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(scriptPath, later, later); err != nil {
+		t.Fatalf("Failed to touch script: %v", err)
+	}
+	var limitErr *StartLimitError
+	if _, err := pm.getOrCreateHost(scriptPath, ""); !errors.As(err, &limitErr) {
+		t.Errorf("Expected a modified script to be started again, got %v", err)
+	}
+}
+
+func TestProcessManager_StartupFailureTTLDisabled(t *testing.T) {
+	pm := newFailingManager(t, 0)
+
+	scriptPath := filepath.Join(t.TempDir(), "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	pm.getOrCreateHost(scriptPath, "")
+	var limitErr *StartLimitError
+	if _, err := pm.getOrCreateHost(scriptPath, ""); !errors.As(err, &limitErr) {
+		t.Errorf("Expected the script to be started again, got %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfile_StartupFailureTTL(t *testing.T) {
+	for input, want := range map[string]caddy.Duration{
+		"10s": caddy.Duration(10 * time.Second),
+		"-1":  caddy.Duration(-1),
+	} {
+		d := caddyfile.NewTestDispenser(`substrate {
+			startup_failure_ttl ` + input + `
+		}`)
+		transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+		if err := transport.UnmarshalCaddyfile(d); err != nil {
+			t.Fatal(err)
+		}
+		if transport.StartupFailureTTL != want {
+			t.Errorf("startup_failure_ttl %s: got %v", input, transport.StartupFailureTTL)
+		}
+		if err := transport.Validate(); err != nil {
+			t.Errorf("startup_failure_ttl %s: unexpected error %v", input, err)
+		}
+	}
+
+	if err := (&SubstrateTransport{StartupTimeout: caddy.Duration(time.Second), StartupFailureTTL: caddy.Duration(-time.Second)}).Validate(); err == nil {
+		t.Error("Expected an error for a negative startup_failure_ttl")
+	}
+}
@@ -0,0 +1,49 @@
+package substrate
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// internalHeaderPrefix names the headers substrate itself sends to processes.
+// Clients' headers with this prefix are always removed, so a script can trust
+// them.
+const internalHeaderPrefix = "X-Substrate-"
+
+// validateStripHeaders checks strip_headers patterns: header names, or name
+// prefixes ending in *.
+func validateStripHeaders(patterns []string) error {
+	for _, pattern := range patterns {
+		name := strings.TrimSuffix(pattern, "*")
+		if name == "" || !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("strip_headers: invalid header name or prefix %q", pattern)
+		}
+	}
+	return nil
+}
+
+// stripHeaders removes the internal headers and those matching patterns from
+// a client request. A pattern ending in * matches every header starting with
+// the rest of it; matching ignores case.
+func stripHeaders(header http.Header, patterns []string) {
+	for name := range header {
+		if hasPrefixFold(name, internalHeaderPrefix) {
+			delete(header, name)
+			continue
+		}
+		for _, pattern := range patterns {
+			prefix, isPrefix := strings.CutSuffix(pattern, "*")
+			if (isPrefix && hasPrefixFold(name, prefix)) || (!isPrefix && strings.EqualFold(name, pattern)) {
+				delete(header, name)
+				break
+			}
+		}
+	}
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
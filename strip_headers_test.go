@@ -0,0 +1,95 @@
+package substrate
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestStripHeaders(t *testing.T) {
+	header := http.Header{
+		"X-Substrate-Warmup":  {"1"},
+		"X-Internal-User":     {"admin"},
+		"X-Internal-Role":     {"root"},
+		"X-Real-Ip":           {"10.0.0.1"},
+		"X-Real-Ip-Original":  {"keep"},
+		"Authorization":       {"keep"},
+		"X-Substrate-Segment": {"forged"},
+	}
+	stripHeaders(header, []string{"x-internal-*", "X-Real-IP"})
+	for _, name := range []string{"X-Substrate-Warmup", "X-Substrate-Segment", "X-Internal-User", "X-Internal-Role", "X-Real-Ip"} {
+		if _, ok := header[name]; ok {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+	for _, name := range []string{"X-Real-Ip-Original", "Authorization"} {
+		if _, ok := header[name]; !ok {
+			t.Errorf("Expected %s to be kept", name)
+		}
+	}
+
+	if err := validateStripHeaders([]string{"X-Ok", "X-Prefix-*"}); err != nil {
+		t.Errorf("Expected valid patterns, got %v", err)
+	}
+	for _, pattern := range []string{"*", "Bad Header", "X-Bad:*"} {
+		if err := validateStripHeaders([]string{pattern}); err == nil {
+			t.Errorf("Expected %q to be rejected", pattern)
+		}
+	}
+}
+
+func TestRoundTrip_StripHeaders(t *testing.T) {
+	var received http.Header
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{StripHeaders: []string{"X-User-*"}}, zaptest.NewLogger(t))
+	transport.transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		received = r.Header.Clone()
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(http.NoBody)}, nil
+	})
+
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Substrate-Warmup", "1")
+	req.Header.Set("X-User-Id", "42")
+	req.Header.Set("Accept", "text/plain")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if received.Get("X-Substrate-Warmup") != "" || received.Get("X-User-Id") != "" || received.Get("Accept") != "text/plain" {
+		t.Errorf("Expected internal and listed headers removed, got %v", received)
+	}
+}
+
+func TestUnmarshalCaddyfile_StripHeaders(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		strip_headers X-User-* X-Real-IP
+		strip_headers X-Tenant
+	}`)
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.StripHeaders) != 3 {
+		t.Errorf("Expected three strip_headers patterns, got %v", transport.StripHeaders)
+	}
+
+	transport = &SubstrateTransport{
+		StartupTimeout: caddy.Duration(time.Second),
+		StripHeaders:   []string{"X-Variant"},
+		Variants:       &Variants{Header: "x-variant", Scripts: map[string]string{"b": "b.js"}},
+	}
+	if err := transport.Validate(); err == nil {
+		t.Error("Expected a variants header that is stripped to be rejected")
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -1,18 +1,28 @@
 package substrate
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func init() {
@@ -25,6 +35,415 @@ type SubstrateTransport struct {
 	Env            map[string]string `json:"env,omitempty"`
 	DenoOpts       string            `json:"deno_opts,omitempty"`
 	CacheDir       string            `json:"cache_dir,omitempty"`
+	ScriptPolicy   *ScriptPolicy     `json:"script_policy,omitempty"`
+
+	// ColdStartQueueTimeout is how long a request waits for a process that
+	// another request is already starting before it gets a 503. It is
+	// separate from StartupTimeout, which is how long the process itself has
+	// to bind its socket. 0 waits for the whole startup.
+	ColdStartQueueTimeout caddy.Duration `json:"cold_start_queue_timeout,omitempty"`
+
+	// StartupFailureTTL is how long a script that failed to start gets the
+	// same 502 at once instead of being started again. Modifying the script
+	// ends it early. Default 5s; -1 starts the script on every request.
+	StartupFailureTTL caddy.Duration `json:"startup_failure_ttl,omitempty"`
+
+	// Schedule lists recurring windows in which the transport scales to
+	// zero or refuses cold starts. It does not apply to services.
+	Schedule []ScheduleWindow `json:"schedule,omitempty"`
+
+	// MaxExtend bounds how long a process may keep itself running through
+	// its control socket after the idle timeout of its last request would
+	// have stopped it. Default 10m; -1 for no limit.
+	MaxExtend caddy.Duration `json:"max_extend,omitempty"`
+
+	// PersistUsage keeps when each script was last used and how long its
+	// recent starts took in Caddy's storage, so they survive a restart. They
+	// are listed by the admin API either way.
+	PersistUsage bool `json:"persist_usage,omitempty"`
+
+	// Service sends every request to the named service of the substrate app
+	// instead of a process for the matched script file.
+	Service string `json:"service,omitempty"`
+
+	// Script chooses the script to run from placeholders, such as the output
+	// of a map directive, instead of the file matcher. A relative result is
+	// taken from the site root; one outside ScriptRoot, or an empty one, gets
+	// a 404.
+	Script string `json:"script,omitempty"`
+
+	// ScriptRoot is the directory scripts chosen by Script must be in,
+	// the site root by default. Placeholders are expanded.
+	ScriptRoot string `json:"script_root,omitempty"`
+
+	// Index lists the entrypoints looked for, in order, when a request
+	// targets a directory, like index files for file_server: the first one
+	// present is run. A directory without one gets a 404.
+	Index []string `json:"index,omitempty"`
+
+	// Methods maps HTTP methods to scripts, relative to the matched script's
+	// directory unless absolute, so GET and POST on one path can run
+	// different scripts. Methods not listed run the matched script.
+	Methods map[string]string `json:"methods,omitempty"`
+
+	// Negotiate maps media types to representation formats, so sibling
+	// scripts serve a URL per format: for report.js, report.json.js answers
+	// requests accepting application/json when it maps to json. The matched
+	// script answers the rest. Responses get Vary: Accept.
+	Negotiate map[string]string `json:"negotiate,omitempty"`
+
+	// HostRoots runs the server script of a project directory chosen by the
+	// request, such as one directory per host, instead of the file matcher.
+	// Requests for hosts without one get a 404.
+	HostRoots *HostRoots `json:"host_roots,omitempty"`
+
+	// Canary routes a percentage of clients to an alternate script.
+	Canary *Canary `json:"canary,omitempty"`
+
+	// Variants routes requests to alternate scripts by header or cookie
+	// value. A request matching a variant is not considered for Canary.
+	Variants *Variants `json:"variants,omitempty"`
+
+	// Mirror copies a percentage of requests to an alternate script and
+	// discards its responses.
+	Mirror *Mirror `json:"mirror,omitempty"`
+
+	// MicroCache answers repeated GET and HEAD requests from memory for as
+	// long as the script's Cache-Control allows.
+	MicroCache *MicroCache `json:"micro_cache,omitempty"`
+
+	// ETag adds ETags to script responses and answers If-None-Match with
+	// 304, without the process while the ETag is known to be current.
+	ETag *ETagConfig `json:"etag,omitempty"`
+
+	// Record keeps the latest requests to each script and the responses it
+	// gave, redacted, for caddy substrate replay.
+	Record *RecordConfig `json:"record,omitempty"`
+
+	// SlowRequest logs requests that take long to complete.
+	SlowRequest *SlowRequestConfig `json:"slow_request,omitempty"`
+
+	// ClientTLS passes the client's certificate and server name to the
+	// process in request headers when the request came over TLS.
+	ClientTLS *ClientTLSConfig `json:"client_tls,omitempty"`
+
+	// StripHeaders lists more request headers to remove before a request
+	// reaches the process, as names or prefixes ending in *. Headers starting
+	// with X-Substrate- are always removed, since substrate sets them itself.
+	StripHeaders []string `json:"strip_headers,omitempty"`
+
+	// HeaderCase lists request headers to send to processes with the casing
+	// given here, such as X-API-Key, for servers that match header names
+	// case-sensitively. Header names are otherwise sent canonicalized
+	// (X-Api-Key), whatever casing the client used.
+	HeaderCase []string `json:"header_case,omitempty"`
+
+	// Notify reports scripts that crash loop to a webhook or command.
+	Notify *NotifyConfig `json:"notify,omitempty"`
+
+	// SLO sets latency and error rate budgets for scripts, logging the
+	// scripts that go over them and reporting them to Notify.
+	SLO *SLOConfig `json:"slo,omitempty"`
+
+	// StopTimeout bounds how long stopping the transport's processes takes
+	// on reload or shutdown: all processes get SIGTERM at once and those
+	// still running after StopTimeout are killed. Keep it below Caddy's
+	// grace_period. Default 10s.
+	StopTimeout caddy.Duration `json:"stop_timeout,omitempty"`
+
+	// SocketPollInterval is how often a starting process's socket is tried,
+	// and SocketDialTimeout how long each try may take. Raise them for very
+	// slow filesystems or heavily loaded machines. Defaults 10ms and 500ms.
+	SocketPollInterval caddy.Duration `json:"socket_poll_interval,omitempty"`
+	SocketDialTimeout  caddy.Duration `json:"socket_dial_timeout,omitempty"`
+
+	// Runtime selects what runs a script: "deno" (the default) or "go",
+	// which compiles the Go main package in the script's directory and runs
+	// the binary with the socket path as its argument.
+	Runtime string `json:"runtime,omitempty"`
+
+	// TypeCheck type-checks TypeScript scripts when they start (deno run
+	// --check), so a type error fails the start like a syntax error does.
+	// Off by default: Deno runs TypeScript without checking it.
+	TypeCheck bool `json:"type_check,omitempty"`
+
+	// Build runs a build step in the script's directory before a process
+	// starts, when its inputs changed since the last build.
+	Build *BuildConfig `json:"build,omitempty"`
+
+	// Warmup sends requests to a new process once its socket is ready, before
+	// it serves any client.
+	Warmup *Warmup `json:"warmup,omitempty"`
+
+	// ReadyPath is requested with GET once a new process's socket accepts
+	// connections. The process is only ready when it answers with a status
+	// below 500, so one that binds its socket but fails every request does
+	// not pass startup. Empty only waits for the socket.
+	ReadyPath string `json:"ready_path,omitempty"`
+
+	// Readiness chooses how a new process is found ready once its socket
+	// accepts connections, by the name of a registered checker. ReadyPath
+	// is short for the http checker. Nil only waits for the socket.
+	Readiness *ReadinessConfig `json:"readiness,omitempty"`
+
+	// Debug starts Deno with the V8 inspector on a free loopback port, for
+	// attaching Chrome DevTools through the admin API. For development only.
+	Debug bool `json:"debug,omitempty"`
+
+	// Dev is a single switch for local development. Unless set otherwise, it
+	// turns on reload_on_change and verbose logging, keeps idle processes
+	// running (idle_timeout 0), and gives every client detailed startup error
+	// bodies, not only internal addresses. Never enable it in production.
+	Dev bool `json:"dev,omitempty"`
+
+	// SocketDir is the directory process sockets are created in. Empty uses
+	// the system temporary directory.
+	SocketDir string `json:"socket_dir,omitempty"`
+
+	// PrivateTmp gives each process its own temporary directory, exported
+	// as TMPDIR (and TMP and TEMP) and removed when the process exits, so
+	// scripts don't litter the shared /tmp or collide with each other.
+	PrivateTmp bool `json:"private_tmp,omitempty"`
+
+	// ReadOnlyProject stops processes from writing to their script's
+	// directory, so a buggy script can't modify its own source while
+	// serving. Writes go to DataDir instead.
+	ReadOnlyProject bool `json:"read_only_project,omitempty"`
+
+	// DataDir is a writable directory for processes, created if missing and
+	// exported as SUBSTRATE_DATA_DIR. With ReadOnlyProject it must be outside
+	// the script directories.
+	DataDir string `json:"data_dir,omitempty"`
+
+	// CoreDumpDir enables core dumps (RLIMIT_CORE) for processes and moves
+	// the core of a crashed process into this directory, where it is
+	// logged with the crash. The kernel's core_pattern must write cores to
+	// files, not pipe them to a handler such as systemd-coredump.
+	CoreDumpDir string `json:"core_dump_dir,omitempty"`
+
+	// TakeoverState is a file the transport keeps its running processes in,
+	// so a new Caddy instance with the same file adopts them instead of
+	// starting its own, as in a blue/green upgrade of the Caddy binary.
+	// Each transport needs a file of its own.
+	TakeoverState string `json:"takeover_state,omitempty"`
+
+	// Umask is the octal file mode creation mask for spawned processes
+	// (e.g. "0027"). Empty inherits Caddy's umask.
+	Umask string `json:"umask,omitempty"`
+
+	// MaxOpenFiles is the open file limit (RLIMIT_NOFILE) of spawned
+	// processes, capped at Caddy's own hard limit. Default 4096; -1 inherits
+	// Caddy's limit. Processes holding over 80% of it are logged and
+	// counted in caddy_substrate_open_files_near_limit_total.
+	MaxOpenFiles int `json:"max_open_files,omitempty"`
+
+	// MaxProcesses caps the processes and threads a spawned process and its
+	// children may have (cgroup v2 pids.max), so a script cannot fork-bomb
+	// the host. Default 512; -1 for no limit. Requires a cgroup v2 hierarchy
+	// Caddy may write to; without one, processes run unlimited.
+	MaxProcesses int `json:"max_processes,omitempty"`
+
+	// IOLimits throttles the disk reads and writes of each spawned process
+	// per block device (cgroup v2 io.max). Like MaxProcesses, it requires a
+	// writable cgroup v2 hierarchy, with the io controller enabled.
+	IOLimits []IOLimit `json:"io_limits,omitempty"`
+
+	// Egress restricts the hosts scripts may connect to, for running
+	// third-party code. Deno enforces it, so it does not apply to runtime go
+	// or to subprocesses a script starts.
+	Egress *EgressPolicy `json:"egress,omitempty"`
+
+	// Hosts maps host names to IP addresses for spawned processes, as extra
+	// /etc/hosts entries that win over the system's, so scripts can reach
+	// staging services without changing the host's resolver. Each process
+	// gets its own user and mount namespace with the file mounted over
+	// /etc/hosts, which needs unprivileged user namespaces when Caddy does
+	// not run as root.
+	Hosts map[string]string `json:"hosts,omitempty"`
+
+	// Group sets the primary group (name or gid) of spawned processes instead
+	// of the script file's group. Requires running as root.
+	Group string `json:"group,omitempty"`
+
+	// SupplementaryGroups lists additional groups (names or gids) for spawned
+	// processes. Requires running as root.
+	SupplementaryGroups []string `json:"supplementary_groups,omitempty"`
+
+	// MaxStartsPerMinute limits how many new processes may be started per
+	// minute across all clients. Requests over the limit get a 429.
+	MaxStartsPerMinute int `json:"max_starts_per_minute,omitempty"`
+
+	// MaxClientStartsPerMinute limits how many new processes a single client
+	// IP may cause to be started per minute.
+	MaxClientStartsPerMinute int `json:"max_client_starts_per_minute,omitempty"`
+
+	// Cluster runs each script on one of the Caddy instances sharing this
+	// instance's storage, forwarding its requests there from the others.
+	Cluster *ClusterConfig `json:"cluster,omitempty"`
+
+	// OverloadSignal gives requests refused because the node is overloaded
+	// (max_starts_per_minute reached, cold_start_queue_timeout expired) a
+	// status and header of their own, for load balancers to shed traffic.
+	OverloadSignal *OverloadSignalConfig `json:"overload_signal,omitempty"`
+
+	// MaxRequestBody is the largest request body in bytes forwarded to a
+	// process. Larger bodies get a 413 before any process is started.
+	MaxRequestBody int64 `json:"max_request_body,omitempty"`
+
+	// MaxResponseBytes aborts a process response whose body grows past this
+	// many bytes, protecting Caddy and clients from unbounded output.
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+
+	// MaxResponseDuration aborts a process response not complete this long
+	// after the request was sent to the process.
+	MaxResponseDuration caddy.Duration `json:"max_response_duration,omitempty"`
+
+	// SpoolRequestBody reads the whole request body (spilling to a temporary
+	// file when large) before starting or contacting a process.
+	SpoolRequestBody bool `json:"spool_request_body,omitempty"`
+
+	// KeepAlive tunes the connection pool to process sockets. Each socket is
+	// its own pool "host", so MaxIdleConnsPerHost applies per process.
+	KeepAlive *reverseproxy.KeepAlive `json:"keep_alive,omitempty"`
+
+	// PrewarmConnections is the number of connections opened to a process as
+	// soon as its socket is ready, so the first burst of requests doesn't pay
+	// for connection setup.
+	PrewarmConnections int `json:"prewarm_connections,omitempty"`
+
+	// HeaderDown sets default headers on process responses, such as
+	// X-Powered-By or security headers. A header the process sets itself is
+	// left alone.
+	HeaderDown map[string]string `json:"header_down,omitempty"`
+
+	// ColdStartHeaders adds X-Substrate-Cold-Start and X-Substrate-Startup-Ms
+	// to responses of requests that waited for their process to start. The
+	// {substrate.cold_start} and {substrate.startup_ms}
+	// placeholders are set either way.
+	ColdStartHeaders bool `json:"cold_start_headers,omitempty"`
+
+	// AcceptEncoding controls the client's Accept-Encoding toward the
+	// process. "passthrough" (the default) forwards it, leaving compression
+	// to the script. "strip" removes it, so processes always answer
+	// uncompressed and Caddy's encode directive compresses once.
+	AcceptEncoding string `json:"accept_encoding,omitempty"`
+
+	// FlushInterval set to -1 streams every process response: reverse_proxy
+	// flushes each write to the client immediately and the upstream hop is
+	// left uncompressed, so server-sent events and long-poll replies are never
+	// held in a buffer. 0 leaves flushing to reverse_proxy's own
+	// flush_interval.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// ResolveSymlinks keys processes by the resolved script path instead of
+	// the requested one, so a script and its symlinks share a single process
+	// running in the target's directory. Off by default.
+	ResolveSymlinks bool `json:"resolve_symlinks,omitempty"`
+
+	// ReloadOnChange replaces a process when its script file is modified. The
+	// replacement is started while the old process keeps serving, so there is
+	// no gap in service.
+	ReloadOnChange bool `json:"reload_on_change,omitempty"`
+
+	// Handover lets a replaced process pass its state to its replacement.
+	// Before the replacement starts, the old process gets a POST to
+	// /.substrate/handover with a file path in X-Substrate-Handover-File; if
+	// it answers 2xx after writing the file, the replacement is started with
+	// SUBSTRATE_HANDOVER_FILE pointing at it.
+	Handover bool `json:"handover,omitempty"`
+
+	// Namespace runs a script as a separate process per namespace, e.g.
+	// "{http.request.host}" for one process per site of a wildcard site
+	// block. Placeholders are expanded per request, and the process gets the
+	// result in SUBSTRATE_NAMESPACE. Empty runs one process per script.
+	Namespace string `json:"namespace,omitempty"`
+
+	// ShareProcesses lets transports with the same options share their
+	// processes, so two sites serving the same script run one process for
+	// it. Transports share only with others that also set it.
+	ShareProcesses bool `json:"share_processes,omitempty"`
+
+	// Verbosity controls per-request logging: "quiet" logs only failures,
+	// "normal" (the default) logs each request at debug level and "verbose"
+	// logs each request at info level. Process lifecycle events are logged
+	// regardless.
+	Verbosity string `json:"verbosity,omitempty"`
+
+	// RequestEnv passes a one-shot process a JSON description of the request
+	// it was started for (method, path, query, host, remote address and
+	// headers) in SUBSTRATE_REQUEST, so a script can decide before binding
+	// its socket, e.g. to reject unauthorized requests early. Requires
+	// idle_timeout -1 or isolation per_request.
+	RequestEnv bool `json:"request_env,omitempty"`
+
+	// Segments is a path pattern such as /apps/*/server.js. When the request
+	// path matches it, the path segments matched by each * are passed to the
+	// process, in order, as SUBSTRATE_SEGMENT_1, SUBSTRATE_SEGMENT_2, ... when
+	// it starts and as X-Substrate-Segment-1, ... headers on every request,
+	// so one script can serve many directories and know which it serves.
+	// A * matches within a single segment.
+	Segments string `json:"segments,omitempty"`
+
+	// ErrorHandling selects how failures to start a process reach the
+	// client. "respond" (the default) answers with a plain text error
+	// response. "handle_errors" returns the error to Caddy instead, so
+	// handle_errors routes can render it; startup failures also set the
+	// {substrate.startup.*} placeholders.
+	ErrorHandling string `json:"error_handling,omitempty"`
+
+	// Isolation controls how requests share processes. "shared" (the
+	// default) sends concurrent requests for a script to the same process;
+	// with idle_timeout -1 that process still serves every request that
+	// overlaps it. "per_request" starts a separate process for every request
+	// and stops it once the response is done, for scripts whose global state
+	// must never be shared.
+	Isolation string `json:"isolation,omitempty"`
+
+	requestLevel zapcore.Level
+	quiet        bool
+
+	// Set by the static_files option of substrate_run, which serves
+	// non-executable files with file_server
+	staticFiles bool
+
+	// The service's definition and the app manager running it, when Service
+	// is set
+	service        *Service
+	serviceManager *ProcessManager
+	app            *App
+
+	// The managerPool key of manager
+	poolKey string
+
+	// Responses kept for MicroCache, nil without it
+	cache *responseCache
+
+	// Latest ETags of script URLs, nil without ETag
+	etags *etagStore
+
+	// This node's view of the cluster, nil without Cluster
+	cluster *clusterNode
+
+	// Slots of the mirrored requests in progress, nil without Mirror
+	mirrors chan struct{}
+
+	// Writes the recordings, nil without Record
+	recorder *recorder
+
+	// Checks scripts against their budgets, nil without SLO
+	slo *sloTracker
+
+	// Env split into the values every process gets and those expanded with
+	// the placeholders of the request a process is started for
+	staticEnv    map[string]string
+	envTemplates map[string]string
+
+	// Schedule, validated
+	schedule []scheduleWindow
+
+	// JSON keys present in the config, so unset options can be inherited
+	// from the global substrate app
+	explicit map[string]bool
 
 	ctx       caddy.Context
 	transport http.RoundTripper
@@ -48,15 +467,102 @@ func (w *oneShotBodyWrapper) Close() error {
 	return err
 }
 
+// requestDone returns the function ending a request to process, stored
+// under key in manager, which stops a one-shot process if it was its last
+// request. It runs once, on its own or as soon as ctx is done: a client
+// going away before the response body is closed must not leave the request
+// counted, nor a one-shot process running, as nothing else ends them.
+func requestDone(ctx context.Context, manager *ProcessManager, key string, process *Process, oneShot bool) func() {
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			// Use goroutine so body close isn't blocked waiting for process to stop
+			go manager.releaseProcess(key, process, oneShot)
+		})
+	}
+	stop := context.AfterFunc(ctx, done)
+	return func() {
+		stop()
+		done()
+	}
+}
+
+// UnmarshalJSON records which options the config sets explicitly.
+func (t *SubstrateTransport) UnmarshalJSON(b []byte) error {
+	type plain SubstrateTransport
+	if err := json.Unmarshal(b, (*plain)(t)); err != nil {
+		return err
+	}
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return err
+	}
+	t.explicit = make(map[string]bool, len(keys))
+	for key := range keys {
+		t.explicit[key] = true
+	}
+	return nil
+}
+
+// isSet reports whether the JSON option key was set in the config. A
+// transport that was not loaded from JSON counts every option as set.
+func (t *SubstrateTransport) isSet(key string) bool {
+	return t.explicit == nil || t.explicit[key]
+}
+
+// applyDefaults fills unset options with their defaults, then with the global
+// substrate options when those are configured.
+func (t *SubstrateTransport) applyDefaults(ctx caddy.Context) error {
+	if !t.isSet("idle_timeout") {
+		t.IdleTimeout = caddy.Duration(1 * time.Hour)
+	}
+	if !t.isSet("startup_timeout") {
+		t.StartupTimeout = caddy.Duration(3 * time.Second)
+	}
+	if !t.isSet("max_open_files") {
+		t.MaxOpenFiles = defaultMaxOpenFiles
+	}
+	if !t.isSet("max_processes") {
+		t.MaxProcesses = defaultMaxProcesses
+	}
+	if !t.isSet("max_extend") {
+		t.MaxExtend = caddy.Duration(defaultMaxExtend)
+	}
+	if !t.isSet("startup_failure_ttl") {
+		t.StartupFailureTTL = caddy.Duration(defaultStartupFailureTTL)
+	}
+
+	app, err := ctx.AppIfConfigured("substrate")
+	if errors.Is(err, caddy.ErrNotConfigured) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading substrate app: %w", err)
+	}
+	t.app = app.(*App)
+	t.app.inherit(t)
+	return nil
+}
+
+// applyDev fills the options dev mode bundles, leaving those set explicitly
+// and any that would conflict with the rest of the config.
+func (t *SubstrateTransport) applyDev() {
+	if !t.isSet("idle_timeout") {
+		t.IdleTimeout = 0
+	}
+	if !t.isSet("verbosity") {
+		t.Verbosity = "verbose"
+	}
+	if !t.isSet("reload_on_change") && t.IdleTimeout != -1 && t.Isolation != "per_request" && t.Service == "" {
+		t.ReloadOnChange = true
+	}
+}
+
 func (SubstrateTransport) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID: "http.reverse_proxy.transport.substrate",
-		New: func() caddy.Module {
-			return &SubstrateTransport{
-				IdleTimeout:    caddy.Duration(1 * time.Hour),
-				StartupTimeout: caddy.Duration(3 * time.Second),
-			}
-		},
+		ID:  "http.reverse_proxy.transport.substrate",
+		New: func() caddy.Module { return new(SubstrateTransport) },
 	}
 }
 
@@ -64,6 +570,45 @@ func (t *SubstrateTransport) Provision(ctx caddy.Context) error {
 	t.ctx = ctx
 	t.logger = ctx.Logger()
 
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+
+	if err := t.applyDefaults(ctx); err != nil {
+		return err
+	}
+	schedule, err := compileSchedule(t.Schedule)
+	if err != nil {
+		return err
+	}
+	t.schedule = schedule
+	if t.Dev {
+		t.applyDev()
+	}
+
+	if t.Service != "" {
+		if t.app == nil {
+			return fmt.Errorf("unknown service %s: no services are defined in the substrate global options", t.Service)
+		}
+		svc, manager, err := t.app.service(t.Service)
+		if err != nil {
+			return err
+		}
+		t.service, t.serviceManager = svc, manager
+	}
+
+	for _, warning := range t.lint() {
+		t.logger.Warn("substrate configuration warning", zap.String("warning", warning))
+	}
+
+	t.requestLevel = zapcore.DebugLevel
+	switch t.Verbosity {
+	case "quiet":
+		t.quiet = true
+	case "verbose":
+		t.requestLevel = zapcore.InfoLevel
+	}
+
 	t.logger.Debug("provisioning substrate transport",
 		zap.Duration("idle_timeout", time.Duration(t.IdleTimeout)),
 		zap.Duration("startup_timeout", time.Duration(t.StartupTimeout)),
@@ -74,25 +619,112 @@ func (t *SubstrateTransport) Provision(ctx caddy.Context) error {
 
 	// Create HTTP transport with Unix socket support
 	httpTransport := new(reverseproxy.HTTPTransport)
+	httpTransport.KeepAlive = t.keepAlive()
+	if t.FlushInterval < 0 || t.AcceptEncoding == "strip" {
+		// Transparent gzip on the upstream hop would let the process's
+		// compressor hold back small writes, and would ask for compression
+		// that strip is meant to leave to Caddy
+		compression := false
+		httpTransport.Compression = &compression
+	}
 	if err := httpTransport.Provision(ctx); err != nil {
 		t.logger.Error("failed to provision HTTP transport", zap.Error(err))
 		return fmt.Errorf("failed to provision HTTP transport: %w", err)
 	}
 
 	t.transport = httpTransport
+
+	if t.MicroCache != nil {
+		t.cache = newResponseCache(t.MicroCache)
+	}
+	if t.ETag != nil {
+		t.etags = newETagStore(t.ETag)
+	}
+	if t.Mirror != nil {
+		t.mirrors = make(chan struct{}, mirrorMaxInFlight)
+	}
+	if t.Record != nil {
+		t.recorder = newRecorder(t.Record, t.logger)
+	}
 	t.logger.Debug("HTTP transport provisioned successfully")
 
 	// Create Deno manager for downloading/caching the Deno runtime
 	t.deno = NewDenoManager(t.CacheDir, t.logger)
 	t.logger.Debug("deno manager created successfully")
 
-	manager, err := NewProcessManager(t.IdleTimeout, t.StartupTimeout, t.Env, t.DenoOpts, t.deno, t.logger)
+	opts, err := t.processOptions()
+	if err != nil {
+		return err
+	}
+	if t.PersistUsage {
+		if err := scriptUsage.attach(ctx, ctx.Storage(), usageStorageKey()); err != nil {
+			t.logger.Warn("failed to load persisted script usage", zap.Error(err))
+		}
+	}
+	t.staticEnv, t.envTemplates = splitEnv(t.Env)
+	if t.Cluster != nil {
+		t.cluster = newClusterNode(t.Cluster, ctx.Storage(), t.logger)
+		go t.cluster.run(ctx)
+	}
+
+	// On a config reload, the transport takes over the processes of the
+	// matching transport in the old config unless process options changed
+	fingerprint := t.processFingerprint()
+	config, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("encoding transport config: %w", err)
+	}
+	var key string
+	if t.ShareProcesses {
+		key = sharedPoolKey(config)
+	} else if key, err = poolKey(ctx, fingerprint); err != nil {
+		return err
+	}
+	reasons := restartReasons(ctx, fingerprint)
+	value, loaded, err := managerPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		manager, err := newProcessManager(t.IdleTimeout, t.StartupTimeout, t.staticEnv, t.DenoOpts, t.deno, t.logger, opts)
+		if err != nil {
+			return nil, err
+		}
+		registerManager(manager)
+		return pooledManager{manager, fingerprint, ctx.Context}, nil
+	})
 	if err != nil {
 		t.logger.Error("failed to create process manager", zap.Error(err))
 		return fmt.Errorf("failed to create process manager: %w", err)
 	}
+	manager := value.(pooledManager).ProcessManager
 	t.manager = manager
-	t.logger.Debug("process manager created successfully")
+	t.poolKey = key
+	manager.setTransportConfig(config)
+	if loaded && value.(pooledManager).config == ctx.Context {
+		t.logger.Debug("sharing process manager with another transport")
+	} else if loaded {
+		changed, onRestart := manager.reconfigure(t.liveSettings())
+		t.logger.Info("keeping running processes across config reload",
+			zap.Strings("changed", changed),
+			zap.Strings("applied_on_restart", onRestart),
+		)
+	} else if len(reasons) > 0 {
+		t.logger.Info("starting new processes, options changed that require a restart",
+			zap.Strings("options", reasons),
+		)
+	} else {
+		t.logger.Debug("process manager created successfully")
+	}
+
+	// Serve dials from connections prewarmed by the manager
+	httpTransport.Transport.DialContext = manager.conns.dialContext(httpTransport.Transport.DialContext)
+
+	// Drop idle connections to a process before it is stopped
+	manager.drains.register(t, httpTransport.Transport.CloseIdleConnections)
+	if t.serviceManager != nil {
+		t.serviceManager.drains.register(t, httpTransport.Transport.CloseIdleConnections)
+	}
+
+	if t.SLO != nil {
+		t.slo = newSLOTracker(t.SLO, t.logger, manager.notifier)
+	}
 
 	t.logger.Info("substrate transport provisioned",
 		zap.Duration("idle_timeout", time.Duration(t.IdleTimeout)),
@@ -105,6 +737,123 @@ func (t *SubstrateTransport) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// keepAlive returns the connection pool settings for process sockets, filling
+// unset values with Caddy's HTTP transport defaults. A nil result leaves all
+// defaults to Caddy.
+func (t *SubstrateTransport) keepAlive() *reverseproxy.KeepAlive {
+	if t.KeepAlive == nil {
+		return nil
+	}
+	keepAlive := *t.KeepAlive
+	if keepAlive.IdleConnTimeout == 0 {
+		keepAlive.IdleConnTimeout = caddy.Duration(2 * time.Minute)
+	}
+	if keepAlive.MaxIdleConnsPerHost == 0 {
+		keepAlive.MaxIdleConnsPerHost = 32
+	}
+	return &keepAlive
+}
+
+// processOptions resolves the transport configuration into the options shared
+// by every process the manager spawns.
+func (t *SubstrateTransport) processOptions() (processOptions, error) {
+	opts := processOptions{
+		scriptPolicy:             t.ScriptPolicy,
+		maxStartsPerMinute:       t.MaxStartsPerMinute,
+		schedule:                 t.schedule,
+		maxClientStartsPerMinute: t.MaxClientStartsPerMinute,
+		prewarmConns:             t.PrewarmConnections,
+		reloadOnChange:           t.ReloadOnChange,
+		handover:                 t.Handover,
+		socketDir:                t.SocketDir,
+		coldStartQueueTimeout:    time.Duration(t.ColdStartQueueTimeout),
+		notify:                   t.Notify,
+		build:                    t.Build,
+		warmup:                   t.Warmup,
+		readiness:                t.Readiness,
+		inspect:                  t.Debug,
+		typeCheck:                t.TypeCheck,
+		egress:                   t.Egress,
+		hosts:                    t.Hosts,
+		stopTimeout:              time.Duration(t.StopTimeout),
+		socketPollInterval:       time.Duration(t.SocketPollInterval),
+		socketDialTimeout:        time.Duration(t.SocketDialTimeout),
+		privateTmp:               t.PrivateTmp,
+		readOnlyProject:          t.ReadOnlyProject,
+		dataDir:                  t.DataDir,
+		coreDumpDir:              t.CoreDumpDir,
+		persistUsage:             t.PersistUsage,
+		takeoverState:            t.TakeoverState,
+	}
+
+	if t.ReadyPath != "" {
+		opts.readiness = &ReadinessConfig{Checker: "http", Args: []string{t.ReadyPath}}
+	}
+	if t.MaxExtend > 0 {
+		opts.maxExtend = time.Duration(t.MaxExtend)
+	}
+	if t.StartupFailureTTL > 0 {
+		opts.startupFailureTTL = time.Duration(t.StartupFailureTTL)
+	}
+	if t.MaxOpenFiles > 0 {
+		opts.maxOpenFiles = capOpenFiles(t.MaxOpenFiles)
+	}
+	if t.MaxProcesses > 0 {
+		opts.maxProcesses = t.MaxProcesses
+		opts.explicitLimits = t.isSet("max_processes")
+	}
+	for _, limit := range t.IOLimits {
+		line, err := limit.ioMax()
+		if err != nil {
+			return opts, err
+		}
+		opts.ioMax = append(opts.ioMax, line)
+		opts.explicitLimits = true
+	}
+
+	if t.ScriptPolicy != nil {
+		if err := t.ScriptPolicy.provision(); err != nil {
+			return opts, fmt.Errorf("invalid script_policy: %w", err)
+		}
+	}
+
+	if t.Umask != "" {
+		umask, err := parseUmask(t.Umask)
+		if err != nil {
+			return opts, err
+		}
+		opts.umask = umask
+	}
+
+	// Checked here rather than in Validate, so a config meant to run as root
+	// can still be adapted by another user
+	if (t.Group != "" || len(t.SupplementaryGroups) > 0) && os.Geteuid() != 0 {
+		return opts, fmt.Errorf("group and supplementary_groups require running Caddy as root")
+	}
+
+	if t.Group != "" {
+		gid, err := lookupGID(t.Group)
+		if err != nil {
+			return opts, fmt.Errorf("invalid group: %w", err)
+		}
+		opts.gid = &gid
+	}
+
+	for _, group := range t.SupplementaryGroups {
+		gid, err := lookupGID(group)
+		if err != nil {
+			return opts, fmt.Errorf("invalid supplementary_groups: %w", err)
+		}
+		opts.groups = append(opts.groups, gid)
+	}
+
+	if t.Runtime == "go" {
+		opts.goCompiler = NewGoCompiler(t.CacheDir, t.logger)
+	}
+
+	return opts, nil
+}
+
 func (t *SubstrateTransport) Validate() error {
 	if t.IdleTimeout < -1 {
 		return fmt.Errorf("idle_timeout must be >= -1 (use -1 for close-after-request, 0 to disable cleanup, or positive duration)")
@@ -118,106 +867,1509 @@ func (t *SubstrateTransport) Validate() error {
 		return fmt.Errorf("startup_timeout cannot be zero")
 	}
 
-	return nil
-}
+	if _, err := compileSchedule(t.Schedule); err != nil {
+		return err
+	}
 
-func (t *SubstrateTransport) Cleanup() error {
-	t.logger.Info("cleaning up substrate transport")
-	if t.manager != nil {
-		if err := t.manager.Stop(); err != nil {
-			t.logger.Error("error during process manager cleanup", zap.Error(err))
+	if t.MaxExtend < 0 && t.MaxExtend != -1 {
+		return fmt.Errorf("max_extend must be positive, or -1 for no limit")
+	}
+
+	if t.MaxOpenFiles < -1 {
+		return fmt.Errorf("max_open_files must be positive, or -1 to inherit Caddy's limit")
+	}
+
+	if t.MaxProcesses < -1 {
+		return fmt.Errorf("max_processes must be positive, or -1 for no limit")
+	}
+
+	for i := range t.IOLimits {
+		if err := t.IOLimits[i].validate(); err != nil {
 			return err
 		}
-		t.logger.Debug("process manager stopped successfully")
 	}
-	t.logger.Info("substrate transport cleanup complete")
-	return nil
-}
 
-func (t *SubstrateTransport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	for d.Next() {
-		for d.NextBlock(0) {
-			switch d.Val() {
-			case "idle_timeout":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				val := d.Val()
-				// Handle special cases for unitless values
-				if val == "0" {
-					t.IdleTimeout = caddy.Duration(0)
-				} else if val == "-1" {
-					t.IdleTimeout = caddy.Duration(-1)
-				} else {
-					dur, err := time.ParseDuration(val)
-					if err != nil {
-						return d.Errf("parsing idle_timeout: %v", err)
-					}
-					t.IdleTimeout = caddy.Duration(dur)
-				}
-			case "startup_timeout":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				dur, err := time.ParseDuration(d.Val())
-				if err != nil {
-					return d.Errf("parsing startup_timeout: %v", err)
-				}
-				t.StartupTimeout = caddy.Duration(dur)
-			case "env":
-				if t.Env == nil {
-					t.Env = make(map[string]string)
-				}
-				for d.NextBlock(1) {
-					key := d.Val()
-					if !d.NextArg() {
-						return d.Errf("env directive requires key-value pairs")
-					}
-					value := d.Val()
-					t.Env[key] = value
-				}
-			case "deno_opts":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				t.DenoOpts = d.Val()
-			case "cache_dir":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				t.CacheDir = d.Val()
-			default:
-				return d.Errf("unknown directive: %s", d.Val())
-			}
+	if t.Egress != nil {
+		if err := t.Egress.validate(); err != nil {
+			return err
 		}
 	}
-	return nil
-}
 
-func (t *SubstrateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	t.logger.Debug("handling request",
-		zap.String("method", req.Method),
-		zap.String("url", req.URL.String()),
-		zap.String("remote_addr", req.RemoteAddr),
-	)
+	if err := validateHosts(t.Hosts); err != nil {
+		return err
+	}
 
-	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if t.Notify != nil {
+		if err := t.Notify.validate(); err != nil {
+			return err
+		}
+	}
 
-	filePath, _ := repl.GetString("http.matchers.file.absolute")
-	if filePath == "" {
-		filePath = req.URL.Path
-		t.logger.Debug("no file matcher found, using URL path",
-			zap.String("path", filePath),
-		)
-	} else {
-		t.logger.Debug("resolved file path from matcher",
-			zap.String("file_path", filePath),
-		)
+	if t.SLO != nil {
+		if err := t.SLO.validate(); err != nil {
+			return err
+		}
 	}
 
-	// Convert to absolute path for consistent process tracking
-	absFilePath, err := filepath.Abs(filePath)
-	if err != nil {
+	switch t.Runtime {
+	case "", "deno", "go":
+	default:
+		return fmt.Errorf("runtime must be deno or go, got %q", t.Runtime)
+	}
+
+	if t.Build != nil {
+		if err := t.Build.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.Warmup != nil {
+		if err := t.Warmup.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.ReadyPath != "" && !strings.HasPrefix(t.ReadyPath, "/") {
+		return fmt.Errorf("ready_path must start with /, got %q", t.ReadyPath)
+	}
+
+	if t.Readiness != nil {
+		if t.ReadyPath != "" {
+			return fmt.Errorf("ready_path and readiness cannot both be set")
+		}
+		if err := t.Readiness.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := validateIndex(t.Index); err != nil {
+		return err
+	}
+
+	if err := validateNegotiate(t.Negotiate); err != nil {
+		return err
+	}
+
+	if err := validateMethods(t.Methods); err != nil {
+		return err
+	}
+
+	if t.HostRoots != nil {
+		if err := t.HostRoots.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.Mirror != nil {
+		if err := t.Mirror.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.Canary != nil {
+		if err := t.Canary.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.Variants != nil {
+		if err := t.Variants.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.MicroCache != nil {
+		if err := t.MicroCache.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.ETag != nil {
+		if err := t.ETag.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.Record != nil {
+		if err := t.Record.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.SlowRequest != nil {
+		if err := t.SlowRequest.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.ClientTLS != nil {
+		if err := t.ClientTLS.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.OverloadSignal != nil {
+		if err := t.OverloadSignal.validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.Cluster != nil {
+		if err := t.Cluster.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := validateHeaderCase(t.HeaderCase); err != nil {
+		return err
+	}
+
+	if err := validateStripHeaders(t.StripHeaders); err != nil {
+		return err
+	}
+
+	if t.DataDir != "" && !filepath.IsAbs(t.DataDir) {
+		return fmt.Errorf("data_dir must be an absolute path, got %q", t.DataDir)
+	}
+
+	if t.CoreDumpDir != "" && !filepath.IsAbs(t.CoreDumpDir) {
+		return fmt.Errorf("core_dump_dir must be an absolute path, got %q", t.CoreDumpDir)
+	}
+
+	if t.TakeoverState != "" && !filepath.IsAbs(t.TakeoverState) {
+		return fmt.Errorf("takeover_state must be an absolute path, got %q", t.TakeoverState)
+	}
+
+	if t.ColdStartQueueTimeout < 0 {
+		return fmt.Errorf("cold_start_queue_timeout cannot be negative")
+	}
+
+	if t.StartupFailureTTL < 0 && t.StartupFailureTTL != -1 {
+		return fmt.Errorf("startup_failure_ttl must be positive, or -1 to not cache startup failures")
+	}
+
+	if t.StopTimeout < 0 {
+		return fmt.Errorf("stop_timeout cannot be negative")
+	}
+
+	if t.SocketPollInterval < 0 {
+		return fmt.Errorf("socket_poll_interval cannot be negative")
+	}
+	if t.SocketDialTimeout < 0 {
+		return fmt.Errorf("socket_dial_timeout cannot be negative")
+	}
+
+	if t.Segments != "" {
+		if _, err := path.Match(t.Segments, ""); err != nil || !strings.Contains(t.Segments, "*") {
+			return fmt.Errorf("segments must be a path pattern with at least one *, got %q", t.Segments)
+		}
+	}
+
+	if t.KeepAlive != nil && (t.KeepAlive.MaxIdleConns < 0 || t.KeepAlive.MaxIdleConnsPerHost < 0 || t.KeepAlive.IdleConnTimeout < 0) {
+		return fmt.Errorf("keepalive settings cannot be negative")
+	}
+
+	switch t.Verbosity {
+	case "", "quiet", "normal", "verbose":
+	default:
+		return fmt.Errorf("verbosity must be quiet, normal or verbose, got %q", t.Verbosity)
+	}
+
+	switch t.AcceptEncoding {
+	case "", "passthrough", "strip":
+	default:
+		return fmt.Errorf("accept_encoding must be passthrough or strip, got %q", t.AcceptEncoding)
+	}
+
+	switch t.ErrorHandling {
+	case "", "respond", "handle_errors":
+	default:
+		return fmt.Errorf("error_handling must be respond or handle_errors, got %q", t.ErrorHandling)
+	}
+
+	switch t.Isolation {
+	case "", "shared", "per_request":
+	default:
+		return fmt.Errorf("isolation must be shared or per_request, got %q", t.Isolation)
+	}
+
+	if t.FlushInterval > 0 {
+		return fmt.Errorf("flush_interval only supports -1 (flush immediately); set flush_interval on reverse_proxy for periodic flushing")
+	}
+
+	if t.PrewarmConnections < 0 {
+		return fmt.Errorf("prewarm_connections cannot be negative")
+	}
+
+	if t.MaxResponseBytes < 0 {
+		return fmt.Errorf("max_response_bytes cannot be negative")
+	}
+
+	if t.MaxResponseDuration < 0 {
+		return fmt.Errorf("max_response_duration cannot be negative")
+	}
+
+	if t.MaxRequestBody < 0 {
+		return fmt.Errorf("max_request_body cannot be negative")
+	}
+
+	if t.MaxStartsPerMinute < 0 || t.MaxClientStartsPerMinute < 0 {
+		return fmt.Errorf("max_starts_per_minute and max_client_starts_per_minute cannot be negative")
+	}
+
+	return t.checkConflicts()
+}
+
+// checkConflicts rejects combinations of options that cannot work together.
+// It runs both when the Caddyfile is adapted and when the config is loaded.
+func (t *SubstrateTransport) checkConflicts() error {
+	if t.IdleTimeout == -1 && t.ReloadOnChange {
+		return fmt.Errorf("reload_on_change has no effect with idle_timeout -1, which starts a new process for every request; remove one of them")
+	}
+
+	if t.Runtime == "go" && t.ReadOnlyProject {
+		return fmt.Errorf("read_only_project relies on Deno permissions and cannot be used with runtime go")
+	}
+
+	if t.Runtime == "go" && t.Debug {
+		return fmt.Errorf("debug starts the Deno inspector and cannot be used with runtime go")
+	}
+
+	if t.Egress != nil && (t.Runtime == "go" || t.Service != "") {
+		return fmt.Errorf("egress is enforced by Deno's permissions and cannot be used with runtime go or a service")
+	}
+
+	if t.Runtime == "go" && t.TypeCheck {
+		return fmt.Errorf("type_check applies to Deno scripts and cannot be used with runtime go")
+	}
+
+	if t.Isolation == "per_request" && t.ReloadOnChange {
+		return fmt.Errorf("reload_on_change has no effect with isolation per_request, which starts a new process for every request; remove one of them")
+	}
+
+	if t.RequestEnv && t.IdleTimeout != -1 && t.Isolation != "per_request" {
+		return fmt.Errorf("request_env requires idle_timeout -1 or isolation per_request, since a shared process serves many requests")
+	}
+
+	if t.IdleTimeout == -1 && t.PrewarmConnections > 0 {
+		return fmt.Errorf("prewarm_connections cannot be used with idle_timeout -1, since each process serves a single request")
+	}
+
+	if t.Variants != nil && t.Variants.Header != "" {
+		header := http.Header{http.CanonicalHeaderKey(t.Variants.Header): nil}
+		stripHeaders(header, t.StripHeaders)
+		if len(header) == 0 {
+			return fmt.Errorf("variants header %s is removed by strip_headers or as an X-Substrate- header; choose another header", t.Variants.Header)
+		}
+	}
+
+	if t.Service != "" && (t.Script != "" || t.HostRoots != nil || len(t.Index) > 0 || len(t.Methods) > 0 || len(t.Negotiate) > 0 || t.Canary != nil || t.Variants != nil || t.Mirror != nil) {
+		return fmt.Errorf("script, host_roots, index, methods, negotiate, canary, variants and mirror cannot be combined with service, which runs its own script or command")
+	}
+
+	if t.ScriptRoot != "" && t.Script == "" {
+		return fmt.Errorf("script_root only applies to scripts chosen by script")
+	}
+
+	if t.Script != "" && t.HostRoots != nil {
+		return fmt.Errorf("script and host_roots both choose the script to run; use one of them")
+	}
+
+	if _, templates := splitEnv(t.Env); len(templates) > 0 && t.Namespace == "" && t.IdleTimeout != -1 && t.Isolation != "per_request" {
+		return fmt.Errorf("env values with {http.*} placeholders require namespace, idle_timeout -1 or isolation per_request, since a shared process serves many requests")
+	}
+
+	if t.Service != "" && (t.IdleTimeout == -1 || t.Isolation == "per_request" || t.ReloadOnChange) {
+		return fmt.Errorf("service cannot be combined with idle_timeout -1, isolation per_request or reload_on_change; the service process is shared and long-lived")
+	}
+
+	if t.Isolation == "per_request" && t.PrewarmConnections > 0 {
+		return fmt.Errorf("prewarm_connections cannot be used with isolation per_request, since each process serves a single request")
+	}
+
+	if t.KeepAlive != nil && t.KeepAlive.Enabled != nil && !*t.KeepAlive.Enabled && t.PrewarmConnections > 0 {
+		return fmt.Errorf("prewarm_connections requires keepalive; prewarmed connections would be closed after one request")
+	}
+
+	if t.ETag != nil && t.FlushInterval < 0 {
+		return fmt.Errorf("etag cannot be combined with flush_interval -1; hashing a response body holds it back from the client")
+	}
+
+	if len(t.Hosts) > 0 && len(t.SupplementaryGroups) > 0 {
+		return fmt.Errorf("hosts cannot be combined with supplementary_groups; processes with hosts entries keep only their primary group")
+	}
+
+	return nil
+}
+
+// lint returns warnings about options that are valid together but probably
+// not what was intended.
+func (t *SubstrateTransport) lint() []string {
+	var warnings []string
+
+	if t.MaxStartsPerMinute > 0 && t.MaxClientStartsPerMinute > t.MaxStartsPerMinute {
+		warnings = append(warnings, fmt.Sprintf("max_client_starts_per_minute (%d) is above max_starts_per_minute (%d) and can never be reached",
+			t.MaxClientStartsPerMinute, t.MaxStartsPerMinute))
+	}
+
+	if keepAlive := t.keepAlive(); keepAlive != nil && t.PrewarmConnections > keepAlive.MaxIdleConnsPerHost {
+		warnings = append(warnings, fmt.Sprintf("prewarm_connections (%d) is above keepalive_idle_conns_per_host (%d); the extra connections will be closed",
+			t.PrewarmConnections, keepAlive.MaxIdleConnsPerHost))
+	}
+
+	if t.IdleTimeout > 0 && t.IdleTimeout < t.StartupTimeout {
+		warnings = append(warnings, "idle_timeout is shorter than startup_timeout; processes may be stopped about as soon as they are ready")
+	}
+
+	if t.ColdStartQueueTimeout > 0 && t.ColdStartQueueTimeout >= t.StartupTimeout {
+		warnings = append(warnings, "cold_start_queue_timeout is not shorter than startup_timeout and has no effect")
+	}
+
+	if t.Warmup != nil && (t.IdleTimeout == -1 || t.Isolation == "per_request") {
+		warnings = append(warnings, "warmup delays every request when each process serves a single request")
+	}
+
+	if t.Debug {
+		warnings = append(warnings, "debug is on: processes run with the V8 inspector, reachable through the admin API; don't use it in production")
+	}
+
+	if t.Handover && !t.ReloadOnChange {
+		warnings = append(warnings, "handover without reload_on_change only applies to restarts through the admin API")
+	}
+
+	if t.SpoolRequestBody && t.MaxRequestBody == 0 {
+		warnings = append(warnings, "spool_request_body without max_request_body spools bodies of any size to disk")
+	}
+
+	return warnings
+}
+
+func (t *SubstrateTransport) Cleanup() error {
+	t.logger.Info("cleaning up substrate transport")
+	if t.serviceManager != nil {
+		t.serviceManager.drains.unregister(t)
+	}
+	if t.manager != nil {
+		t.manager.drains.unregister(t)
+		// Stops the manager unless a transport of the new config took it over
+		if _, err := managerPool.Delete(t.poolKey); err != nil {
+			t.logger.Error("error during process manager cleanup", zap.Error(err))
+			return err
+		}
+		t.logger.Debug("process manager released")
+	}
+	t.logger.Info("substrate transport cleanup complete")
+	return nil
+}
+
+func (t *SubstrateTransport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if err := t.unmarshalOptions(d); err != nil {
+			return err
+		}
+	}
+	if t.staticFiles {
+		return d.Err("static_files is an option of the substrate_run directive")
+	}
+	if err := t.checkConflicts(); err != nil {
+		return d.Err(err.Error())
+	}
+	return nil
+}
+
+// unmarshalOptions parses the transport's option block at the dispenser's
+// current position.
+func (t *SubstrateTransport) unmarshalOptions(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "idle_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val := d.Val()
+			// Handle special cases for unitless values
+			if val == "0" {
+				t.IdleTimeout = caddy.Duration(0)
+			} else if val == "-1" {
+				t.IdleTimeout = caddy.Duration(-1)
+			} else {
+				dur, err := time.ParseDuration(val)
+				if err != nil {
+					return d.Errf("parsing idle_timeout: %v", err)
+				}
+				t.IdleTimeout = caddy.Duration(dur)
+			}
+		case "startup_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing startup_timeout: %v", err)
+			}
+			t.StartupTimeout = caddy.Duration(dur)
+		case "cold_start_queue_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing cold_start_queue_timeout: %v", err)
+			}
+			t.ColdStartQueueTimeout = caddy.Duration(dur)
+		case "startup_failure_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "-1" {
+				t.StartupFailureTTL = caddy.Duration(-1)
+			} else {
+				dur, err := time.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing startup_failure_ttl: %v", err)
+				}
+				t.StartupFailureTTL = caddy.Duration(dur)
+			}
+		case "schedule":
+			// schedule <action> <start>-<end> [<days>...] [{ timezone <tz> }]
+			var window ScheduleWindow
+			if !d.Args(&window.Action) {
+				return d.ArgErr()
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var ok bool
+			if window.Start, window.End, ok = strings.Cut(d.Val(), "-"); !ok {
+				return d.Errf("schedule window must be <start>-<end>, got %q", d.Val())
+			}
+			window.Days = d.RemainingArgs()
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "timezone":
+					if !d.Args(&window.Timezone) {
+						return d.ArgErr()
+					}
+				default:
+					return d.Errf("unknown schedule option: %s", d.Val())
+				}
+			}
+			t.Schedule = append(t.Schedule, window)
+		case "max_extend":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "-1" {
+				t.MaxExtend = caddy.Duration(-1)
+			} else {
+				dur, err := time.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_extend: %v", err)
+				}
+				t.MaxExtend = caddy.Duration(dur)
+			}
+		case "env":
+			if t.Env == nil {
+				t.Env = make(map[string]string)
+			}
+			for d.NextBlock(1) {
+				key := d.Val()
+				if !d.NextArg() {
+					return d.Errf("env directive requires key-value pairs")
+				}
+				value := d.Val()
+				t.Env[key] = value
+			}
+		case "accept_encoding":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "passthrough", "strip":
+				t.AcceptEncoding = d.Val()
+			default:
+				return d.Errf("accept_encoding must be passthrough or strip, got %s", d.Val())
+			}
+		case "header_down":
+			if t.HeaderDown == nil {
+				t.HeaderDown = make(map[string]string)
+			}
+			if d.NextArg() {
+				field := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.HeaderDown[field] = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+			for d.NextBlock(1) {
+				field := d.Val()
+				if !d.NextArg() {
+					return d.Errf("header_down requires field-value pairs")
+				}
+				t.HeaderDown[field] = d.Val()
+			}
+		case "deno_opts":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.DenoOpts = d.Val()
+		case "cache_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.CacheDir = d.Val()
+		case "socket_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.SocketDir = d.Val()
+		case "egress":
+			// egress [<host[:port]>...]
+			t.Egress = &EgressPolicy{Allow: d.RemainingArgs()}
+		case "hosts":
+			// hosts { <name> <address> ... }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if t.Hosts == nil {
+				t.Hosts = make(map[string]string)
+			}
+			for d.NextBlock(1) {
+				name := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.Hosts[name] = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+		case "io_limit":
+			// io_limit <device> { read_bps|write_bps <size>; read_iops|write_iops <n> }
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			limit := IOLimit{Device: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for d.NextBlock(1) {
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch option {
+				case "read_bps", "write_bps":
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("parsing io_limit %s: %v", option, err)
+					}
+					if option == "read_bps" {
+						limit.ReadBPS = size
+					} else {
+						limit.WriteBPS = size
+					}
+				case "read_iops", "write_iops":
+					n, err := strconv.ParseUint(d.Val(), 10, 64)
+					if err != nil {
+						return d.Errf("parsing io_limit %s: %v", option, err)
+					}
+					if option == "read_iops" {
+						limit.ReadIOPS = n
+					} else {
+						limit.WriteIOPS = n
+					}
+				default:
+					return d.Errf("unknown io_limit option: %s", option)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+			t.IOLimits = append(t.IOLimits, limit)
+		case "max_processes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			limit, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_processes: %v", err)
+			}
+			t.MaxProcesses = limit
+		case "max_open_files":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			limit, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_open_files: %v", err)
+			}
+			t.MaxOpenFiles = limit
+		case "umask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Umask = d.Val()
+		case "group":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Group = d.Val()
+		case "supplementary_groups":
+			groups := d.RemainingArgs()
+			if len(groups) == 0 {
+				return d.ArgErr()
+			}
+			t.SupplementaryGroups = append(t.SupplementaryGroups, groups...)
+		case "max_starts_per_minute":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_starts_per_minute: %v", err)
+			}
+			t.MaxStartsPerMinute = n
+		case "max_client_starts_per_minute":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_client_starts_per_minute: %v", err)
+			}
+			t.MaxClientStartsPerMinute = n
+		case "max_request_body":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_request_body: %v", err)
+			}
+			t.MaxRequestBody = int64(size)
+		case "max_response_bytes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_response_bytes: %v", err)
+			}
+			t.MaxResponseBytes = int64(size)
+		case "max_response_duration":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			duration, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_response_duration: %v", err)
+			}
+			t.MaxResponseDuration = caddy.Duration(duration)
+		case "resolve_symlinks":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "on":
+				t.ResolveSymlinks = true
+			case "off":
+				t.ResolveSymlinks = false
+			default:
+				return d.Errf("resolve_symlinks must be on or off, got %s", d.Val())
+			}
+		case "reload_on_change":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ReloadOnChange = true
+		case "namespace":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Namespace = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "share_processes":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ShareProcesses = true
+		case "handover":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Handover = true
+		case "read_only_project":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ReadOnlyProject = true
+		case "data_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.DataDir = d.Val()
+		case "core_dump_dir":
+			if !d.Args(&t.CoreDumpDir) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "takeover_state":
+			if !d.Args(&t.TakeoverState) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "private_tmp":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.PrivateTmp = true
+		case "persist_usage":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.PersistUsage = true
+		case "segments":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Segments = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "request_env":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.RequestEnv = true
+		case "spool_request_body":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.SpoolRequestBody = true
+		case "cold_start_headers":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ColdStartHeaders = true
+		case "keepalive":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if t.KeepAlive == nil {
+				t.KeepAlive = new(reverseproxy.KeepAlive)
+			}
+			if d.Val() == "off" {
+				var disable bool
+				t.KeepAlive.Enabled = &disable
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing keepalive: %v", err)
+			}
+			t.KeepAlive.IdleConnTimeout = caddy.Duration(dur)
+		case "keepalive_idle_conns", "keepalive_idle_conns_per_host":
+			option := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s: %v", option, err)
+			}
+			if t.KeepAlive == nil {
+				t.KeepAlive = new(reverseproxy.KeepAlive)
+			}
+			if option == "keepalive_idle_conns" {
+				t.KeepAlive.MaxIdleConns = n
+			} else {
+				t.KeepAlive.MaxIdleConnsPerHost = n
+			}
+		case "prewarm_connections":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing prewarm_connections: %v", err)
+			}
+			t.PrewarmConnections = n
+		case "verbosity":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Verbosity = d.Val()
+		case "error_handling":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "respond", "handle_errors":
+				t.ErrorHandling = d.Val()
+			default:
+				return d.Errf("error_handling must be respond or handle_errors, got %s", d.Val())
+			}
+		case "isolation":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "shared", "per_request":
+				t.Isolation = d.Val()
+			default:
+				return d.Errf("isolation must be shared or per_request, got %s", d.Val())
+			}
+		case "flush_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "-1" {
+				t.FlushInterval = caddy.Duration(-1)
+			} else {
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing flush_interval: %v", err)
+				}
+				t.FlushInterval = caddy.Duration(dur)
+			}
+		case "script_policy":
+			if t.ScriptPolicy == nil {
+				t.ScriptPolicy = &ScriptPolicy{}
+			}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "reject_world_writable":
+					t.ScriptPolicy.RejectWorldWritable = true
+				case "reject_sticky_dirs":
+					t.ScriptPolicy.RejectStickyDirs = true
+				case "allowed_owners":
+					owners := d.RemainingArgs()
+					if len(owners) == 0 {
+						return d.ArgErr()
+					}
+					t.ScriptPolicy.AllowedOwners = append(t.ScriptPolicy.AllowedOwners, owners...)
+				default:
+					return d.Errf("unknown script_policy option: %s", d.Val())
+				}
+			}
+		case "service":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Service = d.Val()
+		case "script":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Script = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "script_root":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ScriptRoot = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "methods":
+			// methods { <method> <script> ... }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if t.Methods == nil {
+				t.Methods = make(map[string]string)
+			}
+			for d.NextBlock(1) {
+				method := strings.ToUpper(d.Val())
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.Methods[method] = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+		case "negotiate":
+			// negotiate { <media type> <format> ... }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if t.Negotiate == nil {
+				t.Negotiate = make(map[string]string)
+			}
+			for d.NextBlock(1) {
+				mediaType := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.Negotiate[mediaType] = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+		case "index":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			t.Index = append(t.Index, args...)
+		case "host_roots":
+			// host_roots <dir> [<script>]
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			t.HostRoots = &HostRoots{Dir: args[0]}
+			if len(args) == 2 {
+				t.HostRoots.Script = args[1]
+			}
+		case "canary":
+			// canary <script> <percent> [<cookie>]
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			percent, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+			if err != nil {
+				return d.Errf("parsing canary percent: %v", err)
+			}
+			t.Canary = &Canary{Script: args[0], Percent: percent}
+			if len(args) == 3 {
+				t.Canary.Cookie = args[2]
+			}
+		case "mirror":
+			// mirror <script> <percent>
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			percent, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+			if err != nil {
+				return d.Errf("parsing mirror percent: %v", err)
+			}
+			t.Mirror = &Mirror{Script: args[0], Percent: percent}
+		case "record":
+			// record <dir> { max_entries <n>; max_body <size>; redact_header <name...> }
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Record = &RecordConfig{Dir: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "max_entries":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					n, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("parsing record max_entries: %v", err)
+					}
+					t.Record.MaxEntries = n
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "max_body":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("parsing record max_body: %v", err)
+					}
+					t.Record.MaxBody = int64(size)
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "redact_header":
+					names := d.RemainingArgs()
+					if len(names) == 0 {
+						return d.ArgErr()
+					}
+					t.Record.RedactHeaders = append(t.Record.RedactHeaders, names...)
+				default:
+					return d.Errf("unknown record option: %s", d.Val())
+				}
+			}
+		case "slow_request":
+			// slow_request <threshold> [<debug_path>]
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			threshold, err := time.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("parsing slow_request threshold: %v", err)
+			}
+			t.SlowRequest = &SlowRequestConfig{Threshold: caddy.Duration(threshold)}
+			if len(args) == 2 {
+				t.SlowRequest.DebugPath = args[1]
+			}
+		case "strip_headers":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			t.StripHeaders = append(t.StripHeaders, args...)
+		case "header_case":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			t.HeaderCase = append(t.HeaderCase, args...)
+		case "client_tls":
+			// client_tls { cert pem|fingerprint; sni }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ClientTLS = &ClientTLSConfig{}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "cert":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					t.ClientTLS.Cert = d.Val()
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "sni":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					t.ClientTLS.SNI = true
+				default:
+					return d.Errf("unknown client_tls option: %s", d.Val())
+				}
+			}
+		case "cluster":
+			// cluster <address> { heartbeat_interval <duration> }
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Cluster = &ClusterConfig{Address: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "heartbeat_interval":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing cluster heartbeat_interval: %v", err)
+					}
+					t.Cluster.HeartbeatInterval = caddy.Duration(dur)
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				default:
+					return d.Errf("unknown cluster option: %s", d.Val())
+				}
+			}
+		case "overload_signal":
+			// overload_signal { status <code>; header <name> }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.OverloadSignal = &OverloadSignalConfig{}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "status":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					status, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("parsing overload_signal status: %v", err)
+					}
+					t.OverloadSignal.Status = status
+				case "header":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					t.OverloadSignal.Header = d.Val()
+				default:
+					return d.Errf("unknown overload_signal option: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+		case "etag":
+			// etag [<ttl>]
+			t.ETag = &ETagConfig{}
+			if d.NextArg() {
+				ttl, err := time.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing etag ttl: %v", err)
+				}
+				t.ETag.TTL = caddy.Duration(ttl)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "micro_cache":
+			// micro_cache [<max_entries>] { max_body_size <size> }
+			t.MicroCache = &MicroCache{}
+			if d.NextArg() {
+				entries, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("parsing micro_cache max entries: %v", err)
+				}
+				t.MicroCache.MaxEntries = entries
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "max_body_size":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("parsing micro_cache max_body_size: %v", err)
+					}
+					t.MicroCache.MaxBodySize = int64(size)
+				default:
+					return d.Errf("unknown micro_cache option: %s", d.Val())
+				}
+			}
+		case "variants":
+			// variants header|cookie <name> { <value> <script> ... }
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			t.Variants = &Variants{Scripts: make(map[string]string)}
+			switch args[0] {
+			case "header":
+				t.Variants.Header = args[1]
+			case "cookie":
+				t.Variants.Cookie = args[1]
+			default:
+				return d.Errf("variants must select by header or cookie, got %q", args[0])
+			}
+			for d.NextBlock(1) {
+				value := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.Variants.Scripts[value] = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			}
+		case "stop_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing stop_timeout: %v", err)
+			}
+			t.StopTimeout = caddy.Duration(dur)
+		case "socket_poll_interval", "socket_dial_timeout":
+			option := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s: %v", option, err)
+			}
+			if option == "socket_poll_interval" {
+				t.SocketPollInterval = caddy.Duration(dur)
+			} else {
+				t.SocketDialTimeout = caddy.Duration(dur)
+			}
+		case "runtime":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Runtime = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "type_check":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.TypeCheck = true
+		case "debug":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "on":
+				t.Debug = true
+			case "off":
+				t.Debug = false
+			default:
+				return d.Errf("debug must be on or off, got %q", d.Val())
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "dev":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "on":
+				t.Dev = true
+			case "off":
+				t.Dev = false
+			default:
+				return d.Errf("dev must be on or off, got %q", d.Val())
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "warmup":
+			// warmup [<method>] <path> [<count>]
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			warmup := &Warmup{}
+			if !strings.HasPrefix(args[0], "/") {
+				warmup.Method = strings.ToUpper(args[0])
+				args = args[1:]
+			}
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			warmup.Path = args[0]
+			if len(args) == 2 {
+				count, err := strconv.Atoi(args[1])
+				if err != nil || count < 1 {
+					return d.Errf("warmup count must be a positive integer, got %q", args[1])
+				}
+				warmup.Count = count
+			}
+			t.Warmup = warmup
+		case "ready_path":
+			if !d.Args(&t.ReadyPath) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "readiness":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Readiness = &ReadinessConfig{Checker: d.Val(), Args: d.RemainingArgs()}
+		case "build":
+			if t.Build == nil {
+				t.Build = &BuildConfig{}
+			}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "command":
+					command := d.RemainingArgs()
+					if len(command) == 0 {
+						return d.ArgErr()
+					}
+					t.Build.Command = command
+				case "inputs":
+					inputs := d.RemainingArgs()
+					if len(inputs) == 0 {
+						return d.ArgErr()
+					}
+					t.Build.Inputs = append(t.Build.Inputs, inputs...)
+				case "timeout":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					timeout, err := time.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing build timeout: %v", err)
+					}
+					t.Build.Timeout = caddy.Duration(timeout)
+				default:
+					return d.Errf("unknown build option: %s", d.Val())
+				}
+			}
+		case "slo":
+			// slo { latency_p99 <d>; error_rate <rate>; window <d>; min_requests <n>; script <pattern> { ... } }
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.SLO = &SLOConfig{}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "latency_p99", "error_rate":
+					if err := unmarshalSLOBudget(d, &t.SLO.SLOBudget); err != nil {
+						return err
+					}
+				case "window":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing slo window: %v", err)
+					}
+					t.SLO.Window = caddy.Duration(dur)
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "min_requests":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					n, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("parsing slo min_requests: %v", err)
+					}
+					t.SLO.MinRequests = n
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "script":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					script := SLOScriptBudget{Match: d.Val()}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					for d.NextBlock(2) {
+						if err := unmarshalSLOBudget(d, &script.SLOBudget); err != nil {
+							return err
+						}
+					}
+					t.SLO.Scripts = append(t.SLO.Scripts, script)
+				default:
+					return d.Errf("unknown slo option: %s", d.Val())
+				}
+			}
+		case "notify":
+			if t.Notify == nil {
+				t.Notify = &NotifyConfig{}
+			}
+			for d.NextBlock(1) {
+				switch d.Val() {
+				case "webhook":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					t.Notify.Webhook = d.Val()
+				case "command":
+					command := d.RemainingArgs()
+					if len(command) == 0 {
+						return d.ArgErr()
+					}
+					t.Notify.Command = command
+				case "crash_loop":
+					args := d.RemainingArgs()
+					if len(args) != 2 {
+						return d.ArgErr()
+					}
+					threshold, err := strconv.Atoi(args[0])
+					if err != nil {
+						return d.Errf("parsing crash_loop threshold: %v", err)
+					}
+					window, err := time.ParseDuration(args[1])
+					if err != nil {
+						return d.Errf("parsing crash_loop window: %v", err)
+					}
+					t.Notify.CrashLoopThreshold = threshold
+					t.Notify.CrashLoopWindow = caddy.Duration(window)
+				case "interval":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					interval, err := time.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing notify interval: %v", err)
+					}
+					t.Notify.Interval = caddy.Duration(interval)
+				default:
+					return d.Errf("unknown notify option: %s", d.Val())
+				}
+			}
+		case "static_files":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.staticFiles = true
+		default:
+			return d.Errf("unknown directive: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// checkRequest returns a log entry for a per-request event, or nil when the
+// configured verbosity or the logger's level filters it out. Fields are only
+// built by callers when an entry is returned, keeping the proxy path free of
+// logging allocations.
+func (t *SubstrateTransport) checkRequest(level zapcore.Level, msg string) *zapcore.CheckedEntry {
+	if t.quiet {
+		return nil
+	}
+	return t.logger.Check(level, msg)
+}
+
+func (t *SubstrateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c := t.checkRequest(zapcore.DebugLevel, "handling request"); c != nil {
+		c.Write(
+			zap.String("method", req.Method),
+			zap.String("url", req.URL.String()),
+			zap.String("remote_addr", req.RemoteAddr),
+		)
+	}
+
+	// Nothing below may see headers a client set to impersonate substrate
+	forwardedBy := req.Header.Get(clusterForwardedHeader)
+	stripHeaders(req.Header, t.StripHeaders)
+
+	// Requests another node forwarded are served here, whichever node the
+	// script hashes to in this node's view of the cluster. Only a signature
+	// of the cluster secret tells them from a client setting the header.
+	forwarded := t.cluster != nil && forwardedBy != "" && t.cluster.forwardedBy(forwardedBy, time.Now()) != ""
+
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	filePath, _ := repl.GetString("http.matchers.file.absolute")
+	if t.Script != "" {
+		filePath = scriptFromTemplate(req, repl, t.Script, t.ScriptRoot)
+		if filePath == "" {
+			if c := t.checkRequest(t.requestLevel, "no script selected for request"); c != nil {
+				c.Write(zap.String("script", t.Script))
+			}
+			return textResponse(req, http.StatusNotFound, "Not Found"), nil
+		}
+	} else if t.HostRoots != nil {
+		filePath = t.HostRoots.script(repl)
+		if filePath == "" {
+			if c := t.checkRequest(t.requestLevel, "no project directory for request"); c != nil {
+				c.Write(zap.String("host", req.Host))
+			}
+			return textResponse(req, http.StatusNotFound, "Not Found"), nil
+		}
+	} else if filePath == "" {
+		filePath = req.URL.Path
+		if c := t.logger.Check(zapcore.DebugLevel, "no file matcher found, using URL path"); c != nil {
+			c.Write(zap.String("path", filePath))
+		}
+	}
+
+	// Convert to absolute path for consistent process tracking
+	absFilePath, err := filepath.Abs(filePath)
+	if err != nil {
 		t.logger.Error("failed to get absolute path",
 			zap.String("file_path", filePath),
 			zap.Error(err),
@@ -225,58 +2377,204 @@ func (t *SubstrateTransport) RoundTrip(req *http.Request) (*http.Response, error
 		return nil, fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
-	t.logger.Info("routing request to subprocess",
-		zap.String("method", req.Method),
-		zap.String("url", req.URL.Path),
-		zap.String("file_path", absFilePath),
-		zap.String("remote_addr", req.RemoteAddr),
-	)
+	if len(t.Index) > 0 {
+		if info, err := os.Stat(absFilePath); err == nil && info.IsDir() {
+			script := resolveIndex(absFilePath, t.Index)
+			if script == "" {
+				if c := t.checkRequest(t.requestLevel, "no index entrypoint in directory"); c != nil {
+					c.Write(zap.String("dir", absFilePath))
+				}
+				return textResponse(req, http.StatusNotFound, "Not Found"), nil
+			}
+			absFilePath = script
+		}
+	}
+
+	if len(t.Methods) > 0 {
+		absFilePath = methodScript(req, absFilePath, t.Methods)
+	}
+	if len(t.Negotiate) > 0 {
+		absFilePath = negotiateScript(req, absFilePath, t.Negotiate)
+	}
+
+	var canaryCookie *http.Cookie
+	variant := false
+	if t.Variants != nil {
+		absFilePath, variant = t.Variants.route(req, absFilePath)
+	}
+	if t.Canary != nil && !variant {
+		absFilePath, canaryCookie = t.Canary.route(req, absFilePath)
+	}
+
+	// Key the process (and its working directory) by the symlink target, so
+	// every link to a script shares one process. Paths that don't resolve are
+	// left for getOrCreateHost to report.
+	if t.ResolveSymlinks {
+		if resolved, err := filepath.EvalSymlinks(absFilePath); err == nil {
+			absFilePath = resolved
+		}
+	}
+
+	// The process is stored under key, which differs from the script path
+	// for namespaced and isolated processes
+	key := absFilePath
+	namespace := t.namespace(repl)
+	if namespace != "" {
+		key = namespacedKey(absFilePath, namespace)
+	}
+
+	// The live-reload client's event stream is answered by the transport
+	if t.Dev && t.service == nil && isLiveReloadRequest(req) {
+		return t.liveReloadResponse(req, key, absFilePath), nil
+	}
+
+	if c := t.checkRequest(t.requestLevel, "routing request to subprocess"); c != nil {
+		c.Write(
+			zap.String("method", req.Method),
+			zap.String("url", req.URL.Path),
+			zap.String("file_path", absFilePath),
+			zap.String("remote_addr", req.RemoteAddr),
+		)
+	}
+
+	// Answer conditional requests and repeated ones from what the transport
+	// remembers, without touching a process
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	var conditionalKey string
+	if t.etags != nil {
+		conditionalKey = etagKey(req, key)
+	}
+	var responseKey string
+	if t.cache != nil {
+		responseKey = cacheKey(req, key)
+	}
+
+	var remembered *http.Response
+	if conditionalKey != "" {
+		if etag := t.etags.current(conditionalKey, time.Now()); etagMatches(ifNoneMatch, etag) {
+			remembered = notModifiedResponse(req, etag, nil)
+		}
+	}
+	if remembered == nil && responseKey != "" {
+		if entry := t.cache.get(responseKey, time.Now()); entry != nil {
+			remembered = entry.response(req, time.Now())
+			if etag := remembered.Header.Get("ETag"); conditionalKey != "" && etagMatches(ifNoneMatch, etag) {
+				remembered = notModifiedResponse(req, etag, remembered.Header)
+			}
+		}
+	}
+	if remembered != nil {
+		if canaryCookie != nil {
+			remembered.Header.Add("Set-Cookie", canaryCookie.String())
+		}
+		if len(t.Negotiate) > 0 {
+			addVary(remembered.Header, "Accept")
+		}
+		if c := t.checkRequest(t.requestLevel, "request answered without the process"); c != nil {
+			c.Write(
+				zap.String("file_path", absFilePath),
+				zap.Int("status_code", remembered.StatusCode),
+			)
+		}
+		return remembered, nil
+	}
+
+	// In a cluster, a script not running here is served by the node it
+	// hashes to, so it runs on one node only
+	if t.cluster != nil && !forwarded && t.service == nil && t.Isolation != "per_request" && t.manager.processes.get(key) == nil {
+		if owner := t.cluster.owner(key); owner != t.cluster.address {
+			resp, err := t.cluster.forward(req, owner)
+			if err == nil {
+				if c := t.checkRequest(t.requestLevel, "request forwarded to cluster node"); c != nil {
+					c.Write(zap.String("file_path", absFilePath), zap.String("node", owner))
+				}
+				return resp, nil
+			}
+			t.logger.Warn("failed to forward request to cluster node",
+				zap.String("file_path", absFilePath),
+				zap.String("node", owner),
+				zap.Error(err),
+			)
+			// The body may be gone; without one the request is served here
+			if req.Body != nil && req.Body != http.NoBody {
+				return nil, fmt.Errorf("forwarding request to cluster node failed: %w", err)
+			}
+		}
+	}
+
+	// Apply the body policy before committing to a process start
+	if err := prepareRequestBody(req, t.MaxRequestBody, t.SpoolRequestBody); err != nil {
+		t.logger.Warn("rejecting request body",
+			zap.String("file_path", filePath),
+			zap.Int64("content_length", req.ContentLength),
+			zap.Error(err),
+		)
+		if err == errRequestBodyTooLarge {
+			return textResponse(req, http.StatusRequestEntityTooLarge, "Request Entity Too Large"), nil
+		}
+		if err == errRequestBodyTimeout {
+			return textResponse(req, http.StatusRequestTimeout, "Request Timeout"), nil
+		}
+		return textResponse(req, http.StatusBadRequest, "Bad Request"), nil
+	}
 
-	socketPath, err := t.manager.getOrCreateHost(absFilePath)
+	startEnv := t.startEnv(req, t.pathSegments(req))
+	if startEnv == nil {
+		startEnv = make(map[string]string, len(t.envTemplates)+3)
+	}
+	startEnv["SUBSTRATE_ROOT"], startEnv["SUBSTRATE_URL_PREFIX"] = t.location(req, repl, absFilePath)
+	if len(t.envTemplates) > 0 {
+		for name, value := range expandEnv(t.envTemplates, repl) {
+			startEnv[name] = value
+		}
+	}
+	if namespace != "" {
+		startEnv["SUBSTRATE_NAMESPACE"] = namespace
+	}
+	if t.Mirror != nil && t.service == nil && t.Isolation != "per_request" && t.Mirror.sample() {
+		mirrorScript := siblingScript(absFilePath, t.Mirror.Script)
+		mirrorKey := mirrorScript
+		if namespace != "" {
+			mirrorKey = namespacedKey(mirrorScript, namespace)
+		}
+		t.mirror(req, mirrorKey, mirrorScript, startEnv)
+	}
+	var process *Process
+	var cold *coldStart
+	manager, processKey := t.manager, key
+	if t.service != nil {
+		manager, processKey = t.serviceManager, serviceKey(t.Service)
+		process, cold, err = t.serviceManager.getOrCreateService(t.Service, t.service)
+	} else if t.Isolation == "per_request" {
+		processKey, process, cold, err = t.manager.startIsolated(absFilePath, clientIP(req), startEnv)
+	} else {
+		process, cold, err = t.manager.getOrCreateHostFor(key, absFilePath, clientIP(req), startEnv)
+	}
 	if err != nil {
 		t.logger.Error("failed to get or create socket for file",
 			zap.String("file_path", filePath),
 			zap.Error(err),
 		)
 
-		// Return HTTP 502 response instead of error
-		responseBody := "Bad Gateway"
-
-		// If this is a startup error and request is from internal IP, include details
-		if startupErr, ok := err.(*ProcessStartupError); ok && isInternalIP(req.RemoteAddr) {
-			var details strings.Builder
-			details.WriteString(fmt.Sprintf("Process startup failed: %s\n\n", startupErr.Err.Error()))
-			details.WriteString(fmt.Sprintf("Script: %s\n", startupErr.ScriptPath))
-			details.WriteString(fmt.Sprintf("Exit code: %d\n\n", startupErr.ExitCode))
-			if startupErr.Stdout != "" {
-				details.WriteString("Stdout:\n")
-				details.WriteString(startupErr.Stdout)
-				details.WriteString("\n\n")
-			}
-			if startupErr.Stderr != "" {
-				details.WriteString("Stderr:\n")
-				details.WriteString(startupErr.Stderr)
-				details.WriteString("\n")
-			}
-			responseBody = details.String()
-		}
-
-		return &http.Response{
-			StatusCode:    http.StatusBadGateway,
-			Status:        "502 Bad Gateway",
-			Body:          io.NopCloser(strings.NewReader(responseBody)),
-			ContentLength: int64(len(responseBody)),
-			Header: http.Header{
-				"Content-Type": []string{"text/plain; charset=utf-8"},
-			},
-			Request: req,
-		}, nil
-	}
-
-	t.logger.Debug("proxying request to process",
-		zap.String("file_path", filePath),
-		zap.String("socket_path", socketPath),
-	)
+		if t.slo != nil && t.service == nil && sloStartFailure(err) {
+			t.slo.observe(absFilePath, -1, true, time.Now())
+		}
+		return t.startError(req, err)
+	}
+	setColdStartPlaceholders(req, cold)
+	socketPath := process.SocketPath
+
+	// The request is counted on the process until it is done, however it
+	// ends; in one-shot mode, the process is then stopped
+	oneShot := t.service == nil && (t.IdleTimeout == -1 || t.Isolation == "per_request")
+	done := requestDone(req.Context(), manager, processKey, process, oneShot)
+
+	if c := t.checkRequest(zapcore.DebugLevel, "proxying request to process"); c != nil {
+		c.Write(
+			zap.String("file_path", filePath),
+			zap.String("socket_path", socketPath),
+		)
+	}
 
 	// Create a unique host for each socket to enable proper connection pooling.
 	// http.Transport keys connections by req.URL.Host, so different sockets need different hosts.
@@ -292,42 +2590,450 @@ func (t *SubstrateTransport) RoundTrip(req *http.Request) (*http.Response, error
 	}
 	caddyhttp.SetVar(req.Context(), "reverse_proxy.dial_info", dialInfo)
 
+	// The process is about to be stopped: don't keep the connection alive
+	if manager.drains.draining(socketPath) {
+		req.Close = true
+	}
+
+	if t.AcceptEncoding == "strip" {
+		req.Header.Del("Accept-Encoding")
+	}
+
+	if t.ClientTLS != nil {
+		t.ClientTLS.apply(req)
+	}
+
+	// Last, as nothing can find the renamed headers with Get
+	if len(t.HeaderCase) > 0 {
+		applyHeaderCase(req.Header, t.HeaderCase)
+	}
+
+	// The body is wrapped once the response arrives; the time limit covers
+	// waiting for it too
+	var limits *limitedResponseBody
+	if t.MaxResponseBytes > 0 || t.MaxResponseDuration > 0 {
+		limits = &limitedResponseBody{maxBytes: t.MaxResponseBytes}
+	}
+	if t.MaxResponseDuration > 0 {
+		limits.ctx, limits.cancel = context.WithTimeout(req.Context(), time.Duration(t.MaxResponseDuration))
+		req = req.WithContext(limits.ctx)
+	}
+
+	var recordBody *capturedBody
+	if t.recorder != nil && t.service == nil {
+		recordBody = t.recordRequest(req)
+	}
+
 	start := time.Now()
+	var slowDone func()
+	if t.SlowRequest != nil {
+		slowDone = t.watchSlowRequest(req, filePath, socketPath, start)
+	}
 	resp, err := t.transport.RoundTrip(req)
 	duration := time.Since(start)
 
 	if err != nil {
+		if limits != nil && limits.cancel != nil {
+			limits.cancel()
+		}
+		if slowDone != nil {
+			slowDone()
+		}
 		t.logger.Error("process request failed",
 			zap.String("file_path", filePath),
 			zap.String("socket_path", socketPath),
 			zap.Duration("duration", duration),
 			zap.Error(err),
 		)
+		process.countFail()
+		if t.slo != nil && t.service == nil {
+			t.slo.observe(absFilePath, duration, true, time.Now())
+		}
+		done()
 		return nil, fmt.Errorf("request to process failed: %w", err)
 	}
 
-	// In one-shot mode, wrap response body to trigger cleanup after body is fully transmitted
-	if t.IdleTimeout == -1 {
-		resp.Body = &oneShotBodyWrapper{
-			ReadCloser: resp.Body,
-			onClose: func() {
-				// Use goroutine so body close isn't blocked waiting for process to stop
-				go t.manager.closeProcessAfterRequest(absFilePath)
-			},
+	// A request is in progress until its response body is closed
+	if slowDone != nil {
+		resp.Body = onCloseBody(resp, slowDone)
+	}
+
+	// The connection of a WebSocket outlives the response and is not limited
+	if limits != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		if limits.cancel != nil {
+			limits.cancel()
 		}
+		limits = nil
 	}
 
-	t.logger.Info("request completed successfully",
-		zap.String("file_path", filePath),
-		zap.String("socket_path", socketPath),
-		zap.Duration("duration", duration),
-		zap.Int("status_code", resp.StatusCode),
-		zap.Int64("content_length", resp.ContentLength),
-	)
+	if limits != nil {
+		limits.ReadCloser = resp.Body
+		if t.MaxResponseBytes > 0 && resp.ContentLength > t.MaxResponseBytes {
+			limits.Close()
+			t.logger.Warn("rejecting response over max_response_bytes",
+				zap.String("file_path", filePath),
+				zap.Int64("content_length", resp.ContentLength),
+				zap.Int64("max_response_bytes", t.MaxResponseBytes),
+			)
+			done()
+			return nil, fmt.Errorf("request to process failed: %w", errResponseTooLarge)
+		}
+		limits.onLimit = func(err error) {
+			t.logger.Warn("aborting process response",
+				zap.String("file_path", filePath),
+				zap.String("socket_path", socketPath),
+				zap.Duration("duration", time.Since(start)),
+				zap.Error(err),
+			)
+		}
+		resp.Body = limits
+	}
+
+	if t.recorder != nil && t.service == nil {
+		t.recordResponse(req, recordBody, resp, absFilePath, start)
+	}
+
+	if t.slo != nil && t.service == nil {
+		t.slo.observe(absFilePath, duration, resp.StatusCode >= 500, time.Now())
+	}
+
+	for field, value := range t.HeaderDown {
+		if resp.Header.Get(field) == "" {
+			resp.Header.Set(field, value)
+		}
+	}
+
+	var etag string
+	if conditionalKey != "" {
+		etag = t.etags.tag(conditionalKey, resp, time.Now())
+	}
+
+	// Cache before adding anything specific to this client
+	if responseKey != "" {
+		resp = t.cache.store(responseKey, resp, time.Now())
+	}
+
+	if etagMatches(ifNoneMatch, etag) {
+		resp.Body.Close()
+		resp = notModifiedResponse(req, etag, resp.Header)
+	}
+
+	if canaryCookie != nil {
+		resp.Header.Add("Set-Cookie", canaryCookie.String())
+	}
+
+	if len(t.Negotiate) > 0 {
+		addVary(resp.Header, "Accept")
+	}
+
+	if t.ColdStartHeaders && cold != nil {
+		resp.Header.Set("X-Substrate-Cold-Start", "1")
+		resp.Header.Set("X-Substrate-Startup-Ms", strconv.FormatInt(cold.startup.Milliseconds(), 10))
+	}
+
+	if t.Dev {
+		injectLiveReload(req, resp)
+	}
+
+	// reverse_proxy flushes every write of a response with unknown length
+	if t.FlushInterval < 0 {
+		resp.ContentLength = -1
+	}
+
+	// Wrap response body to end the request after body is fully transmitted
+	resp.Body = onCloseBody(resp, done)
+
+	if c := t.checkRequest(t.requestLevel, "request completed successfully"); c != nil {
+		c.Write(
+			zap.String("file_path", filePath),
+			zap.String("socket_path", socketPath),
+			zap.Duration("duration", duration),
+			zap.Int("status_code", resp.StatusCode),
+			zap.Int64("content_length", resp.ContentLength),
+		)
+	}
 
 	return resp, nil
 }
 
+// scriptFromTemplate expands the script option for req. The result, taken
+// from the site root when relative, must be inside base, or the site root
+// when base is empty: placeholders may carry request input. It returns ""
+// when no script can be chosen.
+func scriptFromTemplate(req *http.Request, repl *caddy.Replacer, template, base string) string {
+	script := repl.ReplaceAll(template, "")
+	if script == "" {
+		return ""
+	}
+	root, _ := caddyhttp.GetVar(req.Context(), "root").(string)
+	if root != "" {
+		root, _ = filepath.Abs(repl.ReplaceAll(root, "."))
+	}
+	if base == "" {
+		base = root
+	} else if base = repl.ReplaceAll(base, ""); base != "" {
+		base, _ = filepath.Abs(base)
+	}
+	if base == "" {
+		return ""
+	}
+
+	if filepath.IsAbs(script) {
+		script = filepath.Clean(script)
+	} else if root != "" {
+		script = filepath.Join(root, script)
+	} else {
+		return ""
+	}
+	if script == base || !isWithin(script, base) {
+		return ""
+	}
+	return script
+}
+
+// setColdStartPlaceholders records in the request's replacer whether it waited
+// for a process start, and how long that start took in milliseconds.
+func setColdStartPlaceholders(req *http.Request, cold *coldStart) {
+	repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	var startupMs int64
+	if cold != nil {
+		startupMs = cold.startup.Milliseconds()
+	}
+	repl.Set("substrate.cold_start", cold != nil)
+	repl.Set("substrate.startup_ms", startupMs)
+}
+
+// startError reports a failure to obtain a process, either as a response or,
+// with error_handling handle_errors, as a HandlerError for Caddy's error
+// routes.
+func (t *SubstrateTransport) startError(req *http.Request, err error) (*http.Response, error) {
+	overload := ""
+	if t.OverloadSignal != nil {
+		overload = overloadReason(err)
+	}
+
+	if t.ErrorHandling != "handle_errors" {
+		if startupErr, ok := err.(*ProcessStartupError); ok && t.Dev && acceptsHTML(req) {
+			return overlayResponse(req, startupErr), nil
+		}
+		resp := startErrorResponse(req, err, t.Dev || isInternalIP(req.RemoteAddr))
+		if overload != "" {
+			t.OverloadSignal.signal(resp, overload)
+		}
+		return resp, nil
+	}
+
+	if startupErr, ok := err.(*ProcessStartupError); ok {
+		if repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			repl.Set("substrate.startup.script", startupErr.ScriptPath)
+			repl.Set("substrate.startup.exit_code", startupErr.ExitCode)
+			repl.Set("substrate.startup.stdout", startupErr.Stdout)
+			repl.Set("substrate.startup.stderr", startupErr.Stderr)
+		}
+	}
+	if overload != "" {
+		if repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			repl.Set("substrate.overloaded", overload)
+		}
+		return nil, caddyhttp.Error(t.OverloadSignal.status(), err)
+	}
+	return nil, caddyhttp.Error(startErrorStatus(err), err)
+}
+
+// startErrorStatus is the status code a failure to obtain a process maps to.
+func startErrorStatus(err error) int {
+	switch err.(type) {
+	case *ScriptPolicyError:
+		return http.StatusForbidden
+	case *StartLimitError:
+		return http.StatusTooManyRequests
+	case *ColdStartsPausedError:
+		return http.StatusServiceUnavailable
+	}
+	if err == errColdStartQueueTimeout {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// startErrorResponse converts a failure to obtain a process into the response
+// sent to the client. detailed includes the violated policy or the startup
+// output in the body.
+func startErrorResponse(req *http.Request, err error, detailed bool) *http.Response {
+	// Scripts rejected by the policy get a 403 naming the violated rule
+	if policyErr, ok := err.(*ScriptPolicyError); ok {
+		responseBody := fmt.Sprintf("Forbidden: script policy violation (%s)", policyErr.Rule)
+		if detailed {
+			responseBody = "Forbidden: " + policyErr.Error()
+		}
+		return textResponse(req, http.StatusForbidden, responseBody)
+	}
+
+	// Too many cold starts: refuse without spawning
+	if limitErr, ok := err.(*StartLimitError); ok {
+		resp := textResponse(req, http.StatusTooManyRequests, "Too Many Requests: "+limitErr.Error())
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(limitErr.RetryAfter.Seconds()))))
+		return resp
+	}
+
+	// A scheduled window keeps new processes from starting
+	if pausedErr, ok := err.(*ColdStartsPausedError); ok {
+		resp := textResponse(req, http.StatusServiceUnavailable, "Service Unavailable: "+pausedErr.Error())
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(pausedErr.RetryAfter.Seconds()))))
+		return resp
+	}
+
+	// Gave up waiting behind another request's cold start
+	if err == errColdStartQueueTimeout {
+		return textResponse(req, http.StatusServiceUnavailable, "Service Unavailable")
+	}
+
+	// Return HTTP 502 response instead of error
+	responseBody := "Bad Gateway"
+
+	// If this is a startup error and details may be shown, include them
+	if startupErr, ok := err.(*ProcessStartupError); ok && detailed {
+		var details strings.Builder
+		details.WriteString(fmt.Sprintf("Process startup failed: %s\n\n", startupErr.Err.Error()))
+		details.WriteString(fmt.Sprintf("Script: %s\n", startupErr.ScriptPath))
+		details.WriteString(fmt.Sprintf("Exit code: %d\n\n", startupErr.ExitCode))
+		if startupErr.Stdout != "" {
+			details.WriteString("Stdout:\n")
+			details.WriteString(startupErr.Stdout)
+			details.WriteString("\n\n")
+		}
+		if startupErr.Stderr != "" {
+			details.WriteString("Stderr:\n")
+			details.WriteString(startupErr.Stderr)
+			details.WriteString("\n")
+		}
+		responseBody = details.String()
+	}
+
+	return textResponse(req, http.StatusBadGateway, responseBody)
+}
+
+// namespace expands the namespace option for a request.
+func (t *SubstrateTransport) namespace(repl *caddy.Replacer) string {
+	if t.Namespace == "" || t.service != nil {
+		return ""
+	}
+	return repl.ReplaceAll(t.Namespace, "")
+}
+
+// startEnv returns the variables a process started for req gets.
+func (t *SubstrateTransport) startEnv(req *http.Request, segments []string) map[string]string {
+	if !t.RequestEnv && len(segments) == 0 {
+		return nil
+	}
+	env := make(map[string]string, len(segments)+1)
+	if t.RequestEnv {
+		env["SUBSTRATE_REQUEST"] = requestSummary(req)
+	}
+	for i, segment := range segments {
+		env["SUBSTRATE_SEGMENT_"+strconv.Itoa(i+1)] = segment
+	}
+	return env
+}
+
+// location returns the root a script is served from and the URL path it is
+// mounted at, exported as SUBSTRATE_ROOT and SUBSTRATE_URL_PREFIX. The root
+// is the site root, or the script's directory when none is set. A script
+// found by a file matcher is mounted at the request path without the
+// split_path remainder; one chosen by script or host_roots serves the whole
+// site, at "/".
+func (t *SubstrateTransport) location(req *http.Request, repl *caddy.Replacer, script string) (root, prefix string) {
+	root = filepath.Dir(script)
+	if siteRoot, _ := repl.GetString("http.vars.root"); siteRoot != "" {
+		if abs, err := filepath.Abs(siteRoot); err == nil {
+			root = abs
+		}
+	}
+
+	if t.Script != "" || t.HostRoots != nil {
+		return root, "/"
+	}
+	remainder, _ := repl.GetString("http.matchers.file.remainder")
+	return root, strings.TrimSuffix(req.URL.Path, remainder)
+}
+
+// pathSegments matches the request path against Segments, setting the
+// X-Substrate-Segment headers and returning the matched segments. Headers of
+// that name sent by the client are removed.
+func (t *SubstrateTransport) pathSegments(req *http.Request) []string {
+	if t.Segments == "" {
+		return nil
+	}
+	wildcards := strings.Count(t.Segments, "*")
+	for i := 1; i <= wildcards; i++ {
+		req.Header.Del(segmentHeader(i))
+	}
+
+	segments, ok := matchSegments(t.Segments, req.URL.Path)
+	if !ok {
+		return nil
+	}
+	for i, segment := range segments {
+		req.Header.Set(segmentHeader(i+1), segment)
+	}
+	return segments
+}
+
+func segmentHeader(i int) string {
+	return "X-Substrate-Segment-" + strconv.Itoa(i)
+}
+
+// matchSegments matches urlPath against pattern one path segment at a time,
+// returning the segments matched by pattern segments with a *.
+func matchSegments(pattern, urlPath string) ([]string, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+
+	var segments []string
+	for i, part := range patternParts {
+		if ok, _ := path.Match(part, pathParts[i]); !ok {
+			return nil, false
+		}
+		if strings.Contains(part, "*") {
+			segments = append(segments, pathParts[i])
+		}
+	}
+	return segments, true
+}
+
+// requestSummary describes req for SUBSTRATE_REQUEST.
+func requestSummary(req *http.Request) string {
+	summary, _ := json.Marshal(struct {
+		Method     string      `json:"method"`
+		Path       string      `json:"path"`
+		Query      string      `json:"query"`
+		Host       string      `json:"host"`
+		RemoteAddr string      `json:"remote_addr"`
+		Headers    http.Header `json:"headers"`
+	}{req.Method, req.URL.Path, req.URL.RawQuery, req.Host, req.RemoteAddr, req.Header})
+	return string(summary)
+}
+
+// textResponse builds a plain text response generated by the transport itself.
+func textResponse(req *http.Request, statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    statusCode,
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+		},
+		Request: req,
+	}
+}
+
 var (
 	_ caddy.Module          = (*SubstrateTransport)(nil)
 	_ caddy.Provisioner     = (*SubstrateTransport)(nil)
@@ -1,19 +1,31 @@
 package substrate
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // simpleServerScript is a basic Deno HTTP server for testing
@@ -115,7 +127,7 @@ Deno.addSignalListener("SIGTERM", () => {
 
 	// Test getOrCreateHost directly
 	filePath := scriptPath
-	socketPath, err := transport.manager.getOrCreateHost(filePath)
+	socketPath, err := transport.manager.getOrCreateHost(filePath, "")
 	if err != nil {
 		t.Fatalf("getOrCreateHost failed: %v", err)
 	}
@@ -177,7 +189,7 @@ func TestSymlinkExecution(t *testing.T) {
 	}
 
 	// Test getOrCreateHost with symlinked script
-	socketPath, err := transport.manager.getOrCreateHost(symlinkPath)
+	socketPath, err := transport.manager.getOrCreateHost(symlinkPath, "")
 	if err != nil {
 		t.Fatalf("Failed to get socket path for symlinked script: %v", err)
 	}
@@ -217,18 +229,14 @@ func TestSymlinkExecution(t *testing.T) {
 	}
 
 	// Verify the process is tracked under the symlink path, not the resolved path
-	transport.manager.mu.RLock()
-	_, exists := transport.manager.processes[symlinkPath]
-	transport.manager.mu.RUnlock()
+	exists := transport.manager.processes.get(symlinkPath) != nil
 
 	if !exists {
 		t.Error("Process should be tracked under symlink path")
 	}
 
 	// Verify original script path is not used as key
-	transport.manager.mu.RLock()
-	_, originalExists := transport.manager.processes[originalScript]
-	transport.manager.mu.RUnlock()
+	originalExists := transport.manager.processes.get(originalScript) != nil
 
 	if originalExists {
 		t.Error("Process should not be tracked under original script path when accessed via symlink")
@@ -337,7 +345,7 @@ func TestIdleTimeoutZeroDisablesCleanup(t *testing.T) {
 	}
 
 	// Start process
-	socketPath, err := transport.manager.getOrCreateHost(scriptPath)
+	socketPath, err := transport.manager.getOrCreateHost(scriptPath, "")
 	if err != nil {
 		t.Fatalf("Failed to get socket path: %v", err)
 	}
@@ -345,9 +353,8 @@ func TestIdleTimeoutZeroDisablesCleanup(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 
 	// Verify process is running
-	transport.manager.mu.RLock()
-	process, exists := transport.manager.processes[scriptPath]
-	transport.manager.mu.RUnlock()
+	process := transport.manager.processes.get(scriptPath)
+	exists := process != nil
 
 	if !exists {
 		t.Fatal("Process should exist in manager")
@@ -357,9 +364,7 @@ func TestIdleTimeoutZeroDisablesCleanup(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 
 	// Process should still be running (cleanup disabled)
-	transport.manager.mu.RLock()
-	_, stillExists := transport.manager.processes[scriptPath]
-	transport.manager.mu.RUnlock()
+	stillExists := transport.manager.processes.get(scriptPath) != nil
 
 	if !stillExists {
 		t.Error("Process should still exist when idle_timeout=0 (cleanup disabled)")
@@ -438,9 +443,7 @@ func TestIdleTimeoutNegativeOneClosesAfterRequest(t *testing.T) {
 	time.Sleep(300 * time.Millisecond)
 
 	// Process should no longer exist
-	transport.manager.mu.RLock()
-	_, exists := transport.manager.processes[scriptPath]
-	transport.manager.mu.RUnlock()
+	exists := transport.manager.processes.get(scriptPath) != nil
 
 	if exists {
 		t.Error("Process should be closed after request when idle_timeout=-1")
@@ -457,9 +460,7 @@ func TestIdleTimeoutNegativeOneClosesAfterRequest(t *testing.T) {
 	time.Sleep(300 * time.Millisecond)
 
 	// Process should again be closed
-	transport.manager.mu.RLock()
-	_, exists2 := transport.manager.processes[scriptPath]
-	transport.manager.mu.RUnlock()
+	exists2 := transport.manager.processes.get(scriptPath) != nil
 
 	if exists2 {
 		t.Error("Process should be closed after second request when idle_timeout=-1")
@@ -525,7 +526,7 @@ const server = Deno.serve({
 	defer transport.Cleanup()
 
 	// Start process
-	socketPath, err := transport.manager.getOrCreateHost(scriptPath)
+	socketPath, err := transport.manager.getOrCreateHost(scriptPath, "")
 	if err != nil {
 		t.Fatalf("Failed to get socket path: %v", err)
 	}
@@ -571,3 +572,1021 @@ const server = Deno.serve({
 		}
 	}
 }
+
+func TestUnmarshalCaddyfile_KeepAlive(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		keepalive 5m
+		keepalive_idle_conns_per_host 64
+	}`)
+
+	transport := &SubstrateTransport{}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+
+	keepAlive := transport.keepAlive()
+	if keepAlive.IdleConnTimeout != caddy.Duration(5*time.Minute) {
+		t.Errorf("Expected idle conn timeout 5m, got %v", time.Duration(keepAlive.IdleConnTimeout))
+	}
+	if keepAlive.MaxIdleConnsPerHost != 64 {
+		t.Errorf("Expected 64 idle conns per host, got %d", keepAlive.MaxIdleConnsPerHost)
+	}
+
+	d = caddyfile.NewTestDispenser(`substrate {
+		keepalive off
+	}`)
+	transport = &SubstrateTransport{}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+
+	keepAlive = transport.keepAlive()
+	if keepAlive.Enabled == nil || *keepAlive.Enabled {
+		t.Error("keepalive off should disable keep-alive")
+	}
+	if keepAlive.MaxIdleConnsPerHost != 32 {
+		t.Errorf("Unset idle conns per host should default to 32, got %d", keepAlive.MaxIdleConnsPerHost)
+	}
+}
+
+func TestFlushIntervalStreamsResponses_Integration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	transport := &SubstrateTransport{
+		IdleTimeout:    caddy.Duration(60 * time.Second),
+		StartupTimeout: caddy.Duration(3 * time.Second),
+		FlushInterval:  caddy.Duration(-1),
+	}
+	ctx := caddy.Context{Context: context.Background()}
+	if err := transport.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision transport: %v", err)
+	}
+	defer transport.Cleanup()
+
+	scriptPath := filepath.Join(t.TempDir(), "events.js")
+	script := `Deno.serve({ path: Deno.args[0] }, () => {
+  const enc = new TextEncoder();
+  const body = new ReadableStream({
+    async start(controller) {
+      controller.enqueue(enc.encode("data: first\n\n"));
+      await new Promise((r) => setTimeout(r, 3000));
+      controller.enqueue(enc.encode("data: second\n\n"));
+      controller.close();
+    },
+  });
+  return new Response(body, { headers: { "content-type": "text/event-stream" } });
+});`
+	if err := os.WriteFile(scriptPath, []byte(script), 0644); err != nil {
+		t.Fatalf("Failed to write test script: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/events.js", nil)
+	repl := caddy.NewReplacer()
+	repl.Set("http.matchers.file.absolute", scriptPath)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength != -1 {
+		t.Errorf("Expected streamed response with unknown length, got %d", resp.ContentLength)
+	}
+
+	// The first event must arrive well before the process finishes the body
+	start := time.Now()
+	buf := make([]byte, 64)
+	n, err := resp.Body.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read first event: %v", err)
+	}
+	if got := string(buf[:n]); got != "data: first\n\n" {
+		t.Errorf("Expected first event, got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("First event was buffered for %v", elapsed)
+	}
+}
+
+func TestUnmarshalCaddyfile_FlushInterval(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		flush_interval -1
+	}`)
+
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if transport.FlushInterval != -1 {
+		t.Errorf("Expected flush_interval -1, got %v", transport.FlushInterval)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("flush_interval -1 should be valid: %v", err)
+	}
+
+	transport.FlushInterval = caddy.Duration(100 * time.Millisecond)
+	if err := transport.Validate(); err == nil {
+		t.Error("Positive flush_interval should be rejected")
+	}
+}
+
+func TestUnmarshalCaddyfile_ColdStartQueueTimeout(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		startup_timeout 10s
+		cold_start_queue_timeout 2s
+	}`)
+
+	transport := &SubstrateTransport{}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if transport.ColdStartQueueTimeout != caddy.Duration(2*time.Second) {
+		t.Errorf("Expected cold_start_queue_timeout 2s, got %v", transport.ColdStartQueueTimeout)
+	}
+
+	opts, err := transport.processOptions()
+	if err != nil {
+		t.Fatalf("processOptions failed: %v", err)
+	}
+	if opts.coldStartQueueTimeout != 2*time.Second {
+		t.Errorf("Expected queue timeout in process options, got %v", opts.coldStartQueueTimeout)
+	}
+
+	transport.ColdStartQueueTimeout = -1
+	if err := transport.Validate(); err == nil {
+		t.Error("Negative cold_start_queue_timeout should be rejected")
+	}
+}
+
+func TestUnmarshalCaddyfile_Isolation(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		isolation per_request
+	}`)
+
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if transport.Isolation != "per_request" {
+		t.Errorf("Expected isolation per_request, got %q", transport.Isolation)
+	}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("isolation per_request should be valid: %v", err)
+	}
+
+	d = caddyfile.NewTestDispenser(`substrate {
+		isolation per_client
+	}`)
+	if err := (&SubstrateTransport{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Unknown isolation should be rejected")
+	}
+
+	transport = &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second), Isolation: "per_client"}
+	if err := transport.Validate(); err == nil {
+		t.Error("Unknown isolation should fail validation")
+	}
+}
+
+// newStubProcessTransport provisions a transport whose manager already holds a
+// running "process" for a script, backed by an in-test HTTP server on a unix
+// socket, so RoundTrip can be exercised without Deno. transport holds the
+// options under test; the stub echoes the request's Accept-Encoding in
+// X-Accept-Encoding and whether it asked to close the connection in X-Close,
+// and answers with the max-age given in the max_age query parameter.
+func newStubProcessTransport(tb testing.TB, transport *SubstrateTransport, logger *zap.Logger) (*SubstrateTransport, *http.Request) {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	scriptPath := filepath.Join(dir, "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		tb.Fatalf("Failed to write script: %v", err)
+	}
+
+	socketPath := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		tb.Fatalf("Failed to listen on socket: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("X-Close", strconv.FormatBool(r.Close))
+		if maxAge := r.URL.Query().Get("max_age"); maxAge != "" {
+			w.Header().Set("Cache-Control", "max-age="+maxAge)
+		}
+		io.WriteString(w, "OK")
+	})}
+	go server.Serve(listener)
+	tb.Cleanup(func() { server.Close() })
+
+	// No idle cleanup, so no goroutine reads the logger swapped in below
+	transport.IdleTimeout = caddy.Duration(0)
+	transport.StartupTimeout = caddy.Duration(time.Second)
+	if err := transport.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		tb.Fatalf("Failed to provision transport: %v", err)
+	}
+	transport.logger = logger
+	transport.manager.logger = logger
+
+	ready := make(chan struct{})
+	close(ready)
+	process := &Process{
+		scriptPath: scriptPath,
+		SocketPath: socketPath,
+		cmd:        &exec.Cmd{Process: &os.Process{Pid: os.Getpid()}},
+		logger:     logger,
+		ready:      ready,
+	}
+	transport.manager.processes.acquire(scriptPath, func() (*Process, error) { return process, nil })
+	tb.Cleanup(func() {
+		// The stub must not be signalled on cleanup
+		transport.manager.processes.remove(scriptPath, process)
+		transport.Cleanup()
+	})
+
+	req := httptest.NewRequest("GET", "/app.js", nil)
+	repl := caddy.NewReplacer()
+	repl.Set("http.matchers.file.absolute", scriptPath)
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	return transport, req.WithContext(ctx)
+}
+
+func TestRoundTrip_Verbosity(t *testing.T) {
+	tests := []struct {
+		verbosity string
+		level     zapcore.Level
+		want      int
+	}{
+		{"quiet", zapcore.DebugLevel, 0},
+		{"normal", zapcore.InfoLevel, 0},
+		{"normal", zapcore.DebugLevel, 2},
+		{"verbose", zapcore.InfoLevel, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.verbosity+"/"+tt.level.String(), func(t *testing.T) {
+			core, logs := observer.New(tt.level)
+			transport, req := newStubProcessTransport(t, &SubstrateTransport{Verbosity: tt.verbosity}, zap.New(core))
+
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip failed: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			got := logs.FilterMessage("routing request to subprocess").Len() +
+				logs.FilterMessage("request completed successfully").Len()
+			if got != tt.want {
+				t.Errorf("Expected %d request log lines, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidate_Verbosity(t *testing.T) {
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second), Verbosity: "loud"}
+	if err := transport.Validate(); err == nil {
+		t.Error("Unknown verbosity should be rejected")
+	}
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, verbosity := range []string{"quiet", "normal", "verbose"} {
+		b.Run(verbosity, func(b *testing.B) {
+			logger := zap.New(zapcore.NewCore(
+				zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+				zapcore.AddSync(io.Discard),
+				zapcore.InfoLevel,
+			))
+			transport, req := newStubProcessTransport(b, &SubstrateTransport{Verbosity: verbosity}, logger)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := transport.RoundTrip(req.Clone(req.Context()))
+				if err != nil {
+					b.Fatalf("RoundTrip failed: %v", err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestValidate_ConflictingOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport SubstrateTransport
+	}{
+		{"reload_on_change with one-shot", SubstrateTransport{IdleTimeout: -1, ReloadOnChange: true}},
+		{"prewarm with one-shot", SubstrateTransport{IdleTimeout: -1, PrewarmConnections: 2}},
+		{"reload_on_change with per_request isolation", SubstrateTransport{Isolation: "per_request", ReloadOnChange: true}},
+		{"prewarm with per_request isolation", SubstrateTransport{Isolation: "per_request", PrewarmConnections: 2}},
+		{"request_env with shared processes", SubstrateTransport{IdleTimeout: caddy.Duration(time.Minute), RequestEnv: true}},
+		{"prewarm without keepalive", SubstrateTransport{PrewarmConnections: 2, KeepAlive: &reverseproxy.KeepAlive{Enabled: new(bool)}}},
+		{"type_check with runtime go", SubstrateTransport{Runtime: "go", TypeCheck: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.transport.StartupTimeout = caddy.Duration(time.Second)
+			if err := tt.transport.Validate(); err == nil {
+				t.Error("Expected conflicting options to be rejected")
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfile_ConflictsFailAtAdapt(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		idle_timeout -1
+		reload_on_change
+	}`)
+
+	transport := &SubstrateTransport{}
+	err := transport.UnmarshalCaddyfile(d)
+	if err == nil || !strings.Contains(err.Error(), "reload_on_change") {
+		t.Errorf("Expected reload_on_change conflict at parse time, got %v", err)
+	}
+}
+
+func TestLint(t *testing.T) {
+	transport := &SubstrateTransport{
+		IdleTimeout:              caddy.Duration(time.Hour),
+		StartupTimeout:           caddy.Duration(time.Second),
+		MaxStartsPerMinute:       10,
+		MaxClientStartsPerMinute: 20,
+	}
+	if warnings := transport.lint(); len(warnings) != 1 {
+		t.Errorf("Expected one warning about unreachable client limit, got %v", warnings)
+	}
+
+	transport.MaxClientStartsPerMinute = 5
+	if warnings := transport.lint(); len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+}
+
+func TestRoundTrip_ResolveSymlinks(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{}, zaptest.NewLogger(t))
+	transport.ResolveSymlinks = true
+
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	target, _ := repl.GetString("http.matchers.file.absolute")
+	link := filepath.Join(t.TempDir(), "link.js")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	repl.Set("http.matchers.file.absolute", link)
+
+	// Only the target has a (stub) process; reaching it proves the key
+	// was resolved instead of spawning a process for the link
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected request through the symlink to reach the target's process, got %d", resp.StatusCode)
+	}
+}
+
+func TestStartError_HandleErrors(t *testing.T) {
+	startupErr := &ProcessStartupError{
+		Err:        errors.New("process exited before socket became ready (exit code: 1)"),
+		ExitCode:   1,
+		Stderr:     "SyntaxError",
+		ScriptPath: "/srv/app.js",
+	}
+
+	repl := caddy.NewReplacer()
+	req := httptest.NewRequest("GET", "/app.js", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+	// The default answers with a response
+	resp, err := (&SubstrateTransport{}).startError(req, startupErr)
+	if err != nil || resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 response, got %v, %v", resp, err)
+	}
+
+	transport := &SubstrateTransport{ErrorHandling: "handle_errors"}
+	resp, err = transport.startError(req, startupErr)
+	if resp != nil {
+		t.Error("handle_errors should not produce a response")
+	}
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 HandlerError, got %v", err)
+	}
+	var gotStartupErr *ProcessStartupError
+	if !errors.As(err, &gotStartupErr) {
+		t.Error("HandlerError should wrap the ProcessStartupError")
+	}
+	if stderr, _ := repl.GetString("substrate.startup.stderr"); stderr != "SyntaxError" {
+		t.Errorf("Expected stderr placeholder, got %q", stderr)
+	}
+	if code, _ := repl.GetString("substrate.startup.exit_code"); code != "1" {
+		t.Errorf("Expected exit_code placeholder, got %q", code)
+	}
+
+	_, err = transport.startError(req, &StartLimitError{Scope: "global", Limit: 10})
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 HandlerError, got %v", err)
+	}
+
+	if err := (&SubstrateTransport{StartupTimeout: caddy.Duration(time.Second), ErrorHandling: "panic"}).Validate(); err == nil {
+		t.Error("Unknown error_handling should be rejected")
+	}
+}
+
+func TestRequestSummary(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/api/login.js?next=%2F", nil)
+	req.RemoteAddr = "203.0.113.7:5150"
+	req.Header.Set("Authorization", "Bearer token")
+
+	var summary struct {
+		Method     string              `json:"method"`
+		Path       string              `json:"path"`
+		Query      string              `json:"query"`
+		Host       string              `json:"host"`
+		RemoteAddr string              `json:"remote_addr"`
+		Headers    map[string][]string `json:"headers"`
+	}
+	if err := json.Unmarshal([]byte(requestSummary(req)), &summary); err != nil {
+		t.Fatalf("Summary is not JSON: %v", err)
+	}
+	if summary.Method != "POST" || summary.Path != "/api/login.js" || summary.Query != "next=%2F" ||
+		summary.Host != "example.com" || summary.RemoteAddr != "203.0.113.7:5150" {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+	if got := summary.Headers["Authorization"]; len(got) != 1 || got[0] != "Bearer token" {
+		t.Errorf("Expected headers in summary, got %v", summary.Headers)
+	}
+
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second), IdleTimeout: -1, RequestEnv: true}
+	if err := transport.Validate(); err != nil {
+		t.Errorf("request_env should be valid in one-shot mode: %v", err)
+	}
+}
+
+func TestTransport_Location(t *testing.T) {
+	tests := []struct {
+		name       string
+		transport  *SubstrateTransport
+		vars       map[string]any
+		path       string
+		wantRoot   string
+		wantPrefix string
+	}{
+		{"file matcher", &SubstrateTransport{}, map[string]any{"http.vars.root": "/srv/site"}, "/api/users.js", "/srv/site", "/api/users.js"},
+		{"split path", &SubstrateTransport{}, map[string]any{"http.vars.root": "/srv/site", "http.matchers.file.remainder": "/42/posts"}, "/api/users.js/42/posts", "/srv/site", "/api/users.js"},
+		{"no site root", &SubstrateTransport{}, nil, "/api/users.js", "/srv/site/api", "/api/users.js"},
+		{"script", &SubstrateTransport{Script: "/srv/site/api/users.js"}, map[string]any{"http.vars.root": "/srv/site"}, "/anything", "/srv/site", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			for key, value := range tt.vars {
+				repl.Set(key, value)
+			}
+			req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+			root, prefix := tt.transport.location(req, repl, "/srv/site/api/users.js")
+			if root != tt.wantRoot || prefix != tt.wantPrefix {
+				t.Errorf("location() = %q, %q; want %q, %q", root, prefix, tt.wantRoot, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestPathSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    []string
+		ok      bool
+	}{
+		{"/apps/*/server.js", "/apps/acme/server.js", []string{"acme"}, true},
+		{"/apps/*/v*/*.js", "/apps/acme/v2/main.js", []string{"acme", "v2", "main.js"}, true},
+		{"/apps/*/server.js", "/apps/acme/other.js", nil, false},
+		{"/apps/*/server.js", "/apps/acme/nested/server.js", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := matchSegments(tt.pattern, tt.path)
+		if ok != tt.ok || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("matchSegments(%q, %q) = %v, %v; want %v, %v", tt.pattern, tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second), Segments: "/apps/*/server.js"}
+	if err := transport.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/apps/acme/server.js", nil)
+	req.Header.Set("X-Substrate-Segment-1", "spoofed")
+	env := transport.startEnv(req, transport.pathSegments(req))
+	if got := req.Header.Get("X-Substrate-Segment-1"); got != "acme" {
+		t.Errorf("Expected segment header acme, got %q", got)
+	}
+	if env["SUBSTRATE_SEGMENT_1"] != "acme" || len(env) != 1 {
+		t.Errorf("Unexpected start env: %v", env)
+	}
+
+	req = httptest.NewRequest("GET", "http://example.com/other.js", nil)
+	req.Header.Set("X-Substrate-Segment-1", "spoofed")
+	if env := transport.startEnv(req, transport.pathSegments(req)); env != nil {
+		t.Errorf("Expected no start env without a match, got %v", env)
+	}
+	if got := req.Header.Get("X-Substrate-Segment-1"); got != "" {
+		t.Errorf("Expected client segment header to be removed, got %q", got)
+	}
+
+	transport.Segments = "/apps/server.js"
+	if err := transport.Validate(); err == nil {
+		t.Error("segments without a wildcard should be rejected")
+	}
+}
+
+func TestRoundTrip_HeaderDown(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		header_down X-Powered-By substrate
+		header_down {
+			X-Frame-Options DENY
+			Content-Type text/html
+		}
+	}`)
+	var parsed SubstrateTransport
+	if err := parsed.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if len(parsed.HeaderDown) != 3 || parsed.HeaderDown["X-Frame-Options"] != "DENY" {
+		t.Fatalf("Unexpected header_down: %v", parsed.HeaderDown)
+	}
+
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{HeaderDown: parsed.HeaderDown}, zaptest.NewLogger(t))
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := resp.Header.Get("X-Powered-By"); got != "substrate" {
+		t.Errorf("Expected X-Powered-By default, got %q", got)
+	}
+	if got := resp.Header.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("Expected X-Frame-Options default, got %q", got)
+	}
+	// The stub sets its own Content-Type, which wins
+	if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Expected the process's Content-Type to be kept, got %q", got)
+	}
+}
+
+func TestRoundTrip_DrainingProcess(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{}, zaptest.NewLogger(t))
+	var socketPath string
+	for _, process := range transport.manager.processes.snapshot() {
+		socketPath = process.SocketPath
+	}
+
+	roundTrip := func() string {
+		resp, err := transport.RoundTrip(req.Clone(req.Context()))
+		if err != nil {
+			t.Fatalf("RoundTrip failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.Header.Get("X-Close")
+	}
+
+	if got := roundTrip(); got != "false" {
+		t.Errorf("Expected keep-alive before draining, got X-Close %q", got)
+	}
+
+	transport.manager.drains.start(socketPath)
+	if got := roundTrip(); got != "true" {
+		t.Errorf("Expected Connection: close while draining, got X-Close %q", got)
+	}
+
+	transport.manager.drains.done(socketPath)
+	if got := roundTrip(); got != "false" {
+		t.Errorf("Expected keep-alive once the socket is forgotten, got X-Close %q", got)
+	}
+}
+
+// stoppableStub makes the stub process of transport one that one-shot mode
+// can stop once its requests are done, and returns it.
+func stoppableStub(t *testing.T, transport *SubstrateTransport) *Process {
+	t.Helper()
+	sleeper := startSleeper(t)
+	exited := make(chan struct{})
+	go func() {
+		sleeper.Process.Wait()
+		close(exited)
+	}()
+	var stub *Process
+	for _, process := range transport.manager.processes.snapshot() {
+		process.mu.Lock()
+		process.cmd = sleeper
+		process.exitChan = exited
+		process.activeRequests = 0
+		process.mu.Unlock()
+		stub = process
+	}
+	return stub
+}
+
+// waitForStop waits for process to be stopped.
+func waitForStop(t *testing.T, process *Process) {
+	t.Helper()
+	select {
+	case <-process.exitChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the one-shot process to be stopped")
+	}
+}
+
+func TestRoundTrip_OneShotClientGone(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{}, zaptest.NewLogger(t))
+	transport.IdleTimeout = caddy.Duration(-1)
+	process := stoppableStub(t, transport)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The client goes away without the body being read or closed
+	cancel()
+	waitForStop(t, process)
+	if transport.manager.processes.get(process.scriptPath) != nil {
+		t.Error("Expected the process forgotten")
+	}
+}
+
+func TestRoundTrip_OneShotError(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{}, zaptest.NewLogger(t))
+	transport.IdleTimeout = caddy.Duration(-1)
+	process := stoppableStub(t, transport)
+	serveStubSocket(t, transport, func(conn net.Conn) {})
+
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("Expected the request to fail")
+	}
+	waitForStop(t, process)
+}
+
+func TestRoundTrip_ReleasesProcess(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{}, zaptest.NewLogger(t))
+	var process *Process
+	for _, p := range transport.manager.processes.snapshot() {
+		process = p
+	}
+	idle := process.inFlight()
+	waitForIdle := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for process.inFlight() != idle {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the request released, %d in flight", process.inFlight())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	resp, err := transport.RoundTrip(req.Clone(req.Context()))
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	if got := process.inFlight(); got != idle+1 {
+		t.Errorf("Expected the request counted until its body is closed, got %d", got)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	waitForIdle()
+
+	// A failed request is released too
+	serveStubSocket(t, transport, func(conn net.Conn) {})
+	if _, err := transport.RoundTrip(req.Clone(req.Context())); err == nil {
+		t.Fatal("Expected the request to fail")
+	}
+	waitForIdle()
+	if transport.manager.processes.get(process.scriptPath) != process {
+		t.Error("Expected the process kept outside one-shot mode")
+	}
+}
+
+func TestRoundTrip_Trailers(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport *SubstrateTransport
+		oneShot   bool
+	}{
+		{"default", &SubstrateTransport{}, false},
+		{"one-shot", &SubstrateTransport{}, true},
+		{"response limits", &SubstrateTransport{MaxResponseBytes: 1 << 20, MaxResponseDuration: caddy.Duration(time.Minute)}, false},
+		{"slow_request", &SubstrateTransport{SlowRequest: &SlowRequestConfig{Threshold: caddy.Duration(time.Minute)}}, false},
+		{"etag", &SubstrateTransport{ETag: &ETagConfig{}}, false},
+		{"micro_cache", &SubstrateTransport{MicroCache: &MicroCache{}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, req := newStubProcessTransport(t, tt.transport, zaptest.NewLogger(t))
+			serveStubSocket(t, transport, func(conn net.Conn) {
+				br := bufio.NewReader(conn)
+				for {
+					r, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					io.Copy(io.Discard, r.Body)
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\nTrailer: Grpc-Status\r\nTransfer-Encoding: chunked\r\n\r\n"+
+						"5\r\nhello\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: done\r\n\r\n")
+				}
+			})
+			if tt.oneShot {
+				transport.IdleTimeout = caddy.Duration(-1)
+				stoppableStub(t, transport)
+			}
+
+			// A cached response carries the trailers of the one it was
+			// stored from
+			for i := 0; i < 2; i++ {
+				resp, err := transport.RoundTrip(req.Clone(req.Context()))
+				if err != nil {
+					t.Fatalf("RoundTrip failed: %v", err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != "hello" {
+					t.Errorf("Unexpected body %q", body)
+				}
+				if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "done" {
+					t.Errorf("Expected the trailers passed on, got %v", resp.Trailer)
+				}
+				if tt.oneShot {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTrip_Script(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{Script: "{tenant.script}"}, zaptest.NewLogger(t))
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	scriptPath, _ := repl.GetString("http.matchers.file.absolute")
+	repl.Delete("http.matchers.file.absolute")
+	caddyhttp.SetVar(req.Context(), "root", filepath.Dir(scriptPath))
+
+	resp, err := transport.RoundTrip(req.Clone(req.Context()))
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 when no script is selected, got %d", resp.StatusCode)
+	}
+
+	repl.Set("tenant.script", scriptPath)
+	resp, err = transport.RoundTrip(req.Clone(req.Context()))
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("Expected the selected script to serve, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestScriptFromTemplate(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name   string
+		root   string
+		base   string
+		tenant string
+		want   string
+	}{
+		{"absolute", root, "", filepath.Join(root, "acme/app.js"), filepath.Join(root, "acme/app.js")},
+		{"absolute outside root", root, "", "/srv/acme/app.js", ""},
+		{"absolute without root", "", "", "/srv/acme/app.js", ""},
+		{"absolute in base", "", "/srv", "/srv/acme/app.js", "/srv/acme/app.js"},
+		{"absolute escapes base", "", "/srv", "/srv/../etc/app.js", ""},
+		{"relative", root, "", "acme/app.js", filepath.Join(root, "acme/app.js")},
+		{"relative in base", root, filepath.Join(root, "acme"), "acme/app.js", filepath.Join(root, "acme/app.js")},
+		{"relative outside base", root, filepath.Join(root, "acme"), "globex/app.js", ""},
+		{"relative without root", "", "", "acme/app.js", ""},
+		{"escapes root", root, "", "../app.js", ""},
+		{"root itself", root, "", ".", ""},
+		{"empty", root, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			vars := map[string]any{}
+			if tt.root != "" {
+				vars["root"] = tt.root
+			}
+			req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, vars))
+			repl := caddy.NewReplacer()
+			repl.Set("tenant", tt.tenant)
+
+			if got := scriptFromTemplate(req, repl, "{tenant}", tt.base); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScriptFromTemplate_RequestInput(t *testing.T) {
+	root := t.TempDir()
+	for _, header := range []string{
+		"/etc/passwd.js",
+		"../../../etc/app.js",
+		root + "/../../etc/app.js",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", header)
+		req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{"root": root}))
+		repl := caddyhttp.NewTestReplacer(req)
+
+		if got := scriptFromTemplate(req, repl, "{http.request.header.X-Tenant}", ""); got != "" {
+			t.Errorf("Expected X-Tenant %q to select no script, got %q", header, got)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{"root": root}))
+	repl := caddyhttp.NewTestReplacer(req)
+	if got := scriptFromTemplate(req, repl, "tenants/{http.request.header.X-Tenant}/app.js", ""); got != filepath.Join(root, "tenants/acme/app.js") {
+		t.Errorf("Expected the tenant's script, got %q", got)
+	}
+}
+
+func TestProcess_DrainOnce(t *testing.T) {
+	calls := 0
+	p := &Process{onDrain: func() { calls++ }}
+	p.drain()
+	p.drain()
+	if calls != 1 {
+		t.Errorf("Expected onDrain to run once, got %d", calls)
+	}
+	if !p.draining {
+		t.Error("Expected the process to be marked as draining")
+	}
+}
+
+func TestRoundTrip_AcceptEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want string
+	}{
+		{"", "br, zstd"},
+		{"passthrough", "br, zstd"},
+		{"strip", ""},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			transport, req := newStubProcessTransport(t, &SubstrateTransport{AcceptEncoding: tt.mode}, zaptest.NewLogger(t))
+			req.Header.Set("Accept-Encoding", "br, zstd")
+
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if got := resp.Header.Get("X-Accept-Encoding"); got != tt.want {
+				t.Errorf("Expected process to see Accept-Encoding %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	if err := (&SubstrateTransport{StartupTimeout: caddy.Duration(time.Second), AcceptEncoding: "gzip"}).Validate(); err == nil {
+		t.Error("Unknown accept_encoding should be rejected")
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	var transport SubstrateTransport
+	if err := json.Unmarshal([]byte(`{"dev": true}`), &transport); err != nil {
+		t.Fatal(err)
+	}
+	transport.IdleTimeout = caddy.Duration(time.Hour)
+	transport.applyDev()
+	if !transport.ReloadOnChange || transport.Verbosity != "verbose" || transport.IdleTimeout != 0 {
+		t.Errorf("Expected dev defaults, got reload_on_change=%v verbosity=%q idle_timeout=%v",
+			transport.ReloadOnChange, transport.Verbosity, transport.IdleTimeout)
+	}
+
+	// Explicit options win, and reload_on_change is skipped where it conflicts
+	transport = SubstrateTransport{}
+	if err := json.Unmarshal([]byte(`{"dev": true, "idle_timeout": -1, "verbosity": "quiet"}`), &transport); err != nil {
+		t.Fatal(err)
+	}
+	transport.applyDev()
+	if transport.ReloadOnChange || transport.Verbosity != "quiet" || transport.IdleTimeout != -1 {
+		t.Errorf("Expected explicit options kept, got reload_on_change=%v verbosity=%q idle_timeout=%v",
+			transport.ReloadOnChange, transport.Verbosity, transport.IdleTimeout)
+	}
+	transport.StartupTimeout = caddy.Duration(time.Second)
+	if err := transport.Validate(); err != nil {
+		t.Errorf("Dev mode should not introduce conflicts: %v", err)
+	}
+
+	// Every client gets startup details
+	startupErr := &ProcessStartupError{
+		Err:        errors.New("process exited before socket became ready (exit code: 1)"),
+		ExitCode:   1,
+		Stderr:     "SyntaxError",
+		ScriptPath: "/srv/app.js",
+	}
+	req := httptest.NewRequest("GET", "/app.js", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	for _, dev := range []bool{false, true} {
+		resp, _ := (&SubstrateTransport{Dev: dev}).startError(req, startupErr)
+		body, _ := io.ReadAll(resp.Body)
+		if got := strings.Contains(string(body), "SyntaxError"); got != dev {
+			t.Errorf("dev=%v: expected details %v, got body %q", dev, dev, body)
+		}
+	}
+
+	d := caddyfile.NewTestDispenser(`substrate {
+		dev on
+	}`)
+	parsed := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+	if err := parsed.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Dev {
+		t.Error("Expected dev on")
+	}
+	d = caddyfile.NewTestDispenser(`substrate {
+		dev maybe
+	}`)
+	if err := (&SubstrateTransport{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for dev maybe")
+	}
+}
+
+func TestRoundTrip_Namespace(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{Namespace: "{tenant}"}, zaptest.NewLogger(t))
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	scriptPath, _ := repl.GetString("http.matchers.file.absolute")
+
+	// Serve the stub only in the "a" namespace
+	pm := transport.manager
+	process := pm.processes.get(scriptPath)
+	pm.processes.remove(scriptPath, process)
+	key := namespacedKey(scriptPath, "a")
+	pm.processes.acquire(key, func() (*Process, error) { return process, nil })
+	t.Cleanup(func() { pm.processes.remove(key, process) })
+
+	repl.Set("tenant", "a")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the namespaced process to answer, got %d", resp.StatusCode)
+	}
+
+	if keys := pm.keysFor(scriptPath); len(keys) != 1 || keys[0] != key {
+		t.Errorf("Expected keys [%s], got %v", key, keys)
+	}
+	if keys := pm.keysFor(scriptPath + "x"); len(keys) != 0 {
+		t.Errorf("Expected no keys for another script, got %v", keys)
+	}
+}
+
+func TestUnmarshalCaddyfile_Namespace(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`substrate {
+		namespace {http.request.host}
+	}`)
+	transport := &SubstrateTransport{}
+	if err := transport.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.Namespace != "{http.request.host}" {
+		t.Errorf("Expected namespace {http.request.host}, got %q", transport.Namespace)
+	}
+
+	d = caddyfile.NewTestDispenser(`substrate {
+		namespace
+	}`)
+	if err := (&SubstrateTransport{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for namespace without a value")
+	}
+}
@@ -0,0 +1,375 @@
+package substrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// takeoverStateInterval is how often the takeover state file is written.
+	takeoverStateInterval = time.Second
+
+	// adoptedPollInterval is how often an adopted process, which is not a
+	// child of this instance, is checked for having exited.
+	adoptedPollInterval = 500 * time.Millisecond
+)
+
+// takeoverState is what the takeover state file holds: the processes of the
+// Caddy instance that wrote it, for another instance to adopt.
+type takeoverState struct {
+	Owner     int             `json:"owner"` // pid of the instance
+	Since     time.Time       `json:"since"` // when its process manager was created
+	Processes []takeoverEntry `json:"processes"`
+}
+
+// takeoverEntry describes a running process in the takeover state file.
+type takeoverEntry struct {
+	Key    string `json:"key"`
+	Script string `json:"script"`
+	Socket string `json:"socket"`
+	PID    int    `json:"pid"`
+	// When PID started, telling the process apart from a later one reusing
+	// its pid; 0 in state files written before it was recorded
+	PIDStart  uint64            `json:"pid_start,omitempty"`
+	ModTime   time.Time         `json:"mod_time"`
+	StartedAt time.Time         `json:"started_at"`
+	StartEnv  map[string]string `json:"start_env,omitempty"`
+}
+
+// readTakeoverState reads the state file at path, returning nil if there is
+// none.
+func readTakeoverState(path string) (*takeoverState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state takeoverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// writeTakeoverState replaces the state file at path, so readers never see
+// it half written.
+func writeTakeoverState(path string, state takeoverState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// processAlive reports whether a process with pid exists.
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// processStartTime returns when pid started, in clock ticks after boot, from
+// field 22 of /proc/<pid>/stat.
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, err
+	}
+	// The command name in field 2 may hold spaces and parentheses
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// sameProcess reports whether pid is still the process that started at
+// start, rather than another one reusing its pid. A zero start only checks
+// that pid exists.
+func sameProcess(pid int, start uint64) bool {
+	if start == 0 {
+		return processAlive(pid)
+	}
+	current, err := processStartTime(pid)
+	return err == nil && current == start
+}
+
+// openOutputPipe opens for reading the pipe that pid writes to on descriptor
+// fd, or returns nil when that is not a pipe or can't be opened.
+func openOutputPipe(pid, fd int) *os.File {
+	path := "/proc/" + strconv.Itoa(pid) + "/fd/" + strconv.Itoa(fd)
+	if info, err := os.Stat(path); err != nil || info.Mode().Type() != fs.ModeNamedPipe {
+		return nil
+	}
+	// Opened through /proc, a pipe gives a new read end; nonblocking, so the
+	// open never waits for a writer
+	file, err := os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil
+	}
+	return file
+}
+
+// takenOverBy reports whether state was written by another, newer instance
+// that took over the processes of the manager.
+func (pm *ProcessManager) takenOverBy(state *takeoverState) bool {
+	return state != nil && state.Owner != os.Getpid() && state.Since.After(pm.since) && processAlive(state.Owner)
+}
+
+// takeoverLoop keeps the state file up to date until another instance takes
+// the processes over.
+func (pm *ProcessManager) takeoverLoop() {
+	defer pm.wg.Done()
+
+	ticker := time.NewTicker(takeoverStateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.ctx.Done():
+			return
+		case <-ticker.C:
+			if !pm.saveTakeoverState() {
+				return
+			}
+		}
+	}
+}
+
+// saveTakeoverState writes the running processes to the state file. It
+// returns false, writing nothing, once another instance took them over.
+func (pm *ProcessManager) saveTakeoverState() bool {
+	path := pm.opts.takeoverState
+	if state, err := readTakeoverState(path); err == nil && pm.takenOverBy(state) {
+		pm.logger.Info("processes taken over by another instance",
+			zap.String("state_file", path),
+			zap.Int("instance_pid", state.Owner),
+		)
+		return false
+	}
+
+	state := takeoverState{Owner: os.Getpid(), Since: pm.since, Processes: []takeoverEntry{}}
+	for key, process := range pm.processes.snapshot() {
+		// Isolated processes serve a single request
+		if key != process.scriptPath && !strings.HasPrefix(key, process.scriptPath+"@") {
+			continue
+		}
+		select {
+		case <-process.ready:
+		default:
+			continue
+		}
+		process.mu.RLock()
+		if process.startErr == nil && !process.stopping && !process.draining && process.cmd != nil && process.cmd.Process != nil {
+			state.Processes = append(state.Processes, takeoverEntry{
+				Key:       key,
+				Script:    process.scriptPath,
+				Socket:    process.SocketPath,
+				PID:       process.cmd.Process.Pid,
+				PIDStart:  process.pidStart,
+				ModTime:   process.modTime,
+				StartedAt: process.startedAt,
+				StartEnv:  process.startEnv,
+			})
+		}
+		process.mu.RUnlock()
+	}
+
+	if err := writeTakeoverState(path, state); err != nil {
+		pm.logger.Warn("failed to write takeover state file",
+			zap.String("state_file", path),
+			zap.Error(err),
+		)
+	}
+	return true
+}
+
+// takenOverPIDs returns the pids of the processes another instance took
+// over, which Stop leaves running.
+func (pm *ProcessManager) takenOverPIDs() map[int]bool {
+	if pm.opts.takeoverState == "" {
+		return nil
+	}
+	state, err := readTakeoverState(pm.opts.takeoverState)
+	if err != nil || !pm.takenOverBy(state) {
+		return nil
+	}
+	pids := make(map[int]bool, len(state.Processes))
+	for _, entry := range state.Processes {
+		pids[entry.PID] = true
+	}
+	return pids
+}
+
+// adopt takes over the processes another Caddy instance listed in the state
+// file, so requests are served by them without a cold start. The state
+// file is rewritten at once, so the other instance leaves them running when
+// it stops.
+func (pm *ProcessManager) adopt() {
+	path := pm.opts.takeoverState
+	state, err := readTakeoverState(path)
+	if err != nil {
+		pm.logger.Warn("failed to read takeover state file",
+			zap.String("state_file", path),
+			zap.Error(err),
+		)
+	}
+	if state == nil || state.Owner == os.Getpid() {
+		return
+	}
+
+	adopted := 0
+	for _, entry := range state.Processes {
+		process, err := pm.adoptProcess(entry)
+		if err != nil {
+			pm.logger.Info("not adopting process",
+				zap.String("script_path", entry.Script),
+				zap.Int("pid", entry.PID),
+				zap.Error(err),
+			)
+			continue
+		}
+		if !pm.processes.store(entry.Key, process) {
+			continue
+		}
+		process.readAdoptedOutput()
+		go process.watchAdopted()
+		if idleTimeout := pm.settings().idleTimeout; idleTimeout > 0 {
+			pm.idle.push(entry.Key, process, time.Now().Add(time.Duration(idleTimeout)))
+		}
+		adopted++
+		pm.logger.Info("adopted process from another instance",
+			zap.String("script_path", entry.Script),
+			zap.String("socket_path", entry.Socket),
+			zap.Int("pid", entry.PID),
+		)
+	}
+	if adopted > 0 {
+		pm.saveTakeoverState()
+	}
+}
+
+// adoptProcess returns a Process for a running process of another instance,
+// after checking it is still there and accepting connections.
+func (pm *ProcessManager) adoptProcess(entry takeoverEntry) (*Process, error) {
+	if _, err := os.Stat(entry.Script); err != nil {
+		return nil, err
+	}
+	// Found before checking it is the listed process, so where pidfds are
+	// supported, signals reach that process even if its pid is reused later
+	proc, err := os.FindProcess(entry.PID)
+	if err != nil {
+		return nil, err
+	}
+	if !sameProcess(entry.PID, entry.PIDStart) {
+		return nil, errors.New("process exited")
+	}
+	conn, err := net.DialTimeout("unix", entry.Socket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+
+	settings := pm.settings()
+	process := &Process{
+		scriptPath:    entry.Script,
+		SocketPath:    entry.Socket,
+		key:           entry.Key,
+		cmd:           &exec.Cmd{Path: entry.Script, Process: proc},
+		lastUsed:      time.Now(),
+		modTime:       entry.ModTime,
+		exitCode:      -1,
+		logger:        pm.logger,
+		env:           settings.env,
+		opts:          pm.opts,
+		idleTimeout:   settings.idleTimeout,
+		config:        pm.transportConfig(),
+		startupStdout: &startupBuffer{},
+		startupStderr: &startupBuffer{},
+		stderrTail:    &tailBuffer{size: stderrTailSize},
+		exitChan:      make(chan struct{}),
+		ready:         make(chan struct{}),
+		startedAt:     entry.StartedAt,
+		startEnv:      entry.StartEnv,
+		pidStart:      entry.PIDStart,
+		adopted:       true,
+	}
+	close(process.ready)
+	pm.track(process)
+	return process, nil
+}
+
+// readAdoptedOutput logs the output of an adopted process. The pipes it
+// writes to were made by the instance that started it, and would break once
+// that instance exits; reading them here keeps them open.
+func (p *Process) readAdoptedOutput() {
+	pid := p.cmd.Process.Pid
+	if stdout := openOutputPipe(pid, 1); stdout != nil {
+		p.output.Add(1)
+		go p.logAndBufferOutput(stdout, "stdout", zap.InfoLevel, io.Discard)
+	}
+	if stderr := openOutputPipe(pid, 2); stderr != nil {
+		p.output.Add(1)
+		go p.logAndBufferOutput(stderr, "stderr", zap.ErrorLevel, p.stderrTail)
+	}
+}
+
+// watchAdopted waits for an adopted process to exit. It is not a child of
+// this instance, so its exit status is unknown.
+func (p *Process) watchAdopted() {
+	pid := p.cmd.Process.Pid
+	ticker := time.NewTicker(adoptedPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !sameProcess(pid, p.pidStart) {
+			break
+		}
+	}
+
+	p.mu.Lock()
+	p.exitedAt = time.Now()
+	stopping := p.stopping
+	p.mu.Unlock()
+	close(p.exitChan)
+
+	if !stopping {
+		p.logger.Warn("adopted process exited",
+			zap.String("script_path", p.scriptPath),
+			zap.Int("pid", pid),
+		)
+	}
+	p.onExit()
+}
@@ -0,0 +1,228 @@
+package substrate
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+// startSleeper starts a process another instance could have started, reaped
+// once it exits.
+func startSleeper(t *testing.T) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start sleep: %v", err)
+	}
+	go cmd.Wait()
+	t.Cleanup(func() { cmd.Process.Kill() })
+	return cmd
+}
+
+func newTakeoverManager(t *testing.T, stateFile string) *ProcessManager {
+	t.Helper()
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(time.Minute),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{takeoverState: stateFile},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	return pm
+}
+
+func TestProcessManager_AdoptsProcesses(t *testing.T) {
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	// The socket of the other instance's process
+	socketPath := filepath.Join(dir, "substrate-adopted.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	sleeper := startSleeper(t)
+	gone := startSleeper(t)
+	gone.Process.Kill()
+	for processAlive(gone.Process.Pid) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start, err := processStartTime(sleeper.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateFile := filepath.Join(dir, "state.json")
+	err = writeTakeoverState(stateFile, takeoverState{
+		Owner: sleeper.Process.Pid,
+		Since: time.Now().Add(-time.Hour),
+		Processes: []takeoverEntry{
+			{Key: scriptPath, Script: scriptPath, Socket: socketPath, PID: sleeper.Process.Pid, PIDStart: start, StartedAt: time.Now().Add(-time.Hour)},
+			{Key: scriptPath + "@other", Script: scriptPath, Socket: socketPath, PID: gone.Process.Pid},
+			// Exited, and its pid taken by another process
+			{Key: scriptPath + "@reused", Script: scriptPath, Socket: socketPath, PID: sleeper.Process.Pid, PIDStart: start - 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm := newTakeoverManager(t, stateFile)
+	process := pm.processes.get(scriptPath)
+	if process == nil || !process.adopted || process.cmd.Process.Pid != sleeper.Process.Pid {
+		t.Fatalf("Expected the running process adopted, got %+v", process)
+	}
+	if pm.processes.get(scriptPath+"@other") != nil {
+		t.Error("Expected an exited process not to be adopted")
+	}
+	if pm.processes.get(scriptPath+"@reused") != nil {
+		t.Error("Expected a process reusing a listed pid not to be adopted")
+	}
+
+	// The state file now claims the process for this instance
+	state, err := readTakeoverState(stateFile)
+	if err != nil || state.Owner != os.Getpid() || len(state.Processes) != 1 || state.Processes[0].PID != sleeper.Process.Pid || state.Processes[0].PIDStart != start {
+		t.Fatalf("Expected the state file rewritten, got %+v, %v", state, err)
+	}
+
+	// Stopping the manager stops the adopted process too
+	pm.Stop()
+	select {
+	case <-process.exitChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the adopted process to be stopped")
+	}
+	if processAlive(sleeper.Process.Pid) {
+		t.Error("Expected the adopted process to exit")
+	}
+}
+
+func TestProcessManager_AdoptedProcessOutput(t *testing.T) {
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "app.js")
+	if err := os.WriteFile(scriptPath, []byte("// stub"), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	socketPath := filepath.Join(dir, "substrate-adopted.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// A process of the other instance, writing to its stderr pipe when told
+	stdin, trigger, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trigger.Close()
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", "read line; echo adopted output >&2; exec sleep 30")
+	cmd.Stdin, cmd.Stderr = stdin, stderrW
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	stdin.Close()
+	stderrW.Close()
+	go cmd.Wait()
+	t.Cleanup(func() { cmd.Process.Kill() })
+	start, err := processStartTime(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateFile := filepath.Join(dir, "state.json")
+	err = writeTakeoverState(stateFile, takeoverState{
+		Owner: startSleeper(t).Process.Pid,
+		Since: time.Now().Add(-time.Hour),
+		Processes: []takeoverEntry{
+			{Key: scriptPath, Script: scriptPath, Socket: socketPath, PID: cmd.Process.Pid, PIDStart: start},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := newTakeoverManager(t, stateFile)
+	defer pm.Stop()
+	process := pm.processes.get(scriptPath)
+	if process == nil {
+		t.Fatal("Expected the process adopted")
+	}
+
+	// The other instance exits, closing its end of the pipe
+	stderr.Close()
+	trigger.Write([]byte("go\n"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(process.stderrTail.String(), "adopted output") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the adopted process's output read by this instance")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !sameProcess(cmd.Process.Pid, start) {
+		t.Error("Expected the adopted process to keep running after writing its output")
+	}
+}
+
+func TestProcessManager_LeavesTakenOverProcesses(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+	pm := newTakeoverManager(t, stateFile)
+
+	process := startStubProcess(t, pm, "exec sleep 30")
+	defer process.Stop()
+	close(process.ready)
+	pm.processes.store(process.key, process)
+	pid := process.cmd.Process.Pid
+
+	if !pm.saveTakeoverState() {
+		t.Fatal("Expected the state file written")
+	}
+	state, err := readTakeoverState(stateFile)
+	if err != nil || state.Owner != os.Getpid() || len(state.Processes) != 1 || state.Processes[0].PID != pid || state.Processes[0].PIDStart == 0 {
+		t.Fatalf("Expected the process in the state file, got %+v, %v", state, err)
+	}
+
+	// A newer instance claims the process
+	other := startSleeper(t)
+	state.Owner, state.Since = other.Process.Pid, time.Now()
+	if err := writeTakeoverState(stateFile, *state); err != nil {
+		t.Fatal(err)
+	}
+	if pm.saveTakeoverState() {
+		t.Error("Expected the state file left to the newer instance")
+	}
+
+	pm.Stop()
+	select {
+	case <-process.exitChan:
+		t.Fatal("Expected the taken over process to keep running")
+	default:
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Errorf("Expected the taken over process alive: %v", err)
+	}
+}
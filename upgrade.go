@@ -0,0 +1,24 @@
+package substrate
+
+import (
+	"io"
+	"net/http"
+)
+
+// upgradedBodyWrapper is a oneShotBodyWrapper for the body of a response
+// switching protocols, which is the connection to the process:
+// reverse_proxy writes the client's side of a WebSocket to it.
+type upgradedBodyWrapper struct {
+	*oneShotBodyWrapper
+	io.Writer
+}
+
+// onCloseBody returns the body of resp calling onClose once it is closed,
+// keeping the body of an upgraded connection writable.
+func onCloseBody(resp *http.Response, onClose func()) io.ReadCloser {
+	wrapped := &oneShotBodyWrapper{ReadCloser: resp.Body, onClose: onClose}
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		return &upgradedBodyWrapper{wrapped, conn}
+	}
+	return wrapped
+}
@@ -0,0 +1,95 @@
+package substrate
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestOnCloseBody(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	closed := 0
+	resp := &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: client}
+	body := onCloseBody(resp, func() { closed++ })
+	if _, ok := body.(io.ReadWriteCloser); !ok {
+		t.Fatal("Expected the body of an upgraded connection to stay writable")
+	}
+	body.Close()
+	body.Close()
+	if closed != 1 {
+		t.Errorf("Expected onClose called once, got %d", closed)
+	}
+
+	resp = &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("OK"))}
+	if _, ok := onCloseBody(resp, func() {}).(io.Writer); ok {
+		t.Error("Expected other bodies not to be writable")
+	}
+}
+
+func TestRoundTrip_Upgrade(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{
+		SlowRequest:      &SlowRequestConfig{Threshold: caddy.Duration(time.Minute)},
+		MaxResponseBytes: 4,
+		MicroCache:       &MicroCache{},
+	}, zaptest.NewLogger(t))
+	// Switches to echoing what it is sent
+	serveStubSocket(t, transport, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Connection") != "Upgrade" {
+			io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		io.Copy(conn, br)
+	})
+
+	// As reverse_proxy passes on a WebSocket handshake
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		t.Fatalf("Expected a writable body, got %T", resp.Body)
+	}
+
+	// Past max_response_bytes, which doesn't apply to the connection
+	message := "hello over the socket"
+	if _, err := io.WriteString(conn, message); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	echo := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != message {
+		t.Errorf("Expected the message echoed, got %q, %v", echo, err)
+	}
+}
+
+func TestCacheKey_Upgrade(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost/chat", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if key := cacheKey(req, "/srv/chat.js"); key != "" {
+		t.Errorf("Expected a WebSocket handshake not to be cached, got %q", key)
+	}
+	if key := etagKey(req, "/srv/chat.js"); key != "" {
+		t.Errorf("Expected a WebSocket handshake not to be answered with 304, got %q", key)
+	}
+}
@@ -0,0 +1,76 @@
+package substrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// UpstreamStatus describes a process as an upstream, in the format of
+// reverse_proxy's /reverse_proxy/upstreams admin endpoint, which only lists
+// the upstreams written in the config.
+type UpstreamStatus struct {
+	Address     string `json:"address"`
+	NumRequests int    `json:"num_requests"`
+	Fails       int    `json:"fails"`
+	Healthy     bool   `json:"healthy"`
+	Script      string `json:"script"`
+}
+
+// upstreamStatus reports the process as an upstream. A process is healthy
+// once its socket is ready, until it exits, is frozen or starts draining.
+func (p *Process) upstreamStatus() UpstreamStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	healthy := !p.stopping && !p.draining && !p.frozen
+	select {
+	case <-p.ready:
+		healthy = healthy && p.startErr == nil
+	default:
+		healthy = false
+	}
+	select {
+	case <-p.exitChan:
+		healthy = false
+	default:
+	}
+
+	return UpstreamStatus{
+		Address:     "unix/" + p.SocketPath,
+		NumRequests: p.activeRequests,
+		Fails:       p.fails,
+		Healthy:     healthy,
+		Script:      p.scriptPath,
+	}
+}
+
+// countFail records a request the process failed to answer.
+func (p *Process) countFail() {
+	p.mu.Lock()
+	p.fails++
+	p.mu.Unlock()
+}
+
+func (adminAPI) handleUpstreams(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	statuses := []UpstreamStatus{}
+	for _, pm := range registeredManagers() {
+		for _, process := range pm.processes.snapshot() {
+			statuses = append(statuses, process.upstreamStatus())
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Address < statuses[j].Address })
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(statuses)
+}
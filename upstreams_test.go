@@ -0,0 +1,65 @@
+package substrate
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestAdminAPI_Upstreams(t *testing.T) {
+	pm := newAdminTestManager(t)
+	ready := make(chan struct{})
+	close(ready)
+	running := &Process{scriptPath: "/srv/a.js", SocketPath: "/tmp/a.sock", logger: pm.logger, ready: ready}
+	starting := &Process{scriptPath: "/srv/b.js", SocketPath: "/tmp/b.sock", logger: pm.logger, ready: make(chan struct{})}
+	pm.processes.acquire("/srv/a.js", func() (*Process, error) { return running, nil })
+	pm.processes.acquire("/srv/b.js", func() (*Process, error) { return starting, nil })
+	running.countFail()
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleUpstreams(rec, httptest.NewRequest("GET", "/substrate/upstreams", nil)); err != nil {
+		t.Fatalf("handleUpstreams failed: %v", err)
+	}
+	var statuses []UpstreamStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("Failed to decode upstreams: %v", err)
+	}
+	want := []UpstreamStatus{
+		{Address: "unix//tmp/a.sock", NumRequests: 1, Fails: 1, Healthy: true, Script: "/srv/a.js"},
+		{Address: "unix//tmp/b.sock", NumRequests: 1, Fails: 0, Healthy: false, Script: "/srv/b.js"},
+	}
+	if len(statuses) != len(want) || statuses[0] != want[0] || statuses[1] != want[1] {
+		t.Errorf("Expected %+v, got %+v", want, statuses)
+	}
+
+	running.mu.Lock()
+	running.draining = true
+	running.mu.Unlock()
+	if running.upstreamStatus().Healthy {
+		t.Error("A draining process should be unhealthy")
+	}
+
+	if err := (adminAPI{}).handleUpstreams(httptest.NewRecorder(), httptest.NewRequest("POST", "/substrate/upstreams", nil)); err == nil {
+		t.Error("Expected POST to be rejected")
+	}
+}
+
+func TestRoundTrip_CountsFails(t *testing.T) {
+	transport, req := newStubProcessTransport(t, &SubstrateTransport{}, zaptest.NewLogger(t))
+	transport.transport = roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection reset")
+	})
+
+	if _, err := transport.RoundTrip(req.Clone(req.Context())); err == nil {
+		t.Fatal("Expected the request to fail")
+	}
+	for _, process := range transport.manager.processes.snapshot() {
+		if status := process.upstreamStatus(); status.Fails != 1 {
+			t.Errorf("Expected one failure, got %+v", status)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+const (
+	// usageSaveInterval is how often persisted usage is written to storage.
+	usageSaveInterval = time.Minute
+
+	// usageStartups is how many recent startup times are kept per script.
+	usageStartups = 10
+
+	// maxUsageScripts bounds the scripts usage is kept for; the least
+	// recently used are forgotten first.
+	maxUsageScripts = 1000
+)
+
+// ScriptUsage is what substrate remembers about a script, running or not:
+// when it last served a request and how long its recent starts took. With
+// persist_usage it is kept in Caddy's storage and survives restarts.
+type ScriptUsage struct {
+	Script      string    `json:"script"`
+	LastUsed    time.Time `json:"last_used,omitempty"`
+	LastStarted time.Time `json:"last_started,omitempty"`
+
+	// RecentStartups are the durations of the latest starts, oldest first
+	RecentStartups []caddy.Duration `json:"recent_startups,omitempty"`
+}
+
+// usageStore holds the usage of every script started by any transport.
+type usageStore struct {
+	mu      sync.Mutex
+	scripts map[string]*ScriptUsage
+	storage certmagic.Storage // nil until a transport enables persist_usage
+	key     string
+	dirty   bool
+}
+
+// scriptUsage is shared by all transports, so usage follows scripts across
+// config reloads.
+var scriptUsage = newUsageStore()
+
+func newUsageStore() *usageStore {
+	return &usageStore{scripts: make(map[string]*ScriptUsage)}
+}
+
+// usageStorageKey is where usage is kept in Caddy's storage. It is per
+// instance, so Caddy nodes sharing storage don't overwrite each other.
+func usageStorageKey() string {
+	id, err := caddy.InstanceID()
+	if err != nil {
+		return path.Join("substrate", "usage.json")
+	}
+	return path.Join("substrate", "usage", id.String()+".json")
+}
+
+// attach persists usage to storage from now on. The first time, it loads
+// the usage saved before the last restart; entries already known are kept
+// where they are newer.
+func (u *usageStore) attach(ctx context.Context, storage certmagic.Storage, key string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	loaded := u.storage != nil
+	u.storage, u.key = storage, key
+	if loaded {
+		return nil
+	}
+
+	data, err := storage.Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []ScriptUsage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for _, s := range saved {
+		if current, ok := u.scripts[s.Script]; ok && !current.LastUsed.Before(s.LastUsed) {
+			continue
+		}
+		u.scripts[s.Script] = &s
+	}
+	u.evictLocked(maxUsageScripts)
+	return nil
+}
+
+// entryLocked returns the usage of script, creating it. u.mu must be held.
+func (u *usageStore) entryLocked(script string) *ScriptUsage {
+	entry, ok := u.scripts[script]
+	if !ok {
+		// Make room first, so the new entry, not yet used, is not the one
+		// forgotten
+		u.evictLocked(maxUsageScripts - 1)
+		entry = &ScriptUsage{Script: script}
+		u.scripts[script] = entry
+	}
+	u.dirty = true
+	return entry
+}
+
+// evictLocked forgets the least recently used scripts over limit. u.mu
+// must be held.
+func (u *usageStore) evictLocked(limit int) {
+	for len(u.scripts) > limit {
+		var oldest *ScriptUsage
+		for _, entry := range u.scripts {
+			if oldest == nil || entry.LastUsed.Before(oldest.LastUsed) {
+				oldest = entry
+			}
+		}
+		delete(u.scripts, oldest.Script)
+	}
+}
+
+// used records that script served a request at lastUsed.
+func (u *usageStore) used(script string, lastUsed time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if entry, ok := u.scripts[script]; ok && !entry.LastUsed.Before(lastUsed) {
+		return
+	}
+	u.entryLocked(script).LastUsed = lastUsed
+}
+
+// started records that script started at at, taking d.
+func (u *usageStore) started(script string, d time.Duration, at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	entry := u.entryLocked(script)
+	entry.LastStarted = at
+	entry.RecentStartups = append(entry.RecentStartups, caddy.Duration(d))
+	if n := len(entry.RecentStartups); n > usageStartups {
+		entry.RecentStartups = append([]caddy.Duration(nil), entry.RecentStartups[n-usageStartups:]...)
+	}
+}
+
+// list returns the usage of every script, sorted by script.
+func (u *usageStore) list() []ScriptUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	result := make([]ScriptUsage, 0, len(u.scripts))
+	for _, entry := range u.scripts {
+		s := *entry
+		s.RecentStartups = append([]caddy.Duration(nil), entry.RecentStartups...)
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Script < result[j].Script })
+	return result
+}
+
+// save writes usage to storage if it changed since it was last saved.
+func (u *usageStore) save(ctx context.Context) error {
+	u.mu.Lock()
+	storage, key := u.storage, u.key
+	if storage == nil || !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	u.dirty = false
+	u.mu.Unlock()
+
+	data, err := json.Marshal(u.list())
+	if err == nil {
+		err = storage.Store(ctx, key, data)
+	}
+	if err != nil {
+		u.mu.Lock()
+		u.dirty = true
+		u.mu.Unlock()
+	}
+	return err
+}
+
+// recordUsage records when each of the manager's processes was last used.
+func (pm *ProcessManager) recordUsage() {
+	for _, process := range pm.processes.snapshot() {
+		process.mu.RLock()
+		lastUsed := process.lastUsed
+		process.mu.RUnlock()
+		scriptUsage.used(process.scriptPath, lastUsed)
+	}
+}
+
+// saveUsage records the manager's processes and persists usage.
+func (pm *ProcessManager) saveUsage(ctx context.Context) {
+	pm.recordUsage()
+	if err := scriptUsage.save(ctx); err != nil {
+		pm.logger.Warn("failed to persist script usage", zap.Error(err))
+	}
+}
+
+func (pm *ProcessManager) usageLoop() {
+	defer pm.wg.Done()
+
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pm.ctx.Done():
+			return
+		case <-ticker.C:
+			pm.saveUsage(pm.ctx)
+		}
+	}
+}
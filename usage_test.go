@@ -0,0 +1,122 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+func TestUsageStore_PersistsAcrossRestarts(t *testing.T) {
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	used := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	before := newUsageStore()
+	if err := before.attach(ctx, storage, "substrate/usage/test.json"); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	before.started("/srv/app.js", 300*time.Millisecond, used.Add(-time.Minute))
+	before.used("/srv/app.js", used)
+	if err := before.save(ctx); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	after := newUsageStore()
+	if err := after.attach(ctx, storage, "substrate/usage/test.json"); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	list := after.list()
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 script, got %+v", list)
+	}
+	got := list[0]
+	if got.Script != "/srv/app.js" || !got.LastUsed.Equal(used) || !got.LastStarted.Equal(used.Add(-time.Minute)) {
+		t.Errorf("Unexpected usage after restart: %+v", got)
+	}
+	if len(got.RecentStartups) != 1 || got.RecentStartups[0] != caddy.Duration(300*time.Millisecond) {
+		t.Errorf("Expected the startup time to survive, got %v", got.RecentStartups)
+	}
+}
+
+func TestUsageStore_AttachKeepsNewerUsage(t *testing.T) {
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	old := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	saved := newUsageStore()
+	saved.attach(ctx, storage, "usage.json")
+	saved.used("/srv/app.js", old)
+	saved.save(ctx)
+
+	u := newUsageStore()
+	u.used("/srv/app.js", old.Add(time.Hour))
+	if err := u.attach(ctx, storage, "usage.json"); err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if got := u.list()[0].LastUsed; !got.Equal(old.Add(time.Hour)) {
+		t.Errorf("Expected the newer last use to be kept, got %v", got)
+	}
+}
+
+func TestUsageStore_Bounds(t *testing.T) {
+	u := newUsageStore()
+	for i := 0; i < usageStartups+5; i++ {
+		u.started("/srv/app.js", time.Duration(i)*time.Millisecond, time.Now())
+	}
+	startups := u.list()[0].RecentStartups
+	if len(startups) != usageStartups || startups[0] != caddy.Duration(5*time.Millisecond) {
+		t.Errorf("Expected the latest %d startups, got %v", usageStartups, startups)
+	}
+
+	base := time.Now()
+	for i := 0; i < maxUsageScripts+1; i++ {
+		u.used(fmt.Sprintf("/srv/app%d.js", i), base.Add(time.Duration(i)*time.Second))
+	}
+	if n := len(u.list()); n != maxUsageScripts {
+		t.Errorf("Expected %d scripts, got %d", maxUsageScripts, n)
+	}
+	for _, s := range u.list() {
+		if s.Script == "/srv/app.js" {
+			t.Error("Expected the least recently used script to be forgotten")
+		}
+	}
+}
+
+func TestUsageStore_SaveWithoutStorage(t *testing.T) {
+	u := newUsageStore()
+	u.used("/srv/app.js", time.Now())
+	if err := u.save(context.Background()); err != nil {
+		t.Errorf("save without storage should do nothing, got %v", err)
+	}
+}
+
+func TestAdminAPI_Scripts(t *testing.T) {
+	pm := newAdminTestManager(t)
+	process := &Process{scriptPath: "/srv/usage-listed.js", logger: pm.logger}
+	pm.processes.acquire("/srv/usage-listed.js", func() (*Process, error) { return process, nil })
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleScripts(rec, httptest.NewRequest("GET", "/substrate/scripts", nil)); err != nil {
+		t.Fatalf("handleScripts failed: %v", err)
+	}
+
+	var list []ScriptUsage
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed to decode list: %v", err)
+	}
+	for _, s := range list {
+		if s.Script == "/srv/usage-listed.js" {
+			if !s.LastUsed.Equal(process.lastUsed) {
+				t.Errorf("Expected last use %v, got %v", process.lastUsed, s.LastUsed)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected the running script to be listed, got %+v", list)
+}
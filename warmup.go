@@ -0,0 +1,83 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Warmup describes requests sent to a process once its socket is ready and
+// before it receives real traffic, so JIT compilation and caches are warm for
+// the first client.
+type Warmup struct {
+	// Method is the HTTP method of the warm-up requests. Default GET.
+	Method string `json:"method,omitempty"`
+
+	// Path is the request path, starting with "/".
+	Path string `json:"path"`
+
+	// Count is how many requests to send, one after the other. Default 1.
+	Count int `json:"count,omitempty"`
+}
+
+func (w *Warmup) validate() error {
+	if !strings.HasPrefix(w.Path, "/") {
+		return fmt.Errorf("warmup path must start with /, got %q", w.Path)
+	}
+	if w.Count < 0 {
+		return fmt.Errorf("warmup count cannot be negative")
+	}
+	return nil
+}
+
+// warmUp sends the warm-up requests to process, giving up once timeout
+// passed. Failures are logged: a process that fails to warm up still serves.
+func (pm *ProcessManager) warmUp(process *Process, w *Warmup, timeout time.Duration) {
+	method := w.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	count := w.Count
+	if count == 0 {
+		count = 1
+	}
+
+	ctx, cancel := context.WithTimeout(pm.ctx, timeout)
+	defer cancel()
+
+	client := socketClient(process.SocketPath, 0)
+	defer client.CloseIdleConnections()
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		req, err := http.NewRequestWithContext(ctx, method, "http://substrate.localhost"+w.Path, nil)
+		if err != nil {
+			pm.logger.Warn("invalid warmup request", zap.Error(err))
+			return
+		}
+		req.Header.Set("X-Substrate-Warmup", "1")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			pm.logger.Warn("warmup request failed",
+				zap.String("file", process.scriptPath),
+				zap.Int("request", i+1),
+				zap.Error(err),
+			)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	pm.logger.Debug("process warmed up",
+		zap.String("file", process.scriptPath),
+		zap.Int("requests", count),
+		zap.Duration("duration", time.Since(start)),
+	)
+}
@@ -0,0 +1,94 @@
+package substrate
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestWarmUp(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	pm, err := newProcessManager(
+		caddy.Duration(0),
+		caddy.Duration(time.Second),
+		nil,
+		"",
+		NewDenoManager("", logger),
+		logger,
+		processOptions{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create process manager: %v", err)
+	}
+	defer pm.Stop()
+
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on socket: %v", err)
+	}
+	var mu sync.Mutex
+	var seen []string
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Substrate-Warmup"))
+		mu.Unlock()
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	process := &Process{scriptPath: "/app.js", SocketPath: socketPath}
+	pm.warmUp(process, &Warmup{Method: "HEAD", Path: "/health", Count: 3}, time.Second)
+	pm.warmUp(process, &Warmup{Path: "/"}, time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"HEAD /health 1", "HEAD /health 1", "HEAD /health 1", "GET / 1"}
+	if len(seen) != len(want) {
+		t.Fatalf("Expected warm-up requests %q, got %q", want, seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("Expected warm-up request %q, got %q", want[i], seen[i])
+		}
+	}
+}
+
+func TestUnmarshalCaddyfile_Warmup(t *testing.T) {
+	tests := []struct {
+		line string
+		want Warmup
+	}{
+		{"warmup /", Warmup{Path: "/"}},
+		{"warmup /health 5", Warmup{Path: "/health", Count: 5}},
+		{"warmup head /health 2", Warmup{Method: "HEAD", Path: "/health", Count: 2}},
+	}
+	for _, tt := range tests {
+		d := caddyfile.NewTestDispenser("substrate {\n" + tt.line + "\n}")
+		transport := &SubstrateTransport{StartupTimeout: caddy.Duration(time.Second)}
+		if err := transport.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("%s: UnmarshalCaddyfile failed: %v", tt.line, err)
+		}
+		if transport.Warmup == nil || *transport.Warmup != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.line, tt.want, transport.Warmup)
+		}
+	}
+
+	for _, line := range []string{"warmup", "warmup GET", "warmup / 0"} {
+		d := caddyfile.NewTestDispenser("substrate {\n" + line + "\n}")
+		if err := (&SubstrateTransport{}).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+
+	if err := (&Warmup{Path: "health"}).validate(); err == nil {
+		t.Error("A warmup path without a leading / should be rejected")
+	}
+}